@@ -0,0 +1,621 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// DNSSpoofer is a [PacketPolicy] forging DNS responses.
+//
+// The spoofer inspects DNS queries sent over UDP to port 53 and, when the
+// query name is one of the configured names, immediately sends back a forged
+// response using the original destination as the source. The forged response
+// contains the configured IPv4 addresses for A queries, the configured IPv6
+// addresses for AAAA queries, and no answers for other query types. Names
+// configured without addresses cause NXDOMAIN responses.
+//
+// By default, the spoofer also forwards the original query, which models an
+// on-path injector racing with the legitimate resolver. Use
+// [DNSSpooferOptionDropQuery] to model an in-path middlebox instead.
+//
+// Construct using [NewDNSSpoofer].
+type DNSSpoofer struct {
+	// dropQuery indicates whether to drop the original query.
+	dropQuery bool
+
+	// records maps canonical names to the forged addresses.
+	records map[string][]netip.Addr
+}
+
+// DNSSpooferOption is an option for [NewDNSSpoofer].
+type DNSSpooferOption func(cfg *dnsSpooferConfig)
+
+// dnsSpooferConfig is the internal type modified by [DNSSpooferOption].
+type dnsSpooferConfig struct {
+	dropQuery bool
+}
+
+// DNSSpooferOptionDropQuery sets whether to drop the queries
+// for which the spoofer forges a response.
+//
+// The default is false.
+func DNSSpooferOptionDropQuery(enabled bool) DNSSpooferOption {
+	return func(cfg *dnsSpooferConfig) {
+		cfg.dropQuery = enabled
+	}
+}
+
+// NewDNSSpoofer creates a new [*DNSSpoofer] forging responses for the given
+// names, which are case insensitive and may or may not end with a dot.
+func NewDNSSpoofer(records map[string][]netip.Addr, options ...DNSSpooferOption) *DNSSpoofer {
+	cfg := &dnsSpooferConfig{
+		dropQuery: false,
+	}
+	for _, opt := range options {
+		opt(cfg)
+	}
+
+	canonical := make(map[string][]netip.Addr)
+	for name, addrs := range records {
+		canonical[censorCanonicalName(name)] = append([]netip.Addr{}, addrs...)
+	}
+	return &DNSSpoofer{
+		dropQuery: cfg.dropQuery,
+		records:   canonical,
+	}
+}
+
+// Ensure that [*DNSSpoofer] implements [PacketPolicy].
+var _ PacketPolicy = &DNSSpoofer{}
+
+// HandleFrame implements [PacketPolicy].
+func (ds *DNSSpoofer) HandleFrame(frame VNICFrame, fwd PacketForwarder) {
+	pkt, err := frame.Parse()
+	if err != nil || pkt.Protocol() != ProtocolUDP || pkt.TransportHeader() == nil || pkt.DstPort() != 53 {
+		fwd.Forward(frame)
+		return
+	}
+	response, ok := ds.forge(pkt.Payload())
+	if !ok {
+		fwd.Forward(frame)
+		return
+	}
+	ft := pkt.FiveTuple()
+	fwd.Forward(VNICFrame{Packet: packetNewUDP(ft.Dst, ft.Src, response)})
+	if !ds.dropQuery {
+		fwd.Forward(frame)
+	}
+}
+
+// forge returns the forged response for the given query or false if
+// the query is malformed or we do not need to spoof it.
+func (ds *DNSSpoofer) forge(query []byte) ([]byte, bool) {
+	// 1. parse the query and find the forged addresses
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil || header.Response {
+		return nil, false
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, false
+	}
+	addrs, found := ds.records[censorCanonicalName(question.Name.String())]
+	if !found {
+		return nil, false
+	}
+
+	// 2. create the response header and echo the question
+	rcode := dnsmessage.RCodeSuccess
+	if len(addrs) <= 0 {
+		rcode = dnsmessage.RCodeNameError
+	}
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		OpCode:             header.OpCode,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, false
+	}
+	if err := builder.Question(question); err != nil {
+		return nil, false
+	}
+
+	// 3. add the answers matching the query type
+	if err := builder.StartAnswers(); err != nil {
+		return nil, false
+	}
+	rrHeader := dnsmessage.ResourceHeader{
+		Name:  question.Name,
+		Type:  question.Type,
+		Class: dnsmessage.ClassINET,
+		TTL:   censorDNSTTL,
+	}
+	for _, addr := range addrs {
+		switch {
+		case question.Type == dnsmessage.TypeA && addr.Is4():
+			err = builder.AResource(rrHeader, dnsmessage.AResource{A: addr.As4()})
+		case question.Type == dnsmessage.TypeAAAA && addr.Is6():
+			err = builder.AAAAResource(rrHeader, dnsmessage.AAAAResource{AAAA: addr.As16()})
+		}
+		if err != nil {
+			return nil, false
+		}
+	}
+	response, err := builder.Finish()
+	return response, err == nil
+}
+
+// censorDNSTTL is the TTL of the forged DNS records.
+const censorDNSTTL = 60
+
+// censorCanonicalName returns the lowercase name without the trailing dot.
+func censorCanonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// CensorAction is the action taken by a [*FlowCensor] for censored flows.
+type CensorAction int
+
+// Enumerate the supported [CensorAction] values.
+const (
+	// CensorReset drops the packet triggering censorship and injects
+	// TCP RST segments toward both endpoints of the flow.
+	CensorReset CensorAction = iota
+
+	// CensorBlackhole drops the packet triggering censorship and all
+	// the subsequent packets of the flow in both directions.
+	CensorBlackhole
+
+	// CensorThrottle limits the bandwidth of the flow in both directions
+	// starting from the packet triggering censorship.
+	CensorThrottle
+)
+
+// DefaultCensorThrottle is the default [LinkConfig] used by
+// a [*FlowCensor] to throttle each direction of censored flows.
+var DefaultCensorThrottle = LinkConfig{Bandwidth: 64_000}
+
+// FlowCensor is a [PacketPolicy] censoring TCP flows based on the
+// server name included in the TLS ClientHello (SNI) or in the HTTP
+// Host header sent by the client.
+//
+// The censor reassembles the beginning of the stream sent by the client
+// (i.e., the endpoint sending data first) to find the server name, while
+// forwarding the packets unmodified. When the server name matches the
+// pattern, the censor applies its [CensorAction] to the flow.
+//
+// The censor forgets flows when it sees a FIN or RST segment, except that
+// it remembers censored flows until it sees a RST segment, which allows
+// to model residual censorship of blackholed or throttled flows. The censor
+// also forgets flows that have been idle for longer than the timeout (see
+// [FlowCensorOptionTimeout]), such that the tracked flows do not grow forever.
+//
+// Construct using [NewFlowCensor].
+type FlowCensor struct {
+	// action is the action to apply to censored flows.
+	action CensorAction
+
+	// clock is the clock used by throttling and to expire flows.
+	clock tcpip.Clock
+
+	// flows contains the flows we're tracking indexed by client direction.
+	flows map[censorFlowKey]*censorFlow
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// pattern is the pattern matching censored server names.
+	pattern *regexp.Regexp
+
+	// rng is the random number generator used by throttling.
+	rng *rand.Rand
+
+	// sweep is when we should next remove all the expired flows.
+	sweep time.Time
+
+	// throttle is the link configuration used for throttling.
+	throttle LinkConfig
+
+	// timeout is the idle timeout after which we forget a flow.
+	timeout time.Duration
+}
+
+// FlowCensorOption is an option for [NewFlowCensor].
+type FlowCensorOption func(cfg *flowCensorConfig)
+
+// flowCensorConfig is the internal type modified by [FlowCensorOption].
+type flowCensorConfig struct {
+	clock    tcpip.Clock
+	seed1    uint64
+	seed2    uint64
+	throttle LinkConfig
+	timeout  time.Duration
+}
+
+// DefaultFlowCensorTimeout is the default idle timeout of tracked flows.
+const DefaultFlowCensorTimeout = 5 * time.Minute
+
+// FlowCensorOptionClock sets the [tcpip.Clock] used by throttling and
+// to expire idle flows.
+//
+// The default is to use the wall clock. Use the same clock used by the
+// [*Internet] (see [InternetOptionClock]) when using a [*VirtualClock].
+func FlowCensorOptionClock(clock tcpip.Clock) FlowCensorOption {
+	return func(cfg *flowCensorConfig) {
+		cfg.clock = clock
+	}
+}
+
+// FlowCensorOptionSeed is like [RouterOptionSeed] but sets the seed used
+// to initialize the random number generator used by throttling.
+//
+// The default is to use a random seed. Set an explicit seed to make
+// the throttling of censored flows reproducible across runs.
+func FlowCensorOptionSeed(seed uint64) FlowCensorOption {
+	return func(cfg *flowCensorConfig) {
+		cfg.seed1 = seed
+		cfg.seed2 = seed
+	}
+}
+
+// FlowCensorOptionThrottle sets the [LinkConfig] used to throttle each
+// direction of censored flows when using [CensorThrottle].
+//
+// The default is [DefaultCensorThrottle]. The MTU-related fields are ignored.
+func FlowCensorOptionThrottle(config LinkConfig) FlowCensorOption {
+	return func(cfg *flowCensorConfig) {
+		cfg.throttle = config
+	}
+}
+
+// FlowCensorOptionTimeout sets the idle timeout of tracked flows, including
+// the censored flows, thus bounding the duration of residual censorship.
+//
+// The default is [DefaultFlowCensorTimeout]. A zero or negative
+// value is silently ignored.
+func FlowCensorOptionTimeout(timeout time.Duration) FlowCensorOption {
+	return func(cfg *flowCensorConfig) {
+		if timeout > 0 {
+			cfg.timeout = timeout
+		}
+	}
+}
+
+// NewFlowCensor creates a new [*FlowCensor] applying the given action to the
+// flows whose server name matches the given pattern. Server names are
+// lowercase and do not include ports or trailing dots.
+func NewFlowCensor(pattern *regexp.Regexp, action CensorAction, options ...FlowCensorOption) *FlowCensor {
+	cfg := &flowCensorConfig{
+		clock:    tcpip.NewStdClock(),
+		seed1:    rand.Uint64(),
+		seed2:    rand.Uint64(),
+		throttle: DefaultCensorThrottle,
+		timeout:  DefaultFlowCensorTimeout,
+	}
+	for _, opt := range options {
+		opt(cfg)
+	}
+
+	return &FlowCensor{
+		action:   action,
+		clock:    cfg.clock,
+		flows:    make(map[censorFlowKey]*censorFlow),
+		mu:       sync.Mutex{},
+		pattern:  pattern,
+		rng:      rand.New(rand.NewPCG(cfg.seed1, cfg.seed2)),
+		sweep:    time.Time{},
+		throttle: cfg.throttle,
+		timeout:  cfg.timeout,
+	}
+}
+
+// censorFlowKey identifies a flow in the client to server direction.
+type censorFlowKey struct {
+	client netip.AddrPort
+	server netip.AddrPort
+}
+
+// censorFlow is a flow tracked by the [*FlowCensor].
+type censorFlow struct {
+	// buf contains the beginning of the client stream.
+	buf []byte
+
+	// censored indicates whether we're censoring the flow.
+	censored bool
+
+	// done indicates whether we have finished inspecting the flow.
+	done bool
+
+	// expires is when the flow expires.
+	expires time.Time
+
+	// links contains the links used for throttling indexed by
+	// whether the packet travels in the reply direction.
+	links [2]*routerLink
+
+	// next is the next client sequence number we expect.
+	next uint32
+}
+
+// censorMaxInspect is the maximum number of bytes we inspect.
+const censorMaxInspect = 16384
+
+// Ensure that [*FlowCensor] implements [PacketPolicy].
+var _ PacketPolicy = &FlowCensor{}
+
+// HandleFrame implements [PacketPolicy].
+func (fc *FlowCensor) HandleFrame(frame VNICFrame, fwd PacketForwarder) {
+	// 1. only inspect TCP segments
+	pkt, err := frame.Parse()
+	if err != nil || pkt.Protocol() != ProtocolTCP || pkt.TransportHeader() == nil {
+		fwd.Forward(frame)
+		return
+	}
+	ft, flags := pkt.FiveTuple(), pkt.TCPFlags()
+
+	// 2. find the flow or start tracking it when the client sends data
+	now := fc.clock.Now()
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	key, reply := censorFlowKey{client: ft.Src, server: ft.Dst}, false
+	flow := fc.lookup(key, now)
+	if flow == nil {
+		key, reply = censorFlowKey{client: ft.Dst, server: ft.Src}, true
+		flow = fc.lookup(key, now)
+	}
+	if flow == nil && len(pkt.Payload()) > 0 {
+		fc.expire(now)
+		key, reply = censorFlowKey{client: ft.Src, server: ft.Dst}, false
+		flow = &censorFlow{next: pkt.TCPSeq()}
+		fc.flows[key] = flow
+	}
+	if flow == nil {
+		fwd.Forward(frame)
+		return
+	}
+	flow.expires = now.Add(fc.timeout)
+	if flags&TCPFlagRST != 0 || (flags&TCPFlagFIN != 0 && !flow.censored) {
+		delete(fc.flows, key)
+	}
+
+	// 3. inspect the client stream until we know the server name
+	if !reply && !flow.done {
+		fc.inspect(flow, pkt)
+	}
+
+	// 4. apply the action
+	if !flow.censored {
+		fwd.Forward(frame)
+		return
+	}
+	switch fc.action {
+	case CensorReset:
+		delete(fc.flows, key)
+		fc.reset(pkt, fwd)
+
+	case CensorThrottle:
+		fc.throttleFrame(flow, reply, frame, fwd, now)
+	}
+}
+
+// lookup returns the flow with the given key, if any, forgetting
+// it when it has expired. The caller MUST hold the mutex.
+func (fc *FlowCensor) lookup(key censorFlowKey, now time.Time) *censorFlow {
+	flow := fc.flows[key]
+	if flow != nil && !now.Before(flow.expires) {
+		delete(fc.flows, key)
+		return nil
+	}
+	return flow
+}
+
+// expire forgets all the expired flows, at most once per timeout, such
+// that idle flows do not accumulate. The caller MUST hold the mutex.
+func (fc *FlowCensor) expire(now time.Time) {
+	if now.Before(fc.sweep) {
+		return
+	}
+	fc.sweep = now.Add(fc.timeout)
+	for key, flow := range fc.flows {
+		if !now.Before(flow.expires) {
+			delete(fc.flows, key)
+		}
+	}
+}
+
+// inspect appends the segment payload to the flow buffer, when the segment
+// is in order, and checks whether we know the server name.
+func (fc *FlowCensor) inspect(flow *censorFlow, pkt *Packet) {
+	payload := pkt.Payload()
+	if pkt.TCPSeq() != flow.next || len(payload) <= 0 {
+		return
+	}
+	flow.next += uint32(len(payload))
+	flow.buf = append(flow.buf, payload...)
+	name, complete := censorServerName(flow.buf)
+	if !complete && len(flow.buf) < censorMaxInspect {
+		return
+	}
+	flow.done, flow.buf = true, nil
+	flow.censored = name != "" && fc.pattern.MatchString(name)
+}
+
+// reset injects RST segments toward both endpoints.
+func (fc *FlowCensor) reset(pkt *Packet, fwd PacketForwarder) {
+	ft, seq, ack := pkt.FiveTuple(), pkt.TCPSeq(), pkt.TCPAck()
+	fwd.Forward(VNICFrame{Packet: packetNewTCP(ft.Src, ft.Dst, seq, ack, TCPFlagRST|TCPFlagACK, 0, nil)})
+	fwd.Forward(VNICFrame{Packet: packetNewTCP(ft.Dst, ft.Src, ack, seq+pkt.tcpSegmentLength(), TCPFlagRST|TCPFlagACK, 0, nil)})
+}
+
+// throttleFrame forwards the frame after the delay imposed by the throttling link.
+func (fc *FlowCensor) throttleFrame(flow *censorFlow, reply bool, frame VNICFrame, fwd PacketForwarder, now time.Time) {
+	idx := 0
+	if reply {
+		idx = 1
+	}
+	if flow.links[idx] == nil {
+		flow.links[idx] = newRouterLink(netip.Prefix{}, netip.Prefix{}, fc.throttle)
+	}
+	delay, ok := flow.links[idx].schedule(fc.rng, now, len(frame.Packet))
+	if !ok {
+		return
+	}
+	fwd.ForwardAfter(delay, frame)
+}
+
+// censorServerName returns the server name included in the TLS ClientHello
+// or in the HTTP Host header at the beginning of the given client stream. The
+// boolean indicates whether we have seen enough data to decide, in which case
+// an empty server name means that the stream is neither TLS nor HTTP.
+func censorServerName(buf []byte) (string, bool) {
+	if len(buf) < 1 {
+		return "", false
+	}
+	if buf[0] == 22 { // TLS handshake record
+		return censorParseSNI(buf)
+	}
+	return censorParseHost(buf)
+}
+
+// censorParseSNI parses the SNI of a TLS ClientHello.
+func censorParseSNI(buf []byte) (string, bool) {
+	// 1. reassemble the handshake message from the TLS records
+	var hs []byte
+	for len(buf) >= 5 && buf[0] == 22 {
+		length := int(binary.BigEndian.Uint16(buf[3:5]))
+		if len(buf) < 5+length {
+			hs = append(hs, buf[5:]...)
+			break
+		}
+		hs = append(hs, buf[5:5+length]...)
+		buf = buf[5+length:]
+	}
+	if len(hs) < 4 {
+		return "", false
+	}
+	if hs[0] != 1 { // not a ClientHello
+		return "", true
+	}
+	length := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+	if len(hs) < 4+length {
+		return "", false
+	}
+
+	// 2. skip version, random, session ID, cipher suites, and compression methods
+	msg := censorReader(hs[4 : 4+length])
+	if !msg.skip(2+32) || !msg.skipVector(1) || !msg.skipVector(2) || !msg.skipVector(1) {
+		return "", true
+	}
+
+	// 3. walk the extensions to find the server_name extension
+	exts, ok := msg.vector(2)
+	for ok && len(exts) >= 4 {
+		extType := binary.BigEndian.Uint16(exts)
+		var body censorReader
+		exts = exts[2:]
+		if body, ok = exts.vector(2); !ok {
+			break
+		}
+		if extType != 0 {
+			continue
+		}
+		list, ok := body.vector(2)
+		for ok && len(list) >= 3 {
+			nameType := list[0]
+			list = list[1:]
+			var name censorReader
+			if name, ok = list.vector(2); ok && nameType == 0 {
+				return censorCanonicalName(string(name)), true
+			}
+		}
+		break
+	}
+	return "", true
+}
+
+// censorParseHost parses the Host header of an HTTP request.
+func censorParseHost(buf []byte) (string, bool) {
+	// 1. make sure this looks like an HTTP request
+	method, _, found := bytes.Cut(buf, []byte(" "))
+	if !found {
+		return "", len(buf) > 16
+	}
+	for _, c := range method {
+		if c < 'A' || c > 'Z' {
+			return "", true
+		}
+	}
+
+	// 2. wait for the whole headers and then find the Host header
+	headers, _, found := bytes.Cut(buf, []byte("\r\n\r\n"))
+	if !found {
+		return "", false
+	}
+	lines := strings.Split(string(headers), "\r\n")
+	for _, line := range lines[1:] {
+		key, value, found := strings.Cut(line, ":")
+		if !found || !strings.EqualFold(strings.TrimSpace(key), "host") {
+			continue
+		}
+		host := strings.TrimSpace(value)
+		if hostname, _, err := net.SplitHostPort(host); err == nil {
+			host = hostname
+		}
+		return censorCanonicalName(strings.Trim(host, "[]")), true
+	}
+	return "", true
+}
+
+// censorReader helps parsing TLS messages.
+type censorReader []byte
+
+// skip skips count bytes.
+func (r *censorReader) skip(count int) bool {
+	if len(*r) < count {
+		return false
+	}
+	*r = (*r)[count:]
+	return true
+}
+
+// vector reads a vector prefixed by a length of the given size in bytes.
+func (r *censorReader) vector(size int) (censorReader, bool) {
+	if len(*r) < size {
+		return nil, false
+	}
+	var length int
+	for _, b := range (*r)[:size] {
+		length = length<<8 | int(b)
+	}
+	*r = (*r)[size:]
+	if len(*r) < length {
+		return nil, false
+	}
+	value := (*r)[:length]
+	*r = (*r)[length:]
+	return value, true
+}
+
+// skipVector skips a vector prefixed by a length of the given size in bytes.
+func (r *censorReader) skipVector(size int) bool {
+	_, ok := r.vector(size)
+	return ok
+}
@@ -0,0 +1,315 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"regexp"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// newTestDNSQuery returns a DNS query for the given name and type.
+func newTestDNSQuery(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 0x1234, RecursionDesired: true})
+	require.NoError(t, builder.StartQuestions())
+	require.NoError(t, builder.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+	}))
+	query, err := builder.Finish()
+	require.NoError(t, err)
+	return query
+}
+
+func TestDNSSpoofer(t *testing.T) {
+	client := netip.MustParseAddrPort("10.0.0.2:5353")
+	resolver := netip.MustParseAddrPort("10.0.0.53:53")
+	spoofer := uis.NewDNSSpoofer(map[string][]netip.Addr{
+		"Blocked.Example.COM": {netip.MustParseAddr("10.10.34.35"), netip.MustParseAddr("2001:db8::35")},
+		"nxdomain.example.":   nil,
+	})
+
+	cases := []struct {
+		name    string
+		qtype   dnsmessage.Type
+		rcode   dnsmessage.RCode
+		answers []string
+	}{
+		{"blocked.example.com.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"10.10.34.35"}},
+		{"blocked.example.com.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"2001:db8::35"}},
+		{"blocked.example.com.", dnsmessage.TypeMX, dnsmessage.RCodeSuccess, nil},
+		{"nxdomain.example.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name+tc.qtype.String(), func(t *testing.T) {
+			query := newTestUDPPacket(client, resolver, newTestDNSQuery(t, tc.name, tc.qtype))
+			fwd := &recordingForwarder{}
+			spoofer.HandleFrame(uis.VNICFrame{Packet: query}, fwd)
+			require.Len(t, fwd.frames, 2)
+			require.Equal(t, query, fwd.frames[1].Packet)
+
+			// the forged response comes from the resolver
+			response := fwd.frames[0].Packet
+			require.Equal(t, uint16(0), testUDPChecksum(response))
+			src, dst := testUDPEndpoints(response)
+			require.Equal(t, resolver, src)
+			require.Equal(t, client, dst)
+
+			var parser dnsmessage.Parser
+			header, err := parser.Start(response[28:])
+			require.NoError(t, err)
+			require.True(t, header.Response)
+			require.Equal(t, uint16(0x1234), header.ID)
+			require.Equal(t, tc.rcode, header.RCode)
+			require.NoError(t, parser.SkipAllQuestions())
+			answers, err := parser.AllAnswers()
+			require.NoError(t, err)
+			var addrs []string
+			for _, answer := range answers {
+				switch body := answer.Body.(type) {
+				case *dnsmessage.AResource:
+					addrs = append(addrs, netip.AddrFrom4(body.A).String())
+				case *dnsmessage.AAAAResource:
+					addrs = append(addrs, netip.AddrFrom16(body.AAAA).String())
+				}
+			}
+			require.Equal(t, tc.answers, addrs)
+		})
+	}
+
+	t.Run("other_names", func(t *testing.T) {
+		query := newTestUDPPacket(client, resolver, newTestDNSQuery(t, "example.com.", dnsmessage.TypeA))
+		fwd := &recordingForwarder{}
+		spoofer.HandleFrame(uis.VNICFrame{Packet: query}, fwd)
+		require.Len(t, fwd.frames, 1)
+		require.Equal(t, query, fwd.frames[0].Packet)
+	})
+
+	t.Run("drop_query", func(t *testing.T) {
+		spoofer := uis.NewDNSSpoofer(map[string][]netip.Addr{"nxdomain.example": nil},
+			uis.DNSSpooferOptionDropQuery(true))
+		query := newTestUDPPacket(client, resolver, newTestDNSQuery(t, "nxdomain.example.", dnsmessage.TypeA))
+		fwd := &recordingForwarder{}
+		spoofer.HandleFrame(uis.VNICFrame{Packet: query}, fwd)
+		require.Len(t, fwd.frames, 1)
+		src, _ := testUDPEndpoints(fwd.frames[0].Packet)
+		require.Equal(t, resolver, src)
+	})
+}
+
+// newTestClientHello returns the TLS ClientHello sent by crypto/tls for the given SNI.
+func newTestClientHello(t *testing.T, sni string) []byte {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	go func() {
+		defer conn.Close()
+		_ = tls.Client(conn, &tls.Config{ServerName: sni}).Handshake()
+	}()
+
+	// read the record header and then the record body
+	header := make([]byte, 5)
+	_, err := io.ReadFull(peer, header)
+	require.NoError(t, err)
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	_, err = io.ReadFull(peer, body)
+	require.NoError(t, err)
+	return append(header, body...)
+}
+
+// censorTestForwarder is like [recordingForwarder] but also records the delays.
+type censorTestForwarder struct {
+	delays []time.Duration
+	frames []uis.VNICFrame
+}
+
+func (fwd *censorTestForwarder) Forward(frame uis.VNICFrame) {
+	fwd.ForwardAfter(0, frame)
+}
+
+func (fwd *censorTestForwarder) ForwardAfter(delay time.Duration, frame uis.VNICFrame) {
+	fwd.delays = append(fwd.delays, delay)
+	fwd.frames = append(fwd.frames, frame)
+}
+
+func TestFlowCensor(t *testing.T) {
+	client := netip.MustParseAddrPort("10.0.0.2:40000")
+	server := netip.MustParseAddrPort("10.0.0.1:443")
+	pattern := regexp.MustCompile(`(^|\.)blocked\.example\.com$`)
+
+	// sendStream sends the stream from client to server in two segments
+	// and returns the frames forwarded for each segment.
+	sendStream := func(censor *uis.FlowCensor, stream []byte) []*censorTestForwarder {
+		half := len(stream) / 2
+		var out []*censorTestForwarder
+		for _, seg := range []struct {
+			seq     uint32
+			payload []byte
+		}{{1000, stream[:half]}, {1000 + uint32(half), stream[half:]}} {
+			fwd := &censorTestForwarder{}
+			censor.HandleFrame(uis.VNICFrame{
+				Packet: newTestTCPPacketWithPayload(client, server, seg.seq, uis.TCPFlagACK|uis.TCPFlagPSH, seg.payload),
+			}, fwd)
+			out = append(out, fwd)
+		}
+		return out
+	}
+
+	streams := map[string][]byte{
+		"tls":  newTestClientHello(t, "www.blocked.example.com"),
+		"http": []byte("GET / HTTP/1.1\r\nHost: www.Blocked.Example.com:80\r\nAccept: */*\r\n\r\n"),
+	}
+	for name, stream := range streams {
+		t.Run(name+"_reset", func(t *testing.T) {
+			out := sendStream(uis.NewFlowCensor(pattern, uis.CensorReset), stream)
+			require.Len(t, out[0].frames, 1)
+			require.Len(t, out[1].frames, 2)
+			for _, frame := range out[1].frames {
+				require.Equal(t, uis.TCPFlagRST|uis.TCPFlagACK, frame.Packet[33])
+				require.Equal(t, uint16(0), testTCPChecksum(frame.Packet))
+			}
+			toServer, toClient := out[1].frames[0].Packet, out[1].frames[1].Packet
+			require.Equal(t, server.Addr().AsSlice(), toServer[16:20])
+			require.Equal(t, client.Addr().AsSlice(), toClient[16:20])
+		})
+
+		t.Run(name+"_blackhole", func(t *testing.T) {
+			censor := uis.NewFlowCensor(pattern, uis.CensorBlackhole)
+			out := sendStream(censor, stream)
+			require.Len(t, out[0].frames, 1)
+			require.Empty(t, out[1].frames)
+
+			// subsequent packets in both directions are dropped
+			fwd := &recordingForwarder{}
+			censor.HandleFrame(uis.VNICFrame{Packet: newTestTCPPacket(server, client, 1, uis.TCPFlagACK)}, fwd)
+			require.Empty(t, fwd.frames)
+		})
+
+		t.Run(name+"_throttle", func(t *testing.T) {
+			censor := uis.NewFlowCensor(pattern, uis.CensorThrottle,
+				uis.FlowCensorOptionThrottle(uis.LinkConfig{Bandwidth: 8000, Burst: 1}))
+			out := sendStream(censor, stream)
+			require.Equal(t, []time.Duration{0}, out[0].delays)
+			require.Len(t, out[1].delays, 1)
+			require.Greater(t, out[1].delays[0], time.Duration(0))
+		})
+
+		t.Run(name+"_not_matching", func(t *testing.T) {
+			censor := uis.NewFlowCensor(regexp.MustCompile(`^example\.org$`), uis.CensorBlackhole)
+			out := sendStream(censor, stream)
+			require.Len(t, out[0].frames, 1)
+			require.Len(t, out[1].frames, 1)
+		})
+	}
+}
+
+func TestFlowCensorWithStacks(t *testing.T) {
+	ix := uis.NewInternet()
+	server, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.1"))
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	client, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.2"))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+
+	listener, err := uis.NewListenConfig(server).Listen(context.Background(), "tcp", "10.0.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	censor := uis.NewFlowCensor(regexp.MustCompile(`^blocked\.example\.com$`), uis.CensorReset)
+	go ix.Run(ctx, censor)
+
+	fetch := func(host string) error {
+		conn, err := uis.NewConnector(client).DialContext(ctx, "tcp", "10.0.0.1:80")
+		require.NoError(t, err)
+		defer conn.Close()
+		request := "GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+		_, err = conn.Write([]byte(request))
+		require.NoError(t, err)
+		_, err = io.ReadFull(conn, make([]byte, len(request)))
+		return err
+	}
+
+	require.NoError(t, fetch("example.com"))
+	err = fetch("blocked.example.com")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, syscall.ECONNRESET), "%v", err)
+}
+
+func TestFlowCensorOptions(t *testing.T) {
+	client := netip.MustParseAddrPort("10.0.0.2:40000")
+	server := netip.MustParseAddrPort("10.0.0.1:80")
+	pattern := regexp.MustCompile(`^blocked\.example\.com$`)
+	request := []byte("GET / HTTP/1.1\r\nHost: blocked.example.com\r\n\r\n")
+
+	t.Run("seed", func(t *testing.T) {
+		// delays returns the throttling delays sampled by a censor using the given seed
+		delays := func(seed uint64) []time.Duration {
+			clock := uis.NewVirtualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+			censor := uis.NewFlowCensor(pattern, uis.CensorThrottle,
+				uis.FlowCensorOptionClock(clock),
+				uis.FlowCensorOptionSeed(seed),
+				uis.FlowCensorOptionThrottle(uis.LinkConfig{Jitter: uis.UniformJitter{Max: time.Second}}))
+			fwd := &censorTestForwarder{}
+			censor.HandleFrame(uis.VNICFrame{
+				Packet: newTestTCPPacketWithPayload(client, server, 1000, uis.TCPFlagACK|uis.TCPFlagPSH, request),
+			}, fwd)
+			for seq := range uint32(16) {
+				censor.HandleFrame(uis.VNICFrame{Packet: newTestTCPPacket(server, client, seq, uis.TCPFlagACK)}, fwd)
+			}
+			return fwd.delays
+		}
+		require.Equal(t, delays(42), delays(42))
+		require.NotEqual(t, delays(42), delays(43))
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		clock := uis.NewVirtualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+		censor := uis.NewFlowCensor(pattern, uis.CensorBlackhole,
+			uis.FlowCensorOptionClock(clock),
+			uis.FlowCensorOptionTimeout(time.Minute))
+		fwd := &recordingForwarder{}
+		censor.HandleFrame(uis.VNICFrame{
+			Packet: newTestTCPPacketWithPayload(client, server, 1000, uis.TCPFlagACK|uis.TCPFlagPSH, request),
+		}, fwd)
+		require.Empty(t, fwd.frames)
+
+		// packets refresh the timeout of the censored flow
+		clock.Advance(50 * time.Second)
+		censor.HandleFrame(uis.VNICFrame{Packet: newTestTCPPacket(server, client, 1, uis.TCPFlagACK)}, fwd)
+		clock.Advance(50 * time.Second)
+		censor.HandleFrame(uis.VNICFrame{Packet: newTestTCPPacket(server, client, 1, uis.TCPFlagACK)}, fwd)
+		require.Empty(t, fwd.frames)
+
+		// the censor forgets the flow once it has been idle for too long
+		clock.Advance(time.Minute)
+		censor.HandleFrame(uis.VNICFrame{Packet: newTestTCPPacket(server, client, 1, uis.TCPFlagACK)}, fwd)
+		require.Len(t, fwd.frames, 1)
+	})
+}
@@ -0,0 +1,217 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// VirtualClock is a manually-advanced [tcpip.Clock].
+//
+// Time only moves forward when you call [*VirtualClock.Advance] or
+// [*VirtualClock.AdvanceToNext]. Timers created using AfterFunc run
+// synchronously, in deadline order, on the goroutine advancing the clock.
+//
+// Use [InternetOptionClock] to build all the stacks of an [*Internet]
+// on a shared [*VirtualClock] and use [*Router.Step] to advance it when
+// the simulation is quiescent. This allows to test TCP retransmissions,
+// delayed ACKs and emulated link delays without waiting for them.
+//
+// Note that stdlib deadlines (e.g., [net.Conn] SetDeadline and context
+// timeouts) still use the wall clock.
+//
+// Construct using [NewVirtualClock].
+type VirtualClock struct {
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// now is the current virtual time.
+	now time.Time
+
+	// seq is the sequence number of the next scheduled timer.
+	seq uint64
+
+	// start is the virtual time when we created the clock.
+	start time.Time
+
+	// timers contains the scheduled timers.
+	timers virtualTimerHeap
+}
+
+// NewVirtualClock creates a new [*VirtualClock] starting at the given time.
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{
+		mu:     sync.Mutex{},
+		now:    start,
+		seq:    0,
+		start:  start,
+		timers: virtualTimerHeap{},
+	}
+}
+
+// Ensure that [*VirtualClock] implements [tcpip.Clock].
+var _ tcpip.Clock = &VirtualClock{}
+
+// Now implements [tcpip.Clock].
+func (c *VirtualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NowMonotonic implements [tcpip.Clock].
+func (c *VirtualClock) NowMonotonic() tcpip.MonotonicTime {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return tcpip.MonotonicTime{}.Add(c.now.Sub(c.start))
+}
+
+// AfterFunc implements [tcpip.Clock].
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) tcpip.Timer {
+	t := &virtualTimer{clock: c, fn: f, index: -1}
+	t.Reset(d)
+	return t
+}
+
+// Advance moves the clock forward by the given duration, running all the
+// timers expiring within the given duration in deadline order.
+func (c *VirtualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+	c.advanceTo(target)
+}
+
+// AdvanceToNext moves the clock forward to the deadline of the earliest
+// scheduled timer and runs all the timers expiring at that deadline.
+//
+// This method returns false if there are no scheduled timers.
+func (c *VirtualClock) AdvanceToNext() bool {
+	c.mu.Lock()
+	if len(c.timers) <= 0 {
+		c.mu.Unlock()
+		return false
+	}
+	target := c.timers[0].when
+	c.mu.Unlock()
+	c.advanceTo(target)
+	return true
+}
+
+// advanceTo runs the timers expiring before target and then sets
+// the clock to target, unless the clock is already past target.
+func (c *VirtualClock) advanceTo(target time.Time) {
+	for {
+		c.mu.Lock()
+		if len(c.timers) <= 0 || c.timers[0].when.After(target) {
+			if target.After(c.now) {
+				c.now = target
+			}
+			c.mu.Unlock()
+			return
+		}
+		t := heap.Pop(&c.timers).(*virtualTimer)
+		if t.when.After(c.now) {
+			c.now = t.when
+		}
+		fn := t.fn
+		c.mu.Unlock()
+		fn() // run without holding the mutex
+	}
+}
+
+// virtualTimer implements [tcpip.Timer] for the [*VirtualClock].
+type virtualTimer struct {
+	// clock is the clock owning the timer.
+	clock *VirtualClock
+
+	// fn is the function to invoke.
+	fn func()
+
+	// index is the index inside the heap or -1 if not scheduled.
+	index int
+
+	// seq is the sequence number used to break ties.
+	seq uint64
+
+	// when is the timer deadline.
+	when time.Time
+}
+
+// Ensure that [*virtualTimer] implements [tcpip.Timer].
+var _ tcpip.Timer = &virtualTimer{}
+
+// Stop implements [tcpip.Timer].
+func (t *virtualTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.stopLocked()
+}
+
+// stopLocked is like Stop but assumes the clock mutex is held.
+func (t *virtualTimer) stopLocked() bool {
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.clock.timers, t.index)
+	return true
+}
+
+// Reset implements [tcpip.Timer].
+func (t *virtualTimer) Reset(d time.Duration) {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.stopLocked()
+	t.when = c.now.Add(max(0, d))
+	t.seq = c.seq
+	c.seq++
+	heap.Push(&c.timers, t)
+}
+
+// virtualTimerHeap is a min-heap of [*virtualTimer] sorted by deadline
+// and then by sequence number.
+type virtualTimerHeap []*virtualTimer
+
+var _ heap.Interface = &virtualTimerHeap{}
+
+// Len implements [heap.Interface].
+func (h virtualTimerHeap) Len() int {
+	return len(h)
+}
+
+// Less implements [heap.Interface].
+func (h virtualTimerHeap) Less(i, j int) bool {
+	if !h[i].when.Equal(h[j].when) {
+		return h[i].when.Before(h[j].when)
+	}
+	return h[i].seq < h[j].seq
+}
+
+// Swap implements [heap.Interface].
+func (h virtualTimerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+// Push implements [heap.Interface].
+func (h *virtualTimerHeap) Push(x any) {
+	t := x.(*virtualTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+// Pop implements [heap.Interface].
+func (h *virtualTimerHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
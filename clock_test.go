@@ -0,0 +1,129 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVirtualClock(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("now", func(t *testing.T) {
+		clock := uis.NewVirtualClock(t0)
+		require.Equal(t, t0, clock.Now())
+		mono0 := clock.NowMonotonic()
+		clock.Advance(time.Second)
+		require.Equal(t, t0.Add(time.Second), clock.Now())
+		require.Equal(t, time.Second, clock.NowMonotonic().Sub(mono0))
+	})
+
+	t.Run("timers_run_in_order", func(t *testing.T) {
+		clock := uis.NewVirtualClock(t0)
+		var order []int
+		clock.AfterFunc(2*time.Second, func() { order = append(order, 2) })
+		clock.AfterFunc(time.Second, func() { order = append(order, 1) })
+		clock.AfterFunc(time.Second, func() { order = append(order, 11) })
+		clock.AfterFunc(3*time.Second, func() { order = append(order, 3) })
+
+		clock.Advance(2 * time.Second)
+		require.Equal(t, []int{1, 11, 2}, order)
+		require.Equal(t, t0.Add(2*time.Second), clock.Now())
+
+		require.True(t, clock.AdvanceToNext())
+		require.Equal(t, []int{1, 11, 2, 3}, order)
+		require.Equal(t, t0.Add(3*time.Second), clock.Now())
+
+		require.False(t, clock.AdvanceToNext())
+	})
+
+	t.Run("timer_sees_its_deadline", func(t *testing.T) {
+		clock := uis.NewVirtualClock(t0)
+		var seen time.Time
+		clock.AfterFunc(time.Second, func() { seen = clock.Now() })
+		clock.Advance(time.Hour)
+		require.Equal(t, t0.Add(time.Second), seen)
+		require.Equal(t, t0.Add(time.Hour), clock.Now())
+	})
+
+	t.Run("stop_and_reset", func(t *testing.T) {
+		clock := uis.NewVirtualClock(t0)
+		var count int
+		timer := clock.AfterFunc(time.Second, func() { count++ })
+		require.True(t, timer.Stop())
+		require.False(t, timer.Stop())
+		clock.Advance(time.Hour)
+		require.Zero(t, count)
+
+		timer.Reset(time.Second)
+		clock.Advance(time.Second)
+		require.Equal(t, 1, count)
+		require.False(t, timer.Stop())
+	})
+
+	t.Run("rescheduling_from_callback", func(t *testing.T) {
+		clock := uis.NewVirtualClock(t0)
+		var count int
+		var fn func()
+		fn = func() {
+			if count++; count < 3 {
+				clock.AfterFunc(time.Second, fn)
+			}
+		}
+		clock.AfterFunc(time.Second, fn)
+		clock.Advance(time.Minute)
+		require.Equal(t, 3, count)
+	})
+}
+
+func TestRouterAdvancesVirtualClock(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := uis.NewVirtualClock(t0)
+
+	ix := uis.NewInternet(uis.InternetOptionClock(clock))
+	require.Equal(t, clock, ix.Clock())
+	src := ix.NewVNIC(uis.MTUEthernet)
+	dst := netip.MustParseAddr("10.0.0.1")
+	vnic := ix.NewVNIC(uis.MTUEthernet)
+	disp := &countingDispatcher{}
+	vnic.Attach(disp)
+	require.NoError(t, ix.AddRoute(vnic, dst))
+	env := &routerTestEnv{ix: ix, src: src, disp: disp, dst: dst}
+
+	router := uis.NewRouter(ix)
+	require.NoError(t, router.AddLink(
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+		uis.LinkConfig{Delay: time.Hour},
+	))
+	env.run(t, router)
+
+	// the router must not advance the clock on its own
+	ctx := context.Background()
+	env.send(t)
+	time.Sleep(10 * time.Millisecond)
+	require.Equal(t, t0, clock.Now())
+	require.Equal(t, uint32(0), disp.count.Load())
+
+	// stepping processes the packet in flight and delivers it
+	require.True(t, router.Step(ctx))
+	require.Equal(t, t0.Add(time.Hour), clock.Now())
+	require.Equal(t, uint32(1), disp.count.Load())
+
+	// there are no more timers
+	require.False(t, router.Step(ctx))
+	require.Equal(t, t0.Add(time.Hour), clock.Now())
+}
+
+func TestRouterStepWithoutVirtualClock(t *testing.T) {
+	env := newRouterTestEnv(t)
+	router := uis.NewRouter(env.ix)
+	env.run(t, router)
+	require.False(t, router.Step(context.Background()))
+}
@@ -11,6 +11,8 @@ import (
 	"net"
 	"net/netip"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -84,28 +86,36 @@ func printerMain(ctx context.Context, total *atomic.Uint64) {
 
 // routerMain routes packets until the context is done.
 func routerMain(ctx context.Context, ix *uis.Internet, pcapFile string, snaplen uint16) (err error) {
-	var tr *uis.PCAPTrace
+	policies := []uis.PacketPolicy{}
 
 	if pcapFile != "" {
 		filep := runtimex.PanicOnError1(os.Create(pcapFile))
-		tr = uis.NewPCAPTrace(filep, snaplen)
+		tr := uis.NewPCAPTrace(filep, snaplen)
 		defer func() {
 			err = tr.Close()
 		}()
+		policies = append(policies, tr)
 	}
 
-	for {
-		select {
-		case frame := <-ix.InFlight():
-			if tr != nil {
-				tr.Dump(frame.Packet)
-			}
-			ix.Deliver(frame)
+	ix.Run(ctx, policies...)
+	return
+}
 
-		case <-ctx.Done():
-			return
+// parseBufferRange parses a "min,default,max" buffer size range.
+func parseBufferRange(value string) ([3]int, error) {
+	var sizes [3]int
+	fields := strings.Split(value, ",")
+	if len(fields) != len(sizes) {
+		return sizes, fmt.Errorf("invalid buffer range: %q", value)
+	}
+	for idx, field := range fields {
+		size, err := strconv.Atoi(field)
+		if err != nil {
+			return sizes, fmt.Errorf("invalid buffer range: %q", value)
 		}
+		sizes[idx] = size
 	}
+	return sizes, nil
 }
 
 func main() {
@@ -114,66 +124,92 @@ func main() {
 
 	// 2. add flags to parse
 	var (
-		clientAddr  = fset.String("client-addr", "10.0.0.2", "Select client IP address.")
-		duration    = fset.Duration("duration", 10*time.Second, "Benchmark duration.")
-		pcapFile    = fset.String("pcap-file", "", "Write PCAP at the given file.")
-		pcapSnaplen = fset.Int("pcap-snaplen", 1500, "PCAP snapshot length in bytes.")
-		serverAddr  = fset.String("server-addr", "10.0.0.1", "Select server IP address.")
-		serverPort  = fset.String("server-port", "443", "Select server port.")
+		clientAddr    = fset.String("client-addr", "10.0.0.2", "Select client IP address.")
+		congestion    = fset.String("congestion-control", "reno", "Select TCP congestion control (reno or cubic).")
+		duration      = fset.Duration("duration", 10*time.Second, "Benchmark duration.")
+		minRTO        = fset.Duration("min-rto", 0, "Select TCP minimum RTO (zero means default).")
+		nagle         = fset.Bool("nagle", false, "Enable Nagle's algorithm (delays small TCP segments).")
+		pcapFile      = fset.String("pcap-file", "", "Write PCAP at the given file.")
+		pcapSnaplen   = fset.Int("pcap-snaplen", 1500, "PCAP snapshot length in bytes.")
+		recvBuffer    = fset.String("receive-buffer", "", "Select TCP receive buffer range as min,default,max.")
+		sack          = fset.Bool("sack", false, "Enable TCP selective acknowledgements.")
+		sendBuffer    = fset.String("send-buffer", "", "Select TCP send buffer range as min,default,max.")
+		serverAddr    = fset.String("server-addr", "10.0.0.1", "Select server IP address.")
+		serverPort    = fset.String("server-port", "443", "Select server port.")
+		timestamps    = fset.Bool("timestamps", true, "Enable TCP timestamps.")
+		windowScaling = fset.Bool("window-scaling", true, "Enable TCP window scaling.")
 	)
 
 	// 3. parse command line
 	runtimex.PanicOnError0(fset.Parse(args[1:]))
 
-	// 4. create context with a timeout
+	// 4. create the TCP options shared by both stacks
+	options := []uis.StackOption{
+		uis.StackOptionTCPCongestionControl(uis.TCPCongestionControl(*congestion)),
+		uis.StackOptionTCPMinRTO(*minRTO),
+		uis.StackOptionTCPNagle(*nagle),
+		uis.StackOptionTCPSACK(*sack),
+		uis.StackOptionTCPTimestamps(*timestamps),
+		uis.StackOptionTCPWindowScaling(*windowScaling),
+	}
+	if *recvBuffer != "" {
+		sizes := runtimex.PanicOnError1(parseBufferRange(*recvBuffer))
+		options = append(options, uis.StackOptionTCPReceiveBufferSize(sizes[0], sizes[1], sizes[2]))
+	}
+	if *sendBuffer != "" {
+		sizes := runtimex.PanicOnError1(parseBufferRange(*sendBuffer))
+		options = append(options, uis.StackOptionTCPSendBufferSize(sizes[0], sizes[1], sizes[2]))
+	}
+
+	// 5. create context with a timeout
 	ctx, cancel := context.WithTimeout(context.Background(), *duration)
 	defer cancel()
 
-	// 5. create the internet instance
+	// 6. create the internet instance
 	ix := uis.NewInternet()
 
-	// 6. create the server virtual stack
+	// 7. create the server virtual stack
 	serverIPAddr := netip.MustParseAddr(*serverAddr)
-	serverStack := runtimex.PanicOnError1(ix.NewStack(65535, serverIPAddr))
+	serverStack := runtimex.PanicOnError1(ix.NewStackWithOptions(65535, []netip.Addr{serverIPAddr}, options...))
 	defer serverStack.Close()
 
-	// 7. create the server listener
+	// 8. create the server listener
 	serverEpnt := net.JoinHostPort(*serverAddr, *serverPort)
 	lc := uis.NewListenConfig(serverStack)
 	listener := runtimex.PanicOnError1(lc.Listen(ctx, "tcp", serverEpnt))
 	defer listener.Close()
 
-	// 8. spawn the server goroutine
+	// 9. spawn the server goroutine
 	wg := &sync.WaitGroup{}
 	totalSent := &atomic.Uint64{}
 	wg.Go(func() {
 		serverMain(listener, totalSent)
 	})
 
-	// 9. create the client virtual stack
+	// 10. create the client virtual stack
 	clientIPAddr := netip.MustParseAddr(*clientAddr)
-	clientStack := runtimex.PanicOnError1(ix.NewStack(65535, clientIPAddr))
+	clientStack := runtimex.PanicOnError1(ix.NewStackWithOptions(65535, []netip.Addr{clientIPAddr}, options...))
 	defer clientStack.Close()
 
-	// 10. spawn the client goroutine
+	// 11. spawn the client goroutine
 	totalRecv := &atomic.Uint64{}
 	connector := uis.NewConnector(clientStack)
 	wg.Go(func() {
 		clientMain(ctx, connector, serverEpnt, totalRecv)
 	})
 
-	// 11. spawn the goroutine counting bytes
+	// 12. spawn the goroutine counting bytes
 	wg.Go(func() {
 		printerMain(ctx, totalRecv)
 	})
 
-	// 12. route packets until done
+	// 13. route packets until done
 	runtimex.PanicOnError0(routerMain(ctx, ix, *pcapFile, uint16(*pcapSnaplen)))
 
-	// 13. shut down the stacks explicitly
+	// 14. shut down the stacks explicitly
 	clientStack.Close()
 	serverStack.Close()
 
-	// 14. wait for goroutines to finish
+	// 15. wait for goroutines to finish
 	wg.Wait()
 }
@@ -13,3 +13,26 @@ func Test_main(t *testing.T) {
 	output = io.Discard
 	main()
 }
+
+// Test_mainWithTCPOptions exercises the benchmark with TCP tuning options.
+func Test_mainWithTCPOptions(t *testing.T) {
+	args = []string{
+		"benchmark", "-duration", "500ms", "-congestion-control", "cubic", "-sack",
+		"-timestamps=false", "-window-scaling=false", "-min-rto", "50ms", "-nagle",
+		"-receive-buffer", "4096,65536,1048576", "-send-buffer", "4096,65536,1048576",
+	}
+	output = io.Discard
+	main()
+}
+
+func Test_parseBufferRange(t *testing.T) {
+	sizes, err := parseBufferRange("1,2,3")
+	if err != nil || sizes != [3]int{1, 2, 3} {
+		t.Fatal("unexpected result", sizes, err)
+	}
+	for _, value := range []string{"", "1,2", "1,2,x"} {
+		if _, err := parseBufferRange(value); err == nil {
+			t.Fatal("expected an error for", value)
+		}
+	}
+}
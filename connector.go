@@ -8,54 +8,378 @@ package uis
 
 import (
 	"context"
+	"errors"
 	"net"
 	"net/netip"
-	"syscall"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 )
 
+// Resolver resolves domain names to IP addresses.
+//
+// The [*net.Resolver] type implements this interface.
+type Resolver interface {
+	// LookupNetIP looks up the given host using the given network, which
+	// is "ip", "ip4", or "ip6", and returns its IP addresses.
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// Ensure that [*net.Resolver] implements [Resolver].
+var _ Resolver = &net.Resolver{}
+
 // Connector allows to dial [net.Conn] connections pretty much
 // like [*net.Dialer] except that here we use a [*Stack]
 // implementation as the networking backend.
 //
 // The zero value is invalid. Construct using [NewConnector].
 //
-// Only IP literal endpoints are supported. Dialing a hostname will fail.
+// Dialing a hostname requires a [Resolver]. Without a resolver, only
+// IP literal endpoints are supported and dialing a hostname will fail.
 type Connector struct {
+	// Control is the OPTIONAL function called after creating the gVisor
+	// endpoint and before binding and connecting it, which allows to set
+	// per-socket options (e.g., [tcpip.TTLOption]). Unlike [*net.Dialer],
+	// we pass the [tcpip.Endpoint] rather than a [syscall.RawConn].
+	//
+	// The network is the family-specific network (e.g., "tcp4", "udp6",
+	// or "ip4:icmp") and the address is the remote address. Returning
+	// an error causes the connection attempt to fail with that error,
+	// which we return unmodified.
+	Control func(network, address string, ep tcpip.Endpoint) error
+
+	// ControlContext is like Control but also receives the context passed
+	// to DialContext. When both are set, we ignore Control.
+	ControlContext func(ctx context.Context, network, address string, ep tcpip.Endpoint) error
+
+	// Deadline is the OPTIONAL absolute time after which dialing fails.
+	//
+	// Like [net.Dialer], when both Timeout and Deadline are set,
+	// dialing fails when reaching the earliest of the two.
+	Deadline time.Time
+
+	// FallbackDelay is the OPTIONAL amount of time to wait for a connection
+	// attempt before racing a connection attempt to the next address, which
+	// is the Connection Attempt Delay of Happy Eyeballs (see RFC 8305 Section 5).
+	//
+	// Like [net.Dialer], zero means 300 milliseconds and a negative value
+	// means dialing all the addresses sequentially.
+	FallbackDelay time.Duration
+
+	// KeepAlive is the OPTIONAL idle time before sending TCP keep-alive
+	// probes, which we also use as the interval between the probes.
+	//
+	// Unlike [net.Dialer], zero disables keep-alives, to avoid emitting
+	// packets that the simulation did not ask for. A negative value
+	// also disables keep-alives.
+	KeepAlive time.Duration
+
+	// LocalAddr is the OPTIONAL local address to bind to before connecting,
+	// which allows to pin the source port and to choose among the addresses
+	// of the [*Stack]. When the address is unspecified (e.g., 0.0.0.0:4444),
+	// we only pin the source port. When the address is specified, we only dial
+	// the remote addresses belonging to its family.
+	LocalAddr netip.AddrPort
+
+	// ResolutionDelay is the OPTIONAL amount of time to wait for the IPv6
+	// addresses after receiving the IPv4 addresses (see RFC 8305 Section 3).
+	// Zero means 50 milliseconds.
+	ResolutionDelay time.Duration
+
+	// Resolver is the OPTIONAL [Resolver] used to resolve hostnames.
+	Resolver Resolver
+
+	// Timeout is the OPTIONAL maximum amount of time a dial will
+	// wait for a connection to complete, including resolution.
+	Timeout time.Duration
+
 	// stack is the uis stack to use.
 	stack *Stack
 }
 
 // NewConnector creates a new [*Connector] instance.
 func NewConnector(stack *Stack) *Connector {
-	return &Connector{stack: stack}
+	return &Connector{
+		Control:         nil,
+		ControlContext:  nil,
+		Deadline:        time.Time{},
+		FallbackDelay:   0,
+		KeepAlive:       0,
+		LocalAddr:       netip.AddrPort{},
+		ResolutionDelay: 0,
+		Resolver:        nil,
+		Timeout:         0,
+		stack:           stack,
+	}
 }
 
+// connectorDefaultFallbackDelay is the default [Connector] FallbackDelay.
+const connectorDefaultFallbackDelay = 300 * time.Millisecond
+
 // DialContext creates a new [net.Conn] connection.
+//
+// The network MUST be "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "ip4:icmp",
+// or "ip6:ipv6-icmp". With the raw ICMP networks, the address is a host without
+// port (e.g., 10.0.0.1) and the conn is a ping socket: it only sends echo requests
+// and only receives the matching echo replies (see [*Stack.DialICMP]). Other
+// networks cause [syscall.EPROTOTYPE]. Like the stdlib, we only dial the addresses
+// belonging to the family of the network (e.g., IPv6 addresses for "tcp6").
+//
+// When the address contains a hostname, we resolve it using the [Resolver] and
+// dial the returned addresses using Happy Eyeballs (see RFC 8305): we resolve the
+// IPv6 and IPv4 addresses concurrently, wait for the IPv6 addresses up to the
+// ResolutionDelay, and race connection attempts interleaving the two families,
+// starting a new attempt every FallbackDelay or as soon as an attempt fails.
+// The timers use the clock of the [*Stack] (see [StackOptionClock]). When the
+// FallbackDelay is negative, we dial the addresses sequentially instead, splitting
+// the time until the context deadline among them like [*net.Dialer] does.
 func (c *Connector) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
-	// 1. parse the address into a [netip.AddrPort]
-	addrport, err := netip.ParseAddrPort(address)
+	// 1. make sure the network is supported
+	proto, family, err := networkParse(network)
 	if err != nil {
 		return nil, err
 	}
 
-	// 2. dial using either TCP or UDP
-	var conn net.Conn
-	switch network {
-	case "tcp":
-		conn, err = c.stack.DialTCP(ctx, addrport)
+	// 2. only dial the family of the local address, if specified
+	if addr := c.LocalAddr.Addr(); addr.IsValid() && !addr.IsUnspecified() {
+		localFamily := networkFamilyOf(addr)
+		if family != networkFamilyAny && family != localFamily {
+			return nil, &net.AddrError{Err: "mismatched local address type", Addr: c.LocalAddr.String()}
+		}
+		family = localFamily
+	}
+
+	// 3. honor the Timeout and the Deadline
+	if deadline := c.deadline(time.Now()); !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
 
-	case "udp":
-		conn, err = c.stack.DialUDP(addrport)
+	// 4. use Happy Eyeballs unless configured to dial sequentially
+	if c.FallbackDelay >= 0 {
+		return c.dialHappyEyeballs(ctx, proto, family, address)
+	}
 
-	default:
-		return nil, syscall.EPROTOTYPE
+	// 5. otherwise resolve the address and dial sequentially
+	addrs, err := c.lookup(ctx, proto, family, address)
+	if err != nil {
+		return nil, err
+	}
+	return c.dialSerial(ctx, proto, addrs)
+}
+
+// deadline returns the earliest of now plus the Timeout and the Deadline
+// or the zero time if neither the Timeout nor the Deadline are set.
+func (c *Connector) deadline(now time.Time) time.Time {
+	deadline := c.Deadline
+	if c.Timeout > 0 {
+		if timeout := now.Add(c.Timeout); deadline.IsZero() || timeout.Before(deadline) {
+			deadline = timeout
+		}
+	}
+	return deadline
+}
+
+// lookup resolves the given address into a non-empty list of [netip.AddrPort]
+// belonging to the given family, using the conventions of the given protocol.
+func (c *Connector) lookup(ctx context.Context,
+	proto string, family networkFamily, address string) ([]netip.AddrPort, error) {
+	// 1. split the host and the port, resolving service names
+	host, port, err := connectorSplitHostPort(proto, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. handle the IP literal case or resolve the hostname
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else if addrs, err = c.resolve(ctx, family, host); err != nil {
+		return nil, err
+	}
+
+	// 3. make sure we have addresses belonging to the family
+	addrports := connectorAddrPorts(family, addrs, port)
+	if len(addrports) <= 0 {
+		return nil, networkNoSuitableAddress(address)
+	}
+	return addrports, nil
+}
+
+// resolve resolves the given hostname into a non-empty list of addresses
+// belonging to the given family and fails if we do not have a [Resolver].
+func (c *Connector) resolve(ctx context.Context, family networkFamily, host string) ([]netip.Addr, error) {
+	if c.Resolver == nil {
+		return nil, &net.DNSError{Err: "no resolver configured", Name: host}
 	}
+	addrs, err := c.Resolver.LookupNetIP(ctx, family.resolverNetwork(), host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) <= 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// connectorSplitHostPort splits the given address into a host and a numeric
+// port, resolving service names (e.g., "http") like [*net.Dialer] does using
+// [net.LookupPort]. The addresses of the raw ICMP networks do not have a
+// port, so we return the address and a zero port.
+func connectorSplitHostPort(proto, address string) (string, uint16, error) {
+	if proto == networkProtoICMP {
+		return address, 0, nil
+	}
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := net.LookupPort(proto, portString)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, uint16(port), nil
+}
+
+// connectorAddrPorts builds the endpoints using the addresses belonging to the given
+// family and the given port, which requires unmapping because [*net.Resolver] returns
+// IPv4-mapped IPv6 addresses.
+func connectorAddrPorts(family networkFamily, addrs []netip.Addr, port uint16) []netip.AddrPort {
+	var addrports []netip.AddrPort
+	for _, addr := range addrs {
+		if family.allows(addr) {
+			addrports = append(addrports, netip.AddrPortFrom(addr.Unmap(), port))
+		}
+	}
+	return addrports
+}
+
+// dialSerial dials the given addresses in sequence and returns the first
+// established connection or the first error if all attempts fail.
+func (c *Connector) dialSerial(ctx context.Context, network string, addrs []netip.AddrPort) (net.Conn, error) {
+	var firstErr error
+	for idx, addr := range addrs {
+		// 1. stop if the context is done
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		// 2. give each remaining address a fair share of the remaining time
+		dialCtx := ctx
+		if deadline, ok := ctx.Deadline(); ok {
+			partial := connectorPartialDeadline(time.Now(), deadline, len(addrs)-idx)
+			var cancel context.CancelFunc
+			dialCtx, cancel = context.WithDeadline(ctx, partial)
+			defer cancel()
+		}
+
+		// 3. dial and return on success
+		conn, err := c.dialSingle(dialCtx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("no addresses to dial")
+	}
+	return nil, firstErr
+}
 
-	// 3. remap the error on failure
+// connectorMinPartialTimeout is the minimum time given to each address
+// when splitting the remaining time among several addresses.
+const connectorMinPartialTimeout = 2 * time.Second
+
+// connectorPartialDeadline returns the deadline to use for dialing one of
+// the given number of remaining addresses, like the stdlib does.
+func connectorPartialDeadline(now, deadline time.Time, remaining int) time.Time {
+	timeRemaining := deadline.Sub(now)
+	if timeRemaining <= 0 || remaining <= 1 {
+		return deadline
+	}
+	timeout := timeRemaining / time.Duration(remaining)
+	if timeout < connectorMinPartialTimeout {
+		timeout = min(connectorMinPartialTimeout, timeRemaining)
+	}
+	return now.Add(timeout)
+}
+
+// dialSingle dials a single address.
+func (c *Connector) dialSingle(ctx context.Context, network string, addrport netip.AddrPort) (net.Conn, error) {
+	// 1. create the endpoint, configure it, and connect it
+	var controlErr error
+	control := func(ep tcpip.Endpoint) error {
+		controlErr = c.control(ctx, network, addrport, ep)
+		return controlErr
+	}
+	ep, wq, err := c.stack.dialEndpoint(ctx, network, c.localAddr(addrport), addrport, control)
+	if controlErr != nil {
+		return nil, controlErr // do not remap the errors returned by Control and ControlContext
+	}
 	if err != nil {
 		return nil, errorsRemap(err)
 	}
 
-	// 4. wrap conn to correctly remap errors
-	return &connWrapper{conn}, nil
+	// 2. wrap the endpoint to correctly remap errors
+	switch network {
+	case networkProtoTCP:
+		return &connWrapper{gonet.NewTCPConn(wq, ep)}, nil
+	case networkProtoICMP:
+		return &icmpConnWrapper{gonet.NewUDPConn(wq, ep)}, nil
+	default:
+		return &packetConnWrapper{gonet.NewUDPConn(wq, ep)}, nil
+	}
+}
+
+// localAddr returns the local address to bind to when dialing the given remote
+// address, which is invalid when there is no need to bind. When LocalAddr is
+// unspecified, we use the unspecified address of the remote address family.
+func (c *Connector) localAddr(raddr netip.AddrPort) netip.AddrPort {
+	addr := c.LocalAddr.Addr()
+	switch {
+	case !addr.IsValid():
+		return netip.AddrPort{}
+	case addr.IsUnspecified() && raddr.Addr().Is4():
+		return netip.AddrPortFrom(netip.IPv4Unspecified(), c.LocalAddr.Port())
+	case addr.IsUnspecified():
+		return netip.AddrPortFrom(netip.IPv6Unspecified(), c.LocalAddr.Port())
+	default:
+		return netip.AddrPortFrom(addr.Unmap(), c.LocalAddr.Port())
+	}
+}
+
+// control configures the endpoint used to dial the given remote address by
+// enabling TCP keep-alives, if needed, and calling ControlContext or Control.
+func (c *Connector) control(ctx context.Context, network string, raddr netip.AddrPort, ep tcpip.Endpoint) error {
+	// 1. enable TCP keep-alives if so configured
+	if network == networkProtoTCP && c.KeepAlive > 0 {
+		ep.SocketOptions().SetKeepAlive(true)
+		idle := tcpip.KeepaliveIdleOption(c.KeepAlive)
+		if tcpErr := ep.SetSockOpt(&idle); tcpErr != nil {
+			return errors.New(tcpErr.String())
+		}
+		interval := tcpip.KeepaliveIntervalOption(c.KeepAlive)
+		if tcpErr := ep.SetSockOpt(&interval); tcpErr != nil {
+			return errors.New(tcpErr.String())
+		}
+	}
+
+	// 2. call the user-provided control function, if any
+	family := networkFamilyOf(raddr.Addr())
+	address := raddr.String()
+	if network == networkProtoICMP {
+		address = raddr.Addr().String()
+	}
+	switch {
+	case c.ControlContext != nil:
+		return c.ControlContext(ctx, networkName(network, family), address, ep)
+	case c.Control != nil:
+		return c.Control(networkName(network, family), address, ep)
+	default:
+		return nil
+	}
 }
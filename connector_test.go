@@ -5,6 +5,7 @@ package uis_test
 import (
 	"context"
 	"errors"
+	"net"
 	"net/netip"
 	"syscall"
 	"testing"
@@ -13,6 +14,7 @@ import (
 	"github.com/bassosimone/uis"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
 )
 
 func TestConnectorDialContextRejectsDomain(t *testing.T) {
@@ -31,7 +33,7 @@ func TestConnectorDialContextRejectsUnknownNetwork(t *testing.T) {
 	t.Cleanup(stack.Close)
 
 	connector := uis.NewConnector(stack)
-	_, err := connector.DialContext(context.Background(), "tcp4", "10.0.0.1:80")
+	_, err := connector.DialContext(context.Background(), "unix", "/tmp/uis.sock")
 	require.Error(t, err)
 	assert.True(t, errors.Is(err, syscall.EPROTOTYPE))
 }
@@ -69,3 +71,316 @@ func TestConnectorDialContextRemapsErrors(t *testing.T) {
 	require.Error(t, err)
 	assert.True(t, errors.Is(err, syscall.ECONNREFUSED))
 }
+
+// connectorTestResolver is a [uis.Resolver] using a static map.
+type connectorTestResolver map[string][]netip.Addr
+
+// LookupNetIP implements [uis.Resolver].
+func (r connectorTestResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	addrs, found := r[host]
+	if !found {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+func TestConnectorDialContextWithResolver(t *testing.T) {
+	// create a dual-stack client, a server listening on 10.0.0.1:80 and
+	// a host refusing connections, while nobody owns 2001:db8::1
+	ix := uis.NewInternet()
+	client, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("2001:db8::2"))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	server, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.1"))
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	refusing, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.3"))
+	require.NoError(t, err)
+	t.Cleanup(refusing.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go ix.Run(ctx)
+
+	listener, err := uis.NewListenConfig(server).Listen(ctx, "tcp", "10.0.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	resolver := connectorTestResolver{
+		"example.com":   {netip.MustParseAddr("10.0.0.1")},
+		"mapped.com":    {netip.MustParseAddr("::ffff:10.0.0.1")},
+		"refusing.com":  {netip.MustParseAddr("10.0.0.3"), netip.MustParseAddr("10.0.0.1")},
+		"blackhole.com": {netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("10.0.0.1")},
+		"empty.com":     {},
+	}
+
+	t.Run("success", func(t *testing.T) {
+		for _, domain := range []string{"example.com", "mapped.com", "refusing.com", "blackhole.com"} {
+			connector := uis.NewConnector(client)
+			connector.FallbackDelay = 50 * time.Millisecond
+			connector.Resolver = resolver
+			conn, err := connector.DialContext(ctx, "tcp", net.JoinHostPort(domain, "80"))
+			require.NoError(t, err, domain)
+			require.Equal(t, "10.0.0.1:80", conn.RemoteAddr().String(), domain)
+			require.NoError(t, conn.Close())
+		}
+	})
+
+	t.Run("service name", func(t *testing.T) {
+		connector := uis.NewConnector(client)
+		connector.Resolver = resolver
+		conn, err := connector.DialContext(ctx, "tcp", "example.com:http")
+		require.NoError(t, err)
+		require.Equal(t, "10.0.0.1:80", conn.RemoteAddr().String())
+		require.NoError(t, conn.Close())
+	})
+
+	t.Run("sequential", func(t *testing.T) {
+		connector := uis.NewConnector(client)
+		connector.FallbackDelay = -1
+		connector.Resolver = resolver
+		conn, err := connector.DialContext(ctx, "tcp", "refusing.com:80")
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		connector := uis.NewConnector(client)
+		connector.Resolver = resolver
+
+		var dnsErr *net.DNSError
+		_, err := connector.DialContext(ctx, "tcp", "nonexistent.com:80")
+		require.True(t, errors.As(err, &dnsErr) && dnsErr.IsNotFound)
+		_, err = connector.DialContext(ctx, "tcp", "empty.com:80")
+		require.True(t, errors.As(err, &dnsErr) && dnsErr.IsNotFound)
+
+		_, err = connector.DialContext(ctx, "tcp", "example.com:nonexistent-service")
+		require.Error(t, err)
+		_, err = connector.DialContext(ctx, "tcp", "example.com")
+		require.Error(t, err)
+	})
+}
+
+func TestConnectorDialContextWithFamilies(t *testing.T) {
+	// create dual-stack client and server, where the server listens
+	// using TCP and UDP on both its IPv4 and its IPv6 address
+	ix := uis.NewInternet()
+	client, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("2001:db8::2"))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	server, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2001:db8::1"))
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go ix.Run(ctx)
+
+	for _, address := range []string{"10.0.0.1:80", "[2001:db8::1]:80"} {
+		listener, err := uis.NewListenConfig(server).Listen(ctx, "tcp", address)
+		require.NoError(t, err)
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+	}
+
+	connector := uis.NewConnector(client)
+	connector.Resolver = connectorTestResolver{
+		"example.com": {netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("10.0.0.1")},
+		"ipv4.com":    {netip.MustParseAddr("10.0.0.1")},
+	}
+
+	t.Run("success", func(t *testing.T) {
+		cases := []struct {
+			network string
+			address string
+			remote  string
+		}{
+			{"tcp", "example.com:80", "[2001:db8::1]:80"},
+			{"tcp4", "example.com:80", "10.0.0.1:80"},
+			{"tcp6", "example.com:80", "[2001:db8::1]:80"},
+			{"tcp4", "[::ffff:10.0.0.1]:80", "10.0.0.1:80"},
+			{"udp4", "example.com:53", "10.0.0.1:53"},
+			{"udp6", "example.com:53", "[2001:db8::1]:53"},
+			{"udp6", "[2001:db8::1]:53", "[2001:db8::1]:53"},
+		}
+		for _, tc := range cases {
+			conn, err := connector.DialContext(ctx, tc.network, tc.address)
+			require.NoError(t, err, tc.network, tc.address)
+			require.Equal(t, tc.remote, conn.RemoteAddr().String(), tc.network, tc.address)
+			require.NoError(t, conn.Close())
+		}
+	})
+
+	t.Run("no suitable address", func(t *testing.T) {
+		cases := []struct {
+			network string
+			address string
+		}{
+			{"tcp6", "ipv4.com:80"},
+			{"tcp6", "10.0.0.1:80"},
+			{"tcp6", "[::ffff:10.0.0.1]:80"},
+			{"udp4", "[2001:db8::1]:53"},
+		}
+		for _, tc := range cases {
+			var addrErr *net.AddrError
+			_, err := connector.DialContext(ctx, tc.network, tc.address)
+			require.True(t, errors.As(err, &addrErr), tc.network, tc.address)
+		}
+	})
+}
+
+func TestConnectorDialContextWithOptions(t *testing.T) {
+	// create a client with two IPv4 addresses and a server listening on 10.0.0.1:80
+	// that reports the remote address of the conns it accepts
+	ix := uis.NewInternet()
+	client, err := ix.NewStack(uis.MTUEthernet,
+		netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.3"), netip.MustParseAddr("2001:db8::2"))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	server, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2001:db8::1"))
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go ix.Run(ctx)
+
+	listener, err := uis.NewListenConfig(server).Listen(ctx, "tcp", "10.0.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	remotes := make(chan string, 16)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			remotes <- conn.RemoteAddr().String()
+			conn.Close()
+		}
+	}()
+
+	t.Run("LocalAddr", func(t *testing.T) {
+		for _, tc := range []struct {
+			localAddr string
+			expect    string
+		}{
+			{"10.0.0.3:4444", "10.0.0.3:4444"},
+			{"10.0.0.2:0", "10.0.0.2:"},
+			{"0.0.0.0:5555", ":5555"},
+		} {
+			connector := uis.NewConnector(client)
+			connector.LocalAddr = netip.MustParseAddrPort(tc.localAddr)
+			conn, err := connector.DialContext(ctx, "tcp", "10.0.0.1:80")
+			require.NoError(t, err, tc.localAddr)
+			require.Contains(t, conn.LocalAddr().String(), tc.expect)
+			require.Contains(t, <-remotes, tc.expect)
+			require.NoError(t, conn.Close())
+		}
+	})
+
+	t.Run("LocalAddr restricts the family", func(t *testing.T) {
+		connector := uis.NewConnector(client)
+		connector.LocalAddr = netip.MustParseAddrPort("10.0.0.3:0")
+		connector.Resolver = connectorTestResolver{
+			"example.com": {netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("10.0.0.1")},
+		}
+		conn, err := connector.DialContext(ctx, "tcp", "example.com:80")
+		require.NoError(t, err)
+		require.Equal(t, "10.0.0.1:80", conn.RemoteAddr().String())
+		<-remotes
+		require.NoError(t, conn.Close())
+
+		var addrErr *net.AddrError
+		_, err = connector.DialContext(ctx, "tcp6", "example.com:80")
+		require.True(t, errors.As(err, &addrErr))
+		_, err = connector.DialContext(ctx, "tcp", "[2001:db8::1]:80")
+		require.True(t, errors.As(err, &addrErr))
+	})
+
+	t.Run("Control", func(t *testing.T) {
+		var calls []string
+		connector := uis.NewConnector(client)
+		connector.KeepAlive = 7 * time.Second
+		connector.Control = func(network, address string, ep tcpip.Endpoint) error {
+			calls = append(calls, "Control")
+			return nil
+		}
+		connector.ControlContext = func(ctx context.Context, network, address string, ep tcpip.Endpoint) error {
+			calls = append(calls, "ControlContext "+network+" "+address)
+			require.True(t, ep.SocketOptions().GetKeepAlive())
+			var idle tcpip.KeepaliveIdleOption
+			require.Nil(t, ep.GetSockOpt(&idle))
+			require.Equal(t, 7*time.Second, time.Duration(idle))
+			return nil
+		}
+		conn, err := connector.DialContext(ctx, "tcp", "10.0.0.1:80")
+		require.NoError(t, err)
+		<-remotes
+		require.NoError(t, conn.Close())
+
+		conn, err = connector.DialContext(ctx, "ip6:ipv6-icmp", "2001:db8::1")
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+
+		require.Equal(t, []string{
+			"ControlContext tcp4 10.0.0.1:80",
+			"ControlContext ip6:ipv6-icmp 2001:db8::1",
+		}, calls)
+	})
+
+	t.Run("Control failure", func(t *testing.T) {
+		mockedErr := errors.New("mocked error")
+		connector := uis.NewConnector(client)
+		connector.Control = func(network, address string, ep tcpip.Endpoint) error {
+			require.False(t, ep.SocketOptions().GetKeepAlive())
+			return mockedErr
+		}
+		_, err := connector.DialContext(ctx, "udp", "10.0.0.1:53")
+		require.True(t, errors.Is(err, mockedErr))
+
+		// errors resembling gVisor errors are returned unmodified
+		refusedErr := errors.New("connection was refused")
+		connector.Control = nil
+		connector.ControlContext = func(ctx context.Context, network, address string, ep tcpip.Endpoint) error {
+			return refusedErr
+		}
+		_, err = connector.DialContext(ctx, "tcp", "10.0.0.1:80")
+		require.True(t, err == refusedErr)
+	})
+
+	t.Run("Timeout and Deadline", func(t *testing.T) {
+		// nobody owns 10.0.0.99, so the connection attempt blocks
+		connector := uis.NewConnector(client)
+		connector.Timeout = 100 * time.Millisecond
+		t0 := time.Now()
+		_, err := connector.DialContext(ctx, "tcp", "10.0.0.99:80")
+		require.True(t, errors.Is(err, context.DeadlineExceeded))
+		require.Less(t, time.Since(t0), time.Second)
+
+		connector = uis.NewConnector(client)
+		connector.Deadline = time.Now().Add(100 * time.Millisecond)
+		connector.Timeout = time.Minute
+		t0 = time.Now()
+		_, err = connector.DialContext(ctx, "tcp", "10.0.0.99:80")
+		require.True(t, errors.Is(err, context.DeadlineExceeded))
+		require.Less(t, time.Since(t0), time.Second)
+	})
+}
@@ -0,0 +1,275 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSRecordSet is an in-memory set of DNS records served by a [*DNSServer].
+//
+// Names are case insensitive and may or may not end with a dot. The
+// record set is safe for concurrent use, so you can add records while
+// the server is running (e.g., to simulate a changing zone).
+//
+// The zero value is invalid. Construct using [NewDNSRecordSet].
+type DNSRecordSet struct {
+	// mu protects records.
+	mu sync.RWMutex
+
+	// records maps canonical names to their records, whose header
+	// lacks the name, which we fill when answering queries.
+	records map[string][]dnsmessage.Resource
+}
+
+// NewDNSRecordSet creates an empty [*DNSRecordSet].
+func NewDNSRecordSet() *DNSRecordSet {
+	return &DNSRecordSet{
+		mu:      sync.RWMutex{},
+		records: make(map[string][]dnsmessage.Resource),
+	}
+}
+
+// dnsRecordTTL is the TTL of the records served by a [*DNSServer].
+const dnsRecordTTL = 60
+
+// dnsMaxCNAMEHops is the maximum number of CNAME records we follow.
+const dnsMaxCNAMEHops = 8
+
+// AddAddrs adds A records for the IPv4 addresses and AAAA records for
+// the IPv6 addresses to the given name.
+//
+// This method fails if the name is not a valid DNS name.
+func (rs *DNSRecordSet) AddAddrs(name string, addrs ...netip.Addr) error {
+	var bodies []dnsmessage.ResourceBody
+	for _, addr := range addrs {
+		if addr.Unmap().Is4() {
+			bodies = append(bodies, &dnsmessage.AResource{A: addr.Unmap().As4()})
+		} else {
+			bodies = append(bodies, &dnsmessage.AAAAResource{AAAA: addr.As16()})
+		}
+	}
+	return rs.add(name, bodies...)
+}
+
+// AddCNAME adds a CNAME record pointing to the given target to the given name.
+//
+// When a name has a CNAME record and no records of the queried type,
+// the server answers with the CNAME record followed by the records of
+// the queried type for the target, like a recursive resolver does.
+//
+// This method fails if the name or the target are not valid DNS names.
+func (rs *DNSRecordSet) AddCNAME(name, target string) error {
+	cname, err := dnsmessage.NewName(dnsFQDN(target))
+	if err != nil {
+		return err
+	}
+	return rs.add(name, &dnsmessage.CNAMEResource{CNAME: cname})
+}
+
+// AddTXT adds a TXT record containing the given strings to the given name.
+//
+// This method fails if the name is not a valid DNS name, if there
+// are no strings, or if a string is longer than 255 bytes.
+func (rs *DNSRecordSet) AddTXT(name string, values ...string) error {
+	if len(values) <= 0 {
+		return errors.New("no TXT strings")
+	}
+	return rs.add(name, &dnsmessage.TXTResource{TXT: values})
+}
+
+// AddHTTPS adds the given HTTPS records to the given name (see RFC 9460).
+//
+// This method fails if the name or the records are not valid.
+func (rs *DNSRecordSet) AddHTTPS(name string, records ...dnsmessage.HTTPSResource) error {
+	var bodies []dnsmessage.ResourceBody
+	for _, record := range records {
+		bodies = append(bodies, &record)
+	}
+	return rs.add(name, bodies...)
+}
+
+// AddSVCB adds the given SVCB records to the given name (see RFC 9460).
+//
+// This method fails if the name or the records are not valid.
+func (rs *DNSRecordSet) AddSVCB(name string, records ...dnsmessage.SVCBResource) error {
+	var bodies []dnsmessage.ResourceBody
+	for _, record := range records {
+		bodies = append(bodies, &record)
+	}
+	return rs.add(name, bodies...)
+}
+
+// add validates the records and adds them to the given name.
+func (rs *DNSRecordSet) add(name string, bodies ...dnsmessage.ResourceBody) error {
+	// 1. make sure the name is valid
+	owner, err := dnsmessage.NewName(dnsFQDN(name))
+	if err != nil {
+		return err
+	}
+
+	// 2. make sure we can pack the records, which validates them
+	records := make([]dnsmessage.Resource, 0, len(bodies))
+	for _, body := range bodies {
+		records = append(records, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Type:  dnsBodyType(body),
+				Class: dnsmessage.ClassINET,
+				TTL:   dnsRecordTTL,
+			},
+			Body: body,
+		})
+	}
+	msg := &dnsmessage.Message{Answers: dnsWithOwner(records, owner)}
+	if _, err := msg.Pack(); err != nil {
+		return err
+	}
+
+	// 3. add the records
+	rs.mu.Lock()
+	key := dnsCanonicalName(name)
+	rs.records[key] = append(rs.records[key], records...)
+	rs.mu.Unlock()
+	return nil
+}
+
+// dnsFQDN returns the given name with a trailing dot.
+func dnsFQDN(name string) string {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// dnsCanonicalName returns the lowercase name without the trailing dot.
+func dnsCanonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// dnsWithOwner returns copies of the given records using the given owner name.
+func dnsWithOwner(records []dnsmessage.Resource, owner dnsmessage.Name) []dnsmessage.Resource {
+	output := make([]dnsmessage.Resource, 0, len(records))
+	for _, record := range records {
+		record.Header.Name = owner
+		output = append(output, record)
+	}
+	return output
+}
+
+// lookup returns the response code and the answers for the given question,
+// following the CNAME records of the names lacking records of the queried type.
+func (rs *DNSRecordSet) lookup(question dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.Resource) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	var answers []dnsmessage.Resource
+	owner := question.Name
+	for range dnsMaxCNAMEHops {
+		// 1. a name without records does not exist
+		records, found := rs.records[dnsCanonicalName(owner.String())]
+		if !found {
+			return dnsmessage.RCodeNameError, answers
+		}
+
+		// 2. collect the records of the queried type and the CNAME
+		var matching, cnames []dnsmessage.Resource
+		for _, record := range records {
+			switch record.Header.Type {
+			case question.Type:
+				matching = append(matching, record)
+			case dnsmessage.TypeCNAME:
+				cnames = append(cnames, record)
+			}
+		}
+
+		// 3. stop unless we need to follow the CNAME
+		if len(matching) > 0 || len(cnames) <= 0 {
+			return dnsmessage.RCodeSuccess, append(answers, dnsWithOwner(matching, owner)...)
+		}
+		answers = append(answers, dnsWithOwner(cnames[:1], owner)...)
+		owner = cnames[0].Body.(*dnsmessage.CNAMEResource).CNAME
+	}
+	return dnsmessage.RCodeServerFailure, nil // probably a CNAME loop
+}
+
+// dnsBodyType returns the type of the given record body.
+func dnsBodyType(body dnsmessage.ResourceBody) dnsmessage.Type {
+	switch body.(type) {
+	case *dnsmessage.AResource:
+		return dnsmessage.TypeA
+	case *dnsmessage.AAAAResource:
+		return dnsmessage.TypeAAAA
+	case *dnsmessage.CNAMEResource:
+		return dnsmessage.TypeCNAME
+	case *dnsmessage.TXTResource:
+		return dnsmessage.TypeTXT
+	case *dnsmessage.HTTPSResource:
+		return dnsmessage.TypeHTTPS
+	default:
+		return dnsmessage.TypeSVCB
+	}
+}
+
+// dnsMaxUDPSize is the maximum size of DNS messages over UDP without EDNS(0).
+const dnsMaxUDPSize = 512
+
+// dnsEDNSUDPSize is the UDP payload size we advertise using EDNS(0).
+const dnsEDNSUDPSize = 1232
+
+// respond returns the response to the given query or false if the query is
+// not worth a response. When using UDP, we truncate responses larger than the
+// UDP payload size advertised by the client, which causes it to retry using TCP.
+func (rs *DNSRecordSet) respond(query []byte, udp bool) ([]byte, bool) {
+	// 1. parse the query and ignore responses
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || msg.Response {
+		return nil, false
+	}
+
+	// 2. find the answers
+	resp := &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               msg.ID,
+			Response:         true,
+			OpCode:           msg.OpCode,
+			Authoritative:    true,
+			RecursionDesired: msg.RecursionDesired,
+		},
+		Questions: msg.Questions,
+	}
+	switch {
+	case msg.OpCode != 0:
+		resp.RCode = dnsmessage.RCodeNotImplemented
+	case len(msg.Questions) != 1:
+		resp.RCode = dnsmessage.RCodeFormatError
+	case msg.Questions[0].Class != dnsmessage.ClassINET:
+		resp.RCode = dnsmessage.RCodeRefused
+	default:
+		resp.RCode, resp.Answers = rs.lookup(msg.Questions[0])
+	}
+
+	// 3. honor EDNS(0) when the client uses it
+	maxSize := dnsMaxUDPSize
+	for _, additional := range msg.Additionals {
+		if additional.Header.Type == dnsmessage.TypeOPT {
+			maxSize = max(maxSize, int(additional.Header.Class))
+			var header dnsmessage.ResourceHeader
+			_ = header.SetEDNS0(dnsEDNSUDPSize, dnsmessage.RCodeSuccess, false)
+			resp.Additionals = []dnsmessage.Resource{{Header: header, Body: &dnsmessage.OPTResource{}}}
+			break
+		}
+	}
+
+	// 4. serialize the response truncating it when needed
+	data, err := resp.Pack()
+	if err == nil && udp && len(data) > maxSize {
+		resp.Truncated = true
+		resp.Answers = nil
+		data, err = resp.Pack()
+	}
+	return data, err == nil
+}
@@ -0,0 +1,197 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNSRecordSetAdd(t *testing.T) {
+	rs := NewDNSRecordSet()
+	require.NoError(t, rs.AddAddrs("example.com", netip.MustParseAddr("::ffff:10.0.0.1")))
+	require.NoError(t, rs.AddTXT("example.com.", "v=spf1 -all"))
+	require.NoError(t, rs.AddCNAME("www.example.com", "example.com"))
+	require.NoError(t, rs.AddHTTPS("example.com", dnsmessage.HTTPSResource{
+		SVCBResource: dnsmessage.SVCBResource{Priority: 1, Target: dnsmessage.MustNewName(".")},
+	}))
+
+	require.Error(t, rs.AddAddrs(strings.Repeat("a", 300), netip.MustParseAddr("10.0.0.1")))
+	require.Error(t, rs.AddAddrs("a..b", netip.MustParseAddr("10.0.0.1")))
+	require.Error(t, rs.AddCNAME("example.org", strings.Repeat("a", 300)))
+	require.Error(t, rs.AddTXT("example.org"))
+	require.Error(t, rs.AddTXT("example.org", strings.Repeat("a", 256)))
+	require.Len(t, rs.records, 2)
+	require.Equal(t, dnsmessage.TypeA, rs.records["example.com"][0].Header.Type)
+}
+
+func TestDNSRecordSetLookup(t *testing.T) {
+	rs := NewDNSRecordSet()
+	require.NoError(t, rs.AddAddrs("Example.COM", netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2001:db8::1")))
+	require.NoError(t, rs.AddCNAME("www.example.com", "cdn.example.com"))
+	require.NoError(t, rs.AddCNAME("cdn.example.com", "example.com"))
+	require.NoError(t, rs.AddCNAME("dangling.example.com", "nonexistent.example.com"))
+	require.NoError(t, rs.AddCNAME("loop1.example.com", "loop2.example.com"))
+	require.NoError(t, rs.AddCNAME("loop2.example.com", "loop1.example.com"))
+
+	// lookup returns the rcode and the stringified answers.
+	lookup := func(name string, qtype dnsmessage.Type) (dnsmessage.RCode, []string) {
+		rcode, answers := rs.lookup(dnsmessage.Question{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		})
+		var output []string
+		for _, answer := range answers {
+			output = append(output, answer.Header.Name.String()+" "+answer.Header.Type.String())
+		}
+		return rcode, output
+	}
+
+	cases := []struct {
+		name    string
+		qname   string
+		qtype   dnsmessage.Type
+		rcode   dnsmessage.RCode
+		answers []string
+	}{{
+		name:    "A",
+		qname:   "EXAMPLE.com.",
+		qtype:   dnsmessage.TypeA,
+		rcode:   dnsmessage.RCodeSuccess,
+		answers: []string{"EXAMPLE.com. TypeA"},
+	}, {
+		name:    "AAAA",
+		qname:   "example.com.",
+		qtype:   dnsmessage.TypeAAAA,
+		rcode:   dnsmessage.RCodeSuccess,
+		answers: []string{"example.com. TypeAAAA"},
+	}, {
+		name:    "no data",
+		qname:   "example.com.",
+		qtype:   dnsmessage.TypeTXT,
+		rcode:   dnsmessage.RCodeSuccess,
+		answers: nil,
+	}, {
+		name:    "nonexistent",
+		qname:   "example.org.",
+		qtype:   dnsmessage.TypeA,
+		rcode:   dnsmessage.RCodeNameError,
+		answers: nil,
+	}, {
+		name:  "CNAME chain",
+		qname: "www.example.com.",
+		qtype: dnsmessage.TypeA,
+		rcode: dnsmessage.RCodeSuccess,
+		answers: []string{
+			"www.example.com. TypeCNAME",
+			"cdn.example.com. TypeCNAME",
+			"example.com. TypeA",
+		},
+	}, {
+		name:    "CNAME query",
+		qname:   "www.example.com.",
+		qtype:   dnsmessage.TypeCNAME,
+		rcode:   dnsmessage.RCodeSuccess,
+		answers: []string{"www.example.com. TypeCNAME"},
+	}, {
+		name:    "dangling CNAME",
+		qname:   "dangling.example.com.",
+		qtype:   dnsmessage.TypeA,
+		rcode:   dnsmessage.RCodeNameError,
+		answers: []string{"dangling.example.com. TypeCNAME"},
+	}, {
+		name:    "CNAME loop",
+		qname:   "loop1.example.com.",
+		qtype:   dnsmessage.TypeA,
+		rcode:   dnsmessage.RCodeServerFailure,
+		answers: nil,
+	}}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rcode, answers := lookup(tc.qname, tc.qtype)
+			require.Equal(t, tc.rcode, rcode)
+			require.Equal(t, tc.answers, answers)
+		})
+	}
+}
+
+func TestDNSRecordSetRespond(t *testing.T) {
+	rs := NewDNSRecordSet()
+	require.NoError(t, rs.AddAddrs("example.com", netip.MustParseAddr("10.0.0.1")))
+	for idx := range 8 {
+		require.NoError(t, rs.AddTXT("large.example.com", strings.Repeat(string(rune('a'+idx)), 100)))
+	}
+
+	// query returns a query for the given name and type, optionally using EDNS(0).
+	query := func(name string, qtype dnsmessage.Type, opcode dnsmessage.OpCode, edns bool) []byte {
+		msg := &dnsmessage.Message{
+			Header: dnsmessage.Header{ID: 1234, OpCode: opcode, RecursionDesired: true},
+			Questions: []dnsmessage.Question{{
+				Name:  dnsmessage.MustNewName(name),
+				Type:  qtype,
+				Class: dnsmessage.ClassINET,
+			}},
+		}
+		if edns {
+			var header dnsmessage.ResourceHeader
+			require.NoError(t, header.SetEDNS0(4096, dnsmessage.RCodeSuccess, false))
+			msg.Additionals = []dnsmessage.Resource{{Header: header, Body: &dnsmessage.OPTResource{}}}
+		}
+		data, err := msg.Pack()
+		require.NoError(t, err)
+		return data
+	}
+
+	// respond returns the parsed response to the given query.
+	respond := func(query []byte, udp bool) *dnsmessage.Message {
+		data, ok := rs.respond(query, udp)
+		require.True(t, ok)
+		var msg dnsmessage.Message
+		require.NoError(t, msg.Unpack(data))
+		return &msg
+	}
+
+	t.Run("success", func(t *testing.T) {
+		resp := respond(query("example.com.", dnsmessage.TypeA, 0, false), true)
+		require.Equal(t, uint16(1234), resp.ID)
+		require.True(t, resp.Response && resp.Authoritative && resp.RecursionDesired)
+		require.Equal(t, dnsmessage.RCodeSuccess, resp.RCode)
+		require.Len(t, resp.Questions, 1)
+		require.Len(t, resp.Answers, 1)
+		require.Equal(t, [4]byte{10, 0, 0, 1}, resp.Answers[0].Body.(*dnsmessage.AResource).A)
+	})
+
+	t.Run("truncation", func(t *testing.T) {
+		resp := respond(query("large.example.com.", dnsmessage.TypeTXT, 0, false), true)
+		require.True(t, resp.Truncated)
+		require.Empty(t, resp.Answers)
+
+		resp = respond(query("large.example.com.", dnsmessage.TypeTXT, 0, true), true)
+		require.False(t, resp.Truncated)
+		require.Len(t, resp.Answers, 8)
+		require.Len(t, resp.Additionals, 1)
+
+		resp = respond(query("large.example.com.", dnsmessage.TypeTXT, 0, false), false)
+		require.False(t, resp.Truncated)
+		require.Len(t, resp.Answers, 8)
+	})
+
+	t.Run("not implemented", func(t *testing.T) {
+		resp := respond(query("example.com.", dnsmessage.TypeA, 2, false), true)
+		require.Equal(t, dnsmessage.RCodeNotImplemented, resp.RCode)
+	})
+
+	t.Run("ignored", func(t *testing.T) {
+		_, ok := rs.respond([]byte{1, 2, 3}, true)
+		require.False(t, ok)
+		data, ok := rs.respond(query("example.com.", dnsmessage.TypeA, 0, false), true)
+		require.True(t, ok)
+		_, ok = rs.respond(data, true)
+		require.False(t, ok)
+	})
+}
@@ -0,0 +1,294 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSResolver is a [Resolver] querying a DNS server (e.g., a [*DNSServer])
+// using a [*Connector], thus through the simulated network.
+//
+// Unlike [*net.Resolver], the resolver is hermetic: it does not read /etc/hosts
+// and /etc/resolv.conf, so it sends one query per record type to the configured
+// server, without search domains, and does not retry. We query using UDP and
+// retry using TCP when the response is truncated. Each lookup uses the context
+// deadline or, when the context does not have a deadline, a 5 seconds timeout.
+// The query IDs come from the [*Stack] RNG (see [StackOptionSeed]) and the
+// errors are [*net.DNSError] instances.
+//
+// Construct using [NewDNSResolver].
+type DNSResolver struct {
+	// connector is the connector to use.
+	connector *Connector
+
+	// server is the endpoint of the DNS server.
+	server netip.AddrPort
+}
+
+// NewDNSResolver creates a new [*DNSResolver] querying the given server
+// endpoint (e.g., 10.0.0.53:53) using the given [*Connector].
+func NewDNSResolver(connector *Connector, server netip.AddrPort) *DNSResolver {
+	return &DNSResolver{
+		connector: connector,
+		server:    server,
+	}
+}
+
+// Ensure that [*DNSResolver] implements [Resolver].
+var _ Resolver = &DNSResolver{}
+
+// dnsResolverTimeout is the default lookup timeout.
+const dnsResolverTimeout = 5 * time.Second
+
+// LookupHost is like [*net.Resolver.LookupHost].
+func (r *DNSResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, err := r.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	var output []string
+	for _, addr := range addrs {
+		output = append(output, addr.String())
+	}
+	return output, nil
+}
+
+// LookupNetIP is like [*net.Resolver.LookupNetIP].
+//
+// The network MUST be "ip", "ip4", or "ip6". With "ip", we query for AAAA
+// and A records in parallel and return the IPv6 addresses first.
+func (r *DNSResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	// 1. figure out which record types to query for
+	var qtypes []dnsmessage.Type
+	switch network {
+	case "ip":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeAAAA, dnsmessage.TypeA}
+	case "ip4":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeA}
+	case "ip6":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	// 2. handle the IP literal case
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if (network == "ip4" && !networkFamily4.allows(addr)) || (network == "ip6" && !networkFamily6.allows(addr)) {
+			return nil, networkNoSuitableAddress(host)
+		}
+		return []netip.Addr{addr}, nil
+	}
+
+	// 3. query for each record type in parallel
+	var (
+		errs  = make([]error, len(qtypes))
+		resps = make([]*dnsmessage.Message, len(qtypes))
+		wg    sync.WaitGroup
+	)
+	for idx, qtype := range qtypes {
+		wg.Go(func() {
+			resps[idx], errs[idx] = r.exchange(ctx, host, qtype)
+		})
+	}
+	wg.Wait()
+
+	// 4. collect the addresses in the order of the record types
+	var addrs []netip.Addr
+	for _, resp := range resps {
+		if resp == nil {
+			continue
+		}
+		for _, answer := range resp.Answers {
+			switch body := answer.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs = append(addrs, netip.AddrFrom4(body.A))
+			case *dnsmessage.AAAAResource:
+				addrs = append(addrs, netip.AddrFrom16(body.AAAA))
+			}
+		}
+	}
+
+	// 5. succeed if we have addresses regardless of errors
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, r.newError(host, "no such host", true)
+}
+
+// LookupHTTPS returns the HTTPS records of the given name (see RFC 9460).
+func (r *DNSResolver) LookupHTTPS(ctx context.Context, name string) ([]dnsmessage.HTTPSResource, error) {
+	resp, err := r.exchange(ctx, name, dnsmessage.TypeHTTPS)
+	if err != nil {
+		return nil, err
+	}
+	var output []dnsmessage.HTTPSResource
+	for _, answer := range resp.Answers {
+		if body, ok := answer.Body.(*dnsmessage.HTTPSResource); ok {
+			output = append(output, *body)
+		}
+	}
+	return output, nil
+}
+
+// LookupSVCB returns the SVCB records of the given name (see RFC 9460).
+func (r *DNSResolver) LookupSVCB(ctx context.Context, name string) ([]dnsmessage.SVCBResource, error) {
+	resp, err := r.exchange(ctx, name, dnsmessage.TypeSVCB)
+	if err != nil {
+		return nil, err
+	}
+	var output []dnsmessage.SVCBResource
+	for _, answer := range resp.Answers {
+		if body, ok := answer.Body.(*dnsmessage.SVCBResource); ok {
+			output = append(output, *body)
+		}
+	}
+	return output, nil
+}
+
+// newError creates a new [*net.DNSError] for the given name.
+func (r *DNSResolver) newError(name, message string, notFound bool) *net.DNSError {
+	return &net.DNSError{
+		Err:        message,
+		Name:       name,
+		Server:     r.server.String(),
+		IsNotFound: notFound,
+	}
+}
+
+// exchange sends a query for the given name and type and returns the response,
+// mapping NXDOMAIN and the other errors to a [*net.DNSError].
+func (r *DNSResolver) exchange(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	// 1. apply the default timeout when there is no deadline
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dnsResolverTimeout)
+		defer cancel()
+	}
+
+	// 2. create the query using the stack RNG (see [StackOptionSeed])
+	qname, err := dnsmessage.NewName(dnsFQDN(name))
+	if err != nil {
+		return nil, r.newError(name, "no such host", true)
+	}
+	query := &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               uint16(r.connector.stack.Stack.InsecureRNG().Uint32()),
+			RecursionDesired: true,
+		},
+		Questions: []dnsmessage.Question{{
+			Name:  qname,
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	rawQuery, err := query.Pack()
+	if err != nil {
+		return nil, r.newError(name, "no such host", true)
+	}
+
+	// 3. query using UDP and then using TCP if the response is truncated
+	resp, err := r.roundTrip(ctx, "udp", query, rawQuery)
+	if err == nil && resp.Truncated {
+		resp, err = r.roundTrip(ctx, "tcp", query, rawQuery)
+	}
+	if err != nil {
+		var netErr net.Error
+		dnsErr := r.newError(name, err.Error(), false)
+		dnsErr.IsTimeout = errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+		return nil, dnsErr
+	}
+
+	// 4. map the response code to errors
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+		return resp, nil
+	case dnsmessage.RCodeNameError:
+		return nil, r.newError(name, "no such host", true)
+	default:
+		dnsErr := r.newError(name, "server misbehaving", false)
+		dnsErr.IsTemporary = resp.RCode == dnsmessage.RCodeServerFailure
+		return nil, dnsErr
+	}
+}
+
+// roundTrip sends the query using the given network and returns the matching response.
+func (r *DNSResolver) roundTrip(ctx context.Context,
+	network string, query *dnsmessage.Message, rawQuery []byte) (*dnsmessage.Message, error) {
+	// 1. connect to the server
+	conn, err := r.connector.DialContext(ctx, network, r.server.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// 2. honor the context deadline and cancellation
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer stop()
+
+	// 3. handle the TCP case, where we use length-prefixed messages
+	if network == "tcp" {
+		message := binary.BigEndian.AppendUint16(nil, uint16(len(rawQuery)))
+		if _, err := conn.Write(append(message, rawQuery...)); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		rawResp := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, rawResp); err != nil {
+			return nil, err
+		}
+		resp := &dnsmessage.Message{}
+		if err := resp.Unpack(rawResp); err != nil || !dnsResponseMatches(query, resp) {
+			return nil, errors.New("invalid DNS response")
+		}
+		return resp, nil
+	}
+
+	// 4. handle the UDP case, where we ignore unrelated datagrams
+	if _, err := conn.Write(rawQuery); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, dnsMaxMessageSize)
+	for {
+		count, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		resp := &dnsmessage.Message{}
+		if resp.Unpack(buffer[:count]) == nil && dnsResponseMatches(query, resp) {
+			return resp, nil
+		}
+	}
+}
+
+// dnsResponseMatches returns whether the response matches the query.
+func dnsResponseMatches(query, resp *dnsmessage.Message) bool {
+	return resp.Response &&
+		resp.ID == query.ID &&
+		len(resp.Questions) == 1 &&
+		strings.EqualFold(resp.Questions[0].Name.String(), query.Questions[0].Name.String()) &&
+		resp.Questions[0].Type == query.Questions[0].Type &&
+		resp.Questions[0].Class == query.Questions[0].Class
+}
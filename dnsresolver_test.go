@@ -0,0 +1,149 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestNewDNSResolver(t *testing.T) {
+	records := uis.NewDNSRecordSet()
+	require.NoError(t, records.AddAddrs("example.com", netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2001:db8::1")))
+	require.NoError(t, records.AddCNAME("www.example.com", "example.com"))
+	require.NoError(t, records.AddTXT("example.com", "v=spf1 -all"))
+	var many []netip.Addr
+	for idx := range 40 {
+		many = append(many, netip.AddrFrom4([4]byte{10, 0, 1, byte(idx + 1)}))
+	}
+	require.NoError(t, records.AddAddrs("many.example.com", many...))
+	svcb := dnsmessage.SVCBResource{Priority: 1, Target: dnsmessage.MustNewName("svc.example.com.")}
+	svcb.SetParam(dnsmessage.SVCParamALPN, []byte("\x02h2"))
+	require.NoError(t, records.AddHTTPS("example.com", dnsmessage.HTTPSResource{SVCBResource: svcb}))
+	require.NoError(t, records.AddSVCB("_dns.example.com", svcb))
+	client := newDNSTestEnv(t, records)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	reso := uis.NewDNSResolver(uis.NewConnector(client), dnsTestServerEndpoint)
+
+	t.Run("LookupNetIP", func(t *testing.T) {
+		addrs, err := reso.LookupNetIP(ctx, "ip", "www.example.com")
+		require.NoError(t, err)
+		require.Equal(t, []netip.Addr{netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("10.0.0.1")}, addrs)
+
+		addrs, err = reso.LookupNetIP(ctx, "ip4", "EXAMPLE.COM.")
+		require.NoError(t, err)
+		require.Equal(t, []netip.Addr{netip.MustParseAddr("10.0.0.1")}, addrs)
+
+		addrs, err = reso.LookupNetIP(ctx, "ip6", "10.0.0.1")
+		require.Error(t, err)
+		require.Nil(t, addrs)
+
+		_, err = reso.LookupNetIP(ctx, "tcp", "example.com")
+		require.Error(t, err)
+
+		// the response does not fit UDP, so we retry using TCP
+		addrs, err = reso.LookupNetIP(ctx, "ip4", "many.example.com")
+		require.NoError(t, err)
+		require.Equal(t, many, addrs)
+	})
+
+	t.Run("LookupHost", func(t *testing.T) {
+		hosts, err := reso.LookupHost(ctx, "example.com")
+		require.NoError(t, err)
+		require.Equal(t, []string{"2001:db8::1", "10.0.0.1"}, hosts)
+	})
+
+	t.Run("LookupHTTPS and LookupSVCB", func(t *testing.T) {
+		https, err := reso.LookupHTTPS(ctx, "example.com")
+		require.NoError(t, err)
+		require.Len(t, https, 1)
+		alpn, found := https[0].GetParam(dnsmessage.SVCParamALPN)
+		require.True(t, found)
+		require.Equal(t, []byte("\x02h2"), alpn)
+
+		svcbs, err := reso.LookupSVCB(ctx, "_dns.example.com")
+		require.NoError(t, err)
+		require.Len(t, svcbs, 1)
+		require.Equal(t, "svc.example.com.", svcbs[0].Target.String())
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		var dnsErr *net.DNSError
+		_, err := reso.LookupHost(ctx, "nonexistent.example.com")
+		require.True(t, errors.As(err, &dnsErr))
+		require.True(t, dnsErr.IsNotFound)
+
+		// a name without addresses is like a nonexistent name
+		_, err = reso.LookupHost(ctx, "_dns.example.com")
+		require.True(t, errors.As(err, &dnsErr))
+		require.True(t, dnsErr.IsNotFound)
+
+		// a server that does not exist causes a timeout
+		unreachable := uis.NewDNSResolver(uis.NewConnector(client), netip.MustParseAddrPort("10.0.0.54:53"))
+		shortCtx, shortCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer shortCancel()
+		_, err = unreachable.LookupHTTPS(shortCtx, "example.com")
+		require.True(t, errors.As(err, &dnsErr))
+		require.True(t, dnsErr.IsTimeout)
+	})
+
+	t.Run("Connector", func(t *testing.T) {
+		connector := uis.NewConnector(client)
+		connector.Resolver = reso
+		conn, err := connector.DialContext(ctx, "udp", "www.example.com:443")
+		require.NoError(t, err)
+		require.Equal(t, "[2001:db8::1]:443", conn.RemoteAddr().String())
+		require.NoError(t, conn.Close())
+	})
+}
+
+func TestDNSResolverIsHermetic(t *testing.T) {
+	// create a client and a policy recording the names queried
+	// using UDP toward a DNS server that does not exist
+	ix := uis.NewInternet()
+	client, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.2"))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	var (
+		mu    sync.Mutex
+		names []string
+	)
+	policy := uis.PacketPolicyFunc(func(frame uis.VNICFrame, fwd uis.PacketForwarder) {
+		pkt, err := uis.ParsePacket(frame.Packet)
+		if err == nil && pkt.Protocol() == 17 && pkt.DstPort() == 53 {
+			var msg dnsmessage.Message
+			if msg.Unpack(pkt.Payload()) == nil && len(msg.Questions) == 1 {
+				mu.Lock()
+				names = append(names, msg.Questions[0].Type.String()+" "+msg.Questions[0].Name.String())
+				mu.Unlock()
+			}
+		}
+		fwd.Forward(frame)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go ix.Run(ctx, policy)
+
+	// we send exactly one query per record type regardless of the search
+	// domains, the nameservers, and the options in /etc/resolv.conf
+	reso := uis.NewDNSResolver(uis.NewConnector(client), netip.MustParseAddrPort("10.0.0.53:53"))
+	shortCtx, shortCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer shortCancel()
+	_, err = reso.LookupNetIP(shortCtx, "ip", "example")
+	require.Error(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.ElementsMatch(t, []string{"TypeAAAA example.", "TypeA example."}, names)
+}
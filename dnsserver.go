@@ -0,0 +1,174 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// DNSServer is an authoritative DNS server serving a [*DNSRecordSet] over
+// UDP and TCP using a [*Stack], which allows to resolve names within the
+// simulation (see also [*DNSResolver]).
+//
+// The server answers queries with the records of the queried type, follows
+// CNAME records, answers NXDOMAIN for names without records, and truncates
+// UDP responses that do not fit the UDP payload size, such that clients
+// retry using TCP.
+//
+// Construct using [NewDNSServer].
+type DNSServer struct {
+	// closed indicates whether we have been closed.
+	closed bool
+
+	// conns contains the active TCP conns.
+	conns map[net.Conn]struct{}
+
+	// listener is the TCP listener.
+	listener net.Listener
+
+	// mu protects closed and conns.
+	mu sync.Mutex
+
+	// pconn is the UDP socket.
+	pconn net.PacketConn
+
+	// records contains the records to serve.
+	records *DNSRecordSet
+
+	// wg tracks the running goroutines.
+	wg sync.WaitGroup
+}
+
+// dnsServerIdleTimeout is the time after which the server closes idle TCP conns.
+const dnsServerIdleTimeout = 30 * time.Second
+
+// dnsMaxMessageSize is the maximum size of a DNS message.
+const dnsMaxMessageSize = 65535
+
+// NewDNSServer creates a new [*DNSServer] listening for UDP and TCP queries
+// at the given endpoint (e.g., 10.0.0.53:53) of the given [*Stack] and serving
+// the given records using background goroutines. Use [*DNSServer.Close] to
+// stop the server.
+//
+// This function fails if it cannot listen using UDP or TCP.
+func NewDNSServer(stack *Stack, endpoint netip.AddrPort, records *DNSRecordSet) (*DNSServer, error) {
+	// 1. create the UDP socket
+	ctx := context.Background()
+	lc := NewListenConfig(stack)
+	pconn, err := lc.ListenPacket(ctx, "udp", endpoint.String())
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. create the TCP listener
+	listener, err := lc.Listen(ctx, "tcp", endpoint.String())
+	if err != nil {
+		pconn.Close()
+		return nil, err
+	}
+
+	// 3. start serving in the background
+	srv := &DNSServer{
+		closed:   false,
+		conns:    make(map[net.Conn]struct{}),
+		listener: listener,
+		mu:       sync.Mutex{},
+		pconn:    pconn,
+		records:  records,
+		wg:       sync.WaitGroup{},
+	}
+	srv.wg.Go(srv.serveUDP)
+	srv.wg.Go(srv.serveTCP)
+	return srv, nil
+}
+
+// Close stops the server and waits for the background goroutines to finish.
+func (srv *DNSServer) Close() error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		return nil
+	}
+	srv.closed = true
+	srv.pconn.Close()
+	srv.listener.Close()
+	for conn := range srv.conns {
+		conn.Close()
+	}
+	srv.mu.Unlock()
+	srv.wg.Wait()
+	return nil
+}
+
+// serveUDP serves the queries received using UDP.
+func (srv *DNSServer) serveUDP() {
+	buffer := make([]byte, dnsMaxMessageSize)
+	for {
+		count, addr, err := srv.pconn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		if response, ok := srv.records.respond(buffer[:count], true); ok {
+			_, _ = srv.pconn.WriteTo(response, addr)
+		}
+	}
+}
+
+// serveTCP accepts TCP conns and serves each of them in a goroutine.
+func (srv *DNSServer) serveTCP() {
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return
+		}
+		srv.mu.Lock()
+		if srv.closed {
+			srv.mu.Unlock()
+			conn.Close()
+			return
+		}
+		srv.conns[conn] = struct{}{}
+		srv.wg.Go(func() {
+			srv.serveConn(conn)
+		})
+		srv.mu.Unlock()
+	}
+}
+
+// serveConn serves the queries received using the given TCP conn.
+func (srv *DNSServer) serveConn(conn net.Conn) {
+	defer func() {
+		srv.mu.Lock()
+		delete(srv.conns, conn)
+		srv.mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		// 1. read the length-prefixed query
+		_ = conn.SetReadDeadline(time.Now().Add(dnsServerIdleTimeout))
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		// 2. write the length-prefixed response
+		response, ok := srv.records.respond(query, false)
+		if !ok {
+			continue
+		}
+		message := binary.BigEndian.AppendUint16(nil, uint16(len(response)))
+		if _, err := conn.Write(append(message, response...)); err != nil {
+			return
+		}
+	}
+}
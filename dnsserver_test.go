@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/require"
+)
+
+// dnsTestServerEndpoint is the endpoint of the DNS server created by newDNSTestEnv.
+var dnsTestServerEndpoint = netip.MustParseAddrPort("10.0.0.53:53")
+
+// newDNSTestEnv creates an internet with a DNS server serving the given records
+// and a dual-stack client, routes packets until the test ends, and returns the client.
+func newDNSTestEnv(t *testing.T, records *uis.DNSRecordSet) *uis.Stack {
+	ix := uis.NewInternet()
+	server, err := ix.NewStack(uis.MTUEthernet, dnsTestServerEndpoint.Addr())
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	client, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("2001:db8::2"))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+
+	dnsServer, err := uis.NewDNSServer(server, dnsTestServerEndpoint, records)
+	require.NoError(t, err)
+	t.Cleanup(func() { dnsServer.Close() })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go ix.Run(ctx)
+	return client
+}
+
+func TestNewDNSServer(t *testing.T) {
+	t.Run("UDP and TCP", func(t *testing.T) {
+		records := uis.NewDNSRecordSet()
+		require.NoError(t, records.AddAddrs("example.com", netip.MustParseAddr("10.0.0.1")))
+		client := newDNSTestEnv(t, records)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		query := []byte{
+			0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0x00, 0x01, 0x00, 0x01,
+		}
+
+		// the server answers over UDP
+		conn, err := uis.NewConnector(client).DialContext(ctx, "udp", dnsTestServerEndpoint.String())
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write(query)
+		require.NoError(t, err)
+		buffer := make([]byte, 512)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		count, err := conn.Read(buffer)
+		require.NoError(t, err)
+		require.Equal(t, []byte{0x12, 0x34}, buffer[:2])
+		require.Equal(t, []byte{10, 0, 0, 1}, buffer[count-4:count])
+
+		// the server answers over TCP using length-prefixed messages
+		tconn, err := uis.NewConnector(client).DialContext(ctx, "tcp", dnsTestServerEndpoint.String())
+		require.NoError(t, err)
+		defer tconn.Close()
+		_, err = tconn.Write(append([]byte{0, byte(len(query))}, query...))
+		require.NoError(t, err)
+		require.NoError(t, tconn.SetReadDeadline(time.Now().Add(5*time.Second)))
+		tcount, err := tconn.Read(buffer)
+		require.NoError(t, err)
+		require.Equal(t, []byte{0, byte(count)}, buffer[:2])
+		require.Equal(t, []byte{10, 0, 0, 1}, buffer[tcount-4:tcount])
+	})
+
+	t.Run("address in use", func(t *testing.T) {
+		ix := uis.NewInternet()
+		server, err := ix.NewStack(uis.MTUEthernet, dnsTestServerEndpoint.Addr())
+		require.NoError(t, err)
+		t.Cleanup(server.Close)
+
+		first, err := uis.NewDNSServer(server, dnsTestServerEndpoint, uis.NewDNSRecordSet())
+		require.NoError(t, err)
+		second, err := uis.NewDNSServer(server, dnsTestServerEndpoint, uis.NewDNSRecordSet())
+		require.Error(t, err)
+		require.Nil(t, second)
+
+		// closing more than once is fine
+		require.NoError(t, first.Close())
+		require.NoError(t, first.Close())
+	})
+}
@@ -11,16 +11,88 @@
 // to create two or more [*Stack] instances. The created instances are already
 // configured for sending and receiving raw internet packets.
 //
-// The [Connector] type is a stdlib-like dialer for IP literal endpoints only.
-// The [ListenConfig] type is a stdlib-like listener config for IP literal
-// endpoints only. Use these types to plug this package into higher-level
-// code that expects the net package interfaces.
+// By default, stacks have host-only addresses (e.g., 10.0.0.2/32) and send all
+// the packets directly to their destination. Use [*Internet.NewStackWithPrefixes]
+// to configure the on-link subnets (e.g., 10.0.0.2/24) and [StackOptionGateway]
+// to configure gateways for the other destinations.
+//
+// Use [NewMultiNICStack] to create a [*Stack] with several NICs, possibly
+// attached to distinct [*Internet] instances, and an explicit route table,
+// which allows to simulate multihomed hosts. Use [NewRouterStack] to create a
+// [*Stack] that also forwards packets between its NICs, which allows to use gVisor
+// as a router between [*Internet] instances or as a tunnel endpoint.
+//
+// Use the StackOptionTCP options (e.g., [StackOptionTCPCongestionControl] and
+// [StackOptionTCPSACK]) with [*Internet.NewStackWithOptions] to tune the TCP
+// implementation, which allows to compare algorithms and to reproduce
+// performance regressions.
+//
+// The [Connector] type is a stdlib-like dialer for IP literal endpoints and,
+// when configured with a [Resolver], for hostnames. The [ListenConfig] type
+// is a stdlib-like listener config for IP literal endpoints only. Both support
+// the "tcp", "tcp4", "tcp6", "udp", "udp4", and "udp6" networks, enforcing the
+// family like the stdlib does, as well as the "ip4:icmp" and "ip6:ipv6-icmp"
+// networks, which use ping sockets. Use these types to plug this package into
+// higher-level code that expects the net package interfaces. Like [*net.Dialer],
+// the [Connector] has LocalAddr, Control, ControlContext, KeepAlive, Timeout,
+// and Deadline fields, where the control functions receive the gVisor endpoint.
+// The [Connector] dials hostnames using Happy Eyeballs (see RFC 8305), which allows
+// to test how code behaves when the IPv6 path is blackholed (e.g., using a
+// [PacketPolicy]) while IPv4 works.
+//
+// The [*DNSServer] type serves a [*DNSRecordSet] over UDP and TCP using a
+// [*Stack] and the [*DNSResolver] type queries it through a [Connector],
+// which allows to resolve names within the simulation.
 //
 // To route packets, you need to read packets using [*Internet.InFlight]. If
 // you choose to forward the read packets, then you can deliver them to the right
 // destination using [*Internet.Deliver]. We don't model L2 frames (we just move
-// raw IP packets around) and we don't model multiple hops. These choices keep
-// this package focused on fundamental primitives rather than full frameworks.
+// raw IP packets around) and, by default, we don't model multiple hops (use
+// [*Hop] policies to do that). These choices keep this package focused on
+// fundamental primitives rather than full frameworks.
+//
+// The [*Internet.Deliver] method also delivers IPv4 broadcast and IPv4/IPv6
+// multicast packets, learning which stacks joined which groups by snooping the
+// IGMP and MLD reports they send when created using [StackOptionMulticast].
+// Use [*ListenConfig.ListenPacket] with a multicast address to join the
+// corresponding group.
+//
+// By default, [*Internet.Deliver] silently drops unroutable packets. Use
+// [InternetOptionUnreachable] to send ICMP Destination Unreachable messages
+// instead, so that dialing unroutable addresses fails immediately.
+//
+// The [*Internet.Run] method implements a routing loop on top of these
+// primitives that passes each packet through a chain of [PacketPolicy]
+// allowing to inspect, modify, drop, delay, or duplicate packets. The
+// [*Router] type implements the same loop and additionally emulates per-path
+// one-way delay, jitter, packet losses, bandwidth limits, and path MTU
+// bottlenecks (with IPv4 fragmentation and ICMP errors) using [LinkConfig].
+//
+// Use [VNICFrame.Parse] to obtain a zero-copy [*Packet] view of a frame, which
+// allows policies to inspect the headers and rewrite addresses, ports, and TTL
+// while keeping the checksums consistent.
+//
+// The [*NAT] policy models a network address and port translator (e.g., a home
+// router) with configurable mapping and filtering behavior.
+//
+// The [*Firewall] policy is a stateful packet filter using ordered rules
+// (see [ParseFirewallRule]) to accept, drop, or reject packets.
+//
+// The [*DNSSpoofer] and [*FlowCensor] policies model censorship techniques
+// such as DNS spoofing and SNI-based or Host-based blocking using RST
+// injection, blackholing, or throttling.
+//
+// The [*FlowTable] type tracks the TCP and UDP flows delivered by the [*Internet]
+// (see [InternetOptionFlowTable]) allowing to snapshot their state and counters
+// and to subscribe to state transitions.
+//
+// The [*Switch] type is an alternative to [*Internet] that connects stacks using
+// [*EthernetVNIC] instances carrying Ethernet frames, such that the stacks resolve
+// their neighbors using ARP and NDP. This allows to test link-layer failure modes,
+// such as ARP timeouts and duplicate address detection (see [StackOptionDAD]).
+//
+// The [*VirtualClock] type allows to run the whole simulation on virtual time
+// advanced explicitly using [*Router.Step] (see [InternetOptionClock]).
 //
 // The [*PCAPTrace] type allows you to capture packets in flight in a PCAP format
 // so that you can inspect what happened using tools such as wireshark.
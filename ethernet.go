@@ -0,0 +1,240 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"github.com/bassosimone/runtimex"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// EthernetFrame models an Ethernet II frame.
+type EthernetFrame struct {
+	// Data contains the raw frame including the 14-byte Ethernet header.
+	Data []byte
+}
+
+// EthernetNetwork models the network that an [*EthernetVNIC] sends frames to.
+//
+// The [*Switch] implements this interface.
+type EthernetNetwork interface {
+	SendEthernetFrame(frame EthernetFrame) bool
+}
+
+// EthernetVNIC is like [*VNIC] but carries Ethernet frames with MAC addresses
+// rather than raw IP packets. This type is compatible with [stack.Stack]
+// because it implements the [stack.LinkEndpoint] interface.
+//
+// Since the [*EthernetVNIC] requires link address resolution, the stack uses
+// ARP and NDP to resolve the MAC address of its neighbors, which allows to
+// test link-layer failure modes such as ARP timeouts and duplicate address
+// detection (see [StackOptionDAD]).
+//
+// The [*EthernetVNIC] accepts frames sent to its MAC address, to the broadcast
+// address, and to multicast addresses, and lets the stack filter multicast.
+//
+// Construct using [NewEthernetVNIC].
+type EthernetVNIC struct {
+	// network is the Ethernet network we're attached to.
+	network EthernetNetwork
+
+	// nic is the [*VNIC] managing the MTU, link address, and attach state.
+	nic *VNIC
+}
+
+// NewEthernetVNIC creates a new [*EthernetVNIC] instance.
+//
+// The mtu parameter sets the MTU in bytes excluding the Ethernet header.
+//
+// The mac parameter is the MAC address (see [tcpip.ParseMACAddress]).
+//
+// The network parameter is the [EthernetNetwork] to use.
+func NewEthernetVNIC(mtu uint32, mac tcpip.LinkAddress, network EthernetNetwork) *EthernetVNIC {
+	nic := NewVNIC(mtu, nil)
+	nic.laddr = mac
+	return &EthernetVNIC{network: network, nic: nic}
+}
+
+// Ensure that [*EthernetVNIC] implements [stack.LinkEndpoint].
+var _ stack.LinkEndpoint = &EthernetVNIC{}
+
+// ARPHardwareType implements [stack.LinkEndpoint].
+func (n *EthernetVNIC) ARPHardwareType() header.ARPHardwareType {
+	return header.ARPHardwareEther
+}
+
+// AddHeader implements [stack.LinkEndpoint].
+func (n *EthernetVNIC) AddHeader(pbuf *stack.PacketBuffer) {
+	eth := header.Ethernet(pbuf.LinkHeader().Push(header.EthernetMinimumSize))
+	eth.Encode(&header.EthernetFields{
+		SrcAddr: pbuf.EgressRoute.LocalLinkAddress,
+		DstAddr: pbuf.EgressRoute.RemoteLinkAddress,
+		Type:    pbuf.NetworkProtocolNumber,
+	})
+}
+
+// Attach implements [stack.LinkEndpoint].
+func (n *EthernetVNIC) Attach(disp stack.NetworkDispatcher) {
+	n.nic.Attach(disp)
+}
+
+// Capabilities implements [stack.LinkEndpoint].
+func (n *EthernetVNIC) Capabilities() stack.LinkEndpointCapabilities {
+	return stack.CapabilityResolutionRequired
+}
+
+// Close implements [stack.LinkEndpoint].
+func (n *EthernetVNIC) Close() {
+	n.nic.Close()
+}
+
+// addCloseHook is like [*VNIC.addCloseHook].
+func (n *EthernetVNIC) addCloseHook(owner any, hook func()) bool {
+	return n.nic.addCloseHook(owner, hook)
+}
+
+// IsAttached implements [stack.LinkEndpoint].
+func (n *EthernetVNIC) IsAttached() bool {
+	return n.nic.IsAttached()
+}
+
+// LinkAddress implements [stack.LinkEndpoint].
+func (n *EthernetVNIC) LinkAddress() tcpip.LinkAddress {
+	return n.nic.LinkAddress()
+}
+
+// MTU implements [stack.LinkEndpoint].
+func (n *EthernetVNIC) MTU() uint32 {
+	return n.nic.MTU()
+}
+
+// MaxHeaderLength implements [stack.LinkEndpoint].
+func (n *EthernetVNIC) MaxHeaderLength() uint16 {
+	return header.EthernetMinimumSize
+}
+
+// ParseHeader implements [stack.LinkEndpoint].
+func (n *EthernetVNIC) ParseHeader(pbuf *stack.PacketBuffer) bool {
+	_, ok := pbuf.LinkHeader().Consume(header.EthernetMinimumSize)
+	return ok
+}
+
+// SetLinkAddress implements [stack.LinkEndpoint].
+func (n *EthernetVNIC) SetLinkAddress(addr tcpip.LinkAddress) {
+	n.nic.SetLinkAddress(addr)
+}
+
+// SetMTU implements [stack.LinkEndpoint].
+func (n *EthernetVNIC) SetMTU(mtu uint32) {
+	n.nic.SetMTU(mtu)
+}
+
+// SetOnCloseAction implements [stack.LinkEndpoint].
+func (n *EthernetVNIC) SetOnCloseAction(action func()) {
+	n.nic.SetOnCloseAction(action)
+}
+
+// Wait implements [stack.LinkEndpoint].
+func (n *EthernetVNIC) Wait() {
+	// nothing because we do not create background goroutines
+}
+
+// WritePackets implements [stack.LinkEndpoint].
+func (n *EthernetVNIC) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	// 1. access mutex protected fields
+	n.nic.mu.RLock()
+	isclosed := n.nic.isclosed
+	mtu := n.nic.mtu
+	n.nic.mu.RUnlock()
+
+	// 2. bail if the stack has been closed or there's no network
+	if isclosed || n.network == nil {
+		return 0, &tcpip.ErrNoNet{}
+	}
+
+	// 3. try sending the packets, which already include the
+	// Ethernet header added by the stack using AddHeader
+	var numSent int
+	for _, pb := range pkts.AsSlice() {
+		data := vnicPacketBufferToBytes(pb)
+		if len(data) <= header.EthernetMinimumSize {
+			continue
+		}
+		if uint32(len(data)-header.EthernetMinimumSize) > mtu {
+			continue
+		}
+		if !n.network.SendEthernetFrame(EthernetFrame{Data: data}) {
+			continue
+		}
+		numSent++
+	}
+
+	// 4. return number of packets sent
+	return numSent, nil
+}
+
+// InjectFrame injects an inbound Ethernet frame into the stack.
+//
+// This method returns false if the frame is malformed, is not addressed
+// to this NIC, exceeds the MTU, or the NIC is closed or detached.
+func (n *EthernetVNIC) InjectFrame(frame EthernetFrame) bool {
+	// 1. drop the frames that are too short
+	data := frame.Data
+	if len(data) <= header.EthernetMinimumSize {
+		return false
+	}
+
+	// 2. access mutex protected fields
+	n.nic.mu.RLock()
+	disp := n.nic.disp
+	isclosed := n.nic.isclosed
+	laddr := n.nic.laddr
+	mtu := n.nic.mtu
+	n.nic.mu.RUnlock()
+
+	// 3. do not deliver if we have been closed or have no dispatcher
+	if isclosed || disp == nil {
+		return false
+	}
+
+	// 4. do not deliver if larger than MTU
+	if uint32(len(data)-header.EthernetMinimumSize) > mtu {
+		return false
+	}
+
+	// 5. filter by destination MAC address
+	eth := header.Ethernet(data)
+	pktType, ok := ethernetPacketType(eth.DestinationAddress(), laddr)
+	if !ok {
+		return false
+	}
+
+	// 6. deliver A COPY OF the frame after consuming the Ethernet header
+	copied := make([]byte, len(data))
+	copy(copied, data)
+	pkb := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(copied),
+	})
+	_, ok = pkb.LinkHeader().Consume(header.EthernetMinimumSize)
+	runtimex.Assert(ok)
+	pkb.PktType = pktType
+	disp.DeliverNetworkPacket(eth.Type(), pkb)
+	return true
+}
+
+// ethernetPacketType classifies a frame using its destination MAC
+// address, returning false if the frame is for another host.
+func ethernetPacketType(dst, laddr tcpip.LinkAddress) (tcpip.PacketType, bool) {
+	switch {
+	case dst == header.EthernetBroadcastAddress:
+		return tcpip.PacketBroadcast, true
+	case header.IsMulticastEthernetAddress(dst):
+		return tcpip.PacketMulticast, true
+	case dst == laddr:
+		return tcpip.PacketHost, true
+	default:
+		return tcpip.PacketOtherHost, false
+	}
+}
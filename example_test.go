@@ -56,26 +56,17 @@ func Example_tcpDownloadIPv4() {
 		runtimex.PanicOnError0(conn.Close())
 	})
 
-	// know when both goroutines have stopped
-	stopped := make(chan struct{})
+	// stop routing when both goroutines have stopped
+	routerCtx, stopRouter := context.WithCancel(ctx)
 	go func() {
 		wg.Wait()
-		close(stopped)
+		stopRouter()
 	}()
 
 	// route and capture packets in the foreground
 	traceFile := runtimex.PanicOnError1(os.Create("tcpDownloadIPv4.pcap"))
 	trace := uis.NewPCAPTrace(traceFile, uis.MTUJumbo)
-loop:
-	for {
-		select {
-		case frame := <-ix.InFlight():
-			trace.Dump(frame.Packet)
-			_ = ix.Deliver(frame)
-		case <-stopped:
-			break loop
-		}
-	}
+	ix.Run(routerCtx, trace)
 	runtimex.PanicOnError0(trace.Close())
 
 	// receive and print the server message
@@ -131,26 +122,17 @@ func Example_udpEchoIPv4() {
 		runtimex.PanicOnError0(conn.Close())
 	})
 
-	// know when both goroutines have stopped
-	stopped := make(chan struct{})
+	// stop routing when both goroutines have stopped
+	routerCtx, stopRouter := context.WithCancel(ctx)
 	go func() {
 		wg.Wait()
-		close(stopped)
+		stopRouter()
 	}()
 
 	// route and capture packets in the foreground
 	traceFile := runtimex.PanicOnError1(os.Create("udpEchoIPv4.pcap"))
 	trace := uis.NewPCAPTrace(traceFile, uis.MTUJumbo)
-loop:
-	for {
-		select {
-		case frame := <-ix.InFlight():
-			trace.Dump(frame.Packet)
-			_ = ix.Deliver(frame)
-		case <-stopped:
-			break loop
-		}
-	}
+	ix.Run(routerCtx, trace)
 	runtimex.PanicOnError0(trace.Close())
 
 	// receive and print the echoed message
@@ -206,26 +188,17 @@ func Example_udpEchoIPv6() {
 		runtimex.PanicOnError0(conn.Close())
 	})
 
-	// know when both goroutines have stopped
-	stopped := make(chan struct{})
+	// stop routing when both goroutines have stopped
+	routerCtx, stopRouter := context.WithCancel(ctx)
 	go func() {
 		wg.Wait()
-		close(stopped)
+		stopRouter()
 	}()
 
 	// route and capture packets in the foreground
 	traceFile := runtimex.PanicOnError1(os.Create("udpEchoIPv6.pcap"))
 	trace := uis.NewPCAPTrace(traceFile, uis.MTUJumbo)
-loop:
-	for {
-		select {
-		case frame := <-ix.InFlight():
-			trace.Dump(frame.Packet)
-			_ = ix.Deliver(frame)
-		case <-stopped:
-			break loop
-		}
-	}
+	ix.Run(routerCtx, trace)
 	runtimex.PanicOnError0(trace.Close())
 
 	// receive and print the echoed message
@@ -0,0 +1,598 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// FirewallAction is the action taken by a [*Firewall] for a packet.
+type FirewallAction int
+
+// Enumerate the supported [FirewallAction] values.
+const (
+	// FirewallAccept forwards the packet.
+	FirewallAccept FirewallAction = iota
+
+	// FirewallDrop silently drops the packet.
+	FirewallDrop
+
+	// FirewallReject drops the packet and sends a TCP RST segment, for TCP
+	// packets, or an ICMP Port Unreachable message, for other packets, back
+	// to the sender. The RST segment and the ICMP message use the packet
+	// destination address as their source address.
+	FirewallReject
+)
+
+// FirewallProto is the transport protocol matched by a [FirewallRule].
+type FirewallProto int
+
+// Enumerate the supported [FirewallProto] values.
+const (
+	// FirewallProtoAny matches any protocol.
+	FirewallProtoAny FirewallProto = iota
+
+	// FirewallProtoTCP matches TCP.
+	FirewallProtoTCP
+
+	// FirewallProtoUDP matches UDP.
+	FirewallProtoUDP
+
+	// FirewallProtoICMP matches both ICMPv4 and ICMPv6.
+	FirewallProtoICMP
+)
+
+// FirewallState is a bitmask of connection states matched by a [FirewallRule].
+type FirewallState int
+
+// Enumerate the supported [FirewallState] values.
+const (
+	// FirewallStateNew matches packets belonging to flows for which
+	// the firewall has not seen any packet in the reply direction.
+	FirewallStateNew FirewallState = 1 << iota
+
+	// FirewallStateEstablished matches packets belonging to flows for which
+	// the firewall has seen and accepted packets in both directions.
+	FirewallStateEstablished
+
+	// FirewallStateRelated matches ICMP errors quoting packets belonging
+	// to flows that the firewall is tracking.
+	FirewallStateRelated
+)
+
+// FirewallPorts is an inclusive range of ports matched by a [FirewallRule].
+//
+// The zero value matches any port. Since port zero is not a valid port,
+// [ParseFirewallRule] rejects ranges including it, such that parsing
+// never produces the zero value by accident.
+type FirewallPorts struct {
+	First uint16
+	Last  uint16
+}
+
+// matches returns whether the range matches the given port.
+func (pr FirewallPorts) matches(port uint16) bool {
+	return pr == FirewallPorts{} || (port >= pr.First && port <= pr.Last)
+}
+
+// FirewallRule is a rule of a [*Firewall].
+//
+// A rule matches a packet when all its non-zero fields match the packet.
+// Rules using ports or TCP flags never match packets without ports or TCP
+// flags (e.g., ICMP packets and non-first IPv4 fragments).
+//
+// Use [ParseFirewallRule] to create a rule using a compact syntax.
+type FirewallRule struct {
+	// Action is the action to take for matching packets.
+	Action FirewallAction
+
+	// Proto is the OPTIONAL transport protocol to match.
+	Proto FirewallProto
+
+	// Src is the OPTIONAL source prefix to match.
+	Src netip.Prefix
+
+	// Dst is the OPTIONAL destination prefix to match.
+	Dst netip.Prefix
+
+	// SrcPorts is the OPTIONAL source ports range to match.
+	SrcPorts FirewallPorts
+
+	// DstPorts is the OPTIONAL destination ports range to match.
+	DstPorts FirewallPorts
+
+	// TCPFlags contains the flags that must be set among those in TCPFlagsMask.
+	TCPFlags uint8
+
+	// TCPFlagsMask is the OPTIONAL mask of TCP flags to check.
+	TCPFlagsMask uint8
+
+	// State is the OPTIONAL bitmask of connection states to match.
+	State FirewallState
+}
+
+// Firewall is a stateful packet filter implementing [PacketPolicy].
+//
+// The firewall evaluates the rules in order and applies the action of
+// the first matching rule, or the default action when no rule matches. The
+// firewall tracks the flows for which it accepted packets, which allows to
+// match on the connection state (e.g., to only accept replies).
+//
+// For example, the following rules block UDP/443 (thus forcing clients to
+// fall back from QUIC to TCP) and drop SYNs to 10.0.0.1:
+//
+//	reject udp dport 443
+//	drop tcp to 10.0.0.1 flags syn/syn,ack
+//
+// Construct using [NewFirewall].
+type Firewall struct {
+	// clock is the clock used to expire flows.
+	clock tcpip.Clock
+
+	// defaultAction is the action when no rule matches.
+	defaultAction FirewallAction
+
+	// flows contains the tracked flows indexed by originator direction.
+	flows map[FiveTuple]*firewallFlow
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// rules contains the rules.
+	rules []FirewallRule
+
+	// timeout is the idle timeout after which we forget a flow.
+	timeout time.Duration
+}
+
+// FirewallOption is an option for [NewFirewall].
+type FirewallOption func(cfg *firewallConfig)
+
+// firewallConfig is the internal type modified by [FirewallOption].
+type firewallConfig struct {
+	clock         tcpip.Clock
+	defaultAction FirewallAction
+	timeout       time.Duration
+}
+
+// DefaultFirewallTimeout is the default idle timeout of tracked flows.
+const DefaultFirewallTimeout = 5 * time.Minute
+
+// FirewallOptionClock sets the [tcpip.Clock] used to expire tracked flows.
+//
+// The default is to use the wall clock. Use the same clock used by the
+// [*Internet] (see [InternetOptionClock]) to expire flows consistently
+// with the simulation time.
+func FirewallOptionClock(clock tcpip.Clock) FirewallOption {
+	return func(cfg *firewallConfig) {
+		cfg.clock = clock
+	}
+}
+
+// FirewallOptionDefault sets the action to take when no rule matches.
+//
+// The default is [FirewallAccept].
+func FirewallOptionDefault(action FirewallAction) FirewallOption {
+	return func(cfg *firewallConfig) {
+		cfg.defaultAction = action
+	}
+}
+
+// FirewallOptionTimeout sets the idle timeout of tracked flows.
+//
+// The default is [DefaultFirewallTimeout]. A zero or negative
+// value is silently ignored.
+func FirewallOptionTimeout(timeout time.Duration) FirewallOption {
+	return func(cfg *firewallConfig) {
+		if timeout > 0 {
+			cfg.timeout = timeout
+		}
+	}
+}
+
+// NewFirewall creates a new [*Firewall] using the given rules.
+func NewFirewall(rules []FirewallRule, options ...FirewallOption) *Firewall {
+	cfg := &firewallConfig{
+		clock:         tcpip.NewStdClock(),
+		defaultAction: FirewallAccept,
+		timeout:       DefaultFirewallTimeout,
+	}
+	for _, opt := range options {
+		opt(cfg)
+	}
+
+	return &Firewall{
+		clock:         cfg.clock,
+		defaultAction: cfg.defaultAction,
+		flows:         make(map[FiveTuple]*firewallFlow),
+		mu:            sync.Mutex{},
+		rules:         append([]FirewallRule{}, rules...),
+		timeout:       cfg.timeout,
+	}
+}
+
+// firewallFlow is a tracked flow.
+type firewallFlow struct {
+	// expires is when the flow expires.
+	expires time.Time
+
+	// replied indicates whether we have seen the reply direction.
+	replied bool
+}
+
+// firewallPacket contains the packet fields matched by rules.
+type firewallPacket struct {
+	dst      netip.Addr
+	hasPorts bool
+	isTCP    bool
+	key      FiveTuple
+	proto    FirewallProto
+	src      netip.Addr
+	tcpFlags uint8
+}
+
+// Ensure that [*Firewall] implements [PacketPolicy].
+var _ PacketPolicy = &Firewall{}
+
+// HandleFrame implements [PacketPolicy].
+func (fw *Firewall) HandleFrame(frame VNICFrame, fwd PacketForwarder) {
+	// 1. parse the packet
+	pkt, err := frame.Parse()
+	if err != nil {
+		return
+	}
+	fp := firewallParse(pkt)
+
+	// 2. determine the connection state
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	now := fw.clock.Now()
+	flow, reply := fw.lookup(fp.key, now)
+	state := FirewallStateNew
+	switch {
+	case flow != nil && (reply || flow.replied):
+		state = FirewallStateEstablished
+	case flow == nil && fw.isRelated(pkt, now):
+		state = FirewallStateRelated
+	}
+
+	// 3. find the action to take
+	action := fw.defaultAction
+	for _, rule := range fw.rules {
+		if fw.matches(&rule, fp, state) {
+			action = rule.Action
+			break
+		}
+	}
+
+	// 4. apply the action
+	switch action {
+	case FirewallAccept:
+		fw.track(fp.key, flow, reply, state, now)
+		fwd.Forward(frame)
+
+	case FirewallReject:
+		fw.reject(pkt, fp, fwd)
+	}
+}
+
+// matches returns whether the rule matches the given packet.
+func (fw *Firewall) matches(rule *FirewallRule, fp *firewallPacket, state FirewallState) bool {
+	switch {
+	case rule.Proto != FirewallProtoAny && rule.Proto != fp.proto:
+		return false
+	case rule.Src.IsValid() && !rule.Src.Contains(fp.src):
+		return false
+	case rule.Dst.IsValid() && !rule.Dst.Contains(fp.dst):
+		return false
+	case rule.SrcPorts != FirewallPorts{} && (!fp.hasPorts || !rule.SrcPorts.matches(fp.key.Src.Port())):
+		return false
+	case rule.DstPorts != FirewallPorts{} && (!fp.hasPorts || !rule.DstPorts.matches(fp.key.Dst.Port())):
+		return false
+	case rule.TCPFlagsMask != 0 && (!fp.isTCP || fp.tcpFlags&rule.TCPFlagsMask != rule.TCPFlags):
+		return false
+	case rule.State != 0 && rule.State&state == 0:
+		return false
+	default:
+		return true
+	}
+}
+
+// lookup returns the flow to which the given key belongs, if any, and
+// whether the key is in the reply direction. The caller MUST hold the mutex.
+func (fw *Firewall) lookup(key FiveTuple, now time.Time) (*firewallFlow, bool) {
+	for _, reply := range []bool{false, true} {
+		k := key
+		if reply {
+			k = key.Reverse()
+		}
+		flow := fw.flows[k]
+		if flow == nil {
+			continue
+		}
+		if !now.Before(flow.expires) {
+			delete(fw.flows, k)
+			continue
+		}
+		return flow, reply
+	}
+	return nil, false
+}
+
+// isRelated returns whether the packet is an ICMP error quoting a packet
+// belonging to a tracked flow. The caller MUST hold the mutex.
+func (fw *Firewall) isRelated(pkt *Packet, now time.Time) bool {
+	inner, err := pkt.ICMPQuoted()
+	if err != nil {
+		return false
+	}
+	flow, _ := fw.lookup(inner.FiveTuple(), now)
+	return flow != nil
+}
+
+// track creates or refreshes the tracked flow after accepting a
+// packet. The caller MUST hold the mutex.
+func (fw *Firewall) track(key FiveTuple, flow *firewallFlow, reply bool, state FirewallState, now time.Time) {
+	if state == FirewallStateRelated {
+		return // do not track ICMP errors
+	}
+	if flow == nil {
+		flow = &firewallFlow{}
+		fw.flows[key] = flow
+	}
+	if reply {
+		flow.replied = true
+	}
+	flow.expires = now.Add(fw.timeout)
+}
+
+// reject sends a TCP RST segment or an ICMP error to the sender.
+func (fw *Firewall) reject(pkt *Packet, fp *firewallPacket, fwd PacketForwarder) {
+	if fp.isTCP {
+		if reset, ok := packetNewTCPReset(pkt); ok {
+			fwd.Forward(VNICFrame{Packet: reset})
+		}
+		return
+	}
+	if reply, ok := NewUnreachableFrame(pkt.Frame(), UnreachablePort, netip.Addr{}); ok {
+		fwd.Forward(reply)
+	}
+}
+
+// firewallParse extracts the packet fields matched by rules.
+func firewallParse(pkt *Packet) *firewallPacket {
+	fp := &firewallPacket{
+		dst:      pkt.Dst(),
+		hasPorts: pkt.hasPorts(),
+		isTCP:    pkt.tcpHeader() != nil,
+		key:      pkt.FiveTuple(),
+		proto:    FirewallProtoAny,
+		src:      pkt.Src(),
+		tcpFlags: pkt.TCPFlags(),
+	}
+	switch pkt.Protocol() {
+	case ProtocolTCP:
+		fp.proto = FirewallProtoTCP
+	case ProtocolUDP:
+		fp.proto = FirewallProtoUDP
+	case ProtocolICMPv4, ProtocolICMPv6:
+		fp.proto = FirewallProtoICMP
+	}
+	return fp
+}
+
+// ParseFirewallRule parses a [FirewallRule] from the given string.
+//
+// The syntax is an action (accept, drop, or reject) followed by optional
+// space-separated matchers in any order:
+//
+//   - tcp, udp, or icmp matches the protocol;
+//
+//   - from ADDR and to ADDR match the source and destination address, where
+//     ADDR is either an IP address or a prefix in CIDR notation;
+//
+//   - sport PORTS and dport PORTS match the source and destination ports,
+//     where PORTS is either a port or an inclusive range such as 1000-2000
+//     and port zero is not allowed;
+//
+//   - flags SET/MASK matches TCP packets whose flags in MASK are exactly
+//     SET, where both are comma-separated lists of flag names (fin, syn, rst,
+//     psh, ack, urg) and SET may be "none"; when /MASK is omitted, the mask
+//     is equal to SET, so "flags rst" matches all the RST segments; the mask
+//     cannot be empty, since a rule with an empty mask would match any
+//     packet, so "flags none" is invalid and "flags none/syn,ack" matches
+//     the segments having neither SYN nor ACK set;
+//
+//   - state STATES matches the connection state, where STATES is a
+//     comma-separated list of new, established, and related.
+//
+// For example, "drop tcp to 10.0.0.1 flags syn/syn,ack" drops the
+// SYN segments sent to 10.0.0.1.
+func ParseFirewallRule(s string) (FirewallRule, error) {
+	// 1. parse the action
+	var rule FirewallRule
+	tokens := strings.Fields(s)
+	if len(tokens) < 1 {
+		return FirewallRule{}, fmt.Errorf("missing firewall action: %q", s)
+	}
+	switch tokens[0] {
+	case "accept":
+		rule.Action = FirewallAccept
+	case "drop":
+		rule.Action = FirewallDrop
+	case "reject":
+		rule.Action = FirewallReject
+	default:
+		return FirewallRule{}, fmt.Errorf("invalid firewall action: %q", tokens[0])
+	}
+
+	// 2. parse the matchers
+	for idx := 1; idx < len(tokens); idx++ {
+		var err error
+		switch keyword := tokens[idx]; keyword {
+		case "tcp":
+			rule.Proto = FirewallProtoTCP
+		case "udp":
+			rule.Proto = FirewallProtoUDP
+		case "icmp":
+			rule.Proto = FirewallProtoICMP
+
+		case "from", "to", "sport", "dport", "flags", "state":
+			if idx+1 >= len(tokens) {
+				return FirewallRule{}, fmt.Errorf("missing value for %q: %q", keyword, s)
+			}
+			idx++
+			err = firewallParseMatcher(&rule, keyword, tokens[idx])
+
+		default:
+			err = fmt.Errorf("invalid firewall keyword: %q", keyword)
+		}
+		if err != nil {
+			return FirewallRule{}, err
+		}
+	}
+	return rule, nil
+}
+
+// ParseFirewallRules parses one [FirewallRule] per line using the syntax
+// described by [ParseFirewallRule], ignoring empty lines and comments
+// starting with the # character.
+func ParseFirewallRules(text string) ([]FirewallRule, error) {
+	rules := []FirewallRule{}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		rule, err := ParseFirewallRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineno, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// firewallParseMatcher parses the value of the given matcher keyword.
+func firewallParseMatcher(rule *FirewallRule, keyword, value string) (err error) {
+	switch keyword {
+	case "from":
+		rule.Src, err = firewallParsePrefix(value)
+	case "to":
+		rule.Dst, err = firewallParsePrefix(value)
+	case "sport":
+		rule.SrcPorts, err = firewallParsePorts(value)
+	case "dport":
+		rule.DstPorts, err = firewallParsePorts(value)
+	case "flags":
+		set, mask, found := strings.Cut(value, "/")
+		if rule.TCPFlags, err = firewallParseFlags(set); err != nil {
+			return err
+		}
+		rule.TCPFlagsMask = rule.TCPFlags
+		if found {
+			if rule.TCPFlagsMask, err = firewallParseFlags(mask); err != nil {
+				return err
+			}
+		}
+		switch {
+		case rule.TCPFlagsMask == 0:
+			err = fmt.Errorf("empty TCP flags mask: %q", value)
+		case rule.TCPFlags&^rule.TCPFlagsMask != 0:
+			err = fmt.Errorf("TCP flags not within mask: %q", value)
+		}
+	case "state":
+		rule.State, err = firewallParseState(value)
+	}
+	return err
+}
+
+// firewallParsePrefix parses an address or a prefix.
+func firewallParsePrefix(value string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
+// firewallParsePorts parses a port or a range of ports.
+func firewallParsePorts(value string) (FirewallPorts, error) {
+	first, last, found := strings.Cut(value, "-")
+	if !found {
+		last = first
+	}
+	lo, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return FirewallPorts{}, err
+	}
+	hi, err := strconv.ParseUint(last, 10, 16)
+	if err != nil {
+		return FirewallPorts{}, err
+	}
+	if lo > hi {
+		return FirewallPorts{}, fmt.Errorf("invalid ports range: %q", value)
+	}
+	if lo == 0 {
+		return FirewallPorts{}, fmt.Errorf("invalid port zero: %q", value)
+	}
+	return FirewallPorts{First: uint16(lo), Last: uint16(hi)}, nil
+}
+
+// firewallFlagNames maps flag names to TCP flags.
+var firewallFlagNames = map[string]uint8{
+	"fin": TCPFlagFIN,
+	"syn": TCPFlagSYN,
+	"rst": TCPFlagRST,
+	"psh": TCPFlagPSH,
+	"ack": TCPFlagACK,
+	"urg": TCPFlagURG,
+}
+
+// firewallParseFlags parses a comma-separated list of TCP flags.
+func firewallParseFlags(value string) (uint8, error) {
+	if value == "none" {
+		return 0, nil
+	}
+	var flags uint8
+	for name := range strings.SplitSeq(value, ",") {
+		flag, found := firewallFlagNames[name]
+		if !found {
+			return 0, fmt.Errorf("invalid TCP flag: %q", name)
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+// firewallStateNames maps state names to connection states.
+var firewallStateNames = map[string]FirewallState{
+	"new":         FirewallStateNew,
+	"established": FirewallStateEstablished,
+	"related":     FirewallStateRelated,
+}
+
+// firewallParseState parses a comma-separated list of connection states.
+func firewallParseState(value string) (FirewallState, error) {
+	var state FirewallState
+	for name := range strings.SplitSeq(value, ",") {
+		flag, found := firewallStateNames[name]
+		if !found {
+			return 0, fmt.Errorf("invalid connection state: %q", name)
+		}
+		state |= flag
+	}
+	return state, nil
+}
@@ -0,0 +1,274 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestTCPPacket returns an IPv4 TCP packet with valid checksums.
+func newTestTCPPacket(src, dst netip.AddrPort, seq uint32, flags uint8) []byte {
+	return newTestTCPPacketWithPayload(src, dst, seq, flags, nil)
+}
+
+// newTestTCPPacketWithPayload is like [newTestTCPPacket] but appends the given payload.
+func newTestTCPPacketWithPayload(src, dst netip.AddrPort, seq uint32, flags uint8, payload []byte) []byte {
+	pkt := make([]byte, 40+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = 6
+	copy(pkt[12:16], src.Addr().AsSlice())
+	copy(pkt[16:20], dst.Addr().AsSlice())
+	binary.BigEndian.PutUint16(pkt[10:12], testChecksum(0, pkt[:20]))
+	binary.BigEndian.PutUint16(pkt[20:22], src.Port())
+	binary.BigEndian.PutUint16(pkt[22:24], dst.Port())
+	binary.BigEndian.PutUint32(pkt[24:28], seq)
+	pkt[32] = 5 << 4
+	pkt[33] = flags
+	binary.BigEndian.PutUint16(pkt[34:36], 65535)
+	copy(pkt[40:], payload)
+	binary.BigEndian.PutUint16(pkt[36:38], testTCPChecksum(pkt))
+	return pkt
+}
+
+// testTCPChecksum computes the TCP checksum of an IPv4 TCP packet, which
+// is zero when the packet already contains a valid checksum.
+func testTCPChecksum(pkt []byte) uint16 {
+	var sum uint32
+	for idx := 12; idx < 20; idx += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pkt[idx:]))
+	}
+	sum += 6 + uint32(len(pkt)-20)
+	return testChecksum(sum, pkt[20:])
+}
+
+// firewallTestHandle passes the packet through the firewall and returns the forwarded packets.
+func firewallTestHandle(fw *uis.Firewall, pkt []byte) [][]byte {
+	fwd := &recordingForwarder{}
+	fw.HandleFrame(uis.VNICFrame{Packet: pkt}, fwd)
+	var pkts [][]byte
+	for _, frame := range fwd.frames {
+		pkts = append(pkts, frame.Packet)
+	}
+	return pkts
+}
+
+func TestParseFirewallRule(t *testing.T) {
+	cases := []struct {
+		input  string
+		expect uis.FirewallRule
+	}{{
+		input:  "accept",
+		expect: uis.FirewallRule{Action: uis.FirewallAccept},
+	}, {
+		input: "reject udp dport 443",
+		expect: uis.FirewallRule{
+			Action:   uis.FirewallReject,
+			Proto:    uis.FirewallProtoUDP,
+			DstPorts: uis.FirewallPorts{First: 443, Last: 443},
+		},
+	}, {
+		input: "drop tcp to 10.0.0.1 flags syn/syn,ack",
+		expect: uis.FirewallRule{
+			Action:       uis.FirewallDrop,
+			Proto:        uis.FirewallProtoTCP,
+			Dst:          netip.MustParsePrefix("10.0.0.1/32"),
+			TCPFlags:     uis.TCPFlagSYN,
+			TCPFlagsMask: uis.TCPFlagSYN | uis.TCPFlagACK,
+		},
+	}, {
+		input: "accept from 192.168.1.7/24 sport 1000-2000 flags rst state new,related",
+		expect: uis.FirewallRule{
+			Action:       uis.FirewallAccept,
+			Src:          netip.MustParsePrefix("192.168.1.0/24"),
+			SrcPorts:     uis.FirewallPorts{First: 1000, Last: 2000},
+			TCPFlags:     uis.TCPFlagRST,
+			TCPFlagsMask: uis.TCPFlagRST,
+			State:        uis.FirewallStateNew | uis.FirewallStateRelated,
+		},
+	}, {
+		input: "drop icmp from 2001:db8::1 flags none/fin",
+		expect: uis.FirewallRule{
+			Action:       uis.FirewallDrop,
+			Proto:        uis.FirewallProtoICMP,
+			Src:          netip.MustParsePrefix("2001:db8::1/128"),
+			TCPFlagsMask: uis.TCPFlagFIN,
+		},
+	}}
+	for _, tc := range cases {
+		t.Run(tc.input, func(t *testing.T) {
+			rule, err := uis.ParseFirewallRule(tc.input)
+			require.NoError(t, err)
+			require.Equal(t, tc.expect, rule)
+		})
+	}
+
+	failures := []string{
+		"",
+		"allow",
+		"drop sctp",
+		"drop from",
+		"drop from 10.0.0.0/33",
+		"drop dport 70000",
+		"drop dport 2000-1000",
+		"drop sport x-1",
+		"drop dport 0",
+		"drop sport 0-80",
+		"drop flags xyz",
+		"drop flags syn,ack/syn",
+		"drop flags syn/xyz",
+		"drop flags none",
+		"drop flags none/none",
+		"drop state closed",
+	}
+	for _, input := range failures {
+		t.Run(input, func(t *testing.T) {
+			_, err := uis.ParseFirewallRule(input)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestParseFirewallRules(t *testing.T) {
+	rules, err := uis.ParseFirewallRules(`
+		# block QUIC
+		reject udp dport 443
+
+		accept state established # replies
+	`)
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+
+	_, err = uis.ParseFirewallRules("accept\nallow\n")
+	require.ErrorContains(t, err, "line 2")
+}
+
+func TestFirewall(t *testing.T) {
+	client := netip.MustParseAddrPort("192.168.1.2:5000")
+	server := netip.MustParseAddrPort("10.0.0.1:443")
+
+	t.Run("reject_udp", func(t *testing.T) {
+		rules, err := uis.ParseFirewallRules("reject udp dport 443")
+		require.NoError(t, err)
+		fw := uis.NewFirewall(rules)
+
+		out := firewallTestHandle(fw, newTestUDPPacket(client, server, nil))
+		require.Len(t, out, 1)
+		require.Equal(t, server.Addr().AsSlice(), out[0][12:16])
+		require.Equal(t, client.Addr().AsSlice(), out[0][16:20])
+		require.Equal(t, []byte{3, 3}, out[0][20:22])
+
+		pkt := newTestUDPPacket(client, netip.MustParseAddrPort("10.0.0.1:53"), nil)
+		require.Equal(t, [][]byte{pkt}, firewallTestHandle(fw, pkt))
+	})
+
+	t.Run("reject_tcp", func(t *testing.T) {
+		rules, err := uis.ParseFirewallRules("reject tcp")
+		require.NoError(t, err)
+		fw := uis.NewFirewall(rules)
+
+		out := firewallTestHandle(fw, newTestTCPPacket(client, server, 1000, uis.TCPFlagSYN))
+		require.Len(t, out, 1)
+		rst := out[0]
+		require.Equal(t, uint16(0), testChecksum(0, rst[:20]))
+		require.Equal(t, uint16(0), testTCPChecksum(rst))
+		require.Equal(t, server.Addr().AsSlice(), rst[12:16])
+		require.Equal(t, client.Addr().AsSlice(), rst[16:20])
+		require.Equal(t, server.Port(), binary.BigEndian.Uint16(rst[20:22]))
+		require.Equal(t, client.Port(), binary.BigEndian.Uint16(rst[22:24]))
+		require.Equal(t, uint32(1001), binary.BigEndian.Uint32(rst[28:32]))
+		require.Equal(t, uis.TCPFlagRST|uis.TCPFlagACK, rst[33])
+
+		// we never respond to RST segments
+		require.Empty(t, firewallTestHandle(fw, newTestTCPPacket(client, server, 1000, uis.TCPFlagRST)))
+	})
+
+	t.Run("drop_syn", func(t *testing.T) {
+		rules, err := uis.ParseFirewallRules("drop tcp to 10.0.0.1 flags syn/syn,ack")
+		require.NoError(t, err)
+		fw := uis.NewFirewall(rules)
+
+		require.Empty(t, firewallTestHandle(fw, newTestTCPPacket(client, server, 1000, uis.TCPFlagSYN)))
+		require.Len(t, firewallTestHandle(fw, newTestTCPPacket(client, server, 1000, uis.TCPFlagACK)), 1)
+		require.Len(t, firewallTestHandle(fw, newTestTCPPacket(server, client, 1000, uis.TCPFlagSYN)), 1)
+	})
+
+	t.Run("drop_null", func(t *testing.T) {
+		rules, err := uis.ParseFirewallRules("drop flags none/syn,ack")
+		require.NoError(t, err)
+		fw := uis.NewFirewall(rules)
+
+		require.Empty(t, firewallTestHandle(fw, newTestTCPPacket(client, server, 1000, 0)))
+		require.Empty(t, firewallTestHandle(fw, newTestTCPPacket(client, server, 1000, uis.TCPFlagFIN)))
+		require.Len(t, firewallTestHandle(fw, newTestTCPPacket(client, server, 1000, uis.TCPFlagSYN)), 1)
+		require.Len(t, firewallTestHandle(fw, newTestTCPPacket(client, server, 1000, uis.TCPFlagACK)), 1)
+		require.Len(t, firewallTestHandle(fw, newTestUDPPacket(client, server, nil)), 1)
+	})
+
+	t.Run("stateful", func(t *testing.T) {
+		clock := uis.NewVirtualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+		rules, err := uis.ParseFirewallRules(`
+			accept state established,related
+			accept from 192.168.1.0/24 state new
+		`)
+		require.NoError(t, err)
+		fw := uis.NewFirewall(rules,
+			uis.FirewallOptionDefault(uis.FirewallDrop),
+			uis.FirewallOptionClock(clock),
+			uis.FirewallOptionTimeout(time.Minute),
+		)
+
+		// unsolicited packets are dropped
+		require.Empty(t, firewallTestHandle(fw, newTestUDPPacket(server, client, nil)))
+
+		// replies are accepted once the client has sent a packet
+		request := newTestUDPPacket(client, server, nil)
+		require.Len(t, firewallTestHandle(fw, request), 1)
+		require.Len(t, firewallTestHandle(fw, newTestUDPPacket(server, client, nil)), 1)
+
+		// related ICMP errors are accepted
+		icmp, ok := uis.NewUnreachableFrame(uis.VNICFrame{Packet: request}, uis.UnreachablePort, netip.Addr{})
+		require.True(t, ok)
+		require.Len(t, firewallTestHandle(fw, icmp.Packet), 1)
+
+		// flows expire
+		clock.Advance(2 * time.Minute)
+		require.Empty(t, firewallTestHandle(fw, newTestUDPPacket(server, client, nil)))
+	})
+}
+
+func TestFirewallWithStacks(t *testing.T) {
+	ix := uis.NewInternet()
+	server, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.1"))
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	client, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.2"))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+
+	listener, err := uis.NewListenConfig(server).Listen(context.Background(), "tcp", "10.0.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	rules, err := uis.ParseFirewallRules("reject tcp dport 80")
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go ix.Run(ctx, uis.NewFirewall(rules))
+
+	_, err = uis.NewConnector(client).DialContext(ctx, "tcp", "10.0.0.1:80")
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, syscall.ECONNREFUSED), "%v", err)
+	require.NoError(t, ctx.Err())
+}
@@ -0,0 +1,278 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"sync"
+	"time"
+)
+
+// FlowState is the state of a [Flow] tracked by a [*FlowTable].
+type FlowState int
+
+// Enumerate the [FlowState] values.
+const (
+	// FlowSynSent indicates that the initiator sent a TCP SYN segment
+	// and we have not seen the SYN-ACK yet. For UDP, it indicates that
+	// we have not seen any datagram in the reply direction yet.
+	FlowSynSent FlowState = iota
+
+	// FlowEstablished indicates that the responder sent a TCP SYN-ACK
+	// segment or, for UDP, that we have seen a reply datagram.
+	FlowEstablished
+
+	// FlowFinWait indicates that one of the endpoints sent a TCP FIN
+	// segment. UDP flows never enter this state.
+	FlowFinWait
+
+	// FlowClosed indicates that both endpoints sent a TCP FIN segment or
+	// that either endpoint sent a TCP RST segment. UDP flows never enter
+	// this state, since UDP is connectionless.
+	FlowClosed
+)
+
+// String returns the conntrack-like name of the state (e.g., "SYN_SENT").
+func (s FlowState) String() string {
+	switch s {
+	case FlowSynSent:
+		return "SYN_SENT"
+	case FlowEstablished:
+		return "ESTABLISHED"
+	case FlowFinWait:
+		return "FIN_WAIT"
+	case FlowClosed:
+		return "CLOSED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// FlowCounters contains the counters of one direction of a [Flow].
+type FlowCounters struct {
+	// Bytes is the number of bytes, including the IP and transport headers.
+	Bytes uint64
+
+	// FIN indicates whether this direction has sent a TCP FIN segment.
+	FIN bool
+
+	// Packets is the number of packets.
+	Packets uint64
+}
+
+// Flow is a snapshot of a TCP or UDP flow tracked by a [*FlowTable].
+type Flow struct {
+	// FirstSeen is when we saw the first packet of the flow.
+	FirstSeen time.Time
+
+	// ID uniquely identifies the flow within the [*FlowTable]. We assign
+	// IDs incrementally, therefore they reflect the flows creation order.
+	ID uint64
+
+	// LastSeen is when we saw the last packet of the flow.
+	LastSeen time.Time
+
+	// Original contains the counters of the initiator to responder direction.
+	Original FlowCounters
+
+	// Reply contains the counters of the responder to initiator direction.
+	Reply FlowCounters
+
+	// State is the flow state.
+	State FlowState
+
+	// Tuple is the [FiveTuple] in the initiator to responder direction.
+	Tuple FiveTuple
+}
+
+// FlowEvent describes a [Flow] state transition, including the
+// creation of the flow, which enters the [FlowSynSent] state.
+type FlowEvent struct {
+	// Flow is the snapshot of the flow after the transition.
+	Flow Flow
+
+	// Reply indicates whether the packet causing the transition
+	// travels in the responder to initiator direction.
+	Reply bool
+}
+
+// FlowTable tracks TCP and UDP flows by [FiveTuple], similarly to
+// the Linux conntrack subsystem, allowing tests to write assertions such
+// as "exactly one TCP connection was opened" or "the server sent the
+// FIN segment before the client".
+//
+// Attach to a [*Internet] using [InternetOptionFlowTable], which causes
+// [*Internet.Deliver] to feed the table with every delivered frame.
+//
+// We start tracking a TCP flow when we see a SYN segment without ACK and
+// a UDP flow when we see the first datagram. We ignore TCP segments not
+// belonging to tracked flows (e.g., segments of connections established
+// before attaching the table). Closed TCP flows remain in the table, so
+// that it is possible to inspect them, until a new SYN segment reuses the
+// same [FiveTuple]. We do not expire UDP flows.
+//
+// Construct using [NewFlowTable].
+type FlowTable struct {
+	// flows contains the tracked flows indexed by initiator to responder tuple.
+	flows map[FiveTuple]*Flow
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// nextID is the next flow ID.
+	nextID uint64
+
+	// nextSubscriber is the next subscriber ID.
+	nextSubscriber uint64
+
+	// order contains the tracked flows in creation order.
+	order []*Flow
+
+	// subscribers contains the subscribed callbacks.
+	subscribers map[uint64]func(FlowEvent)
+}
+
+// NewFlowTable creates a new empty [*FlowTable].
+func NewFlowTable() *FlowTable {
+	return &FlowTable{
+		flows:          make(map[FiveTuple]*Flow),
+		mu:             sync.Mutex{},
+		nextID:         1,
+		nextSubscriber: 0,
+		order:          []*Flow{},
+		subscribers:    make(map[uint64]func(FlowEvent)),
+	}
+}
+
+// Flows returns a snapshot of the tracked flows in creation order.
+func (ft *FlowTable) Flows() []Flow {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	flows := make([]Flow, 0, len(ft.order))
+	for _, flow := range ft.order {
+		flows = append(flows, *flow)
+	}
+	return flows
+}
+
+// Subscribe registers a callback invoked for each [FlowEvent] and returns
+// a function to unregister the callback.
+//
+// We invoke the callback synchronously from the goroutine that calls
+// [*Internet.Deliver], after releasing the table lock, so the callback
+// MAY call [*FlowTable.Flows] but MUST NOT block.
+func (ft *FlowTable) Subscribe(callback func(FlowEvent)) (unsubscribe func()) {
+	ft.mu.Lock()
+	id := ft.nextSubscriber
+	ft.nextSubscriber++
+	ft.subscribers[id] = callback
+	ft.mu.Unlock()
+	return func() {
+		ft.mu.Lock()
+		delete(ft.subscribers, id)
+		ft.mu.Unlock()
+	}
+}
+
+// observe updates the table using the given delivered frame.
+func (ft *FlowTable) observe(frame VNICFrame, now time.Time) {
+	// 1. only track TCP and UDP packets with ports
+	pkt, err := frame.Parse()
+	if err != nil || !pkt.hasPorts() {
+		return
+	}
+
+	// 2. update the flow while holding the lock
+	ft.mu.Lock()
+	event, changed := ft.update(pkt, now)
+	callbacks := make([]func(FlowEvent), 0, len(ft.subscribers))
+	if changed {
+		for _, callback := range ft.subscribers {
+			callbacks = append(callbacks, callback)
+		}
+	}
+	ft.mu.Unlock()
+
+	// 3. notify the subscribers without holding the lock
+	for _, callback := range callbacks {
+		callback(event)
+	}
+}
+
+// update finds or creates the flow, updates its counters and its state,
+// and returns the event and whether the state changed. The caller MUST
+// hold the mutex.
+func (ft *FlowTable) update(pkt *Packet, now time.Time) (FlowEvent, bool) {
+	// 1. find the flow and the packet direction
+	tuple, flags := pkt.FiveTuple(), pkt.TCPFlags()
+	isTCP := tuple.Protocol == ProtocolTCP
+	flow, reply := ft.flows[tuple], false
+	if flow == nil {
+		flow, reply = ft.flows[tuple.Reverse()], true
+	}
+
+	// 2. start tracking new flows and flows reusing a closed tuple
+	isSYN := isTCP && flags&(TCPFlagSYN|TCPFlagACK) == TCPFlagSYN
+	if (flow == nil || flow.State == FlowClosed) && (isSYN || (!isTCP && flow == nil)) {
+		flow, reply = ft.create(tuple, now), false
+		ft.count(flow, reply, pkt, now)
+		return FlowEvent{Flow: *flow, Reply: reply}, true
+	}
+	if flow == nil {
+		return FlowEvent{}, false
+	}
+	ft.count(flow, reply, pkt, now)
+
+	// 3. compute the next state
+	prev := flow.State
+	switch {
+	case !isTCP:
+		if reply {
+			flow.State = FlowEstablished
+		}
+
+	case flags&TCPFlagRST != 0:
+		flow.State = FlowClosed
+
+	case flow.State == FlowSynSent && reply && flags&(TCPFlagSYN|TCPFlagACK) == TCPFlagSYN|TCPFlagACK:
+		flow.State = FlowEstablished
+
+	case flags&TCPFlagFIN != 0 && (flow.State == FlowEstablished || flow.State == FlowFinWait):
+		flow.State = FlowFinWait
+		if flow.Original.FIN && flow.Reply.FIN {
+			flow.State = FlowClosed
+		}
+	}
+	return FlowEvent{Flow: *flow, Reply: reply}, flow.State != prev
+}
+
+// create creates and registers a new flow. The caller MUST hold the mutex.
+func (ft *FlowTable) create(tuple FiveTuple, now time.Time) *Flow {
+	flow := &Flow{
+		FirstSeen: now,
+		ID:        ft.nextID,
+		LastSeen:  now,
+		Original:  FlowCounters{},
+		Reply:     FlowCounters{},
+		State:     FlowSynSent,
+		Tuple:     tuple,
+	}
+	ft.nextID++
+	delete(ft.flows, tuple.Reverse())
+	ft.flows[tuple] = flow
+	ft.order = append(ft.order, flow)
+	return flow
+}
+
+// count updates the flow counters. The caller MUST hold the mutex.
+func (ft *FlowTable) count(flow *Flow, reply bool, pkt *Packet, now time.Time) {
+	counters := &flow.Original
+	if reply {
+		counters = &flow.Reply
+	}
+	counters.Packets++
+	counters.Bytes += uint64(len(pkt.Bytes()))
+	if pkt.TCPFlags()&TCPFlagFIN != 0 {
+		counters.FIN = true
+	}
+	flow.LastSeen = now
+}
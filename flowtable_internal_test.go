@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowTableObserve(t *testing.T) {
+	client := netip.MustParseAddrPort("10.0.0.2:5000")
+	server := netip.MustParseAddrPort("10.0.0.1:80")
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// observe passes a TCP segment from src to dst through the table.
+	observe := func(ft *FlowTable, src, dst netip.AddrPort, flags uint8, payload string) {
+		ft.observe(VNICFrame{Packet: packetNewTCP(src, dst, 0, 0, flags, 0, []byte(payload))}, t0)
+	}
+
+	t.Run("tcp_lifecycle", func(t *testing.T) {
+		ft := NewFlowTable()
+		var events []FlowEvent
+		ft.Subscribe(func(ev FlowEvent) {
+			events = append(events, ev)
+		})
+
+		observe(ft, client, server, TCPFlagSYN, "")
+		observe(ft, server, client, TCPFlagSYN|TCPFlagACK, "")
+		observe(ft, client, server, TCPFlagACK, "hello")
+		observe(ft, server, client, TCPFlagACK|TCPFlagFIN, "")
+		observe(ft, client, server, TCPFlagACK|TCPFlagFIN, "")
+		observe(ft, server, client, TCPFlagACK, "")
+
+		flows := ft.Flows()
+		require.Len(t, flows, 1)
+		flow := flows[0]
+		require.Equal(t, uint64(1), flow.ID)
+		require.Equal(t, FiveTuple{Dst: server, Protocol: ProtocolTCP, Src: client}, flow.Tuple)
+		require.Equal(t, FlowClosed, flow.State)
+		require.Equal(t, FlowCounters{Bytes: 3*40 + 5, FIN: true, Packets: 3}, flow.Original)
+		require.Equal(t, FlowCounters{Bytes: 3 * 40, FIN: true, Packets: 3}, flow.Reply)
+
+		var states []FlowState
+		var replies []bool
+		for _, ev := range events {
+			states = append(states, ev.Flow.State)
+			replies = append(replies, ev.Reply)
+		}
+		require.Equal(t, []FlowState{FlowSynSent, FlowEstablished, FlowFinWait, FlowClosed}, states)
+		require.Equal(t, []bool{false, true, true, false}, replies)
+	})
+
+	t.Run("tcp_reset", func(t *testing.T) {
+		ft := NewFlowTable()
+		observe(ft, client, server, TCPFlagSYN, "")
+		observe(ft, server, client, TCPFlagRST|TCPFlagACK, "")
+		require.Equal(t, FlowClosed, ft.Flows()[0].State)
+
+		// reusing the tuple creates a new flow
+		observe(ft, client, server, TCPFlagSYN, "")
+		flows := ft.Flows()
+		require.Len(t, flows, 2)
+		require.Equal(t, FlowClosed, flows[0].State)
+		require.Equal(t, FlowSynSent, flows[1].State)
+		require.Equal(t, uint64(2), flows[1].ID)
+	})
+
+	t.Run("tcp_untracked", func(t *testing.T) {
+		ft := NewFlowTable()
+		observe(ft, client, server, TCPFlagACK, "hello")
+		require.Empty(t, ft.Flows())
+	})
+
+	t.Run("udp", func(t *testing.T) {
+		ft := NewFlowTable()
+		var events []FlowEvent
+		unsubscribe := ft.Subscribe(func(ev FlowEvent) {
+			events = append(events, ev)
+		})
+
+		ft.observe(VNICFrame{Packet: packetNewUDP(client, server, []byte("query"))}, t0)
+		ft.observe(VNICFrame{Packet: packetNewUDP(client, server, []byte("query"))}, t0)
+		unsubscribe()
+		ft.observe(VNICFrame{Packet: packetNewUDP(server, client, []byte("response"))}, t0.Add(time.Second))
+
+		flows := ft.Flows()
+		require.Len(t, flows, 1)
+		require.Equal(t, FlowEstablished, flows[0].State)
+		require.Equal(t, uint64(2), flows[0].Original.Packets)
+		require.Equal(t, uint64(1), flows[0].Reply.Packets)
+		require.Equal(t, t0, flows[0].FirstSeen)
+		require.Equal(t, t0.Add(time.Second), flows[0].LastSeen)
+		require.Len(t, events, 1)
+	})
+}
@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"context"
+	"io"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowTableWithStacks(t *testing.T) {
+	flows := uis.NewFlowTable()
+	var (
+		events []uis.FlowEvent
+		mu     sync.Mutex
+	)
+	flows.Subscribe(func(ev uis.FlowEvent) {
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	})
+
+	ix := uis.NewInternet(uis.InternetOptionFlowTable(flows))
+	server, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.1"))
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	client, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.2"))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go ix.Run(ctx)
+
+	listener, err := uis.NewListenConfig(server).Listen(ctx, "tcp", "10.0.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	// the server reads the request, sends the response, and closes first
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("world"))
+	}()
+
+	conn, err := uis.NewConnector(client).DialContext(ctx, "tcp", "10.0.0.1:80")
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	data, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(data))
+	require.NoError(t, conn.Close())
+
+	require.Eventually(t, func() bool {
+		snapshot := flows.Flows()
+		return len(snapshot) == 1 && snapshot[0].State == uis.FlowClosed
+	}, 5*time.Second, 10*time.Millisecond)
+
+	flow := flows.Flows()[0]
+	require.Equal(t, netip.MustParseAddrPort("10.0.0.1:80"), flow.Tuple.Dst)
+	require.Equal(t, uint8(uis.ProtocolTCP), flow.Tuple.Protocol)
+	require.True(t, flow.Original.FIN)
+	require.True(t, flow.Reply.FIN)
+	require.Greater(t, flow.Original.Bytes, uint64(0))
+	require.Greater(t, flow.Reply.Bytes, uint64(0))
+
+	// the server sent the first FIN segment
+	mu.Lock()
+	defer mu.Unlock()
+	var states []uis.FlowState
+	for _, ev := range events {
+		states = append(states, ev.Flow.State)
+		if ev.Flow.State == uis.FlowFinWait {
+			require.True(t, ev.Reply)
+		}
+	}
+	require.Equal(t, []uis.FlowState{
+		uis.FlowSynSent, uis.FlowEstablished, uis.FlowFinWait, uis.FlowClosed,
+	}, states)
+}
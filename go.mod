@@ -7,6 +7,7 @@ require (
 	github.com/bassosimone/runtimex v0.0.0-20260817130226-a470a996118d
 	github.com/google/gopacket v1.1.19
 	github.com/stretchr/testify v1.12.1
+	golang.org/x/net v0.58.0
 	gvisor.dev/gvisor v0.0.0-20260821024505-0ab051d169df
 )
 
@@ -14,7 +15,6 @@ require (
 	github.com/google/btree v1.1.3 // indirect
 	go.yaml.in/yaml/v3 v3.0.5 // indirect
 	golang.org/x/exp v0.0.0-20260820142414-ca536658362e // indirect
-	golang.org/x/net v0.58.0 // indirect
 	golang.org/x/sys v0.47.0 // indirect
 	golang.org/x/time v0.15.0 // indirect
 )
@@ -0,0 +1,311 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// happyEyeballsDefaultResolutionDelay is the default [Connector] ResolutionDelay.
+const happyEyeballsDefaultResolutionDelay = 50 * time.Millisecond
+
+// happyEyeballsLookupResult is the result of resolving the addresses of a family.
+type happyEyeballsLookupResult struct {
+	// addrs contains the resolved endpoints.
+	addrs []netip.AddrPort
+
+	// err is the lookup error.
+	err error
+
+	// ipv6 indicates whether we resolved IPv6 addresses.
+	ipv6 bool
+
+	// resolved indicates whether the lookup returned any address,
+	// including the ones not belonging to the family.
+	resolved bool
+}
+
+// happyEyeballsDialResult is the result of a connection attempt.
+type happyEyeballsDialResult struct {
+	// conn is the conn on success.
+	conn net.Conn
+
+	// err is the error on failure.
+	err error
+}
+
+// happyEyeballsState contains the addresses we have not dialed yet.
+type happyEyeballsState struct {
+	// ipv4 contains the IPv4 addresses to dial.
+	ipv4 []netip.AddrPort
+
+	// ipv6 contains the IPv6 addresses to dial.
+	ipv6 []netip.AddrPort
+
+	// preferIPv6 indicates whether the next address should be IPv6.
+	preferIPv6 bool
+}
+
+// empty returns whether there are no addresses to dial.
+func (st *happyEyeballsState) empty() bool {
+	return len(st.ipv4) <= 0 && len(st.ipv6) <= 0
+}
+
+// next returns the next address to dial, interleaving the families starting
+// with IPv6 (see RFC 8305 Section 4). The state MUST NOT be empty.
+func (st *happyEyeballsState) next() netip.AddrPort {
+	var addr netip.AddrPort
+	if (st.preferIPv6 && len(st.ipv6) > 0) || len(st.ipv4) <= 0 {
+		addr, st.ipv6 = st.ipv6[0], st.ipv6[1:]
+		st.preferIPv6 = false
+	} else {
+		addr, st.ipv4 = st.ipv4[0], st.ipv4[1:]
+		st.preferIPv6 = true
+	}
+	return addr
+}
+
+// happyEyeballsTimer is a stoppable and resettable timer using the
+// [tcpip.Clock] of the [*Stack], such that delays follow the simulation
+// time (e.g., when using a [*VirtualClock]).
+//
+// Each [*happyEyeballsTimer.Reset] starts a new generation and we ignore
+// the expirations of the previous generations, which could otherwise be
+// delivered by callbacks already running when we stopped the timer.
+type happyEyeballsTimer struct {
+	// C receives a value when the timer expires.
+	C chan struct{}
+
+	// clock is the clock to use.
+	clock tcpip.Clock
+
+	// gen is the current generation.
+	gen uint64
+
+	// mu protects gen and timer.
+	mu sync.Mutex
+
+	// timer is the OPTIONAL underlying timer.
+	timer tcpip.Timer
+}
+
+// newHappyEyeballsTimer creates a new stopped [*happyEyeballsTimer].
+func newHappyEyeballsTimer(clock tcpip.Clock) *happyEyeballsTimer {
+	return &happyEyeballsTimer{
+		C:     make(chan struct{}, 1),
+		clock: clock,
+		gen:   0,
+		mu:    sync.Mutex{},
+		timer: nil,
+	}
+}
+
+// Reset stops the timer and restarts it such that it expires after d.
+func (t *happyEyeballsTimer) Reset(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopLocked()
+	gen := t.gen
+	t.timer = t.clock.AfterFunc(d, func() {
+		t.expire(gen)
+	})
+}
+
+// expire posts an expiration unless the given generation is stale.
+func (t *happyEyeballsTimer) expire(gen uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if gen != t.gen {
+		return
+	}
+	select {
+	case t.C <- struct{}{}:
+	default:
+	}
+}
+
+// Stop stops the timer and discards a pending expiration, if any.
+func (t *happyEyeballsTimer) Stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stopLocked()
+}
+
+// stopLocked is like Stop but the caller MUST hold the mutex.
+func (t *happyEyeballsTimer) stopLocked() {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.gen++
+	select {
+	case <-t.C:
+	default:
+	}
+}
+
+// dialHappyEyeballs dials the given address using Happy Eyeballs (see RFC 8305),
+// only resolving and dialing the addresses belonging to the given family.
+func (c *Connector) dialHappyEyeballs(ctx context.Context,
+	network string, family networkFamily, address string) (net.Conn, error) {
+	// 1. handle the IP literal endpoint case
+	host, port, err := connectorSplitHostPort(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !family.allows(addr) {
+			return nil, networkNoSuitableAddress(address)
+		}
+		return c.dialSingle(ctx, network, netip.AddrPortFrom(addr.Unmap(), port))
+	}
+
+	// 2. resolve the IPv6 and IPv4 addresses concurrently
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var families []networkFamily
+	for _, candidate := range []networkFamily{networkFamily6, networkFamily4} {
+		if family == networkFamilyAny || family == candidate {
+			families = append(families, candidate)
+		}
+	}
+	lookups := make(chan happyEyeballsLookupResult, len(families))
+	for _, lookupFamily := range families {
+		go func() {
+			addrs, err := c.resolve(ctx, lookupFamily, host)
+			lookups <- happyEyeballsLookupResult{
+				addrs:    connectorAddrPorts(lookupFamily, addrs, port),
+				err:      err,
+				ipv6:     lookupFamily == networkFamily6,
+				resolved: len(addrs) > 0,
+			}
+		}()
+	}
+
+	// 3. prepare for running connection attempts in the background
+	clock := c.stack.Stack.Clock()
+	returned := make(chan struct{})
+	defer close(returned)
+	results := make(chan happyEyeballsDialResult)
+	attemptDelay := c.FallbackDelay
+	if attemptDelay == 0 {
+		attemptDelay = connectorDefaultFallbackDelay
+	}
+	attemptTimer := newHappyEyeballsTimer(clock)
+	defer attemptTimer.Stop()
+	var (
+		attemptArmed bool
+		inflight     int
+		state        = &happyEyeballsState{preferIPv6: true}
+	)
+	startNext := func() {
+		addr := state.next()
+		attemptArmed = true
+		inflight++
+		go func() {
+			conn, err := c.dialSingle(ctx, network, addr)
+			select {
+			case results <- happyEyeballsDialResult{conn: conn, err: err}:
+			case <-returned:
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}()
+		attemptTimer.Reset(attemptDelay)
+	}
+
+	// 4. prepare for waiting for the IPv6 addresses (see RFC 8305 Section 3)
+	resolutionDelay := c.ResolutionDelay
+	if resolutionDelay <= 0 {
+		resolutionDelay = happyEyeballsDefaultResolutionDelay
+	}
+	resolutionTimer := newHappyEyeballsTimer(clock)
+	defer resolutionTimer.Stop()
+
+	// 5. run the event loop until we connect or everything fails
+	var (
+		dialErr   error
+		lookupErr error
+		pending   = len(families)
+		resolved  bool
+		started   bool
+		waitIPv6  = family != networkFamily4
+	)
+	for {
+		// 5.1. start dialing once we stopped waiting for the IPv6 addresses
+		if !started && !waitIPv6 && !state.empty() {
+			started = true
+			startNext()
+		}
+
+		// 5.2. immediately dial the addresses resolved after all the previous
+		// attempts failed or after the attempt timer expired without addresses
+		// to dial, since no timer would otherwise start them (see RFC 8305 Section 3)
+		if started && (inflight <= 0 || !attemptArmed) && !state.empty() {
+			startNext()
+		}
+
+		// 5.3. fail when there is nothing else to do
+		if pending <= 0 && inflight <= 0 && state.empty() {
+			switch {
+			case dialErr != nil:
+				return nil, dialErr
+			case lookupErr != nil:
+				return nil, lookupErr
+			case resolved:
+				return nil, networkNoSuitableAddress(address)
+			default:
+				return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			}
+		}
+
+		select {
+		case res := <-lookups:
+			pending--
+			resolved = resolved || res.resolved
+			if res.err != nil && lookupErr == nil {
+				lookupErr = res.err
+			}
+			if res.ipv6 {
+				state.ipv6 = append(state.ipv6, res.addrs...)
+				waitIPv6 = false
+			} else {
+				state.ipv4 = append(state.ipv4, res.addrs...)
+				if waitIPv6 && len(res.addrs) > 0 {
+					resolutionTimer.Reset(resolutionDelay)
+				}
+			}
+
+		case <-resolutionTimer.C:
+			waitIPv6 = false
+
+		case <-attemptTimer.C:
+			attemptArmed = false
+			if !state.empty() {
+				startNext()
+			}
+
+		case res := <-results:
+			inflight--
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if dialErr == nil {
+				dialErr = res.err
+			}
+			if !state.empty() {
+				startNext()
+			}
+
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
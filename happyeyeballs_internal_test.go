@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+func TestHappyEyeballsStateNext(t *testing.T) {
+	state := &happyEyeballsState{
+		ipv4: []netip.AddrPort{
+			netip.MustParseAddrPort("10.0.0.1:80"),
+			netip.MustParseAddrPort("10.0.0.2:80"),
+			netip.MustParseAddrPort("10.0.0.3:80"),
+		},
+		ipv6: []netip.AddrPort{
+			netip.MustParseAddrPort("[2001:db8::1]:80"),
+			netip.MustParseAddrPort("[2001:db8::2]:80"),
+		},
+		preferIPv6: true,
+	}
+	var order []string
+	for !state.empty() {
+		order = append(order, state.next().String())
+	}
+	require.Equal(t, []string{
+		"[2001:db8::1]:80",
+		"10.0.0.1:80",
+		"[2001:db8::2]:80",
+		"10.0.0.2:80",
+		"10.0.0.3:80",
+	}, order)
+}
+
+// happyEyeballsTestClock is a [tcpip.Clock] recording the AfterFunc callbacks,
+// which allows to run them at will (e.g., after stopping the timer).
+type happyEyeballsTestClock struct {
+	tcpip.Clock
+	funcs []func()
+}
+
+// AfterFunc implements [tcpip.Clock].
+func (c *happyEyeballsTestClock) AfterFunc(d time.Duration, f func()) tcpip.Timer {
+	c.funcs = append(c.funcs, f)
+	return c.Clock.AfterFunc(d, func() {})
+}
+
+func TestHappyEyeballsTimerIgnoresStaleExpirations(t *testing.T) {
+	clock := &happyEyeballsTestClock{Clock: NewVirtualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))}
+	timer := newHappyEyeballsTimer(clock)
+
+	// a callback running after we stopped the timer is ignored
+	timer.Reset(time.Second)
+	timer.Stop()
+	clock.funcs[0]()
+	require.Len(t, timer.C, 0)
+
+	// and so is a callback of a previous generation running after a reset
+	timer.Reset(time.Second)
+	clock.funcs[0]()
+	require.Len(t, timer.C, 0)
+
+	// while the callback of the current generation expires the timer
+	clock.funcs[1]()
+	require.Len(t, timer.C, 1)
+
+	// stopping discards the pending expiration
+	timer.Stop()
+	require.Len(t, timer.C, 0)
+}
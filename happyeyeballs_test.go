@@ -0,0 +1,271 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/require"
+)
+
+// happyEyeballsTestAnswer is the answer of a [happyEyeballsTestResolver].
+type happyEyeballsTestAnswer struct {
+	addrs []netip.Addr
+	delay time.Duration
+	err   error
+}
+
+// happyEyeballsTestResolver is a [uis.Resolver] answering for any host
+// using the answer configured for the queried network after its delay.
+type happyEyeballsTestResolver map[string]happyEyeballsTestAnswer
+
+// LookupNetIP implements [uis.Resolver].
+func (r happyEyeballsTestResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	answer := r[network]
+	select {
+	case <-time.After(answer.delay):
+		return answer.addrs, answer.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestConnectorDialContextWithHappyEyeballs(t *testing.T) {
+	// create a dual-stack server listening on port 80 and a dual-stack client,
+	// using a policy that blackholes the packets of the configured IP version
+	ix := uis.NewInternet()
+	server, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2001:db8::1"))
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	client, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("2001:db8::2"))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var blackhole atomic.Uint32
+	policy := uis.PacketPolicyFunc(func(frame uis.VNICFrame, fwd uis.PacketForwarder) {
+		if len(frame.Packet) > 0 && uint32(frame.Packet[0]>>4) == blackhole.Load() {
+			return
+		}
+		fwd.Forward(frame)
+	})
+	go ix.Run(ctx, policy)
+
+	for _, address := range []string{"10.0.0.1:80", "[2001:db8::1]:80"} {
+		listener, err := uis.NewListenConfig(server).Listen(ctx, "tcp", address)
+		require.NoError(t, err)
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+	}
+
+	// dial dials example.com using Happy Eyeballs and the given resolver
+	// and returns the remote address on success and the elapsed time.
+	dial := func(resolver uis.Resolver, port string) (string, time.Duration, error) {
+		connector := uis.NewConnector(client)
+		connector.FallbackDelay = 100 * time.Millisecond
+		connector.ResolutionDelay = 100 * time.Millisecond
+		connector.Resolver = resolver
+		t0 := time.Now()
+		conn, err := connector.DialContext(ctx, "tcp", net.JoinHostPort("example.com", port))
+		elapsed := time.Since(t0)
+		if err != nil {
+			return "", elapsed, err
+		}
+		defer conn.Close()
+		return conn.RemoteAddr().String(), elapsed, nil
+	}
+
+	ipv6 := []netip.Addr{netip.MustParseAddr("2001:db8::1")}
+	ipv4 := []netip.Addr{netip.MustParseAddr("10.0.0.1")}
+
+	t.Run("IPv6 is preferred", func(t *testing.T) {
+		resolver := happyEyeballsTestResolver{
+			"ip6": {addrs: ipv6, delay: 0, err: nil},
+			"ip4": {addrs: ipv4, delay: 0, err: nil},
+		}
+		remote, _, err := dial(resolver, "80")
+		require.NoError(t, err)
+		require.Equal(t, "[2001:db8::1]:80", remote)
+	})
+
+	t.Run("IPv4 is used when IPv6 is blackholed", func(t *testing.T) {
+		blackhole.Store(6)
+		defer blackhole.Store(0)
+		resolver := happyEyeballsTestResolver{
+			"ip6": {addrs: ipv6, delay: 0, err: nil},
+			"ip4": {addrs: ipv4, delay: 0, err: nil},
+		}
+		remote, elapsed, err := dial(resolver, "80")
+		require.NoError(t, err)
+		require.Equal(t, "10.0.0.1:80", remote)
+		require.GreaterOrEqual(t, elapsed, 100*time.Millisecond)
+	})
+
+	t.Run("we wait for slow IPv6 addresses", func(t *testing.T) {
+		resolver := happyEyeballsTestResolver{
+			"ip6": {addrs: ipv6, delay: 30 * time.Millisecond, err: nil},
+			"ip4": {addrs: ipv4, delay: 0, err: nil},
+		}
+		remote, _, err := dial(resolver, "80")
+		require.NoError(t, err)
+		require.Equal(t, "[2001:db8::1]:80", remote)
+	})
+
+	t.Run("we do not wait for too slow IPv6 addresses", func(t *testing.T) {
+		resolver := happyEyeballsTestResolver{
+			"ip6": {addrs: ipv6, delay: 5 * time.Second, err: nil},
+			"ip4": {addrs: ipv4, delay: 0, err: nil},
+		}
+		remote, elapsed, err := dial(resolver, "80")
+		require.NoError(t, err)
+		require.Equal(t, "10.0.0.1:80", remote)
+		require.Less(t, elapsed, time.Second)
+	})
+
+	t.Run("we dial IPv6 addresses resolved after the attempt timer expired", func(t *testing.T) {
+		// the IPv4 attempt starts after the resolution delay and hangs, and the
+		// attempt timer expires without addresses before we resolve IPv6
+		blackhole.Store(4)
+		defer blackhole.Store(0)
+		resolver := happyEyeballsTestResolver{
+			"ip6": {addrs: ipv6, delay: 400 * time.Millisecond, err: nil},
+			"ip4": {addrs: ipv4, delay: 0, err: nil},
+		}
+		remote, elapsed, err := dial(resolver, "80")
+		require.NoError(t, err)
+		require.Equal(t, "[2001:db8::1]:80", remote)
+		require.Less(t, elapsed, 2*time.Second)
+	})
+
+	t.Run("IPv4 is used when the AAAA lookup fails", func(t *testing.T) {
+		resolver := happyEyeballsTestResolver{
+			"ip6": {addrs: nil, delay: 0, err: errors.New("mocked error")},
+			"ip4": {addrs: ipv4, delay: 10 * time.Millisecond, err: nil},
+		}
+		remote, _, err := dial(resolver, "80")
+		require.NoError(t, err)
+		require.Equal(t, "10.0.0.1:80", remote)
+	})
+
+	t.Run("we do not wait after a connection attempt fails", func(t *testing.T) {
+		resolver := happyEyeballsTestResolver{
+			"ip6": {addrs: ipv6, delay: 0, err: nil},
+			"ip4": {addrs: ipv4, delay: 0, err: nil},
+		}
+		connector := uis.NewConnector(client)
+		connector.FallbackDelay = 5 * time.Second
+		connector.Resolver = resolver
+		t0 := time.Now()
+		_, err := connector.DialContext(ctx, "tcp", "example.com:81")
+		require.True(t, errors.Is(err, syscall.ECONNREFUSED))
+		require.Less(t, time.Since(t0), time.Second)
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		mockedErr := errors.New("mocked error")
+		resolver := happyEyeballsTestResolver{
+			"ip6": {addrs: nil, delay: 0, err: mockedErr},
+			"ip4": {addrs: nil, delay: 0, err: mockedErr},
+		}
+		_, _, err := dial(resolver, "80")
+		require.True(t, errors.Is(err, mockedErr))
+
+		var dnsErr *net.DNSError
+		_, _, err = dial(happyEyeballsTestResolver{}, "80")
+		require.True(t, errors.As(err, &dnsErr) && dnsErr.IsNotFound)
+
+		_, _, err = dial(nil, "80")
+		require.True(t, errors.As(err, &dnsErr))
+		_, _, err = dial(resolver, "nonexistent-service")
+		require.Error(t, err)
+	})
+
+	t.Run("IP literals", func(t *testing.T) {
+		connector := uis.NewConnector(client)
+		conn, err := connector.DialContext(ctx, "tcp", "[2001:db8::1]:80")
+		require.NoError(t, err)
+		require.NoError(t, conn.Close())
+	})
+}
+
+func TestConnectorDialContextWithHappyEyeballsAndVirtualClock(t *testing.T) {
+	// create dual-stack client and server stacks using a virtual clock
+	// and a router blackholing all the IPv6 packets
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := uis.NewVirtualClock(t0)
+	ix := uis.NewInternet(uis.InternetOptionClock(clock))
+	server, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2001:db8::1"))
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	client, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("2001:db8::2"))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	router := uis.NewRouter(ix, uis.RouterOptionPolicy(uis.PacketPolicyFunc(
+		func(frame uis.VNICFrame, fwd uis.PacketForwarder) {
+			if len(frame.Packet) > 0 && frame.Packet[0]>>4 == 6 {
+				return
+			}
+			fwd.Forward(frame)
+		})))
+	go router.Run(ctx)
+
+	listener, err := uis.NewListenConfig(server).Listen(ctx, "tcp", "10.0.0.1:80")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	// dial in the background using a delay that is very long in wall time
+	connector := uis.NewConnector(client)
+	connector.FallbackDelay = time.Minute
+	connector.Resolver = happyEyeballsTestResolver{
+		"ip6": {addrs: []netip.Addr{netip.MustParseAddr("2001:db8::1")}},
+		"ip4": {addrs: []netip.Addr{netip.MustParseAddr("10.0.0.1")}},
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := connector.DialContext(ctx, "tcp", "example.com:80")
+		done <- result{conn, err}
+	}()
+
+	// advance the virtual clock until the dial completes
+	wallT0 := time.Now()
+	for {
+		select {
+		case res := <-done:
+			require.NoError(t, res.err)
+			defer res.conn.Close()
+			require.Equal(t, "10.0.0.1:80", res.conn.RemoteAddr().String())
+			require.GreaterOrEqual(t, clock.Now().Sub(t0), time.Minute)
+			require.Less(t, time.Since(wallT0), 5*time.Second)
+			return
+		default:
+		}
+		require.NoError(t, ctx.Err())
+		if !router.Step(ctx) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// Hop is a [PacketPolicy] modeling an intermediate router.
+//
+// For each packet, the hop decrements the IPv4 TTL or the IPv6 Hop Limit
+// and recomputes the checksums. When the TTL or Hop Limit expires, the hop
+// drops the packet and sends an ICMPv4 or ICMPv6 Time Exceeded message
+// back to the sender using the hop address of the same family. When the
+// hop has no address of the right family, it silently drops the packet.
+//
+// Chain multiple [*Hop] instances (e.g., using [*Internet.Run]) to model
+// a path with multiple hops, which allows to test traceroute-like code and
+// code sensitive to the number of hops. Since the [*Router] passes every
+// packet through the policy chain, the hops apply to both directions.
+//
+// Construct using [NewHop].
+type Hop struct {
+	// addr4 is the OPTIONAL IPv4 address.
+	addr4 netip.Addr
+
+	// addr6 is the OPTIONAL IPv6 address.
+	addr6 netip.Addr
+}
+
+// NewHop creates a new [*Hop] using the given IPv4 and IPv6 addresses.
+//
+// If you specify multiple addresses of the same family, we use the
+// first one. Invalid addresses are ignored.
+func NewHop(addrs ...netip.Addr) *Hop {
+	h := &Hop{}
+	for _, addr := range addrs {
+		switch {
+		case addr.Is4() && !h.addr4.IsValid():
+			h.addr4 = addr
+		case addr.Is6() && !h.addr6.IsValid():
+			h.addr6 = addr
+		}
+	}
+	return h
+}
+
+// Ensure that [*Hop] implements [PacketPolicy].
+var _ PacketPolicy = &Hop{}
+
+// HandleFrame implements [PacketPolicy].
+func (h *Hop) HandleFrame(frame VNICFrame, fwd PacketForwarder) {
+	pkt := frame.Packet
+	if len(pkt) < 1 {
+		return
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		h.handleIPv4(frame, fwd)
+	case 6:
+		h.handleIPv6(frame, fwd)
+	}
+}
+
+// handleIPv4 handles an IPv4 packet.
+func (h *Hop) handleIPv4(frame VNICFrame, fwd PacketForwarder) {
+	pkt := frame.Packet
+	if _, ok := packetIPv4HeaderLength(pkt); !ok {
+		return
+	}
+	if pkt[8] <= 1 {
+		h.timeExceeded(h.addr4, packetICMPv4TimeExceeded, pkt, fwd)
+		return
+	}
+	pkt = slices.Clone(pkt)
+	pkt[8]--
+	packetUpdateIPv4Checksum(pkt)
+	fwd.Forward(VNICFrame{Packet: pkt, sender: frame.sender})
+}
+
+// handleIPv6 handles an IPv6 packet.
+func (h *Hop) handleIPv6(frame VNICFrame, fwd PacketForwarder) {
+	pkt := frame.Packet
+	if len(pkt) < packetIPv6HeaderLen {
+		return
+	}
+	if pkt[7] <= 1 {
+		h.timeExceeded(h.addr6, packetICMPv6TimeExceeded, pkt, fwd)
+		return
+	}
+	pkt = slices.Clone(pkt)
+	pkt[7]-- // IPv6 has no header checksum
+	fwd.Forward(VNICFrame{Packet: pkt, sender: frame.sender})
+}
+
+// timeExceeded sends a Time Exceeded message from the given address.
+func (h *Hop) timeExceeded(from netip.Addr, typ uint8, pkt []byte, fwd PacketForwarder) {
+	if !from.IsValid() {
+		return
+	}
+	if msg, ok := packetNewICMPError(from, typ, 0, 0, pkt); ok {
+		fwd.Forward(VNICFrame{Packet: msg})
+	}
+}
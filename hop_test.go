@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingForwarder is a [uis.PacketForwarder] recording the forwarded frames.
+type recordingForwarder struct {
+	frames []uis.VNICFrame
+}
+
+func (fwd *recordingForwarder) Forward(frame uis.VNICFrame) {
+	fwd.frames = append(fwd.frames, frame)
+}
+
+func (fwd *recordingForwarder) ForwardAfter(delay time.Duration, frame uis.VNICFrame) {
+	fwd.frames = append(fwd.frames, frame)
+}
+
+// testChecksum computes the internet checksum of the given data
+// starting from the given partial sum.
+func testChecksum(sum uint32, data []byte) uint16 {
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) > 0 {
+		sum += uint32(data[0]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// testICMPv6Checksum verifies the checksum of an ICMPv6 packet.
+func testICMPv6Checksum(pkt []byte) uint16 {
+	payload := pkt[40:]
+	var sum uint32
+	for idx := 8; idx < 40; idx += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pkt[idx:]))
+	}
+	sum += uint32(len(payload)) + 58
+	return testChecksum(sum, payload)
+}
+
+func TestHop(t *testing.T) {
+	hop := uis.NewHop(netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8:ffff::1"))
+	dst4 := netip.MustParseAddr("10.0.0.1")
+	dst6 := netip.MustParseAddr("2001:db8::1")
+
+	t.Run("ipv4_forward", func(t *testing.T) {
+		pkt := newTestIPv4Packet(dst4)
+		orig := slices.Clone(pkt)
+		fwd := &recordingForwarder{}
+		hop.HandleFrame(uis.VNICFrame{Packet: pkt}, fwd)
+
+		require.Equal(t, orig, pkt)
+		require.Len(t, fwd.frames, 1)
+		out := fwd.frames[0].Packet
+		require.Equal(t, byte(63), out[8])
+		require.Equal(t, uint16(0), testChecksum(0, out[:20]))
+	})
+
+	t.Run("ipv4_time_exceeded", func(t *testing.T) {
+		pkt := newTestIPv4Packet(dst4)
+		pkt[8] = 1
+		fwd := &recordingForwarder{}
+		hop.HandleFrame(uis.VNICFrame{Packet: pkt}, fwd)
+
+		require.Len(t, fwd.frames, 1)
+		out := fwd.frames[0].Packet
+		require.Equal(t, byte(1), out[9])
+		require.Equal(t, netip.MustParseAddr("192.0.2.1").AsSlice(), out[12:16])
+		require.Equal(t, pkt[12:16], out[16:20])
+		require.Equal(t, uint16(0), testChecksum(0, out[:20]))
+		require.Equal(t, byte(11), out[20])
+		require.Equal(t, byte(0), out[21])
+		require.Equal(t, uint16(0), testChecksum(0, out[20:]))
+		require.Equal(t, pkt, out[28:])
+	})
+
+	t.Run("ipv6_forward", func(t *testing.T) {
+		pkt := newTestIPv6Packet(dst6)
+		fwd := &recordingForwarder{}
+		hop.HandleFrame(uis.VNICFrame{Packet: pkt}, fwd)
+
+		require.Len(t, fwd.frames, 1)
+		require.Equal(t, byte(63), fwd.frames[0].Packet[7])
+	})
+
+	t.Run("ipv6_time_exceeded", func(t *testing.T) {
+		pkt := newTestIPv6Packet(dst6)
+		pkt[7] = 1
+		copy(pkt[8:24], netip.MustParseAddr("2001:db8::2").AsSlice())
+		fwd := &recordingForwarder{}
+		hop.HandleFrame(uis.VNICFrame{Packet: pkt}, fwd)
+
+		require.Len(t, fwd.frames, 1)
+		out := fwd.frames[0].Packet
+		require.Equal(t, byte(58), out[6])
+		require.Equal(t, netip.MustParseAddr("2001:db8:ffff::1").AsSlice(), out[8:24])
+		require.Equal(t, pkt[8:24], out[24:40])
+		require.Equal(t, byte(3), out[40])
+		require.Equal(t, uint16(0), testICMPv6Checksum(out))
+		require.Equal(t, pkt, out[48:])
+	})
+
+	t.Run("no_address_for_family", func(t *testing.T) {
+		hop := uis.NewHop(netip.MustParseAddr("2001:db8:ffff::1"))
+		pkt := newTestIPv4Packet(dst4)
+		pkt[8] = 1
+		fwd := &recordingForwarder{}
+		hop.HandleFrame(uis.VNICFrame{Packet: pkt}, fwd)
+		require.Empty(t, fwd.frames)
+	})
+
+	t.Run("no_error_for_errors", func(t *testing.T) {
+		pkt := newTestIPv4Packet(dst4)
+		pkt[8] = 1
+		fwd := &recordingForwarder{}
+		hop.HandleFrame(uis.VNICFrame{Packet: pkt}, fwd)
+		require.Len(t, fwd.frames, 1)
+
+		errpkt := slices.Clone(fwd.frames[0].Packet)
+		errpkt[8] = 1
+		fwd = &recordingForwarder{}
+		hop.HandleFrame(uis.VNICFrame{Packet: errpkt}, fwd)
+		require.Empty(t, fwd.frames)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		fwd := &recordingForwarder{}
+		hop.HandleFrame(uis.VNICFrame{}, fwd)
+		hop.HandleFrame(uis.VNICFrame{Packet: []byte{0x45}}, fwd)
+		hop.HandleFrame(uis.VNICFrame{Packet: []byte{0x60}}, fwd)
+		require.Empty(t, fwd.frames)
+	})
+}
@@ -0,0 +1,76 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import "net/netip"
+
+// UnreachableCode is the reason why a destination is unreachable.
+type UnreachableCode int
+
+// Enumerate the supported [UnreachableCode] values.
+const (
+	// UnreachableNet indicates that the destination network is unreachable,
+	// which maps to [syscall.ENETUNREACH] when dialing.
+	UnreachableNet UnreachableCode = iota
+
+	// UnreachableHost indicates that the destination host is unreachable,
+	// which maps to [syscall.EHOSTUNREACH] when dialing.
+	UnreachableHost
+
+	// UnreachablePort indicates that the destination port is unreachable,
+	// which maps to [syscall.ECONNREFUSED] when dialing.
+	UnreachablePort
+
+	// UnreachableAdminProhibited indicates that communication with the
+	// destination is administratively prohibited (e.g., by a firewall).
+	UnreachableAdminProhibited
+)
+
+// icmpv4Codes maps [UnreachableCode] to ICMPv4 Destination Unreachable codes.
+var icmpv4Codes = map[UnreachableCode]uint8{
+	UnreachableNet:             0,
+	UnreachableHost:            1,
+	UnreachablePort:            3,
+	UnreachableAdminProhibited: 13,
+}
+
+// icmpv6Codes maps [UnreachableCode] to ICMPv6 Destination Unreachable codes.
+var icmpv6Codes = map[UnreachableCode]uint8{
+	UnreachableNet:             0, // no route to destination
+	UnreachableHost:            3, // address unreachable
+	UnreachablePort:            4,
+	UnreachableAdminProhibited: 1,
+}
+
+// NewUnreachableFrame creates an ICMPv4 or ICMPv6 Destination Unreachable
+// message in response to the given original frame using the given code.
+//
+// The from argument is the source address of the message (e.g., the address
+// of the router generating the message). If from is invalid or belongs to the
+// wrong family, we use the destination address of the original packet.
+//
+// This function returns false if the original packet is malformed or if we
+// MUST NOT respond to it with an ICMP error (e.g., because it is itself an
+// ICMP error message or because its source address is multicast).
+func NewUnreachableFrame(original VNICFrame, code UnreachableCode, from netip.Addr) (VNICFrame, bool) {
+	_, dst, ok := internetParseAddrs(original.Packet)
+	if !ok {
+		return VNICFrame{}, false
+	}
+	if !from.IsValid() || from.Is4() != dst.Is4() {
+		from = dst
+	}
+	typ, codes := uint8(packetICMPv4DstUnreachable), icmpv4Codes
+	if dst.Is6() {
+		typ, codes = packetICMPv6DstUnreachable, icmpv6Codes
+	}
+	icmpCode, found := codes[code]
+	if !found {
+		return VNICFrame{}, false
+	}
+	pkt, ok := packetNewICMPError(from, typ, icmpCode, 0, original.Packet)
+	if !ok {
+		return VNICFrame{}, false
+	}
+	return VNICFrame{Packet: pkt}, true
+}
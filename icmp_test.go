@@ -0,0 +1,140 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewUnreachableFrame(t *testing.T) {
+	router4 := netip.MustParseAddr("192.0.2.1")
+	router6 := netip.MustParseAddr("2001:db8:ffff::1")
+	dst4 := netip.MustParseAddr("10.0.0.1")
+	dst6 := netip.MustParseAddr("2001:db8::1")
+
+	cases := []struct {
+		code  uis.UnreachableCode
+		code4 byte
+		code6 byte
+	}{
+		{uis.UnreachableNet, 0, 0},
+		{uis.UnreachableHost, 1, 3},
+		{uis.UnreachablePort, 3, 4},
+		{uis.UnreachableAdminProhibited, 13, 1},
+	}
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("ipv4/%d", tc.code4), func(t *testing.T) {
+			pkt := newTestIPv4Packet(dst4)
+			frame, ok := uis.NewUnreachableFrame(uis.VNICFrame{Packet: pkt}, tc.code, router4)
+			require.True(t, ok)
+			out := frame.Packet
+			require.Equal(t, router4.AsSlice(), out[12:16])
+			require.Equal(t, pkt[12:16], out[16:20])
+			require.Equal(t, byte(1), out[9])
+			require.Equal(t, byte(3), out[20])
+			require.Equal(t, tc.code4, out[21])
+			require.Equal(t, uint16(0), testChecksum(0, out[20:]))
+			require.Equal(t, pkt, out[28:])
+		})
+
+		t.Run(fmt.Sprintf("ipv6/%d", tc.code6), func(t *testing.T) {
+			pkt := newTestIPv6Packet(dst6)
+			copy(pkt[8:24], netip.MustParseAddr("2001:db8::2").AsSlice())
+			frame, ok := uis.NewUnreachableFrame(uis.VNICFrame{Packet: pkt}, tc.code, router6)
+			require.True(t, ok)
+			out := frame.Packet
+			require.Equal(t, router6.AsSlice(), out[8:24])
+			require.Equal(t, pkt[8:24], out[24:40])
+			require.Equal(t, byte(58), out[6])
+			require.Equal(t, byte(1), out[40])
+			require.Equal(t, tc.code6, out[41])
+			require.Equal(t, uint16(0), testICMPv6Checksum(out))
+			require.Equal(t, pkt, out[48:])
+		})
+	}
+
+	t.Run("defaults_to_destination_address", func(t *testing.T) {
+		frame, ok := uis.NewUnreachableFrame(
+			uis.VNICFrame{Packet: newTestIPv4Packet(dst4)}, uis.UnreachableHost, router6)
+		require.True(t, ok)
+		require.Equal(t, dst4.AsSlice(), frame.Packet[12:16])
+	})
+
+	t.Run("unspecified_source", func(t *testing.T) {
+		// newTestIPv6Packet uses the unspecified address as the source
+		_, ok := uis.NewUnreachableFrame(
+			uis.VNICFrame{Packet: newTestIPv6Packet(dst6)}, uis.UnreachableHost, router6)
+		require.False(t, ok)
+	})
+
+	t.Run("icmp_error", func(t *testing.T) {
+		frame, ok := uis.NewUnreachableFrame(
+			uis.VNICFrame{Packet: newTestIPv4Packet(dst4)}, uis.UnreachableHost, router4)
+		require.True(t, ok)
+		_, ok = uis.NewUnreachableFrame(frame, uis.UnreachableHost, router4)
+		require.False(t, ok)
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		_, ok := uis.NewUnreachableFrame(uis.VNICFrame{Packet: []byte{0x45}}, uis.UnreachableHost, router4)
+		require.False(t, ok)
+	})
+}
+
+func TestInternetOptionUnreachable(t *testing.T) {
+	cases := []struct {
+		name   string
+		code   uis.UnreachableCode
+		client string
+		target string
+		expect error
+	}{
+		{"ipv4_host", uis.UnreachableHost, "10.0.0.2", "10.0.0.9:80", syscall.EHOSTUNREACH},
+		{"ipv4_net", uis.UnreachableNet, "10.0.0.2", "10.0.0.9:80", syscall.ENETUNREACH},
+		{"ipv6_host", uis.UnreachableHost, "2001:db8::2", "[2001:db8::9]:80", syscall.EHOSTUNREACH},
+		{"ipv6_net", uis.UnreachableNet, "2001:db8::2", "[2001:db8::9]:80", syscall.ENETUNREACH},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ix := uis.NewInternet(uis.InternetOptionUnreachable(
+				tc.code,
+				netip.MustParseAddr("192.0.2.1"),
+				netip.MustParseAddr("2001:db8:ffff::1"),
+			))
+			client, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr(tc.client))
+			require.NoError(t, err)
+			t.Cleanup(client.Close)
+
+			// the ICMP errors flow through the policies like any other frame
+			var icmpErrors atomic.Int32
+			policy := uis.PacketPolicyFunc(func(frame uis.VNICFrame, fwd uis.PacketForwarder) {
+				if pkt, err := uis.ParsePacket(frame.Packet); err == nil {
+					if _, err := pkt.ICMPQuoted(); err == nil {
+						icmpErrors.Add(1)
+					}
+				}
+				fwd.Forward(frame)
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			go ix.Run(ctx, policy)
+
+			_, err = uis.NewConnector(client).DialContext(ctx, "tcp", tc.target)
+			require.Error(t, err)
+			assert.True(t, errors.Is(err, tc.expect), "%v", err)
+			require.NoError(t, ctx.Err())
+			require.Positive(t, icmpErrors.Load())
+		})
+	}
+}
@@ -0,0 +1,98 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"net"
+	"syscall"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+)
+
+// icmpConnWrapper wraps an ICMP [*gonet.UDPConn] to remap gVisor errors
+// and to use [*net.IPAddr] addresses like the stdlib "ip4:icmp" and
+// "ip6:ipv6-icmp" conns do. Reads return ICMP messages without the IP header.
+type icmpConnWrapper struct {
+	pconn *gonet.UDPConn
+}
+
+var (
+	_ net.Conn       = &icmpConnWrapper{}
+	_ net.PacketConn = &icmpConnWrapper{}
+)
+
+// Close implements [net.Conn] and [net.PacketConn].
+func (icw *icmpConnWrapper) Close() error {
+	return icw.pconn.Close()
+}
+
+// LocalAddr implements [net.Conn] and [net.PacketConn].
+func (icw *icmpConnWrapper) LocalAddr() net.Addr {
+	return icmpIPAddr(icw.pconn.LocalAddr())
+}
+
+// Read implements [net.Conn].
+func (icw *icmpConnWrapper) Read(buff []byte) (int, error) {
+	count, err := icw.pconn.Read(buff)
+	return count, errorsRemap(err)
+}
+
+// ReadFrom implements [net.PacketConn].
+func (icw *icmpConnWrapper) ReadFrom(buff []byte) (int, net.Addr, error) {
+	count, addr, err := icw.pconn.ReadFrom(buff)
+	return count, icmpIPAddr(addr), errorsRemap(err)
+}
+
+// RemoteAddr implements [net.Conn].
+func (icw *icmpConnWrapper) RemoteAddr() net.Addr {
+	return icmpIPAddr(icw.pconn.RemoteAddr())
+}
+
+// SetDeadline implements [net.Conn] and [net.PacketConn].
+func (icw *icmpConnWrapper) SetDeadline(t time.Time) error {
+	return icw.pconn.SetDeadline(t)
+}
+
+// SetReadDeadline implements [net.Conn] and [net.PacketConn].
+func (icw *icmpConnWrapper) SetReadDeadline(t time.Time) error {
+	return icw.pconn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements [net.Conn] and [net.PacketConn].
+func (icw *icmpConnWrapper) SetWriteDeadline(t time.Time) error {
+	return icw.pconn.SetWriteDeadline(t)
+}
+
+// Write implements [net.Conn].
+func (icw *icmpConnWrapper) Write(data []byte) (int, error) {
+	count, err := icw.pconn.Write(data)
+	return count, errorsRemap(err)
+}
+
+// WriteTo implements [net.PacketConn].
+func (icw *icmpConnWrapper) WriteTo(pkt []byte, addr net.Addr) (int, error) {
+	// 1. convert the address to the type that gonet expects
+	var udpAddr *net.UDPAddr
+	switch addr := addr.(type) {
+	case *net.IPAddr:
+		udpAddr = &net.UDPAddr{IP: addr.IP, Zone: addr.Zone}
+	case *net.UDPAddr:
+		udpAddr = addr
+	default:
+		return 0, &net.OpError{Op: "write", Net: "ip", Addr: addr, Err: syscall.EINVAL}
+	}
+
+	// 2. send the ICMP message
+	count, err := icw.pconn.WriteTo(pkt, udpAddr)
+	return count, errorsRemap(err)
+}
+
+// icmpIPAddr converts the [*net.UDPAddr] returned by gonet to a [*net.IPAddr].
+func icmpIPAddr(addr net.Addr) net.Addr {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || udpAddr == nil {
+		return addr
+	}
+	return &net.IPAddr{IP: udpAddr.IP, Zone: udpAddr.Zone}
+}
@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/require"
+)
+
+// icmpTestEchoRequest returns an ICMP echo request for the given family,
+// leaving the checksum and the identifier to the stack.
+func icmpTestEchoRequest(ipv6 bool, seq byte) []byte {
+	kind := byte(8)
+	if ipv6 {
+		kind = 128
+	}
+	return []byte{kind, 0, 0, 0, 0, 0, 0, seq, 'p', 'i', 'n', 'g'}
+}
+
+// icmpTestEchoReplyType returns the ICMP echo reply type for the given family.
+func icmpTestEchoReplyType(ipv6 bool) byte {
+	if ipv6 {
+		return 129
+	}
+	return 0
+}
+
+func TestICMPConn(t *testing.T) {
+	// create dual-stack client and server stacks, where the server
+	// stack automatically answers to ICMP echo requests
+	ix := uis.NewInternet()
+	client, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("2001:db8::2"))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	server, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2001:db8::1"))
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go ix.Run(ctx)
+
+	cases := []struct {
+		network string
+		local   string
+		remote  string
+		ipv6    bool
+	}{
+		{"ip4:icmp", "10.0.0.2", "10.0.0.1", false},
+		{"ip6:ipv6-icmp", "2001:db8::2", "2001:db8::1", true},
+	}
+
+	t.Run("DialContext", func(t *testing.T) {
+		for _, tc := range cases {
+			conn, err := uis.NewConnector(client).DialContext(ctx, tc.network, tc.remote)
+			require.NoError(t, err, tc.network)
+			defer conn.Close()
+			require.Equal(t, tc.remote, conn.RemoteAddr().String())
+			require.Equal(t, "ip", conn.RemoteAddr().Network())
+			require.IsType(t, &net.IPAddr{}, conn.LocalAddr())
+
+			_, err = conn.Write(icmpTestEchoRequest(tc.ipv6, 1))
+			require.NoError(t, err)
+			require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+			buffer := make([]byte, 1500)
+			count, err := conn.Read(buffer)
+			require.NoError(t, err, tc.network)
+			require.Equal(t, icmpTestEchoReplyType(tc.ipv6), buffer[0])
+			require.Equal(t, byte(1), buffer[7])
+			require.Equal(t, []byte("ping"), buffer[8:count])
+		}
+	})
+
+	t.Run("ListenPacket", func(t *testing.T) {
+		for _, tc := range cases {
+			pconn, err := uis.NewListenConfig(client).ListenPacket(ctx, tc.network, tc.local)
+			require.NoError(t, err, tc.network)
+			defer pconn.Close()
+			require.IsType(t, &net.IPAddr{}, pconn.LocalAddr())
+
+			remote := &net.IPAddr{IP: net.ParseIP(tc.remote)}
+			_, err = pconn.WriteTo(icmpTestEchoRequest(tc.ipv6, 2), remote)
+			require.NoError(t, err)
+			require.NoError(t, pconn.SetReadDeadline(time.Now().Add(5*time.Second)))
+			buffer := make([]byte, 1500)
+			count, addr, err := pconn.ReadFrom(buffer)
+			require.NoError(t, err, tc.network)
+			require.Equal(t, remote.String(), addr.String())
+			require.Equal(t, icmpTestEchoReplyType(tc.ipv6), buffer[0])
+			require.Equal(t, byte(2), buffer[7])
+			require.Equal(t, []byte("ping"), buffer[8:count])
+
+			_, err = pconn.WriteTo(icmpTestEchoRequest(tc.ipv6, 3), &net.TCPAddr{IP: remote.IP})
+			require.Error(t, err)
+		}
+	})
+}
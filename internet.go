@@ -3,15 +3,28 @@
 package uis
 
 import (
-	"fmt"
+	"context"
 	"net/netip"
+	"slices"
 	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
 )
 
 // Internet models the entire internet.
 //
 // Construct using [NewInternet].
 type Internet struct {
+	// clock is the clock shared by the stacks and the router.
+	clock tcpip.Clock
+
+	// flows is the OPTIONAL table tracking the delivered flows.
+	flows *FlowTable
+
+	// groups maps multicast groups to the [*VNIC] that joined them
+	// sorted by join time, which makes the delivery order deterministic.
+	groups map[netip.Addr][]*VNIC
+
 	// inflight is the channel receiving inflight packets.
 	inflight chan VNICFrame
 
@@ -19,7 +32,11 @@ type Internet struct {
 	mu sync.RWMutex
 
 	// routes contains the known routes.
-	routes map[netip.Addr]*VNIC
+	routes *routeTable
+
+	// unreachable is the OPTIONAL configuration for sending
+	// ICMP errors in response to unroutable packets.
+	unreachable *internetUnreachable
 }
 
 // InternetOption is an option for [NewInternet].
@@ -27,7 +44,17 @@ type InternetOption func(cfg *internetConfig)
 
 // internetConfig is the internal type modified by [InternetOption].
 type internetConfig struct {
+	clock       tcpip.Clock
+	flows       *FlowTable
 	maxInflight int
+	unreachable *internetUnreachable
+}
+
+// internetUnreachable configures sending ICMP errors for unroutable packets.
+type internetUnreachable struct {
+	code  UnreachableCode
+	from4 netip.Addr
+	from6 netip.Addr
 }
 
 // DefaultMaxInflight is the default maximum number of inflight packets.
@@ -43,19 +70,74 @@ func InternetOptionMaxInflight(max int) InternetOption {
 	}
 }
 
+// InternetOptionClock sets the [tcpip.Clock] shared by all the stacks
+// created using [*Internet.NewStack] and by the [*Router].
+//
+// The default is to use the wall clock. When using a [*VirtualClock],
+// call [*Router.Step] to advance the clock when the simulation is quiescent,
+// which allows to run timer-heavy tests in very little wall time.
+func InternetOptionClock(clock tcpip.Clock) InternetOption {
+	return func(cfg *internetConfig) {
+		cfg.clock = clock
+	}
+}
+
+// InternetOptionFlowTable attaches the given [*FlowTable] to the [*Internet]
+// such that [*Internet.Deliver] feeds it with every delivered frame.
+//
+// The default is not to track flows.
+func InternetOptionFlowTable(table *FlowTable) InternetOption {
+	return func(cfg *internetConfig) {
+		cfg.flows = table
+	}
+}
+
+// InternetOptionUnreachable enables sending ICMPv4 or ICMPv6 Destination
+// Unreachable messages using the given code back to the sender of packets
+// that [*Internet.Deliver] cannot route. The messages are in flight frames
+// (see [*Internet.InFlight]), thus they flow through the [PacketPolicy] chain.
+//
+// The from addresses are the OPTIONAL IPv4 and IPv6 source addresses of the
+// messages (e.g., the addresses of a simulated router). When missing, we use
+// the destination address of the unroutable packet.
+//
+// The default is to silently drop unroutable packets, which causes dialing
+// a nonexistent address to time out. With this option, dialing fails
+// immediately with, e.g., [syscall.EHOSTUNREACH] or [syscall.ENETUNREACH].
+func InternetOptionUnreachable(code UnreachableCode, from ...netip.Addr) InternetOption {
+	return func(cfg *internetConfig) {
+		cfg.unreachable = &internetUnreachable{code: code}
+		for _, addr := range from {
+			switch {
+			case addr.Is4() && !cfg.unreachable.from4.IsValid():
+				cfg.unreachable.from4 = addr
+			case addr.Is6() && !cfg.unreachable.from6.IsValid():
+				cfg.unreachable.from6 = addr
+			}
+		}
+	}
+}
+
 // NewInternet creates and returns a new [*Internet] instance.
 func NewInternet(options ...InternetOption) *Internet {
 	cfg := &internetConfig{
+		clock:       tcpip.NewStdClock(),
+		flows:       nil,
 		maxInflight: DefaultMaxInflight,
+		unreachable: nil,
 	}
 	for _, opt := range options {
 		opt(cfg)
 	}
 
 	return &Internet{
-		inflight: make(chan VNICFrame, cfg.maxInflight),
-		mu:       sync.RWMutex{},
-		routes:   make(map[netip.Addr]*VNIC),
+		clock:       cfg.clock,
+		flows:       cfg.flows,
+		groups:      make(map[netip.Addr][]*VNIC),
+		inflight:    make(chan VNICFrame, cfg.maxInflight),
+		mu:          sync.RWMutex{},
+		routes:      newRouteTable(),
+		unreachable: cfg.unreachable,
 	}
 }
 
@@ -68,24 +150,123 @@ func NewInternet(options ...InternetOption) *Internet {
 // - [MTUJumbo]
 //
 // This method internally invokes the [NewVNIC] factory func.
+//
+// The [*Internet] snoops the IGMP and MLD reports sent by the [*VNIC] to
+// know which multicast groups it has joined (see [*Internet.Deliver]).
 func (ix *Internet) NewVNIC(mtu uint32) *VNIC {
-	return NewVNIC(mtu, internetVNICNetwork{ix: ix})
+	network := &internetVNICNetwork{ix: ix, vnic: nil}
+	network.vnic = NewVNIC(mtu, network)
+	ix.watchVNIC(network.vnic)
+	return network.vnic
 }
 
 // AddRoute registers the given [*VNIC] to have the given addresses
 // such that it is possible to route packets to it.
 //
+// This method is equivalent to calling [*Internet.AddPrefixRoute] with
+// host-only prefixes (i.e., /32 for IPv4 and /128 for IPv6).
+//
 // This method fails if the claimed addresses are already in use.
 func (ix *Internet) AddRoute(vnic *VNIC, addrs ...netip.Addr) error {
+	return ix.AddPrefixRoute(vnic, internetAddrsToPrefixes(addrs...)...)
+}
+
+// AddPrefixRoute registers the given [*VNIC] to own the given IPv4/IPv6
+// prefixes such that it is possible to route packets to it.
+//
+// When routing, we select the route with the longest prefix matching the
+// destination address. Therefore, a single [*VNIC] can own an entire
+// subnet (e.g., 10.0.0.0/8) and you can register a default route (e.g.,
+// 0.0.0.0/0 and ::/0) toward a gateway stack, while more specific routes
+// still take precedence.
+//
+// Routes are automatically removed when the [*VNIC] is closed, which
+// happens, e.g., when you close the corresponding [*Stack].
+//
+// This method fails, without registering any route, if any of the
+// prefixes is invalid or has already been claimed.
+func (ix *Internet) AddPrefixRoute(vnic *VNIC, prefixes ...netip.Prefix) error {
+	ix.mu.Lock()
+	err := ix.routes.add(vnic, prefixes...)
+	ix.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	ix.watchVNIC(vnic)
+	return nil
+}
+
+// ReplaceRoute is like [*Internet.AddRoute] except that it re-homes
+// addresses already claimed by another [*VNIC] to the given [*VNIC].
+//
+// Use this method to simulate failover, IP mobility, and server migration.
+func (ix *Internet) ReplaceRoute(vnic *VNIC, addrs ...netip.Addr) error {
+	return ix.ReplacePrefixRoute(vnic, internetAddrsToPrefixes(addrs...)...)
+}
+
+// ReplacePrefixRoute is like [*Internet.AddPrefixRoute] except that it
+// re-homes prefixes already claimed by another [*VNIC] to the given [*VNIC].
+//
+// This method fails, without modifying any route, if any of the
+// prefixes is invalid.
+func (ix *Internet) ReplacePrefixRoute(vnic *VNIC, prefixes ...netip.Prefix) error {
+	ix.mu.Lock()
+	err := ix.routes.replace(vnic, prefixes...)
+	ix.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	ix.watchVNIC(vnic)
+	return nil
+}
+
+// RemoveRoute unregisters the given addresses previously registered
+// using either [*Internet.AddRoute] or [*Internet.ReplaceRoute].
+//
+// This method fails, without removing any route, if any of the
+// addresses is not currently routed.
+func (ix *Internet) RemoveRoute(addrs ...netip.Addr) error {
+	return ix.RemovePrefixRoute(internetAddrsToPrefixes(addrs...)...)
+}
+
+// RemovePrefixRoute unregisters the given prefixes previously registered
+// using either [*Internet.AddPrefixRoute] or [*Internet.ReplacePrefixRoute].
+//
+// This method fails, without removing any route, if any of the
+// prefixes is invalid or not currently routed.
+func (ix *Internet) RemovePrefixRoute(prefixes ...netip.Prefix) error {
 	ix.mu.Lock()
 	defer ix.mu.Unlock()
-	for _, addr := range addrs {
-		if _, found := ix.routes[addr]; found {
-			return fmt.Errorf("duplicate address detected: %s", addr.String())
+	return ix.routes.remove(prefixes...)
+}
+
+// watchVNIC ensures that we remove all the routes toward the given
+// [*VNIC] and its multicast memberships when it is closed. If the [*VNIC]
+// is already closed, this method removes them immediately.
+//
+// This method MUST be called without holding ix.mu since closing the
+// [*VNIC] invokes the hook while holding the [*VNIC] mutex.
+func (ix *Internet) watchVNIC(vnic *VNIC) {
+	cleanup := func() {
+		ix.mu.Lock()
+		ix.routes.removeVNIC(vnic)
+		for group := range ix.groups {
+			ix.leaveLocked(vnic, group)
 		}
-		ix.routes[addr] = vnic
+		ix.mu.Unlock()
+	}
+	if !vnic.addCloseHook(ix, cleanup) {
+		cleanup()
 	}
-	return nil
+}
+
+// internetAddrsToPrefixes converts addresses to host-only prefixes.
+func internetAddrsToPrefixes(addrs ...netip.Addr) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(addrs))
+	for _, addr := range addrs {
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes
 }
 
 // NewStack creates and attaches a [*Stack] to the [*Internet].
@@ -106,24 +287,59 @@ func (ix *Internet) AddRoute(vnic *VNIC, addrs ...netip.Addr) error {
 //
 // 3. [*Internet.AddrRoute] to create the return routes
 func (ix *Internet) NewStack(mtu uint32, addrs ...netip.Addr) (*Stack, error) {
+	return ix.NewStackWithOptions(mtu, addrs)
+}
+
+// NewStackWithOptions is like [*Internet.NewStack] but additionally
+// allows to specify options for [NewStackWithOptions].
+//
+// The created stack uses the [*Internet] clock (see [InternetOptionClock])
+// unless you override it using [StackOptionClock].
+func (ix *Internet) NewStackWithOptions(mtu uint32, addrs []netip.Addr, options ...StackOption) (*Stack, error) {
+	return ix.NewStackWithPrefixes(mtu, internetAddrsToPrefixes(addrs...), options...)
+}
+
+// NewStackWithPrefixes is like [*Internet.NewStackWithOptions] but configures
+// addresses along with the prefix length of their on-link subnet (e.g., 10.0.0.2/24)
+// using [NewStackWithPrefixes]. Use [StackOptionGateway] to configure gateways.
+//
+// The [*Internet] only routes the addresses toward the stack, not the whole
+// prefixes. Use [*Internet.AddPrefixRoute] to route entire subnets.
+func (ix *Internet) NewStackWithPrefixes(mtu uint32, prefixes []netip.Prefix, options ...StackOption) (*Stack, error) {
 	vnic := ix.NewVNIC(mtu)
-	stack := NewStack(vnic, addrs...)
+	options = append([]StackOption{StackOptionClock(ix.clock)}, options...)
+	stack := NewStackWithPrefixes(vnic, prefixes, options...)
+	addrs := make([]netip.Addr, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		addrs = append(addrs, prefix.Addr())
+	}
 	if err := ix.AddRoute(vnic, addrs...); err != nil {
 		return nil, err
 	}
 	return stack, nil
 }
 
+// Clock returns the [tcpip.Clock] used by the [*Internet].
+func (ix *Internet) Clock() tcpip.Clock {
+	return ix.clock
+}
+
 // internetVNICNetwork adapts the [*Internet] to be a [VNICNetwork].
 type internetVNICNetwork struct {
-	ix *Internet
+	ix   *Internet
+	vnic *VNIC
 }
 
-// Ensure that [internetVNICAdapter] implements [VNICNetwork].
-var _ VNICNetwork = internetVNICNetwork{}
+// Ensure that [*internetVNICNetwork] implements [VNICNetwork].
+var _ VNICNetwork = &internetVNICNetwork{}
 
 // SendFrame implements [VNICNetwork].
-func (n internetVNICNetwork) SendFrame(frame VNICFrame) bool {
+func (n *internetVNICNetwork) SendFrame(frame VNICFrame) bool {
+	// Note: we update the memberships before enqueuing, such that a
+	// stack that joined a group receives the traffic sent immediately
+	// afterwards, and regardless of the [PacketPolicy] in use.
+	n.ix.snoop(n.vnic, frame)
+	frame.sender = n.vnic
 	select {
 	case n.ix.inflight <- frame:
 		return true
@@ -132,64 +348,206 @@ func (n internetVNICNetwork) SendFrame(frame VNICFrame) bool {
 	}
 }
 
+// snoop updates the multicast memberships of the given [*VNIC] using
+// the IGMP or MLD report contained in the given frame, if any.
+func (ix *Internet) snoop(vnic *VNIC, frame VNICFrame) {
+	reports := multicastParseReport(frame.Packet)
+	if len(reports) <= 0 {
+		return
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for _, report := range reports {
+		switch {
+		case !report.group.IsMulticast():
+			// ignore malformed reports
+		case report.join:
+			if !slices.Contains(ix.groups[report.group], vnic) {
+				ix.groups[report.group] = append(ix.groups[report.group], vnic)
+			}
+		default:
+			ix.leaveLocked(vnic, report.group)
+		}
+	}
+}
+
+// leaveLocked removes the given [*VNIC] from the given multicast group.
+//
+// This method MUST be called while holding ix.mu.
+func (ix *Internet) leaveLocked(vnic *VNIC, group netip.Addr) {
+	ix.groups[group] = slices.DeleteFunc(ix.groups[group], func(value *VNIC) bool {
+		return value == vnic
+	})
+	if len(ix.groups[group]) <= 0 {
+		delete(ix.groups, group)
+	}
+}
+
 // InFlight returns the channel where the in flight [VNICFrame] are posted.
 func (ix *Internet) InFlight() <-chan VNICFrame {
 	return ix.inflight
 }
 
-// Deliver routes a frame to the appropriate host based on destination IP.
+// Run routes the packets in flight until the context is done, passing
+// each packet through the given chain of [PacketPolicy] before delivering
+// it to its destination.
+//
+// This method is equivalent to creating a [*Router] using [NewRouter]
+// along with [RouterOptionPolicy] and invoking [*Router.Run].
+func (ix *Internet) Run(ctx context.Context, policies ...PacketPolicy) {
+	NewRouter(ix, RouterOptionPolicy(policies...)).Run(ctx)
+}
+
+// Deliver routes a frame to the appropriate hosts based on destination IP.
 //
-// It parses the destination IP from the raw packet, looks up the registered
-// host for that address, and injects the frame into that host stack.
+// It parses the destination IP from the raw packet, looks up the host
+// registered with the longest prefix matching that address, and injects
+// the frame into that host stack.
+//
+// When the destination is a multicast group, this method injects the frame
+// into all the hosts that joined the group using IGMP or MLD, except the
+// sender. When the destination is the IPv4 limited broadcast address, the
+// IPv4 all-systems group, or the IPv6 all-nodes group, this method injects
+// the frame into all the hosts with routes of the same family, except
+// the sender. The sender is the [*VNIC] that sent the frame, which is only
+// known for frames read from [*Internet.InFlight] (see [VNICFrame]).
 //
 // Returns false if the destination IP cannot be parsed, is not routable
-// (no host registered for that address), or injection fails.
+// (no host registered for a matching prefix or no group members), or
+// injection fails for all the destination hosts.
+//
+// When the destination is not routable and you used [InternetOptionUnreachable],
+// this method also posts an ICMP Destination Unreachable message for the sender
+// to the in flight frames (see [*Internet.InFlight]), unless the destination is
+// a broadcast or multicast address.
+//
+// When you used [InternetOptionFlowTable], this method also updates
+// the [*FlowTable] using each successfully delivered frame.
 func (ix *Internet) Deliver(frame VNICFrame) bool {
-	// Parse the destination IP from the raw packet
-	dstIP, ok := internetParseDestinationIP(frame.Packet)
+	// Parse the source and destination IPs from the raw packet
+	_, dstIP, ok := internetParseAddrs(frame.Packet)
 	if !ok {
 		return false
 	}
 
-	// Look up the NIC for this destination
+	// Look up the NICs for this destination
 	ix.mu.RLock()
-	nic := ix.routes[dstIP]
+	nics := ix.lookupLocked(frame.sender, dstIP)
 	ix.mu.RUnlock()
 
-	// Drop if no route exists (including broadcast/multicast/unknown)
-	if nic == nil {
+	// Drop if no route exists
+	if len(nics) <= 0 {
+		if !internetIsBroadcastOrMulticast(dstIP) {
+			ix.sendUnreachable(frame, dstIP)
+		}
 		return false
 	}
 
-	// Inject the frame into the destination NIC
-	return nic.InjectFrame(frame)
+	// Inject the frame into the destination NICs
+	var delivered bool
+	for _, nic := range nics {
+		delivered = nic.InjectFrame(frame) || delivered
+	}
+	if !delivered {
+		return false
+	}
+
+	// Update the OPTIONAL flow table
+	if ix.flows != nil {
+		ix.flows.observe(frame, ix.clock.Now())
+	}
+	return true
+}
+
+// internetBroadcast4 is the IPv4 limited broadcast address.
+var internetBroadcast4 = netip.AddrFrom4([4]byte{255, 255, 255, 255})
+
+// internetIsBroadcastOrMulticast returns whether the given
+// address is a broadcast or multicast address.
+func internetIsBroadcastOrMulticast(addr netip.Addr) bool {
+	return addr == internetBroadcast4 || addr.IsMulticast()
+}
+
+// lookupLocked returns the NICs to which we should deliver a packet
+// sent by the OPTIONAL sender NIC to the dst address.
+//
+// This method MUST be called while holding ix.mu.
+func (ix *Internet) lookupLocked(sender *VNIC, dst netip.Addr) []*VNIC {
+	// 1. handle unicast destinations
+	if !internetIsBroadcastOrMulticast(dst) {
+		if nic := ix.routes.lookup(dst); nic != nil {
+			return []*VNIC{nic}
+		}
+		return nil
+	}
+
+	// 2. find the candidate NICs
+	var nics []*VNIC
+	switch dst {
+	case internetBroadcast4, multicastAllSystems4, multicastAllNodes6:
+		nics = ix.routes.vnics(dst.Is4())
+	default:
+		nics = slices.Clone(ix.groups[dst])
+	}
+
+	// 3. exclude the sender, since stacks loop back their own packets
+	return slices.DeleteFunc(nics, func(nic *VNIC) bool {
+		return nic == sender
+	})
+}
+
+// sendUnreachable delivers an ICMP Destination Unreachable message in response
+// to the given unroutable frame, if configured to do so.
+func (ix *Internet) sendUnreachable(frame VNICFrame, dstIP netip.Addr) {
+	if ix.unreachable == nil {
+		return
+	}
+	from := ix.unreachable.from6
+	if dstIP.Is4() {
+		from = ix.unreachable.from4
+	}
+	// Note: NewUnreachableFrame refuses to respond to ICMP errors, therefore
+	// there is no risk of looping if the sender is itself unroutable.
+	reply, ok := NewUnreachableFrame(frame, ix.unreachable.code, from)
+	if !ok {
+		return
+	}
+
+	// Note: we post the message in flight like any other frame, such that it
+	// flows through the [PacketPolicy] chain (e.g., link emulation and traces)
+	select {
+	case ix.inflight <- reply:
+	default:
+	}
 }
 
-// internetParseDestinationIP extracts the destination IP from a raw IP packet.
-func internetParseDestinationIP(pkt []byte) (netip.Addr, bool) {
+// internetParseAddrs extracts the source and destination IPs from a raw IP packet.
+func internetParseAddrs(pkt []byte) (src, dst netip.Addr, ok bool) {
 	if len(pkt) < 1 {
-		return netip.Addr{}, false
+		return netip.Addr{}, netip.Addr{}, false
 	}
 
 	version := pkt[0] >> 4
 	switch version {
 	case 4:
-		// IPv4: destination is at bytes 16-19
+		// IPv4: source is at bytes 12-15 and destination at bytes 16-19
 		if len(pkt) < 20 {
-			return netip.Addr{}, false
+			return netip.Addr{}, netip.Addr{}, false
 		}
-		addr, ok := netip.AddrFromSlice(pkt[16:20])
-		return addr, ok
+		src = netip.AddrFrom4([4]byte(pkt[12:16]))
+		dst = netip.AddrFrom4([4]byte(pkt[16:20]))
+		return src, dst, true
 
 	case 6:
-		// IPv6: destination is at bytes 24-39
+		// IPv6: source is at bytes 8-23 and destination at bytes 24-39
 		if len(pkt) < 40 {
-			return netip.Addr{}, false
+			return netip.Addr{}, netip.Addr{}, false
 		}
-		addr, ok := netip.AddrFromSlice(pkt[24:40])
-		return addr, ok
+		src = netip.AddrFrom16([16]byte(pkt[8:24]))
+		dst = netip.AddrFrom16([16]byte(pkt[24:40]))
+		return src, dst, true
 
 	default:
-		return netip.Addr{}, false
+		return netip.Addr{}, netip.Addr{}, false
 	}
 }
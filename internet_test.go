@@ -87,3 +87,206 @@ func TestInternetSendFrameReturnsFalseWhenFull(t *testing.T) {
 	require.True(t, err == nil)
 	require.Equal(t, 0, num)
 }
+
+func TestInternetAddPrefixRouteFailures(t *testing.T) {
+	t.Run("invalid_prefix", func(t *testing.T) {
+		ix := uis.NewInternet()
+		vnic := ix.NewVNIC(uis.MTUEthernet)
+		require.Error(t, ix.AddPrefixRoute(vnic, netip.Prefix{}))
+	})
+
+	t.Run("duplicate_prefix", func(t *testing.T) {
+		ix := uis.NewInternet()
+		vnic := ix.NewVNIC(uis.MTUEthernet)
+		require.NoError(t, ix.AddPrefixRoute(vnic, netip.MustParsePrefix("10.0.0.0/8")))
+		require.Error(t, ix.AddPrefixRoute(vnic, netip.MustParsePrefix("10.1.0.0/8")))
+	})
+
+	t.Run("duplicate_within_call", func(t *testing.T) {
+		ix := uis.NewInternet()
+		vnic := ix.NewVNIC(uis.MTUEthernet)
+		require.Error(t, ix.AddPrefixRoute(vnic,
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("10.0.0.0/8"),
+		))
+
+		// make sure that the failed call did not register anything
+		require.NoError(t, ix.AddPrefixRoute(vnic, netip.MustParsePrefix("10.0.0.0/8")))
+	})
+}
+
+// newTestIPv4Packet returns a minimal IPv4 header with the given destination.
+func newTestIPv4Packet(dst netip.Addr) []byte {
+	pkt := []byte{
+		0x45, 0x00, 0x00, 0x14,
+		0x00, 0x00, 0x00, 0x00,
+		0x40, 0x11, 0x00, 0x00,
+		0x0a, 0x00, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x00,
+	}
+	copy(pkt[16:20], dst.AsSlice())
+	return pkt
+}
+
+// newTestIPv6Packet returns a minimal IPv6 header with the given destination.
+func newTestIPv6Packet(dst netip.Addr) []byte {
+	pkt := make([]byte, 40)
+	pkt[0] = 0x60
+	pkt[6] = 0x11
+	pkt[7] = 0x40
+	copy(pkt[24:40], dst.AsSlice())
+	return pkt
+}
+
+func TestInternetDeliverLongestPrefixMatch(t *testing.T) {
+	ix := uis.NewInternet()
+
+	type entry struct {
+		prefixes []netip.Prefix
+		disp     *countingDispatcher
+		vnic     *uis.VNIC
+	}
+	entries := map[string]*entry{
+		"default": {prefixes: []netip.Prefix{
+			netip.MustParsePrefix("0.0.0.0/0"),
+			netip.MustParsePrefix("::/0"),
+		}},
+		"isp": {prefixes: []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("2001:db8::/32"),
+		}},
+		"cdn": {prefixes: []netip.Prefix{
+			netip.MustParsePrefix("10.1.0.0/16"),
+			netip.MustParsePrefix("2001:db8:1::/48"),
+		}},
+		"host": {prefixes: []netip.Prefix{
+			netip.MustParsePrefix("10.1.0.1/32"),
+			netip.MustParsePrefix("2001:db8:1::1/128"),
+		}},
+	}
+	for _, e := range entries {
+		e.disp = &countingDispatcher{}
+		e.vnic = ix.NewVNIC(uis.MTUEthernet)
+		e.vnic.Attach(e.disp)
+		require.NoError(t, ix.AddPrefixRoute(e.vnic, e.prefixes...))
+	}
+
+	cases := []struct {
+		dst    string
+		expect string
+	}{
+		{"8.8.8.8", "default"},
+		{"10.2.0.1", "isp"},
+		{"10.1.2.3", "cdn"},
+		{"10.1.0.1", "host"},
+		{"2001:4860::8888", "default"},
+		{"2001:db8:2::1", "isp"},
+		{"2001:db8:1::2", "cdn"},
+		{"2001:db8:1::1", "host"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.dst, func(t *testing.T) {
+			before := map[string]uint32{}
+			for name, e := range entries {
+				before[name] = e.disp.count.Load()
+			}
+
+			dst := netip.MustParseAddr(tc.dst)
+			pkt := newTestIPv6Packet(dst)
+			if dst.Is4() {
+				pkt = newTestIPv4Packet(dst)
+			}
+			require.True(t, ix.Deliver(uis.VNICFrame{Packet: pkt}))
+
+			for name, e := range entries {
+				expect := before[name]
+				if name == tc.expect {
+					expect++
+				}
+				require.Equal(t, expect, e.disp.count.Load(), name)
+			}
+		})
+	}
+}
+
+func TestInternetRemoveRoute(t *testing.T) {
+	ix := uis.NewInternet()
+	vnic := ix.NewVNIC(uis.MTUEthernet)
+	disp := &countingDispatcher{}
+	vnic.Attach(disp)
+	addr := netip.MustParseAddr("10.0.0.1")
+	pkt := newTestIPv4Packet(addr)
+
+	require.NoError(t, ix.AddRoute(vnic, addr))
+	require.True(t, ix.Deliver(uis.VNICFrame{Packet: pkt}))
+
+	require.NoError(t, ix.RemoveRoute(addr))
+	require.False(t, ix.Deliver(uis.VNICFrame{Packet: pkt}))
+	require.Equal(t, uint32(1), disp.count.Load())
+
+	// removing a route that does not exist fails
+	require.Error(t, ix.RemoveRoute(addr))
+	require.Error(t, ix.RemovePrefixRoute(netip.Prefix{}))
+
+	// the address can now be claimed again
+	require.NoError(t, ix.AddRoute(vnic, addr))
+}
+
+func TestInternetReplaceRoute(t *testing.T) {
+	ix := uis.NewInternet()
+	addr := netip.MustParseAddr("2001:db8::1")
+	pkt := newTestIPv6Packet(addr)
+
+	primary := ix.NewVNIC(uis.MTUEthernet)
+	primaryDisp := &countingDispatcher{}
+	primary.Attach(primaryDisp)
+	require.NoError(t, ix.AddRoute(primary, addr))
+
+	backup := ix.NewVNIC(uis.MTUEthernet)
+	backupDisp := &countingDispatcher{}
+	backup.Attach(backupDisp)
+	require.Error(t, ix.AddRoute(backup, addr))
+	require.NoError(t, ix.ReplaceRoute(backup, addr))
+
+	require.True(t, ix.Deliver(uis.VNICFrame{Packet: pkt}))
+	require.Zero(t, primaryDisp.count.Load())
+	require.Equal(t, uint32(1), backupDisp.count.Load())
+
+	// closing the old owner must not affect the re-homed address
+	primary.Close()
+	require.True(t, ix.Deliver(uis.VNICFrame{Packet: pkt}))
+	require.Equal(t, uint32(2), backupDisp.count.Load())
+
+	require.Error(t, ix.ReplacePrefixRoute(backup, netip.Prefix{}))
+}
+
+func TestInternetRoutesRemovedOnClose(t *testing.T) {
+	t.Run("vnic", func(t *testing.T) {
+		ix := uis.NewInternet()
+		vnic := ix.NewVNIC(uis.MTUEthernet)
+		vnic.Attach(&countingDispatcher{})
+		prefix := netip.MustParsePrefix("10.0.0.0/8")
+		require.NoError(t, ix.AddPrefixRoute(vnic, prefix))
+
+		vnic.Close()
+		require.False(t, ix.Deliver(uis.VNICFrame{Packet: newTestIPv4Packet(netip.MustParseAddr("10.0.0.1"))}))
+		require.Error(t, ix.RemovePrefixRoute(prefix))
+
+		// adding routes to an already closed VNIC is a no-op
+		require.NoError(t, ix.AddPrefixRoute(vnic, prefix))
+		require.Error(t, ix.RemovePrefixRoute(prefix))
+	})
+
+	t.Run("stack", func(t *testing.T) {
+		ix := uis.NewInternet()
+		addr := netip.MustParseAddr("10.0.0.1")
+
+		stack, err := ix.NewStack(uis.MTUEthernet, addr)
+		require.NoError(t, err)
+		stack.Close()
+
+		stack, err = ix.NewStack(uis.MTUEthernet, addr)
+		require.NoError(t, err)
+		t.Cleanup(stack.Close)
+	})
+}
@@ -0,0 +1,309 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"time"
+)
+
+// LinkConfig describes the one-way conditions of a network path.
+//
+// Use [*Router.AddLink] to apply a [LinkConfig] to a path. The zero
+// value describes an ideal path with no delay, loss, or rate limiting.
+type LinkConfig struct {
+	// Delay is the one-way propagation delay.
+	Delay time.Duration
+
+	// Jitter is the OPTIONAL model for the jitter added to Delay.
+	//
+	// Because each packet samples its own jitter, a nonzero jitter
+	// may cause packets to be delivered out of order.
+	Jitter LinkJitter
+
+	// Loss is the OPTIONAL model deciding which packets are lost.
+	Loss LinkLoss
+
+	// Bandwidth is the OPTIONAL path rate in bits per second.
+	//
+	// A zero value means that the rate is not limited.
+	Bandwidth uint64
+
+	// Burst is the OPTIONAL token bucket size in bytes.
+	//
+	// A zero value means that we use [DefaultLinkBurst].
+	Burst uint64
+
+	// QueueLimit is the OPTIONAL maximum time a packet may wait for
+	// tokens to become available. Packets that would wait longer are
+	// dropped, which models a tail-drop bottleneck queue.
+	//
+	// A zero value means that the queue is unlimited.
+	QueueLimit time.Duration
+
+	// MTU is the OPTIONAL maximum size in bytes of the IP packets
+	// traversing the link, which models a path MTU bottleneck.
+	//
+	// The link fragments larger IPv4 packets when the DF bit is clear.
+	// Otherwise, the link drops the packets and sends back an ICMPv4
+	// Fragmentation Needed or ICMPv6 Packet Too Big message.
+	//
+	// A zero value means that the packet size is not limited.
+	MTU uint32
+
+	// MTUBlackHole OPTIONALLY suppresses the ICMP messages sent when
+	// dropping packets larger than MTU, which models a path MTU
+	// discovery black hole (e.g., a firewall filtering ICMP).
+	MTUBlackHole bool
+
+	// RouterAddrs contains the OPTIONAL IPv4 and IPv6 addresses of the
+	// router at the link ingress, which we use as the source address
+	// of the ICMP messages. When missing, we use the destination
+	// address of the packet that caused the ICMP message.
+	RouterAddrs []netip.Addr
+}
+
+// DefaultLinkBurst is the default token bucket size in bytes.
+const DefaultLinkBurst = MTUEthernet
+
+// LinkJitter models the distribution of the jitter.
+//
+// The [*Router] only invokes this interface from the goroutine
+// running [*Router.Run], hence implementations do not need to
+// provide mutual exclusion for their internal state.
+type LinkJitter interface {
+	// Sample returns the jitter to add to a packet delay. The returned
+	// value may be negative, in which case the [*Router] clamps the
+	// resulting delay such that it is never negative.
+	Sample(rng *rand.Rand) time.Duration
+}
+
+// UniformJitter is a [LinkJitter] uniformly distributed within
+// the [-Max, +Max] interval.
+type UniformJitter struct {
+	Max time.Duration
+}
+
+var _ LinkJitter = UniformJitter{}
+
+// Sample implements [LinkJitter].
+func (j UniformJitter) Sample(rng *rand.Rand) time.Duration {
+	return time.Duration((rng.Float64()*2 - 1) * float64(j.Max))
+}
+
+// NormalJitter is a [LinkJitter] normally distributed with zero
+// mean and the given standard deviation.
+type NormalJitter struct {
+	Stddev time.Duration
+}
+
+var _ LinkJitter = NormalJitter{}
+
+// Sample implements [LinkJitter].
+func (j NormalJitter) Sample(rng *rand.Rand) time.Duration {
+	return time.Duration(rng.NormFloat64() * float64(j.Stddev))
+}
+
+// LinkLoss models packet losses.
+//
+// The [*Router] only invokes this interface from the goroutine
+// running [*Router.Run], hence implementations do not need to
+// provide mutual exclusion for their internal state.
+type LinkLoss interface {
+	// Drop returns whether to drop the current packet.
+	Drop(rng *rand.Rand) bool
+}
+
+// RandomLoss is a [LinkLoss] dropping each packet independently
+// with the given probability within the [0, 1] interval.
+type RandomLoss struct {
+	Probability float64
+}
+
+var _ LinkLoss = RandomLoss{}
+
+// Drop implements [LinkLoss].
+func (l RandomLoss) Drop(rng *rand.Rand) bool {
+	return rng.Float64() < l.Probability
+}
+
+// GilbertElliottLoss is a [LinkLoss] implementing the Gilbert-Elliott
+// two-state Markov model for bursty losses.
+//
+// The model starts in the good state. Before processing each packet, the
+// model moves from good to bad with probability P and from bad to good
+// with probability R. Then, it drops the packet with probability LossGood
+// in the good state and with probability LossBad in the bad state. With
+// LossGood equal to zero and LossBad equal to one, this model reduces to
+// the simple Gilbert model.
+//
+// This model is stateful: use distinct instances for distinct paths unless
+// you actually want the paths to share the same loss state.
+type GilbertElliottLoss struct {
+	// P is the probability of moving from the good to the bad state.
+	P float64
+
+	// R is the probability of moving from the bad to the good state.
+	R float64
+
+	// LossGood is the loss probability in the good state.
+	LossGood float64
+
+	// LossBad is the loss probability in the bad state.
+	LossBad float64
+
+	// bad indicates whether we're in the bad state.
+	bad bool
+}
+
+var _ LinkLoss = &GilbertElliottLoss{}
+
+// Drop implements [LinkLoss].
+func (l *GilbertElliottLoss) Drop(rng *rand.Rand) bool {
+	switch {
+	case l.bad && rng.Float64() < l.R:
+		l.bad = false
+	case !l.bad && rng.Float64() < l.P:
+		l.bad = true
+	}
+	if l.bad {
+		return rng.Float64() < l.LossBad
+	}
+	return rng.Float64() < l.LossGood
+}
+
+// routerLink is a [LinkConfig] applied to a (src, dst) path along with its state.
+type routerLink struct {
+	// config is the link configuration.
+	config LinkConfig
+
+	// dst is the destination prefix.
+	dst netip.Prefix
+
+	// last is the last time we updated the token bucket.
+	last time.Time
+
+	// src is the source prefix.
+	src netip.Prefix
+
+	// tokens is the number of bytes available in the token bucket, which
+	// becomes negative when packets are waiting for tokens.
+	tokens float64
+}
+
+// newRouterLink creates a new [*routerLink] with a full token bucket.
+func newRouterLink(src, dst netip.Prefix, config LinkConfig) *routerLink {
+	if config.Burst == 0 {
+		config.Burst = DefaultLinkBurst
+	}
+	return &routerLink{
+		config: config,
+		dst:    dst,
+		last:   time.Time{},
+		src:    src,
+		tokens: float64(config.Burst),
+	}
+}
+
+// matches returns whether the link applies to the given addresses.
+func (lnk *routerLink) matches(src, dst netip.Addr) bool {
+	return lnk.src.Contains(src) && lnk.dst.Contains(dst)
+}
+
+// specificity returns the number of bits used to match a packet.
+func (lnk *routerLink) specificity() int {
+	return lnk.src.Bits() + lnk.dst.Bits()
+}
+
+// fit enforces the link MTU on the given packet. It returns the packets
+// to send over the link (either the original packet or its fragments) and
+// the OPTIONAL ICMP message to send back to the sender.
+func (lnk *routerLink) fit(pkt []byte) (pkts [][]byte, reply []byte) {
+	// 1. handle the common case where the packet fits
+	mtu := int(lnk.config.MTU)
+	if mtu <= 0 || len(pkt) <= mtu {
+		return [][]byte{pkt}, nil
+	}
+
+	// 2. fragment IPv4 packets unless DF is set
+	var typ, code uint8
+	switch pkt[0] >> 4 {
+	case 4:
+		if _, ok := packetIPv4HeaderLength(pkt); !ok {
+			return nil, nil
+		}
+		if !packetIPv4DontFragment(pkt) {
+			frags, _ := packetFragmentIPv4(pkt, mtu)
+			return frags, nil
+		}
+		typ, code = packetICMPv4DstUnreachable, packetICMPv4FragmentationNeeded
+
+	case 6:
+		typ, code = packetICMPv6PacketTooBig, 0
+
+	default:
+		return nil, nil
+	}
+
+	// 3. drop the packet and possibly tell the sender
+	if lnk.config.MTUBlackHole {
+		return nil, nil
+	}
+	from := lnk.routerAddr(pkt[0]>>4 == 4)
+	if !from.IsValid() {
+		_, dst, ok := internetParseAddrs(pkt)
+		if !ok {
+			return nil, nil
+		}
+		from = dst
+	}
+	reply, _ = packetNewICMPError(from, typ, code, uint32(mtu), pkt)
+	return nil, reply
+}
+
+// routerAddr returns the configured router address of the given family.
+func (lnk *routerLink) routerAddr(is4 bool) netip.Addr {
+	for _, addr := range lnk.config.RouterAddrs {
+		if addr.Is4() == is4 {
+			return addr
+		}
+	}
+	return netip.Addr{}
+}
+
+// schedule decides the fate of a packet of the given size entering the
+// link at the given time. It returns the delay after which we should deliver
+// the packet and whether we should deliver the packet at all.
+func (lnk *routerLink) schedule(rng *rand.Rand, now time.Time, size int) (time.Duration, bool) {
+	// 1. apply the loss model
+	if lnk.config.Loss != nil && lnk.config.Loss.Drop(rng) {
+		return 0, false
+	}
+
+	// 2. compute the time spent waiting for the token bucket
+	var wait time.Duration
+	if lnk.config.Bandwidth > 0 {
+		rate := float64(lnk.config.Bandwidth) / 8 // bytes per second
+		if !lnk.last.IsZero() {
+			elapsed := now.Sub(lnk.last).Seconds()
+			lnk.tokens = min(float64(lnk.config.Burst), lnk.tokens+elapsed*rate)
+		}
+		lnk.last = now
+		tokens := lnk.tokens - float64(size)
+		if tokens < 0 {
+			wait = time.Duration(-tokens / rate * float64(time.Second))
+		}
+		if lnk.config.QueueLimit > 0 && wait > lnk.config.QueueLimit {
+			return 0, false
+		}
+		lnk.tokens = tokens
+	}
+
+	// 3. add propagation delay and jitter
+	delay := lnk.config.Delay
+	if lnk.config.Jitter != nil {
+		delay = max(0, delay+lnk.config.Jitter.Sample(rng))
+	}
+	return wait + delay, true
+}
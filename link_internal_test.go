@@ -0,0 +1,139 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouterLinkTokenBucket(t *testing.T) {
+	any4 := netip.MustParsePrefix("0.0.0.0/0")
+	rng := rand.New(rand.NewPCG(1, 2))
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("rate", func(t *testing.T) {
+		lnk := newRouterLink(any4, any4, LinkConfig{
+			Delay:     10 * time.Millisecond,
+			Bandwidth: 8000, // 1000 bytes per second
+			Burst:     1000,
+		})
+
+		// the first packet consumes the burst
+		delay, ok := lnk.schedule(rng, t0, 1000)
+		require.True(t, ok)
+		require.Equal(t, 10*time.Millisecond, delay)
+
+		// the second packet waits for the bucket to refill
+		delay, ok = lnk.schedule(rng, t0, 500)
+		require.True(t, ok)
+		require.Equal(t, 510*time.Millisecond, delay)
+
+		// the bucket refills over time
+		delay, ok = lnk.schedule(rng, t0.Add(2*time.Second), 1000)
+		require.True(t, ok)
+		require.Equal(t, 10*time.Millisecond, delay)
+	})
+
+	t.Run("queue_limit", func(t *testing.T) {
+		lnk := newRouterLink(any4, any4, LinkConfig{
+			Bandwidth:  8000, // 1000 bytes per second
+			Burst:      1000,
+			QueueLimit: 750 * time.Millisecond,
+		})
+
+		_, ok := lnk.schedule(rng, t0, 1000)
+		require.True(t, ok)
+		_, ok = lnk.schedule(rng, t0, 500)
+		require.True(t, ok)
+		_, ok = lnk.schedule(rng, t0, 500)
+		require.False(t, ok)
+	})
+}
+
+// newTestLinkPacket returns an IPv4 or IPv6 UDP packet of the given total size.
+func newTestLinkPacket(src, dst netip.Addr, size int) []byte {
+	if src.Is4() {
+		return packetNewIPv4(src, dst, 17, make([]byte, size-packetIPv4HeaderLen))
+	}
+	return packetNewIPv6(src, dst, 17, make([]byte, size-packetIPv6HeaderLen))
+}
+
+func TestRouterLinkFit(t *testing.T) {
+	any4 := netip.MustParsePrefix("0.0.0.0/0")
+	router4 := netip.MustParseAddr("192.0.2.1")
+	router6 := netip.MustParseAddr("2001:db8:ffff::1")
+	src4, dst4 := netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1")
+	src6, dst6 := netip.MustParseAddr("2001:db8::2"), netip.MustParseAddr("2001:db8::1")
+	config := LinkConfig{MTU: 1280, RouterAddrs: []netip.Addr{router4, router6}}
+
+	t.Run("fits", func(t *testing.T) {
+		lnk := newRouterLink(any4, any4, config)
+		pkt := newTestLinkPacket(src4, dst4, 1280)
+		pkts, reply := lnk.fit(pkt)
+		require.Equal(t, [][]byte{pkt}, pkts)
+		require.Nil(t, reply)
+	})
+
+	t.Run("ipv4_fragment", func(t *testing.T) {
+		lnk := newRouterLink(any4, any4, config)
+		pkt := newTestLinkPacket(src4, dst4, 3000)
+		pkts, reply := lnk.fit(pkt)
+		require.Nil(t, reply)
+		require.Len(t, pkts, 3)
+
+		var payload []byte
+		for idx, frag := range pkts {
+			require.LessOrEqual(t, len(frag), 1280)
+			require.Equal(t, uint16(0), packetChecksumFinish(packetChecksumAdd(0, frag[:20])))
+			flags := uint16(frag[6])<<8 | uint16(frag[7])
+			require.Equal(t, len(payload)/8, int(flags&0x1fff))
+			require.Equal(t, idx < len(pkts)-1, flags&0x2000 != 0)
+			payload = append(payload, frag[20:]...)
+		}
+		require.Equal(t, pkt[20:], payload)
+	})
+
+	t.Run("ipv4_fragmentation_needed", func(t *testing.T) {
+		lnk := newRouterLink(any4, any4, config)
+		pkt := newTestLinkPacket(src4, dst4, 1500)
+		pkt[6] |= 0x40 // set DF
+		packetUpdateIPv4Checksum(pkt)
+		pkts, reply := lnk.fit(pkt)
+		require.Empty(t, pkts)
+		require.NotNil(t, reply)
+		require.Equal(t, router4.AsSlice(), reply[12:16])
+		require.Equal(t, src4.AsSlice(), reply[16:20])
+		require.Equal(t, []byte{3, 4}, reply[20:22])
+		require.Equal(t, []byte{0, 0, 0x05, 0x00}, reply[24:28])
+	})
+
+	t.Run("ipv6_packet_too_big", func(t *testing.T) {
+		lnk := newRouterLink(any4, any4, config)
+		pkts, reply := lnk.fit(newTestLinkPacket(src6, dst6, 1500))
+		require.Empty(t, pkts)
+		require.NotNil(t, reply)
+		require.Equal(t, router6.AsSlice(), reply[8:24])
+		require.Equal(t, src6.AsSlice(), reply[24:40])
+		require.Equal(t, []byte{2, 0}, reply[40:42])
+		require.Equal(t, []byte{0, 0, 0x05, 0x00}, reply[44:48])
+	})
+
+	t.Run("black_hole", func(t *testing.T) {
+		config := config
+		config.MTUBlackHole = true
+		lnk := newRouterLink(any4, any4, config)
+		pkts, reply := lnk.fit(newTestLinkPacket(src6, dst6, 1500))
+		require.Empty(t, pkts)
+		require.Nil(t, reply)
+
+		// we still fragment IPv4 packets without DF
+		pkts, reply = lnk.fit(newTestLinkPacket(src4, dst4, 1500))
+		require.Len(t, pkts, 2)
+		require.Nil(t, reply)
+	})
+}
@@ -0,0 +1,79 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUniformJitter(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	jitter := uis.UniformJitter{Max: 10 * time.Millisecond}
+	for range 1024 {
+		value := jitter.Sample(rng)
+		require.GreaterOrEqual(t, value, -10*time.Millisecond)
+		require.LessOrEqual(t, value, 10*time.Millisecond)
+	}
+}
+
+func TestNormalJitter(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	jitter := uis.NormalJitter{Stddev: 10 * time.Millisecond}
+	var sum time.Duration
+	const count = 4096
+	for range count {
+		sum += jitter.Sample(rng)
+	}
+	mean := sum / count
+	require.Less(t, mean.Abs(), 2*time.Millisecond)
+}
+
+func TestRandomLoss(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 128 {
+		require.False(t, uis.RandomLoss{Probability: 0}.Drop(rng))
+		require.True(t, uis.RandomLoss{Probability: 1}.Drop(rng))
+	}
+}
+
+func TestGilbertElliottLoss(t *testing.T) {
+	t.Run("always_good", func(t *testing.T) {
+		rng := rand.New(rand.NewPCG(1, 2))
+		loss := &uis.GilbertElliottLoss{P: 0, R: 1, LossGood: 0, LossBad: 1}
+		for range 128 {
+			require.False(t, loss.Drop(rng))
+		}
+	})
+
+	t.Run("always_bad", func(t *testing.T) {
+		rng := rand.New(rand.NewPCG(1, 2))
+		loss := &uis.GilbertElliottLoss{P: 1, R: 0, LossGood: 0, LossBad: 1}
+		for range 128 {
+			require.True(t, loss.Drop(rng))
+		}
+	})
+
+	t.Run("bursty", func(t *testing.T) {
+		rng := rand.New(rand.NewPCG(1, 2))
+		loss := &uis.GilbertElliottLoss{P: 0.05, R: 0.5, LossGood: 0, LossBad: 1}
+		var drops, bursts int
+		var previous bool
+		for range 4096 {
+			dropped := loss.Drop(rng)
+			if dropped {
+				drops++
+				if previous {
+					bursts++
+				}
+			}
+			previous = dropped
+		}
+		require.Positive(t, drops)
+		require.Positive(t, bursts)
+	})
+}
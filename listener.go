@@ -9,7 +9,6 @@ package uis
 import (
 	"context"
 	"net"
-	"net/netip"
 	"syscall"
 
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
@@ -21,6 +20,8 @@ import (
 // The zero value is invalid. Construct using [NewListenConfig].
 //
 // Only IP literal endpoints are supported. Listening on a hostname will fail.
+// Like the stdlib, we fail if the address does not belong to the family of the
+// network (e.g., when listening using "tcp6" on an IPv4 address).
 type ListenConfig struct {
 	// stack is the uis stack to use.
 	stack *Stack
@@ -32,37 +33,64 @@ func NewListenConfig(stack *Stack) *ListenConfig {
 }
 
 // ListenPacket creates a listening packet conn.
+//
+// The network MUST be "udp", "udp4", "udp6", "ip4:icmp", or "ip6:ipv6-icmp". With
+// the raw ICMP networks, the address is an IP address (e.g., 10.0.0.1) and the conn
+// is a ping socket: it only sends echo requests and only receives the matching echo
+// replies (see [*Stack.ListenICMP]). Other networks cause [syscall.EPROTOTYPE].
+//
+// When the address is a multicast address (e.g., 224.0.0.251:5353), the
+// conn joins the corresponding group, like [net.ListenMulticastUDP] does,
+// which requires creating the stack using [StackOptionMulticast].
 func (lc *ListenConfig) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
-	// 1. reject networks different from udp
-	if network != "udp" {
+	// 1. reject networks different from udp and icmp
+	proto, family, err := networkParse(network)
+	if err != nil || proto == networkProtoTCP {
 		return nil, syscall.EPROTOTYPE
 	}
 
-	// 2. convert to [netip.AddrPort]
-	addrport, err := netip.ParseAddrPort(address)
+	// 2. handle the raw ICMP networks
+	if proto == networkProtoICMP {
+		addr, err := networkParseAddr(family, address)
+		if err != nil {
+			return nil, err
+		}
+		pconn, err := lc.stack.ListenICMP(addr)
+		if err != nil {
+			return nil, errorsRemap(err)
+		}
+		return &icmpConnWrapper{pconn}, nil
+	}
+
+	// 3. convert to [netip.AddrPort]
+	addrport, err := networkParseAddrPort(family, address)
 	if err != nil {
 		return nil, err
 	}
 
-	// 3. create a UDP connection
+	// 4. create a UDP connection
 	pconn, err := lc.stack.ListenUDP(addrport)
 	if err != nil {
 		return nil, errorsRemap(err)
 	}
 
-	// 4. wrap the connection to remap the errors
+	// 5. wrap the connection to remap the errors
 	return &packetConnWrapper{pconn}, nil
 }
 
 // Listen creates a listening TCP socket.
+//
+// The network MUST be "tcp", "tcp4", or "tcp6". Other networks
+// cause [syscall.EPROTOTYPE].
 func (lc *ListenConfig) Listen(ctx context.Context, network, address string) (net.Listener, error) {
 	// 1. reject networks different from tcp
-	if network != "tcp" {
+	proto, family, err := networkParse(network)
+	if err != nil || proto != networkProtoTCP {
 		return nil, syscall.EPROTOTYPE
 	}
 
 	// 2. convert to [netip.AddrPort]
-	addrport, err := netip.ParseAddrPort(address)
+	addrport, err := networkParseAddrPort(family, address)
 	if err != nil {
 		return nil, err
 	}
@@ -21,7 +21,7 @@ func TestListenConfigListenRejectsUnknownNetwork(t *testing.T) {
 	t.Cleanup(stack.Close)
 
 	listenCfg := uis.NewListenConfig(stack)
-	_, err := listenCfg.Listen(context.Background(), "tcp4", "10.0.0.1:80")
+	_, err := listenCfg.Listen(context.Background(), "udp", "10.0.0.1:80")
 	require.Error(t, err)
 	assert.True(t, errors.Is(err, syscall.EPROTOTYPE))
 }
@@ -42,7 +42,7 @@ func TestListenConfigListenPacketRejectsUnknownNetwork(t *testing.T) {
 	t.Cleanup(stack.Close)
 
 	listenCfg := uis.NewListenConfig(stack)
-	_, err := listenCfg.ListenPacket(context.Background(), "udp4", "10.0.0.1:53")
+	_, err := listenCfg.ListenPacket(context.Background(), "tcp", "10.0.0.1:53")
 	require.Error(t, err)
 	assert.True(t, errors.Is(err, syscall.EPROTOTYPE))
 }
@@ -57,6 +57,69 @@ func TestListenConfigListenPacketRejectsDomain(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestListenConfigWithFamilies(t *testing.T) {
+	vnic := uis.NewVNIC(uis.MTUEthernet, nil)
+	stack := uis.NewStack(vnic, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2001:db8::1"))
+	t.Cleanup(stack.Close)
+	listenCfg := uis.NewListenConfig(stack)
+
+	t.Run("Listen", func(t *testing.T) {
+		for _, tc := range []struct {
+			network string
+			address string
+			good    bool
+		}{
+			{"tcp4", "10.0.0.1:0", true},
+			{"tcp4", "[::ffff:10.0.0.1]:0", true},
+			{"tcp6", "[2001:db8::1]:0", true},
+			{"tcp4", "[2001:db8::1]:0", false},
+			{"tcp6", "10.0.0.1:0", false},
+		} {
+			listener, err := listenCfg.Listen(context.Background(), tc.network, tc.address)
+			if !tc.good {
+				var addrErr *net.AddrError
+				require.True(t, errors.As(err, &addrErr), tc.network, tc.address)
+				continue
+			}
+			require.NoError(t, err, tc.network, tc.address)
+			require.NoError(t, listener.Close())
+		}
+	})
+
+	t.Run("ListenPacket", func(t *testing.T) {
+		for _, tc := range []struct {
+			network string
+			address string
+			good    bool
+		}{
+			{"udp4", "10.0.0.1:0", true},
+			{"udp6", "[2001:db8::1]:0", true},
+			{"ip4:icmp", "10.0.0.1", true},
+			{"ip4:1", "10.0.0.1", true},
+			{"ip6:ipv6-icmp", "2001:db8::1", true},
+			{"ip6:58", "2001:db8::1", true},
+			{"udp4", "[2001:db8::1]:0", false},
+			{"udp6", "10.0.0.1:0", false},
+			{"ip4:icmp", "2001:db8::1", false},
+			{"ip6:ipv6-icmp", "10.0.0.1", false},
+		} {
+			pconn, err := listenCfg.ListenPacket(context.Background(), tc.network, tc.address)
+			if !tc.good {
+				var addrErr *net.AddrError
+				require.True(t, errors.As(err, &addrErr), tc.network, tc.address)
+				continue
+			}
+			require.NoError(t, err, tc.network, tc.address)
+			require.NoError(t, pconn.Close())
+		}
+
+		_, err := listenCfg.ListenPacket(context.Background(), "ip4:icmp", "10.0.0.1:0")
+		require.Error(t, err)
+		_, err = listenCfg.ListenPacket(context.Background(), "ip4:tcp", "10.0.0.1")
+		require.True(t, errors.Is(err, syscall.EPROTOTYPE))
+	})
+}
+
 func TestListenConfigListenAddressInUse(t *testing.T) {
 	vnic := uis.NewVNIC(uis.MTUEthernet, nil)
 	stack := uis.NewStack(vnic, netip.MustParseAddr("10.0.0.1"))
@@ -0,0 +1,175 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"encoding/binary"
+	"net/netip"
+)
+
+// IGMP message types (see RFC 2236 and RFC 3376).
+const (
+	multicastIGMPv1Report = 0x12
+	multicastIGMPv2Report = 0x16
+	multicastIGMPv2Leave  = 0x17
+	multicastIGMPv3Report = 0x22
+)
+
+// MLD message types (see RFC 2710 and RFC 3810).
+const (
+	multicastMLDv1Report = 131
+	multicastMLDv1Done   = 132
+	multicastMLDv2Report = 143
+)
+
+// multicastProtocolIGMP is the IGMP protocol number.
+const multicastProtocolIGMP = 2
+
+// multicastHopByHop is the IPv6 Hop-by-Hop Options extension header number,
+// which precedes MLD messages since they carry the Router Alert option.
+const multicastHopByHop = 0
+
+// Group record types (see RFC 3376 Sect. 4.2.12 and RFC 3810 Sect. 5.2.12).
+const (
+	multicastModeIsInclude   = 1
+	multicastModeIsExclude   = 2
+	multicastChangeToInclude = 3
+	multicastChangeToExclude = 4
+	multicastAllowNewSources = 5
+)
+
+// multicastAllSystems4 is the IPv4 all-systems group, which all hosts join
+// without sending IGMP reports (see RFC 2236 Sect. 6).
+var multicastAllSystems4 = netip.MustParseAddr("224.0.0.1")
+
+// multicastAllNodes6 is the IPv6 link-local all-nodes group, which all
+// nodes join without sending MLD reports (see RFC 2710 Sect. 5).
+var multicastAllNodes6 = netip.MustParseAddr("ff02::1")
+
+// multicastMembership is a membership change parsed from a report.
+type multicastMembership struct {
+	// group is the multicast group.
+	group netip.Addr
+
+	// join is true when joining and false when leaving.
+	join bool
+}
+
+// multicastParseReport returns the membership changes contained in the
+// given raw IP packet, or nil if it is not an IGMP or MLD report.
+//
+// We do not track the sources of source-specific memberships, therefore
+// we deliver all the traffic sent to a group to all its members.
+func multicastParseReport(pkt []byte) []multicastMembership {
+	proto, offset, ok := packetTransport(pkt)
+	if !ok {
+		return nil
+	}
+	switch {
+	case pkt[0]>>4 == 4 && proto == multicastProtocolIGMP:
+		return multicastParseIGMP(pkt[offset:])
+
+	case pkt[0]>>4 == 6 && proto == multicastHopByHop:
+		// skip the Hop-by-Hop header, whose length is in 8-byte units
+		// not including the first 8 bytes (see RFC 8200 Sect. 4.3)
+		if len(pkt) < offset+8 {
+			return nil
+		}
+		next := pkt[offset]
+		offset += (int(pkt[offset+1]) + 1) * 8
+		if next != ProtocolICMPv6 || len(pkt) < offset {
+			return nil
+		}
+		return multicastParseMLD(pkt[offset:])
+
+	case pkt[0]>>4 == 6 && proto == ProtocolICMPv6:
+		return multicastParseMLD(pkt[offset:])
+
+	default:
+		return nil
+	}
+}
+
+// multicastParseIGMP parses an IGMP message.
+func multicastParseIGMP(msg []byte) []multicastMembership {
+	if len(msg) < 8 {
+		return nil
+	}
+	switch msg[0] {
+	case multicastIGMPv1Report, multicastIGMPv2Report:
+		group := netip.AddrFrom4([4]byte(msg[4:8]))
+		return []multicastMembership{{group: group, join: true}}
+
+	case multicastIGMPv2Leave:
+		group := netip.AddrFrom4([4]byte(msg[4:8]))
+		return []multicastMembership{{group: group, join: false}}
+
+	case multicastIGMPv3Report:
+		return multicastParseRecords(msg[8:], int(binary.BigEndian.Uint16(msg[6:8])), 4)
+
+	default:
+		return nil
+	}
+}
+
+// multicastParseMLD parses an MLD message.
+func multicastParseMLD(msg []byte) []multicastMembership {
+	if len(msg) < 8 {
+		return nil
+	}
+	switch msg[0] {
+	case multicastMLDv1Report, multicastMLDv1Done:
+		if len(msg) < 24 {
+			return nil
+		}
+		group := netip.AddrFrom16([16]byte(msg[8:24]))
+		return []multicastMembership{{group: group, join: msg[0] == multicastMLDv1Report}}
+
+	case multicastMLDv2Report:
+		return multicastParseRecords(msg[8:], int(binary.BigEndian.Uint16(msg[6:8])), 16)
+
+	default:
+		return nil
+	}
+}
+
+// multicastParseRecords parses the group records of IGMPv3 and MLDv2 reports,
+// which only differ in the size of the addresses.
+//
+// Each record contains the type, the auxiliary data length in 4-byte units, the
+// number of sources, the group address, the sources, and the auxiliary data.
+func multicastParseRecords(data []byte, count, addrlen int) []multicastMembership {
+	var out []multicastMembership
+	for range count {
+		// 1. parse the fixed part of the record
+		if len(data) < 4+addrlen {
+			break
+		}
+		rtype := data[0]
+		auxlen := int(data[1]) * 4
+		nsources := int(binary.BigEndian.Uint16(data[2:4]))
+		group, _ := netip.AddrFromSlice(data[4 : 4+addrlen])
+		size := 4 + addrlen + nsources*addrlen + auxlen
+		if len(data) < size {
+			break
+		}
+		data = data[size:]
+
+		// 2. map the record to a membership change
+		switch rtype {
+		case multicastModeIsExclude, multicastChangeToExclude:
+			// excluding no sources means receiving from any source
+			out = append(out, multicastMembership{group: group, join: true})
+
+		case multicastModeIsInclude, multicastChangeToInclude:
+			// including no sources means leaving the group
+			out = append(out, multicastMembership{group: group, join: nsources > 0})
+
+		case multicastAllowNewSources:
+			if nsources > 0 {
+				out = append(out, multicastMembership{group: group, join: true})
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,125 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMulticastParseReport(t *testing.T) {
+	group4 := netip.MustParseAddr("224.0.0.251")
+	group6 := netip.MustParseAddr("ff02::fb")
+
+	// ipv4 returns an IPv4 packet with a Router Alert option carrying the given IGMP message.
+	ipv4 := func(msg ...byte) []byte {
+		pkt := []byte{
+			0x46, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00,
+			0x01, 0x02, 0x00, 0x00,
+			0x0a, 0x00, 0x00, 0x01,
+			0xe0, 0x00, 0x00, 0x16,
+			0x94, 0x04, 0x00, 0x00,
+		}
+		pkt = append(pkt, msg...)
+		pkt[3] = byte(len(pkt))
+		return pkt
+	}
+
+	// ipv6 returns an IPv6 packet with a Hop-by-Hop header carrying the given MLD message.
+	ipv6 := func(msg ...byte) []byte {
+		pkt := make([]byte, 40)
+		pkt[0] = 0x60
+		pkt[5] = byte(8 + len(msg))
+		pkt[7] = 1
+		pkt = append(pkt, 58, 0, 5, 2, 0, 0, 1, 0)
+		return append(pkt, msg...)
+	}
+
+	cases := []struct {
+		name   string
+		pkt    []byte
+		expect []multicastMembership
+	}{{
+		name:   "igmpv2_report",
+		pkt:    ipv4(append([]byte{0x16, 0, 0, 0}, group4.AsSlice()...)...),
+		expect: []multicastMembership{{group: group4, join: true}},
+	}, {
+		name:   "igmpv2_leave",
+		pkt:    ipv4(append([]byte{0x17, 0, 0, 0}, group4.AsSlice()...)...),
+		expect: []multicastMembership{{group: group4, join: false}},
+	}, {
+		name: "igmpv3_report",
+		pkt: ipv4(append(append(
+			[]byte{0x22, 0, 0, 0, 0, 0, 0, 2},
+			append([]byte{multicastChangeToExclude, 0, 0, 0}, group4.AsSlice()...)...),
+			append([]byte{multicastChangeToInclude, 0, 0, 0}, 239, 1, 1, 1)...)...),
+		expect: []multicastMembership{
+			{group: group4, join: true},
+			{group: netip.MustParseAddr("239.1.1.1"), join: false},
+		},
+	}, {
+		name:   "igmpv3_truncated",
+		pkt:    ipv4(append([]byte{0x22, 0, 0, 0, 0, 0, 0, 1, multicastChangeToExclude, 0, 0, 1}, group4.AsSlice()...)...),
+		expect: nil,
+	}, {
+		name:   "mldv1_report",
+		pkt:    ipv6(append([]byte{131, 0, 0, 0, 0, 0, 0, 0}, group6.AsSlice()...)...),
+		expect: []multicastMembership{{group: group6, join: true}},
+	}, {
+		name:   "mldv1_done",
+		pkt:    ipv6(append([]byte{132, 0, 0, 0, 0, 0, 0, 0}, group6.AsSlice()...)...),
+		expect: []multicastMembership{{group: group6, join: false}},
+	}, {
+		name: "mldv2_report",
+		pkt: ipv6(append(
+			[]byte{143, 0, 0, 0, 0, 0, 0, 1, multicastModeIsExclude, 0, 0, 0},
+			group6.AsSlice()...)...),
+		expect: []multicastMembership{{group: group6, join: true}},
+	}, {
+		name:   "not_a_report",
+		pkt:    ipv6(append([]byte{130, 0, 0, 0, 0, 0, 0, 0}, group6.AsSlice()...)...),
+		expect: nil,
+	}}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.Equal(t, tc.expect, multicastParseReport(tc.pkt))
+		})
+	}
+}
+
+func TestStackOptionMulticast(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			ix := NewInternet()
+			var options []StackOption
+			if enabled {
+				options = append(options, StackOptionMulticast())
+			}
+			addrs := []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2001:db8::1")}
+			sx, err := ix.NewStackWithOptions(MTUEthernet, addrs, options...)
+			require.NoError(t, err)
+			t.Cleanup(sx.Close)
+			pconn, err := sx.ListenUDP(netip.MustParseAddrPort("224.0.0.251:5353"))
+			require.NoError(t, err)
+			t.Cleanup(func() { pconn.Close() })
+
+			// the stack only sends reports when multicast is enabled
+			var reports int
+			timeout := time.After(200 * time.Millisecond)
+			for done := false; !done; {
+				select {
+				case frame := <-ix.InFlight():
+					reports += len(multicastParseReport(frame.Packet))
+				case <-timeout:
+					done = true
+				}
+			}
+			require.Equal(t, enabled, reports > 0)
+		})
+	}
+}
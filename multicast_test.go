@@ -0,0 +1,248 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestIGMPPacket returns an IPv4 packet containing an IGMPv2 message.
+func newTestIGMPPacket(src, group netip.Addr, msgType byte) []byte {
+	pkt := make([]byte, 28)
+	pkt[0] = 0x45
+	pkt[3] = 28
+	pkt[8] = 1
+	pkt[9] = 2
+	copy(pkt[12:16], src.AsSlice())
+	copy(pkt[16:20], group.AsSlice())
+	pkt[20] = msgType
+	copy(pkt[24:28], group.AsSlice())
+	return pkt
+}
+
+// newTestMLDPacket returns an IPv6 packet containing an MLDv1 message
+// preceded by a Hop-by-Hop header with the Router Alert option.
+func newTestMLDPacket(group netip.Addr, msgType byte) []byte {
+	pkt := make([]byte, 40+8+24)
+	pkt[0] = 0x60
+	pkt[5] = 32
+	pkt[6] = 0
+	pkt[7] = 1
+	copy(pkt[24:40], group.AsSlice())
+	copy(pkt[40:48], []byte{58, 0, 5, 2, 0, 0, 1, 0})
+	pkt[48] = msgType
+	copy(pkt[56:72], group.AsSlice())
+	return pkt
+}
+
+// multicastTestVNIC creates a [*uis.VNIC] owning the given address.
+func multicastTestVNIC(t *testing.T, ix *uis.Internet, addr netip.Addr) (*uis.VNIC, *countingDispatcher) {
+	vnic := ix.NewVNIC(uis.MTUEthernet)
+	disp := &countingDispatcher{}
+	vnic.Attach(disp)
+	require.NoError(t, ix.AddRoute(vnic, addr))
+	return vnic, disp
+}
+
+// multicastTestSend makes the given [*uis.VNIC] send the given packet.
+func multicastTestSend(t *testing.T, vnic *uis.VNIC, pkt []byte) {
+	pkts := makePacketList(pkt)
+	defer pkts.DecRef()
+	num, err := vnic.WritePackets(pkts)
+	require.True(t, err == nil)
+	require.Equal(t, 1, num)
+}
+
+// multicastTestDeliver makes the given [*uis.VNIC] send the given packet and
+// delivers the resulting in flight frame, discarding the previous ones.
+func multicastTestDeliver(t *testing.T, ix *uis.Internet, vnic *uis.VNIC, pkt []byte) bool {
+	multicastTestSend(t, vnic, pkt)
+	for {
+		select {
+		case frame := <-ix.InFlight():
+			if bytes.Equal(frame.Packet, pkt) {
+				return ix.Deliver(frame)
+			}
+		default:
+			t.Fatal("the packet is not in flight")
+			return false
+		}
+	}
+}
+
+func TestInternetMulticastMembership(t *testing.T) {
+	t.Run("ipv4", func(t *testing.T) {
+		ix := uis.NewInternet()
+		sender, senderDisp := multicastTestVNIC(t, ix, netip.MustParseAddr("10.0.0.1"))
+		member, memberDisp := multicastTestVNIC(t, ix, netip.MustParseAddr("10.0.0.2"))
+		other, otherDisp := multicastTestVNIC(t, ix, netip.MustParseAddr("10.0.0.3"))
+		group := netip.MustParseAddr("224.0.0.251")
+		pkt := newTestUDPPacket(netip.MustParseAddrPort("10.0.0.1:5353"),
+			netip.AddrPortFrom(group, 5353), []byte("query"))
+
+		// nobody has joined the group yet
+		require.False(t, multicastTestDeliver(t, ix, sender, pkt))
+
+		// the member and the sender join the group
+		multicastTestSend(t, member, newTestIGMPPacket(netip.MustParseAddr("10.0.0.2"), group, 0x16))
+		multicastTestSend(t, sender, newTestIGMPPacket(netip.MustParseAddr("10.0.0.1"), group, 0x16))
+		require.True(t, multicastTestDeliver(t, ix, sender, pkt))
+		require.Equal(t, uint32(1), memberDisp.count.Load())
+		require.Equal(t, uint32(0), senderDisp.count.Load())
+		require.Equal(t, uint32(0), otherDisp.count.Load())
+
+		// the member leaves the group
+		multicastTestSend(t, member, newTestIGMPPacket(netip.MustParseAddr("10.0.0.2"), group, 0x17))
+		require.False(t, multicastTestDeliver(t, ix, sender, pkt))
+		require.Equal(t, uint32(1), memberDisp.count.Load())
+
+		// closing the NIC also leaves the group
+		multicastTestSend(t, other, newTestIGMPPacket(netip.MustParseAddr("10.0.0.3"), group, 0x16))
+		require.True(t, multicastTestDeliver(t, ix, sender, pkt))
+		require.Equal(t, uint32(1), otherDisp.count.Load())
+		other.Close()
+		require.False(t, multicastTestDeliver(t, ix, sender, pkt))
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		ix := uis.NewInternet()
+		member, memberDisp := multicastTestVNIC(t, ix, netip.MustParseAddr("2001:db8::2"))
+		group := netip.MustParseAddr("ff02::fb")
+		pkt := newTestIPv6Packet(group)
+		require.False(t, ix.Deliver(uis.VNICFrame{Packet: pkt}))
+
+		multicastTestSend(t, member, newTestMLDPacket(group, 131))
+		require.True(t, ix.Deliver(uis.VNICFrame{Packet: pkt}))
+		require.Equal(t, uint32(1), memberDisp.count.Load())
+
+		multicastTestSend(t, member, newTestMLDPacket(group, 132))
+		require.False(t, ix.Deliver(uis.VNICFrame{Packet: pkt}))
+	})
+}
+
+func TestInternetBroadcast(t *testing.T) {
+	ix := uis.NewInternet(uis.InternetOptionUnreachable(uis.UnreachableHost))
+	sender, senderDisp := multicastTestVNIC(t, ix, netip.MustParseAddr("10.0.0.1"))
+	vnic4, disp4 := multicastTestVNIC(t, ix, netip.MustParseAddr("10.0.0.2"))
+	_, disp6 := multicastTestVNIC(t, ix, netip.MustParseAddr("2001:db8::2"))
+
+	// the limited broadcast reaches all the IPv4 hosts except the sender
+	broadcast := newTestUDPPacket(netip.MustParseAddrPort("10.0.0.1:68"),
+		netip.MustParseAddrPort("255.255.255.255:67"), []byte("discover"))
+	require.True(t, multicastTestDeliver(t, ix, sender, broadcast))
+	require.Equal(t, uint32(0), senderDisp.count.Load())
+	require.Equal(t, uint32(1), disp4.count.Load())
+	require.Equal(t, uint32(0), disp6.count.Load())
+
+	// so does the all-systems group, here sent by 10.0.0.2
+	require.True(t, multicastTestDeliver(t, ix, vnic4, newTestIPv4Packet(netip.MustParseAddr("224.0.0.1"))))
+	require.Equal(t, uint32(1), senderDisp.count.Load())
+	require.Equal(t, uint32(1), disp4.count.Load())
+	require.Equal(t, uint32(0), disp6.count.Load())
+
+	// we exclude the sending NIC regardless of the source address
+	spoofed := newTestUDPPacket(netip.MustParseAddrPort("10.0.0.2:68"),
+		netip.MustParseAddrPort("255.255.255.255:67"), []byte("spoofed"))
+	require.True(t, multicastTestDeliver(t, ix, sender, spoofed))
+	require.Equal(t, uint32(1), senderDisp.count.Load())
+	require.Equal(t, uint32(2), disp4.count.Load())
+
+	// the all-nodes group reaches all the IPv6 hosts when we do not know the sender
+	require.True(t, ix.Deliver(uis.VNICFrame{Packet: newTestIPv6Packet(netip.MustParseAddr("ff02::1"))}))
+	require.Equal(t, uint32(1), disp6.count.Load())
+
+	// we do not send ICMP errors for undeliverable multicast
+	require.False(t, ix.Deliver(uis.VNICFrame{Packet: newTestIPv4Packet(netip.MustParseAddr("239.1.1.1"))}))
+	require.Len(t, ix.InFlight(), 0)
+	require.Equal(t, uint32(1), senderDisp.count.Load())
+	require.Equal(t, uint32(2), disp4.count.Load())
+}
+
+func TestInternetMulticastWithStacks(t *testing.T) {
+	cases := []struct {
+		name   string
+		group  string
+		sender string
+		member string
+	}{
+		{"ipv4", "224.0.0.251:5353", "10.0.0.1", "10.0.0.2"},
+		{"ipv6", "[ff02::fb]:5353", "2001:db8::1", "2001:db8::2"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ix := uis.NewInternet()
+			sender, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr(tc.sender))
+			require.NoError(t, err)
+			t.Cleanup(sender.Close)
+			member, err := ix.NewStackWithOptions(uis.MTUEthernet,
+				[]netip.Addr{netip.MustParseAddr(tc.member)}, uis.StackOptionMulticast())
+			require.NoError(t, err)
+			t.Cleanup(member.Close)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			go ix.Run(ctx)
+
+			// listening on the group address joins the group
+			mconn, err := uis.NewListenConfig(member).ListenPacket(ctx, "udp", tc.group)
+			require.NoError(t, err)
+			t.Cleanup(func() { mconn.Close() })
+
+			sconn, err := uis.NewListenConfig(sender).ListenPacket(ctx, "udp",
+				netip.AddrPortFrom(netip.MustParseAddr(tc.sender), 0).String())
+			require.NoError(t, err)
+			t.Cleanup(func() { sconn.Close() })
+
+			group := net.UDPAddrFromAddrPort(netip.MustParseAddrPort(tc.group))
+			_, err = sconn.WriteTo([]byte("query"), group)
+			require.NoError(t, err)
+
+			buf := make([]byte, 64)
+			require.NoError(t, mconn.SetReadDeadline(time.Now().Add(5*time.Second)))
+			count, addr, err := mconn.ReadFrom(buf)
+			require.NoError(t, err)
+			require.Equal(t, "query", string(buf[:count]))
+			require.Equal(t, tc.sender, addr.(*net.UDPAddr).AddrPort().Addr().String())
+		})
+	}
+}
+
+func TestInternetBroadcastWithStacks(t *testing.T) {
+	ix := uis.NewInternet()
+	client, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.2"))
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	server, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.1"))
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go ix.Run(ctx)
+
+	sconn, err := uis.NewListenConfig(server).ListenPacket(ctx, "udp", "0.0.0.0:67")
+	require.NoError(t, err)
+	t.Cleanup(func() { sconn.Close() })
+
+	cconn, err := uis.NewListenConfig(client).ListenPacket(ctx, "udp", "10.0.0.2:68")
+	require.NoError(t, err)
+	t.Cleanup(func() { cconn.Close() })
+
+	_, err = cconn.WriteTo([]byte("discover"), &net.UDPAddr{IP: net.IPv4bcast, Port: 67})
+	require.NoError(t, err)
+
+	buf := make([]byte, 64)
+	require.NoError(t, sconn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	count, addr, err := sconn.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "discover", string(buf[:count]))
+	require.Equal(t, "10.0.0.2:68", addr.String())
+}
@@ -0,0 +1,523 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// NATBehavior describes how a [*NAT] creates mappings or filters
+// incoming packets (see RFC 4787 and RFC 5382).
+type NATBehavior int
+
+// Enumerate the supported [NATBehavior] values.
+const (
+	// NATEndpointIndependent reuses the same mapping for all the remote
+	// endpoints (when mapping) and accepts packets from any remote endpoint
+	// (when filtering). This is the behavior of a full-cone NAT.
+	NATEndpointIndependent NATBehavior = iota
+
+	// NATAddressDependent uses distinct mappings for distinct remote
+	// addresses (when mapping) and only accepts packets from remote
+	// addresses that the internal endpoint has contacted (when filtering).
+	NATAddressDependent
+
+	// NATAddressPortDependent uses distinct mappings for distinct remote
+	// endpoints (when mapping) and only accepts packets from remote endpoints
+	// that the internal endpoint has contacted (when filtering). When
+	// used for mapping, this is the behavior of a symmetric NAT.
+	NATAddressPortDependent
+)
+
+// Default [*NAT] mapping timeouts.
+const (
+	// DefaultNATUDPTimeout is the default UDP mapping timeout (see RFC 4787).
+	DefaultNATUDPTimeout = 5 * time.Minute
+
+	// DefaultNATTCPTimeout is the default TCP mapping timeout (see RFC 5382).
+	DefaultNATTCPTimeout = 2*time.Hour + 4*time.Minute
+)
+
+// NAT is a [PacketPolicy] modeling a network address and port translator
+// (e.g., a home router) connecting internal prefixes to the internet.
+//
+// The NAT translates the source address and port of TCP and UDP packets
+// sent by internal hosts to external hosts to the NAT public address and a
+// mapped port, and translates replies back, updating the checksums. ICMP
+// errors related to mapped flows are also translated back, which allows
+// path MTU discovery to work across the NAT.
+//
+// The NAT drops packets that would require a mapping it cannot create (e.g.,
+// ICMP echo requests and non-first IPv4 fragments), incoming packets for
+// which no mapping exists or that the filtering behavior rejects, and packets
+// sent by external hosts directly to internal addresses. The NAT forwards
+// unmodified the packets not involving internal hosts or the public address.
+//
+// Internal hosts are regular [*Stack] instances attached to the same
+// [*Internet] using addresses within the internal prefixes. There is
+// no need to add a route for the public address.
+//
+// Construct using [NewNAT].
+type NAT struct {
+	// clock is the clock used to expire mappings.
+	clock tcpip.Clock
+
+	// filtering is the filtering behavior.
+	filtering NATBehavior
+
+	// hairpinning indicates whether we support hairpinning.
+	hairpinning bool
+
+	// internal contains the internal prefixes.
+	internal []netip.Prefix
+
+	// mapping is the mapping behavior.
+	mapping NATBehavior
+
+	// mappings maps a flow to its mapping.
+	mappings map[natMappingKey]*natMapping
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// nextPort is the next external port to try.
+	nextPort uint16
+
+	// ports maps an external port to its mapping.
+	ports map[natPortKey]*natMapping
+
+	// public is the public address.
+	public netip.Addr
+
+	// tcpTimeout is the TCP mapping timeout.
+	tcpTimeout time.Duration
+
+	// udpTimeout is the UDP mapping timeout.
+	udpTimeout time.Duration
+}
+
+// NATOption is an option for [NewNAT].
+type NATOption func(cfg *natConfig)
+
+// natConfig is the internal type modified by [NATOption].
+type natConfig struct {
+	clock       tcpip.Clock
+	filtering   NATBehavior
+	hairpinning bool
+	mapping     NATBehavior
+	tcpTimeout  time.Duration
+	udpTimeout  time.Duration
+}
+
+// NATOptionClock sets the [tcpip.Clock] used to expire mappings.
+//
+// The default is to use the wall clock. Use the same clock used by the
+// [*Internet] (see [InternetOptionClock]) to expire mappings consistently
+// with the simulation time.
+func NATOptionClock(clock tcpip.Clock) NATOption {
+	return func(cfg *natConfig) {
+		cfg.clock = clock
+	}
+}
+
+// NATOptionMapping sets the mapping behavior.
+//
+// The default is [NATEndpointIndependent], as recommended by RFC 4787.
+func NATOptionMapping(behavior NATBehavior) NATOption {
+	return func(cfg *natConfig) {
+		cfg.mapping = behavior
+	}
+}
+
+// NATOptionFiltering sets the filtering behavior.
+//
+// The default is [NATAddressPortDependent].
+func NATOptionFiltering(behavior NATBehavior) NATOption {
+	return func(cfg *natConfig) {
+		cfg.filtering = behavior
+	}
+}
+
+// NATOptionHairpinning sets whether internal hosts can reach each other
+// using the public address and the mapped ports.
+//
+// The default is true, as required by RFC 4787.
+func NATOptionHairpinning(enabled bool) NATOption {
+	return func(cfg *natConfig) {
+		cfg.hairpinning = enabled
+	}
+}
+
+// NATOptionTCPTimeout sets the TCP mapping timeout.
+//
+// The default is [DefaultNATTCPTimeout]. Outgoing packets refresh the
+// timeout. A zero or negative value is silently ignored.
+func NATOptionTCPTimeout(timeout time.Duration) NATOption {
+	return func(cfg *natConfig) {
+		if timeout > 0 {
+			cfg.tcpTimeout = timeout
+		}
+	}
+}
+
+// NATOptionUDPTimeout sets the UDP mapping timeout.
+//
+// The default is [DefaultNATUDPTimeout]. Outgoing packets refresh the
+// timeout. A zero or negative value is silently ignored.
+func NATOptionUDPTimeout(timeout time.Duration) NATOption {
+	return func(cfg *natConfig) {
+		if timeout > 0 {
+			cfg.udpTimeout = timeout
+		}
+	}
+}
+
+// NewNAT creates a new [*NAT] translating packets sent by hosts within the
+// given internal prefixes to the given public address.
+//
+// Internal prefixes whose family differs from the public address family are
+// ignored. Invalid prefixes are ignored.
+func NewNAT(public netip.Addr, internal []netip.Prefix, options ...NATOption) *NAT {
+	cfg := &natConfig{
+		clock:       tcpip.NewStdClock(),
+		filtering:   NATAddressPortDependent,
+		hairpinning: true,
+		mapping:     NATEndpointIndependent,
+		tcpTimeout:  DefaultNATTCPTimeout,
+		udpTimeout:  DefaultNATUDPTimeout,
+	}
+	for _, opt := range options {
+		opt(cfg)
+	}
+
+	prefixes := []netip.Prefix{}
+	for _, prefix := range internal {
+		if prefix.IsValid() && prefix.Addr().Is4() == public.Is4() {
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+
+	return &NAT{
+		clock:       cfg.clock,
+		filtering:   cfg.filtering,
+		hairpinning: cfg.hairpinning,
+		internal:    prefixes,
+		mapping:     cfg.mapping,
+		mappings:    make(map[natMappingKey]*natMapping),
+		mu:          sync.Mutex{},
+		nextPort:    natFirstPort,
+		ports:       make(map[natPortKey]*natMapping),
+		public:      public,
+		tcpTimeout:  cfg.tcpTimeout,
+		udpTimeout:  cfg.udpTimeout,
+	}
+}
+
+// natFirstPort is the first port we use for mappings.
+const natFirstPort = 1024
+
+// natMappingKey is the key identifying a mapping.
+type natMappingKey struct {
+	// internal is the internal endpoint.
+	internal netip.AddrPort
+
+	// proto is the transport protocol.
+	proto uint8
+
+	// remote is the part of the remote endpoint that matters
+	// according to the mapping behavior.
+	remote netip.AddrPort
+}
+
+// natPortKey is the key identifying an external port.
+type natPortKey struct {
+	port  uint16
+	proto uint8
+}
+
+// natMapping is a mapping between an internal endpoint and an external port.
+type natMapping struct {
+	// expires is when the mapping expires.
+	expires time.Time
+
+	// external is the external port.
+	external uint16
+
+	// key is the key of the mapping.
+	key natMappingKey
+
+	// remoteAddrs contains the remote addresses contacted using the mapping.
+	remoteAddrs map[netip.Addr]struct{}
+
+	// remoteEndpoints contains the remote endpoints contacted using the mapping.
+	remoteEndpoints map[netip.AddrPort]struct{}
+}
+
+// Ensure that [*NAT] implements [PacketPolicy].
+var _ PacketPolicy = &NAT{}
+
+// HandleFrame implements [PacketPolicy].
+func (n *NAT) HandleFrame(frame VNICFrame, fwd PacketForwarder) {
+	// 1. parse the addresses
+	src, dst, ok := internetParseAddrs(frame.Packet)
+	if !ok || src.Is4() != n.public.Is4() {
+		fwd.Forward(frame)
+		return
+	}
+	fromInside, toInside := n.isInternal(src), n.isInternal(dst)
+
+	// 2. decide what to do
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch {
+	case fromInside && dst == n.public:
+		if n.hairpinning {
+			n.hairpin(frame, fwd)
+		}
+
+	case fromInside && !toInside:
+		n.outbound(frame, fwd)
+
+	case !fromInside && dst == n.public:
+		n.inbound(frame, fwd)
+
+	case !fromInside && toInside:
+		// external hosts cannot directly reach internal hosts
+
+	default:
+		fwd.Forward(frame)
+	}
+}
+
+// isInternal returns whether the given address is internal.
+func (n *NAT) isInternal(addr netip.Addr) bool {
+	return slices.ContainsFunc(n.internal, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+}
+
+// outbound translates a packet sent by an internal host.
+func (n *NAT) outbound(frame VNICFrame, fwd PacketForwarder) {
+	pkt, ok := natParse(frame)
+	if !ok {
+		return
+	}
+	ft := pkt.FiveTuple()
+	mapping, ok := n.mapOutbound(ft.Src, ft.Dst, ft.Protocol)
+	if !ok {
+		return
+	}
+	natSetSource(pkt, netip.AddrPortFrom(n.public, mapping.external))
+	fwd.Forward(pkt.Frame())
+}
+
+// inbound translates a packet sent by an external host to the public address.
+func (n *NAT) inbound(frame VNICFrame, fwd PacketForwarder) {
+	orig, err := frame.Parse()
+	if err != nil {
+		return
+	}
+	if orig.Protocol() == ProtocolICMPv4 || orig.Protocol() == ProtocolICMPv6 {
+		n.inboundICMPError(orig, fwd)
+		return
+	}
+	if !natTranslatable(orig) {
+		return
+	}
+	pkt, ft := orig.Clone(), orig.FiveTuple()
+	mapping, ok := n.mapInbound(ft.Src, ft.Dst.Port(), ft.Protocol)
+	if !ok {
+		return
+	}
+	natSetDestination(pkt, mapping.key.internal)
+	fwd.Forward(pkt.Frame())
+}
+
+// hairpin translates a packet sent by an internal host to the public address.
+func (n *NAT) hairpin(frame VNICFrame, fwd PacketForwarder) {
+	pkt, ok := natParse(frame)
+	if !ok {
+		return
+	}
+	ft := pkt.FiveTuple()
+	outMapping, ok := n.mapOutbound(ft.Src, ft.Dst, ft.Protocol)
+	if !ok {
+		return
+	}
+	external := netip.AddrPortFrom(n.public, outMapping.external)
+	inMapping, ok := n.mapInbound(external, ft.Dst.Port(), ft.Protocol)
+	if !ok {
+		return
+	}
+	natSetSource(pkt, external)
+	natSetDestination(pkt, inMapping.key.internal)
+	fwd.Forward(pkt.Frame())
+}
+
+// inboundICMPError translates an ICMP error related to a mapped flow.
+func (n *NAT) inboundICMPError(orig *Packet, fwd PacketForwarder) {
+	// 1. make sure this is an ICMP error quoting a packet we sent
+	pkt := orig.Clone()
+	inner, err := pkt.ICMPQuoted()
+	if err != nil || !natTranslatable(inner) || inner.Src() != n.public {
+		return
+	}
+	ft := inner.FiveTuple()
+
+	// 2. find the mapping and apply the filtering rules
+	mapping, ok := n.mapInbound(ft.Dst, ft.Src.Port(), ft.Protocol)
+	if !ok {
+		return
+	}
+
+	// 3. rewrite the quoted packet and the outer destination
+	natSetSource(inner, mapping.key.internal)
+	_ = pkt.SetDst(mapping.key.internal.Addr())
+	packetUpdateICMPChecksum(pkt.buf, pkt.transport)
+	fwd.Forward(pkt.Frame())
+}
+
+// mapOutbound finds or creates the mapping for an outgoing packet, refreshes
+// it, and records the remote endpoint. The caller MUST hold the mutex.
+func (n *NAT) mapOutbound(src, dst netip.AddrPort, proto uint8) (*natMapping, bool) {
+	// 1. compute the mapping key according to the mapping behavior
+	key := natMappingKey{internal: src, proto: proto, remote: netip.AddrPort{}}
+	switch n.mapping {
+	case NATAddressDependent:
+		key.remote = netip.AddrPortFrom(dst.Addr(), 0)
+	case NATAddressPortDependent:
+		key.remote = dst
+	}
+
+	// 2. reuse an existing mapping or create a new one
+	now := n.clock.Now()
+	mapping := n.mappings[key]
+	if mapping != nil && !now.Before(mapping.expires) {
+		n.expire(mapping)
+		mapping = nil
+	}
+	if mapping == nil {
+		port, ok := n.allocatePort(src.Port(), proto, now)
+		if !ok {
+			return nil, false
+		}
+		mapping = &natMapping{
+			expires:         time.Time{},
+			external:        port,
+			key:             key,
+			remoteAddrs:     make(map[netip.Addr]struct{}),
+			remoteEndpoints: make(map[netip.AddrPort]struct{}),
+		}
+		n.mappings[key] = mapping
+		n.ports[natPortKey{port: port, proto: proto}] = mapping
+	}
+
+	// 3. refresh the mapping and record the remote endpoint
+	mapping.expires = now.Add(n.timeout(proto))
+	mapping.remoteAddrs[dst.Addr()] = struct{}{}
+	mapping.remoteEndpoints[dst] = struct{}{}
+	return mapping, true
+}
+
+// mapInbound finds the mapping for an incoming packet sent by the given remote
+// endpoint to the given external port and applies the filtering rules. The
+// caller MUST hold the mutex.
+func (n *NAT) mapInbound(remote netip.AddrPort, port uint16, proto uint8) (*natMapping, bool) {
+	mapping := n.ports[natPortKey{port: port, proto: proto}]
+	if mapping == nil {
+		return nil, false
+	}
+	if !n.clock.Now().Before(mapping.expires) {
+		n.expire(mapping)
+		return nil, false
+	}
+	switch n.filtering {
+	case NATAddressDependent:
+		_, ok := mapping.remoteAddrs[remote.Addr()]
+		return mapping, ok
+	case NATAddressPortDependent:
+		_, ok := mapping.remoteEndpoints[remote]
+		return mapping, ok
+	default:
+		return mapping, true
+	}
+}
+
+// allocatePort allocates an external port, trying to preserve the
+// given internal port. The caller MUST hold the mutex.
+func (n *NAT) allocatePort(preferred uint16, proto uint8, now time.Time) (uint16, bool) {
+	if preferred >= natFirstPort && n.portAvailable(preferred, proto, now) {
+		return preferred, true
+	}
+	for range 65536 - natFirstPort {
+		port := n.nextPort
+		n.nextPort++
+		if n.nextPort < natFirstPort {
+			n.nextPort = natFirstPort
+		}
+		if n.portAvailable(port, proto, now) {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// portAvailable returns whether the given external port is available,
+// expiring its mapping if needed. The caller MUST hold the mutex.
+func (n *NAT) portAvailable(port uint16, proto uint8, now time.Time) bool {
+	mapping := n.ports[natPortKey{port: port, proto: proto}]
+	if mapping != nil && !now.Before(mapping.expires) {
+		n.expire(mapping)
+		mapping = nil
+	}
+	return mapping == nil
+}
+
+// expire removes the given mapping. The caller MUST hold the mutex.
+func (n *NAT) expire(mapping *natMapping) {
+	delete(n.mappings, mapping.key)
+	delete(n.ports, natPortKey{port: mapping.external, proto: mapping.key.proto})
+}
+
+// timeout returns the mapping timeout for the given protocol.
+func (n *NAT) timeout(proto uint8) time.Duration {
+	if proto == ProtocolTCP {
+		return n.tcpTimeout
+	}
+	return n.udpTimeout
+}
+
+// natParse parses a TCP or UDP packet and returns a [*Packet] referencing a copy
+// of the packet. This function returns false for other protocols, for non-first
+// fragments, and for malformed packets.
+func natParse(frame VNICFrame) (*Packet, bool) {
+	pkt, err := frame.Parse()
+	if err != nil || !natTranslatable(pkt) {
+		return nil, false
+	}
+	return pkt.Clone(), true
+}
+
+// natTranslatable returns whether the packet is a TCP or UDP packet with ports.
+func natTranslatable(pkt *Packet) bool {
+	return (pkt.Protocol() == ProtocolTCP || pkt.Protocol() == ProtocolUDP) && pkt.hasPorts()
+}
+
+// natSetSource replaces the source endpoint of a translatable packet. Since
+// the [*NAT] only handles packets of the public address family and with
+// ports, the mutators cannot fail and we can ignore their errors.
+func natSetSource(pkt *Packet, ap netip.AddrPort) {
+	_ = pkt.SetSrc(ap.Addr())
+	_ = pkt.SetSrcPort(ap.Port())
+}
+
+// natSetDestination is like natSetSource but for the destination endpoint.
+func natSetDestination(pkt *Packet, ap netip.AddrPort) {
+	_ = pkt.SetDst(ap.Addr())
+	_ = pkt.SetDstPort(ap.Port())
+}
@@ -0,0 +1,273 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestUDPPacket returns an IPv4 UDP packet with valid checksums.
+func newTestUDPPacket(src, dst netip.AddrPort, payload []byte) []byte {
+	pkt := make([]byte, 28+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = 17
+	copy(pkt[12:16], src.Addr().AsSlice())
+	copy(pkt[16:20], dst.Addr().AsSlice())
+	binary.BigEndian.PutUint16(pkt[10:12], testChecksum(0, pkt[:20]))
+	binary.BigEndian.PutUint16(pkt[20:22], src.Port())
+	binary.BigEndian.PutUint16(pkt[22:24], dst.Port())
+	binary.BigEndian.PutUint16(pkt[24:26], uint16(8+len(payload)))
+	copy(pkt[28:], payload)
+	binary.BigEndian.PutUint16(pkt[26:28], testUDPChecksum(pkt))
+	return pkt
+}
+
+// testUDPChecksum computes the UDP checksum of an IPv4 UDP packet, which
+// is zero when the packet already contains a valid checksum.
+func testUDPChecksum(pkt []byte) uint16 {
+	var sum uint32
+	for idx := 12; idx < 20; idx += 2 {
+		sum += uint32(binary.BigEndian.Uint16(pkt[idx:]))
+	}
+	sum += 17 + uint32(len(pkt)-20)
+	return testChecksum(sum, pkt[20:])
+}
+
+// testUDPEndpoints returns the endpoints of an IPv4 UDP packet.
+func testUDPEndpoints(pkt []byte) (netip.AddrPort, netip.AddrPort) {
+	src := netip.AddrFrom4([4]byte(pkt[12:16]))
+	dst := netip.AddrFrom4([4]byte(pkt[16:20]))
+	return netip.AddrPortFrom(src, binary.BigEndian.Uint16(pkt[20:22])),
+		netip.AddrPortFrom(dst, binary.BigEndian.Uint16(pkt[22:24]))
+}
+
+// natTestHandle passes the packet through the NAT and returns
+// the resulting packet or nil if the NAT dropped the packet.
+func natTestHandle(t *testing.T, nat *uis.NAT, pkt []byte) []byte {
+	fwd := &recordingForwarder{}
+	nat.HandleFrame(uis.VNICFrame{Packet: pkt}, fwd)
+	require.LessOrEqual(t, len(fwd.frames), 1)
+	if len(fwd.frames) <= 0 {
+		return nil
+	}
+	out := fwd.frames[0].Packet
+	require.Equal(t, uint16(0), testChecksum(0, out[:20]))
+	if out[9] == 17 {
+		require.Equal(t, uint16(0), testUDPChecksum(out))
+	}
+	return out
+}
+
+var (
+	natTestPublic   = netip.MustParseAddr("203.0.113.1")
+	natTestInternal = []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")}
+	natTestClient   = netip.MustParseAddrPort("192.168.1.2:5000")
+	natTestServer   = netip.MustParseAddrPort("8.8.8.8:53")
+)
+
+func TestNATOutbound(t *testing.T) {
+	t.Run("endpoint_independent_mapping", func(t *testing.T) {
+		nat := uis.NewNAT(natTestPublic, natTestInternal)
+		out := natTestHandle(t, nat, newTestUDPPacket(natTestClient, natTestServer, []byte("abc")))
+		require.NotNil(t, out)
+		src, dst := testUDPEndpoints(out)
+		require.Equal(t, netip.AddrPortFrom(natTestPublic, 5000), src)
+		require.Equal(t, natTestServer, dst)
+
+		other := netip.MustParseAddrPort("1.1.1.1:53")
+		out = natTestHandle(t, nat, newTestUDPPacket(natTestClient, other, []byte("abc")))
+		require.NotNil(t, out)
+		src2, _ := testUDPEndpoints(out)
+		require.Equal(t, src, src2)
+	})
+
+	t.Run("address_port_dependent_mapping", func(t *testing.T) {
+		nat := uis.NewNAT(natTestPublic, natTestInternal, uis.NATOptionMapping(uis.NATAddressPortDependent))
+		out := natTestHandle(t, nat, newTestUDPPacket(natTestClient, natTestServer, []byte("abc")))
+		require.NotNil(t, out)
+		src, _ := testUDPEndpoints(out)
+
+		other := netip.AddrPortFrom(natTestServer.Addr(), 54)
+		out = natTestHandle(t, nat, newTestUDPPacket(natTestClient, other, []byte("abc")))
+		require.NotNil(t, out)
+		src2, _ := testUDPEndpoints(out)
+		require.Equal(t, natTestPublic, src2.Addr())
+		require.NotEqual(t, src.Port(), src2.Port())
+	})
+
+	t.Run("unrelated_traffic", func(t *testing.T) {
+		nat := uis.NewNAT(natTestPublic, natTestInternal)
+		pkt := newTestUDPPacket(netip.MustParseAddrPort("10.0.0.1:1234"), natTestServer, nil)
+		require.Equal(t, pkt, natTestHandle(t, nat, pkt))
+	})
+
+	t.Run("unsupported_protocol", func(t *testing.T) {
+		nat := uis.NewNAT(natTestPublic, natTestInternal)
+		pkt := newTestUDPPacket(natTestClient, natTestServer, nil)
+		pkt[9] = 1 // ICMP
+		require.Nil(t, natTestHandle(t, nat, pkt))
+	})
+}
+
+func TestNATInbound(t *testing.T) {
+	cases := []struct {
+		name      string
+		filtering uis.NATBehavior
+		sameAddr  bool
+		otherAddr bool
+	}{
+		{"endpoint_independent_filtering", uis.NATEndpointIndependent, true, true},
+		{"address_dependent_filtering", uis.NATAddressDependent, true, false},
+		{"address_port_dependent_filtering", uis.NATAddressPortDependent, false, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			nat := uis.NewNAT(natTestPublic, natTestInternal, uis.NATOptionFiltering(tc.filtering))
+			external := netip.AddrPortFrom(natTestPublic, 5000)
+
+			// no mapping exists yet
+			require.Nil(t, natTestHandle(t, nat, newTestUDPPacket(natTestServer, external, nil)))
+
+			// create the mapping
+			require.NotNil(t, natTestHandle(t, nat, newTestUDPPacket(natTestClient, natTestServer, nil)))
+
+			// the reply is translated back
+			out := natTestHandle(t, nat, newTestUDPPacket(natTestServer, external, []byte("reply")))
+			require.NotNil(t, out)
+			src, dst := testUDPEndpoints(out)
+			require.Equal(t, natTestServer, src)
+			require.Equal(t, natTestClient, dst)
+
+			sameAddr := netip.AddrPortFrom(natTestServer.Addr(), 54)
+			out = natTestHandle(t, nat, newTestUDPPacket(sameAddr, external, nil))
+			require.Equal(t, tc.sameAddr, out != nil)
+
+			otherAddr := netip.MustParseAddrPort("9.9.9.9:53")
+			out = natTestHandle(t, nat, newTestUDPPacket(otherAddr, external, nil))
+			require.Equal(t, tc.otherAddr, out != nil)
+		})
+	}
+
+	t.Run("direct_to_internal", func(t *testing.T) {
+		nat := uis.NewNAT(natTestPublic, natTestInternal, uis.NATOptionFiltering(uis.NATEndpointIndependent))
+		require.Nil(t, natTestHandle(t, nat, newTestUDPPacket(natTestServer, natTestClient, nil)))
+	})
+
+	t.Run("icmp_error", func(t *testing.T) {
+		nat := uis.NewNAT(natTestPublic, natTestInternal)
+		out := natTestHandle(t, nat, newTestUDPPacket(natTestClient, natTestServer, []byte("abc")))
+		require.NotNil(t, out)
+
+		reply, ok := uis.NewUnreachableFrame(uis.VNICFrame{Packet: out}, uis.UnreachablePort, netip.Addr{})
+		require.True(t, ok)
+		in := natTestHandle(t, nat, reply.Packet)
+		require.NotNil(t, in)
+		require.Equal(t, natTestClient.Addr().AsSlice(), in[16:20])
+		require.Equal(t, uint16(0), testChecksum(0, in[20:]))
+		src, dst := testUDPEndpoints(in[28:])
+		require.Equal(t, natTestClient, src)
+		require.Equal(t, natTestServer, dst)
+	})
+}
+
+func TestNATTimeout(t *testing.T) {
+	clock := uis.NewVirtualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	nat := uis.NewNAT(natTestPublic, natTestInternal,
+		uis.NATOptionClock(clock), uis.NATOptionUDPTimeout(30*time.Second))
+	external := netip.AddrPortFrom(natTestPublic, 5000)
+
+	require.NotNil(t, natTestHandle(t, nat, newTestUDPPacket(natTestClient, natTestServer, nil)))
+	clock.Advance(20 * time.Second)
+	require.NotNil(t, natTestHandle(t, nat, newTestUDPPacket(natTestServer, external, nil)))
+
+	// incoming packets do not refresh the mapping
+	clock.Advance(20 * time.Second)
+	require.Nil(t, natTestHandle(t, nat, newTestUDPPacket(natTestServer, external, nil)))
+
+	// outgoing packets create a new mapping
+	require.NotNil(t, natTestHandle(t, nat, newTestUDPPacket(natTestClient, natTestServer, nil)))
+	clock.Advance(20 * time.Second)
+	require.NotNil(t, natTestHandle(t, nat, newTestUDPPacket(natTestClient, natTestServer, nil)))
+	clock.Advance(20 * time.Second)
+	require.NotNil(t, natTestHandle(t, nat, newTestUDPPacket(natTestServer, external, nil)))
+}
+
+func TestNATHairpinning(t *testing.T) {
+	peer := netip.MustParseAddrPort("192.168.1.3:6000")
+	external := netip.AddrPortFrom(natTestPublic, 5000)
+
+	t.Run("enabled", func(t *testing.T) {
+		nat := uis.NewNAT(natTestPublic, natTestInternal, uis.NATOptionFiltering(uis.NATEndpointIndependent))
+		require.NotNil(t, natTestHandle(t, nat, newTestUDPPacket(natTestClient, natTestServer, nil)))
+
+		out := natTestHandle(t, nat, newTestUDPPacket(peer, external, []byte("hello")))
+		require.NotNil(t, out)
+		src, dst := testUDPEndpoints(out)
+		require.Equal(t, netip.AddrPortFrom(natTestPublic, 6000), src)
+		require.Equal(t, natTestClient, dst)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		nat := uis.NewNAT(natTestPublic, natTestInternal,
+			uis.NATOptionFiltering(uis.NATEndpointIndependent), uis.NATOptionHairpinning(false))
+		require.NotNil(t, natTestHandle(t, nat, newTestUDPPacket(natTestClient, natTestServer, nil)))
+		require.Nil(t, natTestHandle(t, nat, newTestUDPPacket(peer, external, nil)))
+	})
+}
+
+func TestNATWithStacks(t *testing.T) {
+	ix := uis.NewInternet()
+	server, err := ix.NewStack(uis.MTUEthernet, natTestServer.Addr())
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	client, err := ix.NewStack(uis.MTUEthernet, natTestClient.Addr())
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go ix.Run(ctx, uis.NewNAT(natTestPublic, natTestInternal))
+
+	listener, err := uis.NewListenConfig(server).Listen(ctx, "tcp", "8.8.8.8:80")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	remote := make(chan net.Addr, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			remote <- nil
+			return
+		}
+		defer conn.Close()
+		remote <- conn.RemoteAddr()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	conn, err := uis.NewConnector(client).DialContext(ctx, "tcp", "8.8.8.8:80")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	addr := <-remote
+	require.NotNil(t, addr)
+	host, _, err := net.SplitHostPort(addr.String())
+	require.NoError(t, err)
+	require.Equal(t, natTestPublic.String(), host)
+}
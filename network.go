@@ -0,0 +1,145 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// networkFamily is the address family required by a network name.
+type networkFamily int
+
+const (
+	// networkFamilyAny allows both IPv4 and IPv6 (e.g., "tcp").
+	networkFamilyAny networkFamily = iota
+
+	// networkFamily4 requires IPv4 (e.g., "tcp4").
+	networkFamily4
+
+	// networkFamily6 requires IPv6 (e.g., "tcp6").
+	networkFamily6
+)
+
+// Enumerate the transport protocols returned by [networkParse].
+const (
+	networkProtoICMP = "icmp"
+	networkProtoTCP  = "tcp"
+	networkProtoUDP  = "udp"
+)
+
+// networkParse parses a stdlib network name and returns the transport protocol
+// and the required address family. We support "tcp", "tcp4", "tcp6", "udp", "udp4",
+// "udp6", and the raw ICMP networks, which are "ip4:icmp" (or "ip4:1") and
+// "ip6:ipv6-icmp" (or "ip6:58"). Other networks cause [syscall.EPROTOTYPE].
+func networkParse(network string) (string, networkFamily, error) {
+	switch network {
+	case "tcp":
+		return networkProtoTCP, networkFamilyAny, nil
+	case "tcp4":
+		return networkProtoTCP, networkFamily4, nil
+	case "tcp6":
+		return networkProtoTCP, networkFamily6, nil
+	case "udp":
+		return networkProtoUDP, networkFamilyAny, nil
+	case "udp4":
+		return networkProtoUDP, networkFamily4, nil
+	case "udp6":
+		return networkProtoUDP, networkFamily6, nil
+	case "ip4:icmp", "ip4:1":
+		return networkProtoICMP, networkFamily4, nil
+	case "ip6:ipv6-icmp", "ip6:58":
+		return networkProtoICMP, networkFamily6, nil
+	default:
+		return "", 0, syscall.EPROTOTYPE
+	}
+}
+
+// allows returns whether the family allows using the given address, where
+// IPv4-mapped IPv6 addresses count as IPv4 addresses like in the stdlib.
+func (family networkFamily) allows(addr netip.Addr) bool {
+	switch family {
+	case networkFamily4:
+		return addr.Unmap().Is4()
+	case networkFamily6:
+		return addr.Is6() && !addr.Is4In6()
+	default:
+		return true
+	}
+}
+
+// networkFamilyOf returns the family of the given address, where
+// IPv4-mapped IPv6 addresses count as IPv4 addresses.
+func networkFamilyOf(addr netip.Addr) networkFamily {
+	if addr.Unmap().Is4() {
+		return networkFamily4
+	}
+	return networkFamily6
+}
+
+// networkName returns the family-specific network name for the given
+// protocol and family (e.g., "tcp4" for TCP and IPv4), which is what
+// the stdlib passes to the [*net.Dialer] control functions.
+func networkName(proto string, family networkFamily) string {
+	switch {
+	case proto == networkProtoICMP && family == networkFamily6:
+		return "ip6:ipv6-icmp"
+	case proto == networkProtoICMP:
+		return "ip4:icmp"
+	case family == networkFamily6:
+		return proto + "6"
+	default:
+		return proto + "4"
+	}
+}
+
+// resolverNetwork returns the network to use with [Resolver].
+func (family networkFamily) resolverNetwork() string {
+	switch family {
+	case networkFamily4:
+		return "ip4"
+	case networkFamily6:
+		return "ip6"
+	default:
+		return "ip"
+	}
+}
+
+// networkNoSuitableAddress returns the error emitted by the stdlib when the
+// address does not belong to the family required by the network.
+func networkNoSuitableAddress(address string) error {
+	return &net.AddrError{Err: "no suitable address found", Addr: address}
+}
+
+// networkParseAddrPort parses an IP literal endpoint (e.g., 10.0.0.1:80) and makes
+// sure it belongs to the given family, unmapping IPv4-mapped IPv6 addresses for IPv4.
+func networkParseAddrPort(family networkFamily, address string) (netip.AddrPort, error) {
+	addrport, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if !family.allows(addrport.Addr()) {
+		return netip.AddrPort{}, networkNoSuitableAddress(address)
+	}
+	if family == networkFamily4 {
+		addrport = netip.AddrPortFrom(addrport.Addr().Unmap(), addrport.Port())
+	}
+	return addrport, nil
+}
+
+// networkParseAddr is like [networkParseAddrPort] but for IP literal addresses
+// (e.g., 10.0.0.1), which are the addresses used by the raw ICMP networks.
+func networkParseAddr(family networkFamily, address string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	if !family.allows(addr) {
+		return netip.Addr{}, networkNoSuitableAddress(address)
+	}
+	if family == networkFamily4 {
+		addr = addr.Unmap()
+	}
+	return addr, nil
+}
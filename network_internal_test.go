@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"errors"
+	"net/netip"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetworkParse(t *testing.T) {
+	cases := []struct {
+		network string
+		proto   string
+		family  networkFamily
+	}{
+		{"tcp", networkProtoTCP, networkFamilyAny},
+		{"tcp4", networkProtoTCP, networkFamily4},
+		{"tcp6", networkProtoTCP, networkFamily6},
+		{"udp", networkProtoUDP, networkFamilyAny},
+		{"udp4", networkProtoUDP, networkFamily4},
+		{"udp6", networkProtoUDP, networkFamily6},
+		{"ip4:icmp", networkProtoICMP, networkFamily4},
+		{"ip4:1", networkProtoICMP, networkFamily4},
+		{"ip6:ipv6-icmp", networkProtoICMP, networkFamily6},
+		{"ip6:58", networkProtoICMP, networkFamily6},
+	}
+	for _, tc := range cases {
+		proto, family, err := networkParse(tc.network)
+		require.NoError(t, err, tc.network)
+		require.Equal(t, tc.proto, proto, tc.network)
+		require.Equal(t, tc.family, family, tc.network)
+	}
+
+	for _, network := range []string{"", "unix", "ip", "ip:icmp", "ip4:tcp", "ip6:icmp", "TCP"} {
+		_, _, err := networkParse(network)
+		require.True(t, errors.Is(err, syscall.EPROTOTYPE), network)
+	}
+}
+
+func TestNetworkFamilyAllows(t *testing.T) {
+	ipv4 := netip.MustParseAddr("10.0.0.1")
+	mapped := netip.MustParseAddr("::ffff:10.0.0.1")
+	ipv6 := netip.MustParseAddr("2001:db8::1")
+
+	require.True(t, networkFamilyAny.allows(ipv4))
+	require.True(t, networkFamilyAny.allows(mapped))
+	require.True(t, networkFamilyAny.allows(ipv6))
+
+	require.True(t, networkFamily4.allows(ipv4))
+	require.True(t, networkFamily4.allows(mapped))
+	require.False(t, networkFamily4.allows(ipv6))
+
+	require.False(t, networkFamily6.allows(ipv4))
+	require.False(t, networkFamily6.allows(mapped))
+	require.True(t, networkFamily6.allows(ipv6))
+}
@@ -0,0 +1,818 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// Enumerate the IP protocol numbers we care about.
+const (
+	ProtocolICMPv4 = 1
+	ProtocolTCP    = 6
+	ProtocolUDP    = 17
+	ProtocolICMPv6 = 58
+)
+
+// Enumerate the ICMPv4 types we care about.
+const (
+	packetICMPv4EchoReply      = 0
+	packetICMPv4DstUnreachable = 3
+	packetICMPv4EchoRequest    = 8
+	packetICMPv4TimeExceeded   = 11
+)
+
+// packetICMPv4FragmentationNeeded is the Destination Unreachable code
+// indicating that fragmentation is needed but the DF bit is set.
+const packetICMPv4FragmentationNeeded = 4
+
+// Enumerate the ICMPv6 types we care about.
+const (
+	packetICMPv6DstUnreachable = 1
+	packetICMPv6PacketTooBig   = 2
+	packetICMPv6TimeExceeded   = 3
+)
+
+// packetIPv4HeaderLen is the length of the IPv4 headers we generate.
+const packetIPv4HeaderLen = 20
+
+// packetIPv6HeaderLen is the length of the IPv6 fixed header.
+const packetIPv6HeaderLen = 40
+
+// packetDefaultTTL is the TTL of the packets we generate.
+const packetDefaultTTL = 64
+
+// Enumerate the TCP flags.
+const (
+	TCPFlagFIN uint8 = 1 << iota
+	TCPFlagSYN
+	TCPFlagRST
+	TCPFlagPSH
+	TCPFlagACK
+	TCPFlagURG
+)
+
+// ErrMalformedPacket indicates that [ParsePacket] could not parse a packet.
+var ErrMalformedPacket = errors.New("malformed packet")
+
+// FiveTuple identifies the transport flow a packet belongs to.
+type FiveTuple struct {
+	// Dst is the destination endpoint.
+	Dst netip.AddrPort
+
+	// Protocol is the transport protocol (e.g., [ProtocolTCP]).
+	Protocol uint8
+
+	// Src is the source endpoint.
+	Src netip.AddrPort
+}
+
+// Reverse returns the [FiveTuple] of the packets flowing in the opposite direction.
+func (ft FiveTuple) Reverse() FiveTuple {
+	return FiveTuple{Dst: ft.Src, Protocol: ft.Protocol, Src: ft.Dst}
+}
+
+// Parse is a convenience method that calls [ParsePacket] with the frame packet.
+//
+// Unlike [ParsePacket], the returned [*Packet] remembers the [*VNIC] that sent
+// the frame, if any, such that [*Packet.Frame] preserves it.
+func (f VNICFrame) Parse() (*Packet, error) {
+	pkt, err := ParsePacket(f.Packet)
+	if err != nil {
+		return nil, err
+	}
+	pkt.sender = f.sender
+	return pkt, nil
+}
+
+// Packet is a zero-copy view of an IPv4 or IPv6 packet.
+//
+// The accessors return values and slices referencing the underlying packet,
+// which [*Packet] does not copy. The mutators modify the underlying packet in
+// place and incrementally update the IPv4 header checksum and the TCP, UDP, or
+// ICMPv6 checksum. Since a [PacketPolicy] MUST NOT modify the frames it receives,
+// use [*Packet.Clone] to obtain a private copy before using the mutators.
+//
+// We do not parse IPv6 extension headers, therefore [*Packet.Protocol] returns
+// the IPv6 Next Header, which may be an extension header. In such a case, the
+// packet has no transport header and its payload starts after the fixed header.
+//
+// Construct using [ParsePacket] or [VNICFrame.Parse].
+type Packet struct {
+	// buf is the packet truncated to the length in the IP header.
+	buf []byte
+
+	// dst is the destination address.
+	dst netip.Addr
+
+	// fragment indicates whether this is an IPv4 fragment.
+	fragment bool
+
+	// nonFirst indicates whether this is an IPv4 fragment other than the first.
+	nonFirst bool
+
+	// payload is the offset of the transport payload.
+	payload int
+
+	// proto is the transport protocol.
+	proto uint8
+
+	// sender is the OPTIONAL [*VNIC] that sent the packet (see [VNICFrame]).
+	sender *VNIC
+
+	// src is the source address.
+	src netip.Addr
+
+	// transport is the offset of the transport header.
+	transport int
+}
+
+// ParsePacket parses the given IPv4 or IPv6 packet without copying it.
+//
+// We parse the TCP, UDP, ICMPv4, and ICMPv6 headers of the packet, unless the
+// packet is a non-first fragment. This function returns an error wrapping
+// [ErrMalformedPacket] if the IP header or the transport header is truncated.
+func ParsePacket(pkt []byte) (*Packet, error) {
+	return packetParse(pkt, false)
+}
+
+// packetParse implements [ParsePacket]. When lenient is true, we accept truncated
+// packets, which is useful to parse the packet quoted by ICMP error messages.
+func packetParse(pkt []byte, lenient bool) (*Packet, error) {
+	// 1. parse the IP header
+	proto, transport, ok := packetTransport(pkt)
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid or truncated IP header", ErrMalformedPacket)
+	}
+	src, dst, _ := internetParseAddrs(pkt)
+	p := &Packet{
+		buf:       pkt,
+		dst:       dst,
+		fragment:  false,
+		nonFirst:  false,
+		payload:   transport,
+		proto:     proto,
+		sender:    nil,
+		src:       src,
+		transport: transport,
+	}
+	total := packetIPv6HeaderLen + int(binary.BigEndian.Uint16(pkt[4:6]))
+	if src.Is4() {
+		total = int(binary.BigEndian.Uint16(pkt[2:4]))
+		flags := binary.BigEndian.Uint16(pkt[6:8])
+		p.fragment = flags&0x3fff != 0
+		p.nonFirst = flags&0x1fff != 0
+	}
+
+	// 2. honour the length in the IP header
+	switch {
+	case total < transport:
+		return nil, fmt.Errorf("%w: invalid IP total length", ErrMalformedPacket)
+	case total > len(pkt) && !lenient:
+		return nil, fmt.Errorf("%w: truncated IP payload", ErrMalformedPacket)
+	case total < len(pkt):
+		p.buf = pkt[:total]
+	}
+
+	// 3. parse the transport header
+	if p.nonFirst {
+		return p, nil
+	}
+	hlen := 0
+	switch proto {
+	case ProtocolTCP:
+		hlen = 20
+		if len(p.buf) > transport+12 {
+			hlen = int(p.buf[transport+12]>>4) * 4
+		}
+		if hlen < 20 {
+			return nil, fmt.Errorf("%w: invalid TCP data offset", ErrMalformedPacket)
+		}
+	case ProtocolUDP, ProtocolICMPv4, ProtocolICMPv6:
+		hlen = 8
+	}
+	if len(p.buf) < transport+hlen {
+		if !lenient {
+			return nil, fmt.Errorf("%w: truncated transport header", ErrMalformedPacket)
+		}
+		hlen = len(p.buf) - transport
+	}
+	p.payload = transport + hlen
+	return p, nil
+}
+
+// Bytes returns the underlying packet.
+func (p *Packet) Bytes() []byte {
+	return p.buf
+}
+
+// Frame returns a [VNICFrame] containing the underlying packet, which
+// remembers the sender of the frame parsed using [VNICFrame.Parse].
+func (p *Packet) Frame() VNICFrame {
+	return VNICFrame{Packet: p.buf, sender: p.sender}
+}
+
+// Clone returns a [*Packet] referencing a copy of the underlying packet.
+func (p *Packet) Clone() *Packet {
+	c := *p
+	c.buf = slices.Clone(p.buf)
+	return &c
+}
+
+// Version returns the IP version (i.e., 4 or 6).
+func (p *Packet) Version() int {
+	return int(p.buf[0] >> 4)
+}
+
+// Src returns the source address.
+func (p *Packet) Src() netip.Addr {
+	return p.src
+}
+
+// Dst returns the destination address.
+func (p *Packet) Dst() netip.Addr {
+	return p.dst
+}
+
+// TTL returns the IPv4 TTL or the IPv6 Hop Limit.
+func (p *Packet) TTL() uint8 {
+	if p.src.Is4() {
+		return p.buf[8]
+	}
+	return p.buf[7]
+}
+
+// Protocol returns the transport protocol (e.g., [ProtocolTCP]).
+func (p *Packet) Protocol() uint8 {
+	return p.proto
+}
+
+// IsFragment returns whether the packet is an IPv4 fragment.
+func (p *Packet) IsFragment() bool {
+	return p.fragment
+}
+
+// NetworkHeader returns the IP header, including IPv4 options.
+func (p *Packet) NetworkHeader() []byte {
+	return p.buf[:p.transport]
+}
+
+// TransportHeader returns the TCP, UDP, ICMPv4, or ICMPv6 header or nil
+// when the packet is a non-first fragment or uses another protocol.
+func (p *Packet) TransportHeader() []byte {
+	if p.payload <= p.transport {
+		return nil
+	}
+	return p.buf[p.transport:p.payload]
+}
+
+// Payload returns the bytes following the transport header. For ICMP error
+// messages, the payload is the quoted packet (see [*Packet.ICMPQuoted]).
+func (p *Packet) Payload() []byte {
+	return p.buf[p.payload:]
+}
+
+// hasPorts returns whether the packet has a transport header containing ports.
+func (p *Packet) hasPorts() bool {
+	return (p.proto == ProtocolTCP || p.proto == ProtocolUDP) && p.payload-p.transport >= 4
+}
+
+// SrcPort returns the TCP or UDP source port or zero.
+func (p *Packet) SrcPort() uint16 {
+	if !p.hasPorts() {
+		return 0
+	}
+	return binary.BigEndian.Uint16(p.buf[p.transport:])
+}
+
+// DstPort returns the TCP or UDP destination port or zero.
+func (p *Packet) DstPort() uint16 {
+	if !p.hasPorts() {
+		return 0
+	}
+	return binary.BigEndian.Uint16(p.buf[p.transport+2:])
+}
+
+// FiveTuple returns the [FiveTuple] of the packet. The ports are zero
+// when the packet is a non-first fragment or is not TCP or UDP.
+func (p *Packet) FiveTuple() FiveTuple {
+	return FiveTuple{
+		Dst:      netip.AddrPortFrom(p.dst, p.DstPort()),
+		Protocol: p.proto,
+		Src:      netip.AddrPortFrom(p.src, p.SrcPort()),
+	}
+}
+
+// tcpHeader returns the TCP header or nil.
+func (p *Packet) tcpHeader() []byte {
+	if p.proto != ProtocolTCP || p.payload-p.transport < 20 {
+		return nil
+	}
+	return p.buf[p.transport:p.payload]
+}
+
+// tcpSegmentLength returns the TCP segment length (i.e., the payload
+// length plus one for the SYN flag and plus one for the FIN flag).
+func (p *Packet) tcpSegmentLength() uint32 {
+	length := uint32(len(p.Payload()))
+	if p.TCPFlags()&TCPFlagSYN != 0 {
+		length++
+	}
+	if p.TCPFlags()&TCPFlagFIN != 0 {
+		length++
+	}
+	return length
+}
+
+// TCPFlags returns the TCP flags (e.g., [TCPFlagSYN]) or zero.
+func (p *Packet) TCPFlags() uint8 {
+	if tcp := p.tcpHeader(); tcp != nil {
+		return tcp[13]
+	}
+	return 0
+}
+
+// TCPSeq returns the TCP sequence number or zero.
+func (p *Packet) TCPSeq() uint32 {
+	if tcp := p.tcpHeader(); tcp != nil {
+		return binary.BigEndian.Uint32(tcp[4:8])
+	}
+	return 0
+}
+
+// TCPAck returns the TCP acknowledgement number or zero.
+func (p *Packet) TCPAck() uint32 {
+	if tcp := p.tcpHeader(); tcp != nil {
+		return binary.BigEndian.Uint32(tcp[8:12])
+	}
+	return 0
+}
+
+// isICMP returns whether the packet has an ICMPv4 or ICMPv6 header.
+func (p *Packet) isICMP() bool {
+	is4 := p.src.Is4()
+	return ((is4 && p.proto == ProtocolICMPv4) || (!is4 && p.proto == ProtocolICMPv6)) &&
+		p.payload-p.transport >= 8
+}
+
+// ICMPType returns the ICMPv4 or ICMPv6 type or zero.
+func (p *Packet) ICMPType() uint8 {
+	if !p.isICMP() {
+		return 0
+	}
+	return p.buf[p.transport]
+}
+
+// ICMPCode returns the ICMPv4 or ICMPv6 code or zero.
+func (p *Packet) ICMPCode() uint8 {
+	if !p.isICMP() {
+		return 0
+	}
+	return p.buf[p.transport+1]
+}
+
+// ICMPQuoted parses the packet quoted by an ICMPv4 or ICMPv6 error message.
+//
+// Since ICMP error messages usually quote a truncated packet, we accept
+// truncated IP payloads and transport headers. The returned [*Packet]
+// references the payload of p, so its mutators modify p in place without
+// updating the ICMP checksum of p.
+func (p *Packet) ICMPQuoted() (*Packet, error) {
+	if !p.isICMP() || !packetIsICMPError(p.buf) {
+		return nil, fmt.Errorf("%w: not an ICMP error message", ErrMalformedPacket)
+	}
+	return packetParse(p.Payload(), true)
+}
+
+// SetSrc replaces the source address, updating the checksums. This method
+// returns an error if the address family does not match the packet family.
+func (p *Packet) SetSrc(addr netip.Addr) error {
+	if addr.Is4() != p.src.Is4() || !addr.IsValid() {
+		return fmt.Errorf("address family mismatch: %s", addr)
+	}
+	offset := 8
+	if p.src.Is4() {
+		offset = 12
+	}
+	p.replace(offset, addr.AsSlice(), true)
+	p.src = addr
+	return nil
+}
+
+// SetDst replaces the destination address, updating the checksums. This method
+// returns an error if the address family does not match the packet family.
+func (p *Packet) SetDst(addr netip.Addr) error {
+	if addr.Is4() != p.dst.Is4() || !addr.IsValid() {
+		return fmt.Errorf("address family mismatch: %s", addr)
+	}
+	offset := 24
+	if p.dst.Is4() {
+		offset = 16
+	}
+	p.replace(offset, addr.AsSlice(), true)
+	p.dst = addr
+	return nil
+}
+
+// SetSrcPort replaces the TCP or UDP source port, updating the checksum. This
+// method returns an error if the packet does not have a TCP or UDP header.
+func (p *Packet) SetSrcPort(port uint16) error {
+	if !p.hasPorts() {
+		return errors.New("packet without TCP or UDP ports")
+	}
+	p.replace(p.transport, binary.BigEndian.AppendUint16(nil, port), true)
+	return nil
+}
+
+// SetDstPort replaces the TCP or UDP destination port, updating the checksum. This
+// method returns an error if the packet does not have a TCP or UDP header.
+func (p *Packet) SetDstPort(port uint16) error {
+	if !p.hasPorts() {
+		return errors.New("packet without TCP or UDP ports")
+	}
+	p.replace(p.transport+2, binary.BigEndian.AppendUint16(nil, port), true)
+	return nil
+}
+
+// SetTTL replaces the IPv4 TTL or the IPv6 Hop Limit, updating the IPv4 header checksum.
+func (p *Packet) SetTTL(ttl uint8) {
+	if p.src.Is4() {
+		// the TTL shares a 16-bit word with the protocol
+		p.replace(8, []byte{ttl, p.buf[9]}, false)
+		return
+	}
+	p.buf[7] = ttl // IPv6 has no header checksum
+}
+
+// replace replaces the bytes at the given offset with value and incrementally
+// updates the IPv4 header checksum, when the bytes belong to the IPv4 header, and
+// the TCP, UDP, or ICMPv6 checksum, when covered is true. The value MUST have an
+// even length and the offset MUST be even, which holds for the fields we modify.
+func (p *Packet) replace(offset int, value []byte, covered bool) {
+	old := p.buf[offset : offset+len(value)]
+	if offset < p.transport && p.src.Is4() {
+		csum := packetChecksumReplace(binary.BigEndian.Uint16(p.buf[10:12]), old, value)
+		binary.BigEndian.PutUint16(p.buf[10:12], csum)
+	}
+	csumOffset := p.transport + packetChecksumOffset(p.proto)
+	if covered && csumOffset >= p.transport && csumOffset+2 <= p.payload {
+		field := p.buf[csumOffset : csumOffset+2]
+		csum := binary.BigEndian.Uint16(field)
+		switch {
+		case p.proto == ProtocolUDP && csum == 0 && p.src.Is4():
+			// the UDP checksum is optional for IPv4
+		default:
+			csum = packetChecksumReplace(csum, old, value)
+			if csum == 0 && p.proto == ProtocolUDP {
+				csum = 0xffff
+			}
+			binary.BigEndian.PutUint16(field, csum)
+		}
+	}
+	copy(old, value)
+}
+
+// packetChecksumAdd adds data to a running ones-complement sum.
+func packetChecksumAdd(sum uint32, data []byte) uint32 {
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) > 0 {
+		sum += uint32(data[0]) << 8
+	}
+	return sum
+}
+
+// packetChecksumFinish folds and complements a running ones-complement sum.
+func packetChecksumFinish(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
+
+// packetPseudoHeaderSum returns the running sum of the TCP/UDP/ICMPv6
+// pseudo-header for the given addresses, protocol, and upper-layer length.
+func packetPseudoHeaderSum(src, dst netip.Addr, proto uint8, length int) uint32 {
+	sum := packetChecksumAdd(0, src.AsSlice())
+	sum = packetChecksumAdd(sum, dst.AsSlice())
+	if src.Is4() {
+		return sum + uint32(proto) + uint32(length)
+	}
+	return sum + uint32(length>>16) + uint32(length&0xffff) + uint32(proto)
+}
+
+// packetIPv4HeaderLength returns the IPv4 header length or false if
+// the packet is too short to contain a valid IPv4 header.
+func packetIPv4HeaderLength(pkt []byte) (int, bool) {
+	if len(pkt) < packetIPv4HeaderLen {
+		return 0, false
+	}
+	hlen := int(pkt[0]&0x0f) * 4
+	if hlen < packetIPv4HeaderLen || len(pkt) < hlen {
+		return 0, false
+	}
+	return hlen, true
+}
+
+// packetUpdateIPv4Checksum recomputes the IPv4 header checksum in place.
+//
+// The caller MUST ensure that the packet contains a valid IPv4 header.
+func packetUpdateIPv4Checksum(pkt []byte) {
+	hlen, _ := packetIPv4HeaderLength(pkt)
+	pkt[10], pkt[11] = 0, 0
+	binary.BigEndian.PutUint16(pkt[10:12], packetChecksumFinish(packetChecksumAdd(0, pkt[:hlen])))
+}
+
+// packetNewIPv4 creates a new IPv4 packet with the given payload.
+func packetNewIPv4(src, dst netip.Addr, proto uint8, payload []byte) []byte {
+	pkt := make([]byte, packetIPv4HeaderLen+len(payload))
+	pkt[0] = 0x45
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	pkt[8] = packetDefaultTTL
+	pkt[9] = proto
+	copy(pkt[12:16], src.AsSlice())
+	copy(pkt[16:20], dst.AsSlice())
+	copy(pkt[packetIPv4HeaderLen:], payload)
+	packetUpdateIPv4Checksum(pkt)
+	return pkt
+}
+
+// packetNewIPv6 creates a new IPv6 packet with the given payload.
+func packetNewIPv6(src, dst netip.Addr, proto uint8, payload []byte) []byte {
+	pkt := make([]byte, packetIPv6HeaderLen+len(payload))
+	pkt[0] = 0x60
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(len(payload)))
+	pkt[6] = proto
+	pkt[7] = packetDefaultTTL
+	copy(pkt[8:24], src.AsSlice())
+	copy(pkt[24:40], dst.AsSlice())
+	copy(pkt[packetIPv6HeaderLen:], payload)
+	return pkt
+}
+
+// packetTransport returns the transport protocol and the offset of the
+// transport header of the given IP packet or false if the packet is malformed.
+//
+// We do not parse IPv6 extension headers, therefore the returned protocol
+// is the IPv6 Next Header, which may be an extension header.
+func packetTransport(pkt []byte) (uint8, int, bool) {
+	if len(pkt) < 1 {
+		return 0, 0, false
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		hlen, ok := packetIPv4HeaderLength(pkt)
+		if !ok {
+			return 0, 0, false
+		}
+		return pkt[9], hlen, true
+
+	case 6:
+		if len(pkt) < packetIPv6HeaderLen {
+			return 0, 0, false
+		}
+		return pkt[6], packetIPv6HeaderLen, true
+
+	default:
+		return 0, 0, false
+	}
+}
+
+// packetChecksumOffset returns the offset of the checksum within the header of the
+// given transport protocol or -1 if the checksum does not cover the IP addresses.
+func packetChecksumOffset(proto uint8) int {
+	switch proto {
+	case ProtocolTCP:
+		return 16
+	case ProtocolUDP:
+		return 6
+	case ProtocolICMPv6:
+		return 2
+	default:
+		return -1
+	}
+}
+
+// packetChecksumReplace incrementally updates the given checksum after
+// replacing old with value (see RFC 1624). Both slices MUST have the same
+// even length and MUST start at an even offset of the checksummed data.
+func packetChecksumReplace(csum uint16, old, value []byte) uint16 {
+	sum := uint32(^csum)
+	for idx := 0; idx+1 < len(old); idx += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[idx:]))
+		sum += uint32(binary.BigEndian.Uint16(value[idx:]))
+	}
+	return packetChecksumFinish(sum)
+}
+
+// packetUpdateICMPChecksum recomputes the checksum of the ICMPv4 or ICMPv6
+// message starting at the given offset of the given IP packet in place.
+func packetUpdateICMPChecksum(pkt []byte, transport int) {
+	msg := pkt[transport:]
+	msg[2], msg[3] = 0, 0
+	var sum uint32
+	if pkt[0]>>4 == 6 {
+		src, dst, _ := internetParseAddrs(pkt)
+		sum = packetPseudoHeaderSum(src, dst, ProtocolICMPv6, len(msg))
+	}
+	binary.BigEndian.PutUint16(msg[2:4], packetChecksumFinish(packetChecksumAdd(sum, msg)))
+}
+
+// packetNewTCP creates a new IPv4 or IPv6 TCP packet without options
+// and with the given payload, computing the checksums.
+func packetNewTCP(src, dst netip.AddrPort, seq, ack uint32, flags uint8, window uint16, payload []byte) []byte {
+	segment := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(segment[0:2], src.Port())
+	binary.BigEndian.PutUint16(segment[2:4], dst.Port())
+	binary.BigEndian.PutUint32(segment[4:8], seq)
+	binary.BigEndian.PutUint32(segment[8:12], ack)
+	segment[12] = 5 << 4
+	segment[13] = flags
+	binary.BigEndian.PutUint16(segment[14:16], window)
+	copy(segment[20:], payload)
+	sum := packetPseudoHeaderSum(src.Addr(), dst.Addr(), ProtocolTCP, len(segment))
+	binary.BigEndian.PutUint16(segment[16:18], packetChecksumFinish(packetChecksumAdd(sum, segment)))
+	if src.Addr().Is4() {
+		return packetNewIPv4(src.Addr(), dst.Addr(), ProtocolTCP, segment)
+	}
+	return packetNewIPv6(src.Addr(), dst.Addr(), ProtocolTCP, segment)
+}
+
+// packetNewUDP creates a new IPv4 or IPv6 UDP packet with
+// the given payload, computing the checksums.
+func packetNewUDP(src, dst netip.AddrPort, payload []byte) []byte {
+	datagram := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(datagram[0:2], src.Port())
+	binary.BigEndian.PutUint16(datagram[2:4], dst.Port())
+	binary.BigEndian.PutUint16(datagram[4:6], uint16(len(datagram)))
+	copy(datagram[8:], payload)
+	sum := packetPseudoHeaderSum(src.Addr(), dst.Addr(), ProtocolUDP, len(datagram))
+	csum := packetChecksumFinish(packetChecksumAdd(sum, datagram))
+	if csum == 0 {
+		csum = 0xffff
+	}
+	binary.BigEndian.PutUint16(datagram[6:8], csum)
+	if src.Addr().Is4() {
+		return packetNewIPv4(src.Addr(), dst.Addr(), ProtocolUDP, datagram)
+	}
+	return packetNewIPv6(src.Addr(), dst.Addr(), ProtocolUDP, datagram)
+}
+
+// packetNewTCPReset creates a TCP RST segment in response to the given TCP
+// segment following the rules in RFC 9293. This function returns false if
+// the packet is not a TCP segment or is itself a RST segment.
+func packetNewTCPReset(p *Packet) ([]byte, bool) {
+	if p.tcpHeader() == nil || p.TCPFlags()&TCPFlagRST != 0 {
+		return nil, false
+	}
+	ft := p.FiveTuple()
+	if p.TCPFlags()&TCPFlagACK != 0 {
+		return packetNewTCP(ft.Dst, ft.Src, p.TCPAck(), 0, TCPFlagRST, 0, nil), true
+	}
+	return packetNewTCP(ft.Dst, ft.Src, 0, p.TCPSeq()+p.tcpSegmentLength(), TCPFlagRST|TCPFlagACK, 0, nil), true
+}
+
+// packetIPv4DontFragment returns whether the given IPv4 packet has the DF bit set.
+//
+// The caller MUST ensure that the packet contains a valid IPv4 header.
+func packetIPv4DontFragment(pkt []byte) bool {
+	return binary.BigEndian.Uint16(pkt[6:8])&0x4000 != 0
+}
+
+// packetFragmentIPv4 splits the given IPv4 packet into fragments whose size
+// does not exceed the given MTU. The packet may itself be a fragment, in
+// which case we produce fragments of the same original datagram.
+//
+// Non-first fragments use a 20-byte header without IP options.
+//
+// This function returns false if the packet is malformed or if the MTU is
+// too small to carry at least eight bytes of payload per fragment.
+func packetFragmentIPv4(pkt []byte, mtu int) ([][]byte, bool) {
+	// 1. parse the header and the payload
+	hlen, ok := packetIPv4HeaderLength(pkt)
+	if !ok {
+		return nil, false
+	}
+	total := int(binary.BigEndian.Uint16(pkt[2:4]))
+	if total < hlen || total > len(pkt) {
+		return nil, false
+	}
+	payload := pkt[hlen:total]
+	flags := binary.BigEndian.Uint16(pkt[6:8])
+	offset := int(flags&0x1fff) * 8
+	moreFragments := flags&0x2000 != 0
+
+	// 2. split the payload into chunks whose size is a multiple of eight bytes
+	frags := [][]byte{}
+	for len(payload) > 0 {
+		fhlen := hlen
+		if len(frags) > 0 {
+			fhlen = packetIPv4HeaderLen
+		}
+		size := min(len(payload), (mtu-fhlen)&^7)
+		if size <= 0 {
+			return nil, false
+		}
+		frag := make([]byte, fhlen+size)
+		copy(frag, pkt[:fhlen])
+		frag[0] = 0x40 | byte(fhlen/4)
+		copy(frag[fhlen:], payload[:size])
+		binary.BigEndian.PutUint16(frag[2:4], uint16(len(frag)))
+		fragOffset := uint16(offset / 8)
+		if size < len(payload) || moreFragments {
+			fragOffset |= 0x2000
+		}
+		binary.BigEndian.PutUint16(frag[6:8], fragOffset)
+		packetUpdateIPv4Checksum(frag)
+		frags = append(frags, frag)
+		payload = payload[size:]
+		offset += size
+	}
+	return frags, true
+}
+
+// packetIsICMPError returns whether the given IP packet is an ICMP
+// error message, in response to which we MUST NOT generate ICMP errors.
+func packetIsICMPError(pkt []byte) bool {
+	switch pkt[0] >> 4 {
+	case 4:
+		hlen, ok := packetIPv4HeaderLength(pkt)
+		if !ok || pkt[9] != ProtocolICMPv4 || len(pkt) <= hlen {
+			return false
+		}
+		switch pkt[hlen] {
+		case packetICMPv4EchoReply, packetICMPv4EchoRequest:
+			return false
+		default:
+			return true // conservatively assume everything else is an error
+		}
+
+	case 6:
+		if len(pkt) <= packetIPv6HeaderLen || pkt[6] != ProtocolICMPv6 {
+			return false
+		}
+		return pkt[packetIPv6HeaderLen] < 128 // RFC 4443 error messages
+
+	default:
+		return false
+	}
+}
+
+// packetIsNonFirstFragment returns whether the given IPv4 packet is a
+// fragment other than the first one, which we MUST NOT respond to.
+func packetIsNonFirstFragment(pkt []byte) bool {
+	return pkt[0]>>4 == 4 && len(pkt) >= packetIPv4HeaderLen &&
+		binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0
+}
+
+// packetNewICMPError creates an ICMPv4 or ICMPv6 error message from
+// the given address, using the given type, code and four bytes of
+// additional data, quoting the given original packet.
+//
+// The original packet MUST be an IPv4 packet if from is an IPv4 address
+// and an IPv6 packet if from is an IPv6 address.
+//
+// This function returns false if the original packet is malformed, is an
+// ICMP error message, is not the first fragment, or if its source address
+// is unspecified or multicast, since we MUST NOT generate ICMP errors in
+// response to such packets (see RFC 1122 and RFC 4443).
+func packetNewICMPError(from netip.Addr, typ, code uint8, rest uint32, original []byte) ([]byte, bool) {
+	src, _, ok := internetParseAddrs(original)
+	if !ok || src.Is4() != from.Is4() || !src.IsValid() || src.IsUnspecified() || src.IsMulticast() {
+		return nil, false
+	}
+	if packetIsICMPError(original) || packetIsNonFirstFragment(original) {
+		return nil, false
+	}
+
+	// RFC 1812 and RFC 4443 say to quote as much of the original packet
+	// as possible without exceeding the minimum MTU (576 or 1280 bytes).
+	maxSize, proto := 576, uint8(ProtocolICMPv4)
+	if from.Is6() {
+		maxSize, proto = MTUMinimumIPv6, ProtocolICMPv6
+	}
+	quoted := original[:min(len(original), maxSize-packetIPv6HeaderLen-8)]
+	if from.Is4() {
+		quoted = original[:min(len(original), maxSize-packetIPv4HeaderLen-8)]
+	}
+
+	msg := make([]byte, 8+len(quoted))
+	msg[0] = typ
+	msg[1] = code
+	binary.BigEndian.PutUint32(msg[4:8], rest)
+	copy(msg[8:], quoted)
+
+	if from.Is4() {
+		binary.BigEndian.PutUint16(msg[2:4], packetChecksumFinish(packetChecksumAdd(0, msg)))
+		return packetNewIPv4(from, src, proto, msg), true
+	}
+	sum := packetPseudoHeaderSum(from, src, proto, len(msg))
+	binary.BigEndian.PutUint16(msg[2:4], packetChecksumFinish(packetChecksumAdd(sum, msg)))
+	return packetNewIPv6(from, src, proto, msg), true
+}
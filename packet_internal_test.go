@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// packetTestForwarder is a [PacketForwarder] recording the forwarded frames.
+type packetTestForwarder struct {
+	frames []VNICFrame
+}
+
+// Forward implements [PacketForwarder].
+func (fwd *packetTestForwarder) Forward(frame VNICFrame) {
+	fwd.frames = append(fwd.frames, frame)
+}
+
+// ForwardAfter implements [PacketForwarder].
+func (fwd *packetTestForwarder) ForwardAfter(delay time.Duration, frame VNICFrame) {
+	fwd.frames = append(fwd.frames, frame)
+}
+
+func TestPacketFramePreservesSender(t *testing.T) {
+	sender := &VNIC{}
+	frame := VNICFrame{
+		Packet: packetNewUDP(netip.MustParseAddrPort("192.168.1.2:68"),
+			netip.MustParseAddrPort("255.255.255.255:67"), []byte("discover")),
+		sender: sender,
+	}
+
+	t.Run("Parse and Clone", func(t *testing.T) {
+		pkt, err := frame.Parse()
+		require.NoError(t, err)
+		require.Same(t, sender, pkt.Frame().sender)
+		require.Same(t, sender, pkt.Clone().Frame().sender)
+
+		// a packet parsed from bytes does not know the sender
+		pkt, err = ParsePacket(frame.Packet)
+		require.NoError(t, err)
+		require.Nil(t, pkt.Frame().sender)
+	})
+
+	t.Run("NAT", func(t *testing.T) {
+		nat := NewNAT(netip.MustParseAddr("10.0.0.1"), []netip.Prefix{netip.MustParsePrefix("192.168.1.0/24")})
+		fwd := &packetTestForwarder{}
+		nat.HandleFrame(frame, fwd)
+		require.Len(t, fwd.frames, 1)
+		require.Same(t, sender, fwd.frames[0].sender)
+	})
+}
@@ -0,0 +1,211 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePacket(t *testing.T) {
+	client := netip.MustParseAddrPort("192.168.1.2:5000")
+	server := netip.MustParseAddrPort("10.0.0.1:443")
+
+	t.Run("tcp", func(t *testing.T) {
+		raw := newTestTCPPacketWithPayload(client, server, 1000, uis.TCPFlagSYN|uis.TCPFlagACK, []byte("abc"))
+		binary.BigEndian.PutUint32(raw[28:32], 2000)
+		pkt, err := uis.VNICFrame{Packet: raw}.Parse()
+		require.NoError(t, err)
+
+		require.Equal(t, 4, pkt.Version())
+		require.Equal(t, client.Addr(), pkt.Src())
+		require.Equal(t, server.Addr(), pkt.Dst())
+		require.Equal(t, uint8(64), pkt.TTL())
+		require.Equal(t, uint8(uis.ProtocolTCP), pkt.Protocol())
+		require.False(t, pkt.IsFragment())
+		require.Len(t, pkt.NetworkHeader(), 20)
+		require.Len(t, pkt.TransportHeader(), 20)
+		require.Equal(t, []byte("abc"), pkt.Payload())
+		require.Equal(t, client.Port(), pkt.SrcPort())
+		require.Equal(t, server.Port(), pkt.DstPort())
+		require.Equal(t, uis.TCPFlagSYN|uis.TCPFlagACK, pkt.TCPFlags())
+		require.Equal(t, uint32(1000), pkt.TCPSeq())
+		require.Equal(t, uint32(2000), pkt.TCPAck())
+		require.Equal(t, uint8(0), pkt.ICMPType())
+
+		ft := pkt.FiveTuple()
+		require.Equal(t, uis.FiveTuple{Dst: server, Protocol: uis.ProtocolTCP, Src: client}, ft)
+		require.Equal(t, uis.FiveTuple{Dst: client, Protocol: uis.ProtocolTCP, Src: server}, ft.Reverse())
+
+		// the view references the original packet
+		require.Same(t, &raw[0], &pkt.Bytes()[0])
+	})
+
+	t.Run("trailing_bytes", func(t *testing.T) {
+		raw := newTestUDPPacket(client, server, []byte("abc"))
+		pkt, err := uis.ParsePacket(append(slices.Clone(raw), 0, 0, 0, 0))
+		require.NoError(t, err)
+		require.Equal(t, raw, pkt.Bytes())
+		require.Equal(t, []byte("abc"), pkt.Payload())
+	})
+
+	t.Run("non_first_fragment", func(t *testing.T) {
+		raw := newTestUDPPacket(client, server, []byte("abcdefgh"))
+		binary.BigEndian.PutUint16(raw[6:8], 1)
+		pkt, err := uis.ParsePacket(raw)
+		require.NoError(t, err)
+		require.True(t, pkt.IsFragment())
+		require.Nil(t, pkt.TransportHeader())
+		require.Len(t, pkt.Payload(), 16)
+		require.Equal(t, uint16(0), pkt.SrcPort())
+		require.Error(t, pkt.Clone().SetSrcPort(1234))
+	})
+
+	t.Run("unknown_protocol", func(t *testing.T) {
+		raw := newTestUDPPacket(client, server, nil)
+		raw[9] = 47 // GRE
+		pkt, err := uis.ParsePacket(raw)
+		require.NoError(t, err)
+		require.Nil(t, pkt.TransportHeader())
+		require.Len(t, pkt.Payload(), 8)
+		require.Equal(t, uis.FiveTuple{
+			Dst:      netip.AddrPortFrom(server.Addr(), 0),
+			Protocol: 47,
+			Src:      netip.AddrPortFrom(client.Addr(), 0),
+		}, pkt.FiveTuple())
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		tcp := newTestTCPPacket(client, server, 1000, uis.TCPFlagSYN)
+		badOffset := slices.Clone(tcp)
+		badOffset[32] = 4 << 4
+		cases := map[string][]byte{
+			"empty":              nil,
+			"short_ipv4":         {0x45},
+			"short_ipv6":         {0x60},
+			"bad_version":        make([]byte, 40),
+			"truncated_payload":  tcp[:30],
+			"truncated_udp":      newTestIPv4Packet(server.Addr()),
+			"truncated_ipv6_udp": newTestIPv6Packet(netip.MustParseAddr("2001:db8::1")),
+			"bad_data_offset":    badOffset,
+		}
+		for name, raw := range cases {
+			t.Run(name, func(t *testing.T) {
+				_, err := uis.ParsePacket(raw)
+				require.ErrorIs(t, err, uis.ErrMalformedPacket)
+			})
+		}
+	})
+}
+
+func TestPacketMutators(t *testing.T) {
+	client := netip.MustParseAddrPort("192.168.1.2:5000")
+	server := netip.MustParseAddrPort("10.0.0.1:443")
+	public := netip.MustParseAddrPort("203.0.113.1:6000")
+
+	for name, raw := range map[string][]byte{
+		"tcp": newTestTCPPacketWithPayload(client, server, 1000, uis.TCPFlagACK, []byte("hello")),
+		"udp": newTestUDPPacket(client, server, []byte("hello")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			orig, err := uis.ParsePacket(raw)
+			require.NoError(t, err)
+			saved := slices.Clone(raw)
+			pkt := orig.Clone()
+
+			require.NoError(t, pkt.SetSrc(public.Addr()))
+			require.NoError(t, pkt.SetSrcPort(public.Port()))
+			require.NoError(t, pkt.SetDst(netip.MustParseAddr("10.0.0.2")))
+			require.NoError(t, pkt.SetDstPort(80))
+			pkt.SetTTL(17)
+
+			// the original packet is unchanged
+			require.Equal(t, saved, raw)
+
+			// the view and the bytes agree and the checksums are valid
+			out := pkt.Bytes()
+			require.Equal(t, uint16(0), testChecksum(0, out[:20]))
+			if name == "tcp" {
+				require.Equal(t, uint16(0), testTCPChecksum(out))
+			} else {
+				require.Equal(t, uint16(0), testUDPChecksum(out))
+			}
+			reparsed, err := uis.ParsePacket(out)
+			require.NoError(t, err)
+			require.Equal(t, uis.FiveTuple{
+				Dst:      netip.MustParseAddrPort("10.0.0.2:80"),
+				Protocol: pkt.Protocol(),
+				Src:      public,
+			}, reparsed.FiveTuple())
+			require.Equal(t, pkt.FiveTuple(), reparsed.FiveTuple())
+			require.Equal(t, uint8(17), reparsed.TTL())
+			require.Equal(t, []byte("hello"), reparsed.Payload())
+
+			// we refuse to mix address families
+			require.Error(t, pkt.SetSrc(netip.MustParseAddr("2001:db8::1")))
+			require.Error(t, pkt.SetDst(netip.Addr{}))
+		})
+	}
+
+	t.Run("udp_without_checksum", func(t *testing.T) {
+		raw := newTestUDPPacket(client, server, nil)
+		raw[26], raw[27] = 0, 0
+		pkt, err := uis.ParsePacket(raw)
+		require.NoError(t, err)
+		require.NoError(t, pkt.SetSrcPort(1234))
+		require.Equal(t, []byte{0, 0}, raw[26:28])
+	})
+}
+
+func TestPacketICMPQuoted(t *testing.T) {
+	t.Run("ipv4", func(t *testing.T) {
+		client := netip.MustParseAddrPort("192.168.1.2:5000")
+		server := netip.MustParseAddrPort("10.0.0.1:53")
+		original := newTestUDPPacket(client, server, []byte("query"))
+		reply, ok := uis.NewUnreachableFrame(uis.VNICFrame{Packet: original}, uis.UnreachablePort, netip.Addr{})
+		require.True(t, ok)
+
+		pkt, err := reply.Parse()
+		require.NoError(t, err)
+		require.Equal(t, uint8(3), pkt.ICMPType())
+		require.Equal(t, uint8(3), pkt.ICMPCode())
+
+		inner, err := pkt.ICMPQuoted()
+		require.NoError(t, err)
+		require.Equal(t, uis.FiveTuple{Dst: server, Protocol: uis.ProtocolUDP, Src: client}, inner.FiveTuple())
+		require.Equal(t, []byte("query"), inner.Payload())
+
+		// a packet that is not an ICMP error does not quote anything
+		orig, err := uis.ParsePacket(original)
+		require.NoError(t, err)
+		_, err = orig.ICMPQuoted()
+		require.ErrorIs(t, err, uis.ErrMalformedPacket)
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		raw := newTestIPv6Packet(netip.MustParseAddr("2001:db8::1"))
+		copy(raw[8:24], netip.MustParseAddr("2001:db8::2").AsSlice())
+		raw[5] = 8
+		raw = append(raw, 0x13, 0x88, 0x00, 0x35, 0x00, 0x08, 0x00, 0x00)
+		reply, ok := uis.NewUnreachableFrame(uis.VNICFrame{Packet: raw}, uis.UnreachableHost, netip.Addr{})
+		require.True(t, ok)
+
+		pkt, err := reply.Parse()
+		require.NoError(t, err)
+		require.Equal(t, uint8(1), pkt.ICMPType())
+		require.Equal(t, uint8(3), pkt.ICMPCode())
+		inner, err := pkt.ICMPQuoted()
+		require.NoError(t, err)
+		require.Equal(t, uint16(5000), inner.SrcPort())
+		require.Equal(t, uint16(53), inner.DstPort())
+
+		// the ICMPv6 checksum covers the pseudo-header
+		require.NoError(t, pkt.SetDst(netip.MustParseAddr("2001:db8::3")))
+		require.Equal(t, uint16(0), testICMPv6Checksum(pkt.Bytes()))
+	})
+}
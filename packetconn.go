@@ -15,11 +15,18 @@ import (
 
 // packetConnWrapper wraps a [net.PacketConn] and remaps gVisor errors
 // to emulate stdlib errors.
+//
+// Like [*net.UDPConn], it implements both [net.PacketConn] and [net.Conn],
+// which matters to code using the former to detect datagram conns (e.g.,
+// the pure Go resolver when using a custom Dial function).
 type packetConnWrapper struct {
 	pconn *gonet.UDPConn
 }
 
-var _ net.PacketConn = &packetConnWrapper{}
+var (
+	_ net.Conn       = &packetConnWrapper{}
+	_ net.PacketConn = &packetConnWrapper{}
+)
 
 // Close implements [net.PacketConn].
 func (pcw *packetConnWrapper) Close() error {
@@ -31,12 +38,23 @@ func (pcw *packetConnWrapper) LocalAddr() net.Addr {
 	return pcw.pconn.LocalAddr()
 }
 
+// Read implements [net.Conn].
+func (pcw *packetConnWrapper) Read(buff []byte) (int, error) {
+	count, err := pcw.pconn.Read(buff)
+	return count, errorsRemap(err)
+}
+
 // ReadFrom implements [net.PacketConn].
 func (pcw *packetConnWrapper) ReadFrom(buff []byte) (int, net.Addr, error) {
 	count, addr, err := pcw.pconn.ReadFrom(buff)
 	return count, addr, errorsRemap(err)
 }
 
+// RemoteAddr implements [net.Conn].
+func (pcw *packetConnWrapper) RemoteAddr() net.Addr {
+	return pcw.pconn.RemoteAddr()
+}
+
 // SetDeadline implements [net.PacketConn].
 func (pcw *packetConnWrapper) SetDeadline(t time.Time) error {
 	return pcw.pconn.SetDeadline(t)
@@ -52,6 +70,12 @@ func (pcw *packetConnWrapper) SetWriteDeadline(t time.Time) error {
 	return pcw.pconn.SetWriteDeadline(t)
 }
 
+// Write implements [net.Conn].
+func (pcw *packetConnWrapper) Write(data []byte) (int, error) {
+	count, err := pcw.pconn.Write(data)
+	return count, errorsRemap(err)
+}
+
 // WriteTo implements [net.PacketConn].
 func (pcw *packetConnWrapper) WriteTo(pkt []byte, addr net.Addr) (int, error) {
 	count, err := pcw.pconn.WriteTo(pkt, addr)
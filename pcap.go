@@ -17,6 +17,7 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcapgo"
+	"gvisor.dev/gvisor/pkg/tcpip"
 )
 
 // pcapSnapshot is a packet snapshot.
@@ -26,6 +27,9 @@ type pcapSnapshot struct {
 
 	// length is the original length.
 	length int
+
+	// when is when we captured the packet.
+	when time.Time
 }
 
 // PCAPTrace is an open PCAP trace.
@@ -33,6 +37,9 @@ type PCAPTrace struct {
 	// cancel allows to cancel the background goroutine.
 	cancel context.CancelFunc
 
+	// clock is the clock used to timestamp packets.
+	clock tcpip.Clock
+
 	// dropped is the number of packets dropped.
 	dropped atomic.Uint64
 
@@ -66,6 +73,7 @@ type PCAPTraceOption func(cfg *pcapTraceConfig)
 // pcapTraceConfig is the internal type modified by [PCAPTraceOption].
 type pcapTraceConfig struct {
 	bufferSize int
+	clock      tcpip.Clock
 }
 
 // PCAPTraceOptionBuffer sets the buffer size for the internal packet channel.
@@ -82,6 +90,17 @@ func PCAPTraceOptionBuffer(bufferSize int) PCAPTraceOption {
 	}
 }
 
+// PCAPTraceOptionClock sets the [tcpip.Clock] used to timestamp packets.
+//
+// The default is to use the wall clock. Use the same clock used by the
+// [*Internet] (see [InternetOptionClock]) to obtain timestamps consistent
+// with the simulation time, which are reproducible with a [*VirtualClock].
+func PCAPTraceOptionClock(clock tcpip.Clock) PCAPTraceOption {
+	return func(cfg *pcapTraceConfig) {
+		cfg.clock = clock
+	}
+}
+
 // NewPCAPTrace creates a new [*PCAPTrace] instance.
 //
 // Takes ownership of the [io.WriteCloser] and ensures the file is closed and
@@ -94,12 +113,14 @@ func NewPCAPTrace(wc io.WriteCloser, snapSize uint16, options ...PCAPTraceOption
 	ctx, cancel := context.WithCancel(context.Background())
 	cfg := &pcapTraceConfig{
 		bufferSize: 4096,
+		clock:      tcpip.NewStdClock(),
 	}
 	for _, opt := range options {
 		opt(cfg)
 	}
 	tr := &PCAPTrace{
 		cancel:   cancel,
+		clock:    cfg.clock,
 		dropped:  atomic.Uint64{},
 		errch:    make(chan error, 1),
 		snaps:    make(chan pcapSnapshot, cfg.bufferSize),
@@ -119,12 +140,23 @@ func (tr *PCAPTrace) Dump(packet []byte) {
 	packetSnap := make([]byte, snapSize)
 	copy(packetSnap, packet)
 	select {
-	case tr.snaps <- pcapSnapshot{length: len(packet), data: packetSnap}:
+	case tr.snaps <- pcapSnapshot{length: len(packet), data: packetSnap, when: tr.clock.Now()}:
 	default:
 		tr.dropped.Add(1)
 	}
 }
 
+// Ensure that [*PCAPTrace] implements [PacketPolicy].
+var _ PacketPolicy = &PCAPTrace{}
+
+// HandleFrame implements [PacketPolicy] by dumping the frame packet
+// and then forwarding the frame unmodified. This allows to capture
+// packets using [*Internet.Run] or [RouterOptionPolicy].
+func (tr *PCAPTrace) HandleFrame(frame VNICFrame, fwd PacketForwarder) {
+	tr.Dump(frame.Packet)
+	fwd.Forward(frame)
+}
+
 // Dropped returns the number of packets dropped due to buffer overflow.
 //
 // Packets are dropped when Dump is called but the internal buffer is full.
@@ -177,7 +209,7 @@ func (tr *PCAPTrace) readOrDrain(ctx context.Context) (pcapSnapshot, bool) {
 
 func (tr *PCAPTrace) savePacket(w *pcapgo.Writer, pinfo pcapSnapshot) error {
 	ci := gopacket.CaptureInfo{
-		Timestamp:      time.Now(),
+		Timestamp:      pinfo.when,
 		CaptureLength:  len(pinfo.data),
 		Length:         pinfo.length,
 		InterfaceIndex: 0,
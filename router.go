@@ -0,0 +1,430 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Router routes the packets in flight within an [*Internet].
+//
+// The router reads packets using [*Internet.InFlight], passes them through
+// the chain of [PacketPolicy] configured using [RouterOptionPolicy], applies
+// the conditions configured for the corresponding path using [*Router.AddLink],
+// and finally delivers them using [*Internet.Deliver].
+//
+// Construct using [NewRouter].
+type Router struct {
+	// ix is the internet we're routing for.
+	ix *Internet
+
+	// links contains the configured links sorted by decreasing specificity.
+	links []*routerLink
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// policies contains the policy chain.
+	policies []PacketPolicy
+
+	// queue contains the packets waiting to be delivered.
+	queue routerQueue
+
+	// rng is the random number generator used by the links.
+	rng *rand.Rand
+
+	// seq is the sequence number of the next queued packet.
+	seq uint64
+
+	// steps receives the [*Router.Step] requests.
+	steps chan chan bool
+}
+
+// RouterOption is an option for [NewRouter].
+type RouterOption func(cfg *routerConfig)
+
+// routerConfig is the internal type modified by [RouterOption].
+type routerConfig struct {
+	policies []PacketPolicy
+	seed1    uint64
+	seed2    uint64
+}
+
+// RouterOptionPolicy appends the given [PacketPolicy] to the chain of
+// policies processing each packet in flight.
+//
+// Policies run in the order in which they have been added, before the
+// link emulation configured using [*Router.AddLink].
+func RouterOptionPolicy(policies ...PacketPolicy) RouterOption {
+	return func(cfg *routerConfig) {
+		cfg.policies = append(cfg.policies, policies...)
+	}
+}
+
+// RouterOptionSeed sets the seed used to initialize the random number
+// generator used to sample jitter and losses.
+//
+// The default is to use a random seed. Set an explicit seed to make
+// jitter and losses reproducible across runs.
+func RouterOptionSeed(seed uint64) RouterOption {
+	return func(cfg *routerConfig) {
+		cfg.seed1 = seed
+		cfg.seed2 = seed
+	}
+}
+
+// NewRouter creates a new [*Router] for the given [*Internet].
+func NewRouter(ix *Internet, options ...RouterOption) *Router {
+	cfg := &routerConfig{
+		policies: []PacketPolicy{},
+		seed1:    rand.Uint64(),
+		seed2:    rand.Uint64(),
+	}
+	for _, opt := range options {
+		opt(cfg)
+	}
+
+	return &Router{
+		ix:       ix,
+		links:    []*routerLink{},
+		mu:       sync.Mutex{},
+		policies: cfg.policies,
+		queue:    routerQueue{},
+		rng:      rand.New(rand.NewPCG(cfg.seed1, cfg.seed2)),
+		seq:      0,
+		steps:    make(chan chan bool),
+	}
+}
+
+// AddLink configures the conditions of the one-way path from the
+// src prefix to the dst prefix using the given [LinkConfig].
+//
+// Packets matching multiple links use the most specific link (i.e., the
+// one where src and dst prefixes have the largest number of bits). Packets
+// not matching any link are delivered immediately.
+//
+// All the packets matching a link share its token bucket, so you can
+// model a shared bottleneck using broad prefixes.
+//
+// This method fails if the prefixes are invalid or if a link for
+// exactly the same prefixes already exists.
+func (r *Router) AddLink(src, dst netip.Prefix, config LinkConfig) error {
+	src, err := routeTableNormalize(src)
+	if err != nil {
+		return err
+	}
+	dst, err = routeTableNormalize(dst)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, lnk := range r.links {
+		if lnk.src == src && lnk.dst == dst {
+			return fmt.Errorf("duplicate link detected: %s -> %s", src.String(), dst.String())
+		}
+	}
+	r.links = append(r.links, newRouterLink(src, dst, config))
+	slices.SortStableFunc(r.links, func(a, b *routerLink) int {
+		return b.specificity() - a.specificity()
+	})
+	return nil
+}
+
+// Run routes packets until the context is done.
+//
+// The router uses the [*Internet] clock (see [InternetOptionClock]) to
+// schedule delayed packets. The router never advances a [*VirtualClock]
+// on its own: use [*Router.Step] to move virtual time forward.
+//
+// When the context is done, this method drops the packets that are still
+// waiting to be delivered and returns. Do not call Run concurrently.
+func (r *Router) Run(ctx context.Context) {
+	// 1. prepare for being notified when queued packets are due
+	clock := r.ix.clock
+	wakeup := make(chan struct{}, 1)
+	timer := clock.AfterFunc(time.Hour, func() {
+		select {
+		case wakeup <- struct{}{}:
+		default:
+		}
+	})
+	timer.Stop()
+	defer timer.Stop()
+
+	// 2. route until the context is done
+	defer r.reset()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case frame := <-r.ix.InFlight():
+			r.process(frame, 0, clock.Now())
+
+		case <-wakeup:
+			r.flush(clock.Now())
+
+		case reply := <-r.steps:
+			reply <- r.step(clock.(*VirtualClock))
+		}
+
+		if len(r.queue) > 0 {
+			timer.Reset(r.queue[0].when.Sub(clock.Now()))
+		}
+	}
+}
+
+// Step asks [*Router.Run] to process all the packets in flight, to advance the
+// [*VirtualClock] (see [InternetOptionClock]) to the deadline of its earliest
+// timer, and to deliver the queued packets that are due at the new time.
+//
+// The router cannot know whether the stacks and the application are still
+// going to send packets, so it is the caller's responsibility to invoke
+// Step only when the simulation is quiescent (e.g., all the goroutines are
+// waiting for a timer or for a packet). This makes virtual time depend only
+// on the sequence of steps rather than on goroutine scheduling.
+//
+// This method returns false when the clock is not a [*VirtualClock], when
+// the clock has no pending timers, or when the context is done before
+// [*Router.Run] handles the request. Because [*Internet.Run] does not expose
+// its [*Router], create the [*Router] using [NewRouter] to use this method.
+func (r *Router) Step(ctx context.Context) bool {
+	if _, ok := r.ix.clock.(*VirtualClock); !ok {
+		return false
+	}
+	reply := make(chan bool, 1)
+	select {
+	case r.steps <- reply:
+		return <-reply
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// step implements [*Router.Step] on the goroutine running [*Router.Run].
+func (r *Router) step(vclock *VirtualClock) bool {
+	// 1. process the packets in flight, if any
+	for drained := false; !drained; {
+		select {
+		case frame := <-r.ix.InFlight():
+			r.process(frame, 0, vclock.Now())
+		default:
+			drained = true
+		}
+	}
+
+	// 2. advance the clock and deliver the packets that are due
+	ok := vclock.AdvanceToNext()
+	r.flush(vclock.Now())
+	return ok
+}
+
+// process passes the given frame to the given stage of the processing
+// chain. Stages [0, len(r.policies)) are the policies, the next stage is
+// the link emulation, and the final stage is the delivery.
+func (r *Router) process(frame VNICFrame, stage int, now time.Time) {
+	switch {
+	case stage < len(r.policies):
+		r.policies[stage].HandleFrame(frame, &routerForwarder{r: r, stage: stage + 1, now: now})
+
+	case stage == len(r.policies):
+		r.emulate(frame, now)
+
+	default:
+		_ = r.ix.Deliver(frame)
+	}
+}
+
+// emulate applies the link emulation to the given frame.
+func (r *Router) emulate(frame VNICFrame, now time.Time) {
+	// 1. find the link to use, if any
+	stage := len(r.policies) + 1
+	lnk := r.findLink(frame)
+	if lnk == nil {
+		r.process(frame, stage, now)
+		return
+	}
+
+	// 2. enforce the link MTU, sending ICMP errors through the whole
+	// chain such that, e.g., a [*NAT] can translate them
+	pkts, reply := lnk.fit(frame.Packet)
+	if reply != nil {
+		r.process(VNICFrame{Packet: reply}, 0, now)
+	}
+
+	for _, pkt := range pkts {
+		// 3. decide whether and when to deliver
+		delay, ok := lnk.schedule(r.rng, now, len(pkt))
+		if !ok {
+			continue
+		}
+
+		// 4. deliver now or later
+		r.schedule(VNICFrame{Packet: pkt, sender: frame.sender}, stage, now, delay)
+	}
+}
+
+// schedule passes the frame to the given stage after the given delay.
+func (r *Router) schedule(frame VNICFrame, stage int, now time.Time, delay time.Duration) {
+	if delay <= 0 {
+		r.process(frame, stage, now)
+		return
+	}
+	heap.Push(&r.queue, &routerQueueEntry{
+		frame: frame,
+		seq:   r.seq,
+		stage: stage,
+		when:  now.Add(delay),
+	})
+	r.seq++
+}
+
+// findLink returns the most specific link matching the frame or nil.
+func (r *Router) findLink(frame VNICFrame) *routerLink {
+	src, dst, ok := internetParseAddrs(frame.Packet)
+	if !ok {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, lnk := range r.links {
+		if lnk.matches(src, dst) {
+			return lnk
+		}
+	}
+	return nil
+}
+
+// flush delivers all the queued packets that are due at the given time.
+func (r *Router) flush(now time.Time) {
+	for len(r.queue) > 0 && !r.queue[0].when.After(now) {
+		entry := heap.Pop(&r.queue).(*routerQueueEntry)
+		r.process(entry.frame, entry.stage, now)
+	}
+}
+
+// reset drops the queued packets.
+func (r *Router) reset() {
+	r.queue = routerQueue{}
+}
+
+// routerQueueEntry is an entry in the [routerQueue].
+type routerQueueEntry struct {
+	// frame is the frame to deliver.
+	frame VNICFrame
+
+	// seq is the sequence number used to break ties.
+	seq uint64
+
+	// stage is the processing stage to resume from.
+	stage int
+
+	// when is when to deliver the frame.
+	when time.Time
+}
+
+// routerQueue is a min-heap of [*routerQueueEntry] sorted by delivery time
+// and then by sequence number, such that packets due at the same time
+// are delivered in the same order in which they were queued.
+type routerQueue []*routerQueueEntry
+
+var _ heap.Interface = &routerQueue{}
+
+// Len implements [heap.Interface].
+func (q routerQueue) Len() int {
+	return len(q)
+}
+
+// Less implements [heap.Interface].
+func (q routerQueue) Less(i, j int) bool {
+	if !q[i].when.Equal(q[j].when) {
+		return q[i].when.Before(q[j].when)
+	}
+	return q[i].seq < q[j].seq
+}
+
+// Swap implements [heap.Interface].
+func (q routerQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+// Push implements [heap.Interface].
+func (q *routerQueue) Push(x any) {
+	*q = append(*q, x.(*routerQueueEntry))
+}
+
+// Pop implements [heap.Interface].
+func (q *routerQueue) Pop() any {
+	old := *q
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return entry
+}
+
+// PacketPolicy is a hook in the [*Router] packet processing chain.
+//
+// A policy may inspect the frame, modify it, drop it (by not forwarding
+// it), delay it (using [PacketForwarder.ForwardAfter]), duplicate it (by
+// forwarding it more than once), or inject new frames (by forwarding them).
+//
+// The [*Router] invokes policies from the goroutine running [*Router.Run],
+// hence policies must not block. Policies sharing mutable state with other
+// goroutines are responsible for providing mutual exclusion.
+type PacketPolicy interface {
+	HandleFrame(frame VNICFrame, fwd PacketForwarder)
+}
+
+// PacketPolicyFunc adapts a func to be a [PacketPolicy].
+type PacketPolicyFunc func(frame VNICFrame, fwd PacketForwarder)
+
+var _ PacketPolicy = PacketPolicyFunc(nil)
+
+// HandleFrame implements [PacketPolicy].
+func (fx PacketPolicyFunc) HandleFrame(frame VNICFrame, fwd PacketForwarder) {
+	fx(frame, fwd)
+}
+
+// PacketForwarder forwards frames to the next stage of the [*Router] chain.
+//
+// A [PacketForwarder] is only valid during the [PacketPolicy] HandleFrame
+// invocation that received it and must not be retained.
+//
+// Policies that modify frames must not modify the Packet in place since
+// other policies (e.g., for duplication) may retain references to it.
+// Copy the packet before modifying it instead.
+type PacketForwarder interface {
+	// Forward immediately passes the frame to the next stage.
+	Forward(frame VNICFrame)
+
+	// ForwardAfter passes the frame to the next stage after the given delay.
+	ForwardAfter(delay time.Duration, frame VNICFrame)
+}
+
+// routerForwarder implements [PacketForwarder] for the [*Router].
+type routerForwarder struct {
+	r     *Router
+	stage int
+	now   time.Time
+}
+
+var _ PacketForwarder = &routerForwarder{}
+
+// Forward implements [PacketForwarder].
+func (fwd *routerForwarder) Forward(frame VNICFrame) {
+	fwd.r.process(frame, fwd.stage, fwd.now)
+}
+
+// ForwardAfter implements [PacketForwarder].
+func (fwd *routerForwarder) ForwardAfter(delay time.Duration, frame VNICFrame) {
+	fwd.r.schedule(frame, fwd.stage, fwd.now, delay)
+}
@@ -0,0 +1,262 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/require"
+)
+
+// routerTestEnv is the environment used by router tests.
+type routerTestEnv struct {
+	ix   *uis.Internet
+	src  *uis.VNIC
+	disp *countingDispatcher
+	dst  netip.Addr
+}
+
+// newRouterTestEnv creates a [*routerTestEnv] where src sends to dst.
+func newRouterTestEnv(t *testing.T) *routerTestEnv {
+	ix := uis.NewInternet()
+	src := ix.NewVNIC(uis.MTUEthernet)
+	require.NoError(t, ix.AddRoute(src, netip.MustParseAddr("10.0.0.2")))
+
+	dst := netip.MustParseAddr("10.0.0.1")
+	vnic := ix.NewVNIC(uis.MTUEthernet)
+	disp := &countingDispatcher{}
+	vnic.Attach(disp)
+	require.NoError(t, ix.AddRoute(vnic, dst))
+
+	return &routerTestEnv{ix: ix, src: src, disp: disp, dst: dst}
+}
+
+// send sends a packet from src to dst.
+func (env *routerTestEnv) send(t *testing.T) {
+	pkts := makePacketList(newTestIPv4Packet(env.dst))
+	defer pkts.DecRef()
+	num, err := env.src.WritePackets(pkts)
+	require.True(t, err == nil)
+	require.Equal(t, 1, num)
+}
+
+// run runs the router in the background until the test ends.
+func (env *routerTestEnv) run(t *testing.T, router *uis.Router) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		router.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestRouterAddLinkFailures(t *testing.T) {
+	router := uis.NewRouter(uis.NewInternet())
+	any4 := netip.MustParsePrefix("0.0.0.0/0")
+
+	require.Error(t, router.AddLink(netip.Prefix{}, any4, uis.LinkConfig{}))
+	require.Error(t, router.AddLink(any4, netip.Prefix{}, uis.LinkConfig{}))
+	require.NoError(t, router.AddLink(any4, any4, uis.LinkConfig{}))
+	require.Error(t, router.AddLink(any4, any4, uis.LinkConfig{}))
+}
+
+func TestRouterWithoutLinks(t *testing.T) {
+	env := newRouterTestEnv(t)
+	env.run(t, uis.NewRouter(env.ix))
+	env.send(t)
+	require.Eventually(t, func() bool {
+		return env.disp.count.Load() == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestRouterDelay(t *testing.T) {
+	env := newRouterTestEnv(t)
+	router := uis.NewRouter(env.ix)
+	require.NoError(t, router.AddLink(
+		netip.MustParsePrefix("10.0.0.2/32"),
+		netip.MustParsePrefix("10.0.0.1/32"),
+		uis.LinkConfig{Delay: 200 * time.Millisecond},
+	))
+	env.run(t, router)
+
+	t0 := time.Now()
+	env.send(t)
+	require.Eventually(t, func() bool {
+		return env.disp.count.Load() == 1
+	}, 5*time.Second, time.Millisecond)
+	require.GreaterOrEqual(t, time.Since(t0), 200*time.Millisecond)
+}
+
+func TestRouterLoss(t *testing.T) {
+	env := newRouterTestEnv(t)
+	router := uis.NewRouter(env.ix, uis.RouterOptionSeed(1))
+	require.NoError(t, router.AddLink(
+		netip.MustParsePrefix("0.0.0.0/0"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+		uis.LinkConfig{Loss: uis.RandomLoss{Probability: 1}},
+	))
+	env.run(t, router)
+
+	for range 16 {
+		env.send(t)
+	}
+	time.Sleep(100 * time.Millisecond)
+	require.Zero(t, env.disp.count.Load())
+}
+
+func TestRouterPolicies(t *testing.T) {
+	t.Run("drop", func(t *testing.T) {
+		env := newRouterTestEnv(t)
+		var seen atomic.Uint32
+		policy := uis.PacketPolicyFunc(func(frame uis.VNICFrame, fwd uis.PacketForwarder) {
+			seen.Add(1)
+		})
+		env.run(t, uis.NewRouter(env.ix, uis.RouterOptionPolicy(policy)))
+		env.send(t)
+		require.Eventually(t, func() bool {
+			return seen.Load() == 1
+		}, time.Second, time.Millisecond)
+		require.Zero(t, env.disp.count.Load())
+	})
+
+	t.Run("duplicate", func(t *testing.T) {
+		env := newRouterTestEnv(t)
+		policy := uis.PacketPolicyFunc(func(frame uis.VNICFrame, fwd uis.PacketForwarder) {
+			fwd.Forward(frame)
+			fwd.Forward(frame)
+		})
+		env.run(t, uis.NewRouter(env.ix, uis.RouterOptionPolicy(policy)))
+		env.send(t)
+		require.Eventually(t, func() bool {
+			return env.disp.count.Load() == 2
+		}, time.Second, time.Millisecond)
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		env := newRouterTestEnv(t)
+		policy := uis.PacketPolicyFunc(func(frame uis.VNICFrame, fwd uis.PacketForwarder) {
+			fwd.ForwardAfter(200*time.Millisecond, frame)
+		})
+		env.run(t, uis.NewRouter(env.ix, uis.RouterOptionPolicy(policy)))
+		t0 := time.Now()
+		env.send(t)
+		require.Eventually(t, func() bool {
+			return env.disp.count.Load() == 1
+		}, 5*time.Second, time.Millisecond)
+		require.GreaterOrEqual(t, time.Since(t0), 200*time.Millisecond)
+	})
+
+	t.Run("chain_order", func(t *testing.T) {
+		env := newRouterTestEnv(t)
+		var order []string
+		var mu sync.Mutex
+		makePolicy := func(name string) uis.PacketPolicy {
+			return uis.PacketPolicyFunc(func(frame uis.VNICFrame, fwd uis.PacketForwarder) {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				fwd.Forward(frame)
+			})
+		}
+		env.run(t, uis.NewRouter(env.ix, uis.RouterOptionPolicy(makePolicy("a"), makePolicy("b"))))
+		env.send(t)
+		require.Eventually(t, func() bool {
+			return env.disp.count.Load() == 1
+		}, time.Second, time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		require.Equal(t, []string{"a", "b"}, order)
+	})
+}
+
+func TestInternetRun(t *testing.T) {
+	env := newRouterTestEnv(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		env.ix.Run(ctx)
+	}()
+	env.send(t)
+	require.Eventually(t, func() bool {
+		return env.disp.count.Load() == 1
+	}, time.Second, time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestRouterPathMTU(t *testing.T) {
+	cases := []struct {
+		name   string
+		prefix string
+		client string
+		server string
+	}{
+		{"ipv4", "0.0.0.0/0", "10.0.0.2", "10.0.0.1"},
+		{"ipv6", "::/0", "2001:db8::2", "2001:db8::1"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ix := uis.NewInternet()
+			server, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr(tc.server))
+			require.NoError(t, err)
+			t.Cleanup(server.Close)
+			client, err := ix.NewStack(uis.MTUEthernet, netip.MustParseAddr(tc.client))
+			require.NoError(t, err)
+			t.Cleanup(client.Close)
+
+			// the path between client and server has a bottleneck MTU
+			router := uis.NewRouter(ix)
+			prefix := netip.MustParsePrefix(tc.prefix)
+			require.NoError(t, router.AddLink(prefix, prefix, uis.LinkConfig{MTU: uis.MTUMinimumIPv6}))
+			env := &routerTestEnv{ix: ix}
+			env.run(t, router)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			endpoint := netip.AddrPortFrom(netip.MustParseAddr(tc.server), 80).String()
+			listener, err := uis.NewListenConfig(server).Listen(ctx, "tcp", endpoint)
+			require.NoError(t, err)
+			t.Cleanup(func() { listener.Close() })
+
+			payload := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+			received := make(chan []byte, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					received <- nil
+					return
+				}
+				defer conn.Close()
+				data := make([]byte, len(payload))
+				_, _ = io.ReadFull(conn, data)
+				received <- data
+			}()
+
+			conn, err := uis.NewConnector(client).DialContext(ctx, "tcp", endpoint)
+			require.NoError(t, err)
+			defer conn.Close()
+			_, err = conn.Write(payload)
+			require.NoError(t, err)
+
+			select {
+			case data := <-received:
+				require.Equal(t, payload, data)
+			case <-ctx.Done():
+				t.Fatal(ctx.Err())
+			}
+		})
+	}
+}
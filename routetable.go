@@ -0,0 +1,180 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+)
+
+// routeTable is a longest-prefix-match routing table.
+//
+// This type is not goroutine safe. The caller is responsible
+// for providing mutual exclusion.
+type routeTable struct {
+	// routes maps masked prefixes to the owning NIC.
+	routes map[netip.Prefix]*VNIC
+
+	// bits4 contains the IPv4 prefix lengths in use sorted in descending order.
+	bits4 []int
+
+	// bits6 contains the IPv6 prefix lengths in use sorted in descending order.
+	bits6 []int
+}
+
+// newRouteTable creates a new, empty [*routeTable].
+func newRouteTable() *routeTable {
+	return &routeTable{
+		routes: make(map[netip.Prefix]*VNIC),
+		bits4:  []int{},
+		bits6:  []int{},
+	}
+}
+
+// routeTableNormalize validates the prefix and returns its masked form.
+func routeTableNormalize(prefix netip.Prefix) (netip.Prefix, error) {
+	if !prefix.IsValid() {
+		return netip.Prefix{}, fmt.Errorf("invalid prefix: %s", prefix.String())
+	}
+	return prefix.Masked(), nil
+}
+
+// add registers all the given prefixes as routes toward the given [*VNIC].
+//
+// This method fails, without modifying the table, if any of the
+// prefixes is invalid or already in use.
+func (rt *routeTable) add(vnic *VNIC, prefixes ...netip.Prefix) error {
+	masked, err := routeTableNormalizeAll(prefixes...)
+	if err != nil {
+		return err
+	}
+	for idx, prefix := range masked {
+		if _, found := rt.routes[prefix]; found || slices.Contains(masked[:idx], prefix) {
+			return fmt.Errorf("duplicate prefix detected: %s", prefix.String())
+		}
+	}
+	for _, prefix := range masked {
+		rt.routes[prefix] = vnic
+	}
+	rt.reindex()
+	return nil
+}
+
+// reindex rebuilds the lists of prefix lengths in use.
+func (rt *routeTable) reindex() {
+	rt.bits4 = rt.bits4[:0]
+	rt.bits6 = rt.bits6[:0]
+	for prefix := range rt.routes {
+		switch {
+		case prefix.Addr().Is4():
+			if !slices.Contains(rt.bits4, prefix.Bits()) {
+				rt.bits4 = append(rt.bits4, prefix.Bits())
+			}
+		default:
+			if !slices.Contains(rt.bits6, prefix.Bits()) {
+				rt.bits6 = append(rt.bits6, prefix.Bits())
+			}
+		}
+	}
+	slices.Sort(rt.bits4)
+	slices.Reverse(rt.bits4)
+	slices.Sort(rt.bits6)
+	slices.Reverse(rt.bits6)
+}
+
+// lookup returns the [*VNIC] owning the longest prefix matching
+// the given address or nil if there is no matching route.
+func (rt *routeTable) lookup(addr netip.Addr) *VNIC {
+	bits := rt.bits6
+	if addr.Is4() {
+		bits = rt.bits4
+	}
+	for _, bitlen := range bits {
+		prefix, err := addr.Prefix(bitlen)
+		if err != nil {
+			continue
+		}
+		if vnic := rt.routes[prefix]; vnic != nil {
+			return vnic
+		}
+	}
+	return nil
+}
+
+// vnics returns the [*VNIC] owning at least an IPv4 prefix, when is4 is
+// true, or an IPv6 prefix, otherwise, using a deterministic order.
+func (rt *routeTable) vnics(is4 bool) []*VNIC {
+	prefixes := slices.Collect(maps.Keys(rt.routes))
+	slices.SortFunc(prefixes, func(a, b netip.Prefix) int {
+		return a.Compare(b)
+	})
+	var vnics []*VNIC
+	for _, prefix := range prefixes {
+		vnic := rt.routes[prefix]
+		if prefix.Addr().Is4() == is4 && !slices.Contains(vnics, vnic) {
+			vnics = append(vnics, vnic)
+		}
+	}
+	return vnics
+}
+
+// replace registers all the given prefixes as routes toward the given [*VNIC]
+// overriding any existing route for the same prefixes.
+//
+// This method fails, without modifying the table, if any of the
+// prefixes is invalid.
+func (rt *routeTable) replace(vnic *VNIC, prefixes ...netip.Prefix) error {
+	masked, err := routeTableNormalizeAll(prefixes...)
+	if err != nil {
+		return err
+	}
+	for _, prefix := range masked {
+		rt.routes[prefix] = vnic
+	}
+	rt.reindex()
+	return nil
+}
+
+// remove unregisters all the given prefixes.
+//
+// This method fails, without modifying the table, if any of the
+// prefixes is invalid or not registered.
+func (rt *routeTable) remove(prefixes ...netip.Prefix) error {
+	masked, err := routeTableNormalizeAll(prefixes...)
+	if err != nil {
+		return err
+	}
+	for _, prefix := range masked {
+		if _, found := rt.routes[prefix]; !found {
+			return fmt.Errorf("no such prefix: %s", prefix.String())
+		}
+	}
+	for _, prefix := range masked {
+		delete(rt.routes, prefix)
+	}
+	rt.reindex()
+	return nil
+}
+
+// removeVNIC unregisters all the routes toward the given [*VNIC].
+func (rt *routeTable) removeVNIC(vnic *VNIC) {
+	maps.DeleteFunc(rt.routes, func(_ netip.Prefix, value *VNIC) bool {
+		return value == vnic
+	})
+	rt.reindex()
+}
+
+// routeTableNormalizeAll is like routeTableNormalize but for many prefixes.
+func routeTableNormalizeAll(prefixes ...netip.Prefix) ([]netip.Prefix, error) {
+	masked := make([]netip.Prefix, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		prefix, err := routeTableNormalize(prefix)
+		if err != nil {
+			return nil, err
+		}
+		masked = append(masked, prefix)
+	}
+	return masked, nil
+}
@@ -9,119 +9,691 @@ package uis
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	randv2 "math/rand/v2"
+	"net"
 	"net/netip"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/bassosimone/runtimex"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
 )
 
 // Stack is a wrapper for [*stack.Stack] allowing basic network
 // operations with gVisor's TCP and UDP conns.
 //
-// Construct using [NewStack].
+// Construct using [NewStack] or [NewMultiNICStack].
 type Stack struct {
 	Stack *stack.Stack
+
+	// nic is the NIC to which we bind endpoints or zero to
+	// let gVisor choose the NIC using the route table.
+	nic tcpip.NICID
 }
 
 // stackNICID is the NIC ID used by [NewStack] for the single NIC configuration.
 const stackNICID = 1
 
+// StackNIC configures a NIC of a [*Stack] created using [NewMultiNICStack].
+type StackNIC struct {
+	// Addrs contains the IPv4/IPv6 addresses to configure.
+	Addrs []netip.Addr
+
+	// Link is the [stack.LinkEndpoint] to use (e.g., a [*VNIC]).
+	Link stack.LinkEndpoint
+}
+
+// StackRoute is a route of a [*Stack] created using [NewMultiNICStack].
+type StackRoute struct {
+	// Destination is the destination prefix (e.g., 0.0.0.0/0).
+	Destination netip.Prefix
+
+	// Gateway is the OPTIONAL address of the next hop.
+	Gateway netip.Addr
+
+	// NIC is the ID of the NIC to use, which is the one-based index
+	// of the NIC within the [StackNIC] list.
+	NIC tcpip.NICID
+}
+
+// StackOption is an option for [NewStackWithOptions].
+type StackOption func(cfg *stackConfig)
+
+// stackConfig is the internal type modified by [StackOption].
+type stackConfig struct {
+	clock              tcpip.Clock
+	dad                stack.DADConfigurations
+	forwarding         bool
+	gateway4           netip.Addr
+	gateway6           netip.Addr
+	multicast          bool
+	randSource         rand.Source
+	secureRNG          io.Reader
+	tcpNoTimestamps    bool
+	tcpNoWindowScaling bool
+	tcpOptions         []tcpip.SettableTransportProtocolOption
+}
+
+// StackOptionClock sets the [tcpip.Clock] used by the stack.
+//
+// The default is to use the wall clock. Use a [*VirtualClock] to
+// control the passing of time within the stack.
+func StackOptionClock(clock tcpip.Clock) StackOption {
+	return func(cfg *stackConfig) {
+		cfg.clock = clock
+	}
+}
+
+// StackOptionDAD enables duplicate address detection using the given number of
+// probes sent every retransmit interval. This option only makes sense when using
+// an [*EthernetVNIC], since the [*VNIC] does not perform neighbor discovery.
+//
+// With DAD enabled, IPv6 addresses are tentative, thus unusable, until the stack
+// completes the detection (i.e., after transmits times retransmit) and the stack
+// removes the addresses that another host on the same link is already using.
+// For IPv4, this option configures the ARP probes that [stack.Stack.CheckDuplicateAddress]
+// uses, since gVisor does not automatically check IPv4 addresses.
+//
+// The default is to disable DAD. Passing zero transmits also disables DAD.
+func StackOptionDAD(transmits uint8, retransmit time.Duration) StackOption {
+	return func(cfg *stackConfig) {
+		cfg.dad = stack.DADConfigurations{
+			DupAddrDetectTransmits: transmits,
+			RetransmitTimer:        retransmit,
+		}
+	}
+}
+
+// StackOptionForwarding enables IPv4 and IPv6 forwarding on all the NICs, such
+// that the stack forwards the packets it receives for other hosts using its route
+// table, decrementing the TTL and sending ICMP errors like a real router does.
+//
+// The default is to disable forwarding. See also [NewRouterStack].
+func StackOptionForwarding() StackOption {
+	return func(cfg *stackConfig) {
+		cfg.forwarding = true
+	}
+}
+
+// StackOptionGateway sets the IPv4 and/or IPv6 gateways used by the default
+// routes of stacks created using [NewStackWithOptions] and [NewStackWithPrefixes].
+//
+// We use the first IPv4 address as the IPv4 gateway and the first IPv6
+// address as the IPv6 gateway, ignoring the other addresses.
+//
+// The default is to have no gateways, thus the stack sends all packets
+// directly to their destination. This does not make a difference when using
+// a [*VNIC], which does not have link-layer addresses. Conversely, when using
+// an [*EthernetVNIC], the stack resolves the gateway address and sends to the
+// gateway the packets for the destinations outside of the on-link subnets.
+//
+// This option is ignored by [NewMultiNICStack], which uses explicit routes.
+func StackOptionGateway(addrs ...netip.Addr) StackOption {
+	return func(cfg *stackConfig) {
+		for _, addr := range addrs {
+			switch {
+			case addr.Is4() && !cfg.gateway4.IsValid():
+				cfg.gateway4 = addr
+			case addr.Is6() && !cfg.gateway6.IsValid():
+				cfg.gateway6 = addr
+			}
+		}
+	}
+}
+
+// StackOptionMulticast enables IGMP and MLD, such that the stack sends the
+// membership reports that the [*Internet] snoops to learn which stacks joined
+// which multicast groups (see [*Internet.Deliver]).
+//
+// The default is to disable IGMP and MLD, since they cause the stack to send
+// unsolicited reports (e.g., for the IPv6 solicited-node groups), which would
+// otherwise show up in [*Internet.InFlight], in packet traces, and in the router
+// queues, and arm report timers on the clock. Without this option, the stack can
+// still join groups, but the [*Internet] does not deliver the group traffic to it.
+func StackOptionMulticast() StackOption {
+	return func(cfg *stackConfig) {
+		cfg.multicast = true
+	}
+}
+
+// StackOptionRandSource sets the [rand.Source] used by the stack to
+// generate non-cryptographic random numbers (e.g., ephemeral ports).
+//
+// The source must be safe for concurrent use. The default is to use
+// a source seeded by the stack secure random number generator.
+func StackOptionRandSource(source rand.Source) StackOption {
+	return func(cfg *stackConfig) {
+		cfg.randSource = source
+	}
+}
+
+// StackOptionSecureRNG sets the [io.Reader] used by the stack to generate
+// cryptographic random numbers (e.g., TCP initial sequence numbers).
+//
+// The reader must be safe for concurrent use. The default is to use
+// the operating system cryptographically secure random number generator.
+func StackOptionSecureRNG(reader io.Reader) StackOption {
+	return func(cfg *stackConfig) {
+		cfg.secureRNG = reader
+	}
+}
+
+// StackOptionSeed configures both [StackOptionRandSource] and
+// [StackOptionSecureRNG] to use deterministic generators derived
+// from the given seed.
+//
+// Stacks created with the same seed generate the same TCP initial
+// sequence numbers, ephemeral ports, and IP IDs. When combined with
+// a [*VirtualClock] (see [InternetOptionClock]), this allows to obtain
+// byte-identical packet traces across runs. Use distinct seeds for
+// distinct stacks within the same simulation.
+//
+// The secure RNG stand-in is deterministic and MUST only be used for testing.
+func StackOptionSeed(seed uint64) StackOption {
+	return func(cfg *stackConfig) {
+		cfg.randSource = &stackLockedSource{src: rand.NewSource(int64(seed))}
+		var key [32]byte
+		binary.LittleEndian.PutUint64(key[:], seed)
+		cfg.secureRNG = &stackLockedReader{r: randv2.NewChaCha8(key)}
+	}
+}
+
+// stackLockedSource is a [rand.Source] safe for concurrent use.
+type stackLockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+var _ rand.Source = &stackLockedSource{}
+
+// Int63 implements [rand.Source].
+func (s *stackLockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+// Seed implements [rand.Source].
+func (s *stackLockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// stackLockedReader is an [io.Reader] safe for concurrent use.
+type stackLockedReader struct {
+	mu sync.Mutex
+	r  io.Reader
+}
+
+var _ io.Reader = &stackLockedReader{}
+
+// Read implements [io.Reader].
+func (r *stackLockedReader) Read(data []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.r.Read(data)
+}
+
 // NewStack creates a new [*Stack] using a [stack.LinkEndpoint].
+//
+// This function is equivalent to [NewStackWithOptions] without options.
 func NewStack(vnic stack.LinkEndpoint, addrs ...netip.Addr) *Stack {
-	// 1. create options for the new stack
-	stackOptions := stack.Options{
-		NetworkProtocols: []stack.NetworkProtocolFactory{
-			ipv4.NewProtocol,
-			ipv6.NewProtocol,
-		},
-		TransportProtocols: []stack.TransportProtocolFactory{
-			tcp.NewProtocol,
-			udp.NewProtocol,
-			icmp.NewProtocol4,
-			icmp.NewProtocol6,
-		},
-		HandleLocal: true,
-	}
+	return NewStackWithOptions(vnic, addrs)
+}
 
-	// 2. create the network stack itself
-	nsp := stack.New(stackOptions)
+// NewStackWithOptions creates a new [*Stack] using a [stack.LinkEndpoint],
+// the given addresses, and the given options.
+//
+// This function is equivalent to [NewStackWithPrefixes] with host-only
+// prefixes (i.e., /32 for IPv4 and /128 for IPv6).
+func NewStackWithOptions(vnic stack.LinkEndpoint, addrs []netip.Addr, options ...StackOption) *Stack {
+	return NewStackWithPrefixes(vnic, internetAddrsToPrefixes(addrs...), options...)
+}
+
+// NewStackWithPrefixes creates a new [*Stack] using a [stack.LinkEndpoint],
+// the given addresses along with the prefix length of their on-link subnet
+// (e.g., 10.0.0.2/24), and the given options.
+//
+// The stack routes the packets for the on-link subnets directly to their
+// destination and all the other packets using default routes for both
+// protocol families, which use the gateways configured with [StackOptionGateway].
+func NewStackWithPrefixes(vnic stack.LinkEndpoint, prefixes []netip.Prefix, options ...StackOption) *Stack {
+	// 1. create the network stack itself
+	cfg := stackNewConfig(options...)
+	nsp := stackNew(cfg)
 
-	// 3. attach the provided NIC to the gvisor stack
-	runtimex.Assert(nsp.CreateNIC(stackNICID, vnic) == nil)
+	// 2. attach the provided NIC to the gvisor stack
+	runtimex.Assert(nsp.CreateNIC(stackNICID, tcpWrapLinkEndpoint(cfg, vnic)) == nil)
 
-	// 4. configure all the provided addresses
-	for _, addr := range addrs {
-		protoAddr := stackAddrToProtocolAddress(addr)
+	// 3. configure all the provided addresses
+	for _, prefix := range prefixes {
+		protoAddr := stackPrefixToProtocolAddress(prefix)
 		properties := stack.AddressProperties{}
 		runtimex.Assert(nsp.AddProtocolAddress(stackNICID, protoAddr, properties) == nil)
 	}
 
+	// 4. add routes for the on-link subnets
+	var table []tcpip.Route
+	for _, prefix := range prefixes {
+		if !prefix.IsSingleIP() {
+			table = append(table, tcpip.Route{
+				Destination: stackPrefixToSubnet(prefix),
+				Gateway:     tcpip.Address{},
+				NIC:         stackNICID,
+			})
+		}
+	}
+
 	// 5. add default routes for both protocol families
-	nsp.AddRoute(tcpip.Route{
+	table = append(table, tcpip.Route{
 		Destination: header.IPv4EmptySubnet,
+		Gateway:     stackAddrToAddress(cfg.gateway4),
 		NIC:         stackNICID,
 	})
-	nsp.AddRoute(tcpip.Route{
+	table = append(table, tcpip.Route{
 		Destination: header.IPv6EmptySubnet,
+		Gateway:     stackAddrToAddress(cfg.gateway6),
 		NIC:         stackNICID,
 	})
+	nsp.SetRouteTable(stackSortRoutes(table))
 
-	return &Stack{nsp}
+	return &Stack{Stack: nsp, nic: stackNICID}
 }
 
-func stackAddrToProtocolAddress(addr netip.Addr) tcpip.ProtocolAddress {
-	switch {
-	case addr.Is4():
-		return tcpip.ProtocolAddress{
-			Protocol:          ipv4.ProtocolNumber,
-			AddressWithPrefix: tcpip.AddrFromSlice(addr.AsSlice()).WithPrefix(),
+// NewMultiNICStack creates a new [*Stack] with the given NICs, which may be
+// attached to distinct networks (e.g., distinct [*Internet] instances), and
+// the given route table, which allows to simulate multihomed hosts.
+//
+// The NIC IDs are the one-based indexes of the NICs within the list.
+//
+// Unlike [NewStackWithOptions], this function does not add default routes,
+// so you MUST provide all the routes. When multiple routes match, the stack
+// uses the one with the longest prefix. Also, the endpoints created by the
+// returned [*Stack] are not bound to a specific NIC, so the stack selects the
+// NIC using the local address, when specified, or the route table.
+//
+// This function fails if there are no NICs, if a route is invalid or refers
+// to a nonexistent NIC, or if gVisor refuses the configuration.
+func NewMultiNICStack(nics []StackNIC, routes []StackRoute, options ...StackOption) (*Stack, error) {
+	// 1. convert and validate the routes
+	if len(nics) <= 0 {
+		return nil, errors.New("no NICs")
+	}
+	table := make([]tcpip.Route, 0, len(routes))
+	for _, route := range routes {
+		entry, err := stackNewRoute(route, len(nics))
+		if err != nil {
+			return nil, err
 		}
+		table = append(table, entry)
+	}
 
-	default:
-		return tcpip.ProtocolAddress{
-			Protocol:          ipv6.ProtocolNumber,
-			AddressWithPrefix: tcpip.AddrFromSlice(addr.AsSlice()).WithPrefix(),
+	// 2. create the network stack itself
+	cfg := stackNewConfig(options...)
+	nsp := stackNew(cfg)
+
+	// 3. attach the NICs and configure their addresses
+	for idx, nic := range nics {
+		nicID := tcpip.NICID(idx + 1)
+		if tcpErr := nsp.CreateNIC(nicID, tcpWrapLinkEndpoint(cfg, nic.Link)); tcpErr != nil {
+			nsp.Destroy()
+			return nil, fmt.Errorf("cannot create NIC %d: %s", nicID, tcpErr)
 		}
+		for _, addr := range nic.Addrs {
+			protoAddr := stackAddrToProtocolAddress(addr)
+			properties := stack.AddressProperties{}
+			if tcpErr := nsp.AddProtocolAddress(nicID, protoAddr, properties); tcpErr != nil {
+				nsp.Destroy()
+				return nil, fmt.Errorf("cannot add %s to NIC %d: %s", addr, nicID, tcpErr)
+			}
+		}
+	}
+
+	// 4. install the route table
+	nsp.SetRouteTable(stackSortRoutes(table))
+
+	return &Stack{Stack: nsp, nic: 0}, nil
+}
+
+// NewRouterStack is like [NewMultiNICStack] but additionally enables forwarding
+// (see [StackOptionForwarding]), such that the stack routes packets between its
+// NICs using the given routes. Because the NICs may be attached to distinct
+// [*Internet] instances, this allows to use gVisor as a router between network
+// segments, or as a tunnel endpoint forwarding decapsulated traffic.
+//
+// Remember to route the prefixes behind the router toward the router NICs (see
+// [*Internet.AddPrefixRoute]) so that the [*Internet] delivers the packets for
+// such prefixes to the router.
+func NewRouterStack(nics []StackNIC, routes []StackRoute, options ...StackOption) (*Stack, error) {
+	return NewMultiNICStack(nics, routes, append(slices.Clip(options), StackOptionForwarding())...)
+}
+
+// stackNewRoute converts a [StackRoute] to a [tcpip.Route].
+func stackNewRoute(route StackRoute, numNICs int) (tcpip.Route, error) {
+	if !route.Destination.IsValid() {
+		return tcpip.Route{}, fmt.Errorf("invalid route destination: %s", route.Destination)
+	}
+	if route.NIC < 1 || int(route.NIC) > numNICs {
+		return tcpip.Route{}, fmt.Errorf("no such NIC: %d", route.NIC)
+	}
+	if route.Gateway.IsValid() && route.Gateway.Is4() != route.Destination.Addr().Is4() {
+		return tcpip.Route{}, fmt.Errorf("gateway %s does not match %s", route.Gateway, route.Destination)
+	}
+	entry := tcpip.Route{
+		Destination: stackPrefixToSubnet(route.Destination),
+		Gateway:     stackAddrToAddress(route.Gateway),
+		NIC:         route.NIC,
+	}
+	return entry, nil
+}
+
+// stackSortRoutes sorts the routes by descending prefix length, which
+// is needed because gVisor uses the first matching route.
+func stackSortRoutes(table []tcpip.Route) []tcpip.Route {
+	slices.SortStableFunc(table, func(a, b tcpip.Route) int {
+		return b.Destination.Prefix() - a.Destination.Prefix()
+	})
+	return table
+}
+
+// stackNewConfig creates the [*stackConfig] using the given options.
+func stackNewConfig(options ...StackOption) *stackConfig {
+	cfg := &stackConfig{
+		clock:              nil, // gVisor uses the wall clock by default
+		dad:                stack.DADConfigurations{},
+		forwarding:         false,
+		gateway4:           netip.Addr{},
+		gateway6:           netip.Addr{},
+		multicast:          false,
+		randSource:         nil, // gVisor seeds using the secure RNG by default
+		secureRNG:          nil, // gVisor uses crypto/rand by default
+		tcpNoTimestamps:    false,
+		tcpNoWindowScaling: false,
+		tcpOptions:         nil, // gVisor uses its own defaults
+	}
+	for _, opt := range options {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// stackNew creates a new [*stack.Stack] without NICs using the given config.
+func stackNew(cfg *stackConfig) *stack.Stack {
+	nsp := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocolFactory{
+			ipv4.NewProtocolWithOptions(ipv4.Options{
+				IGMP: ipv4.IGMPOptions{Enabled: cfg.multicast},
+			}),
+			ipv6.NewProtocolWithOptions(ipv6.Options{
+				DADConfigs: cfg.dad,
+				MLD:        ipv6.MLDOptions{Enabled: cfg.multicast},
+			}),
+			arp.NewProtocolWithOptions(arp.Options{DADConfigs: cfg.dad}),
+		},
+		TransportProtocols: []stack.TransportProtocolFactory{
+			tcp.NewProtocol,
+			udp.NewProtocol,
+			icmp.NewProtocol4,
+			icmp.NewProtocol6,
+		},
+		HandleLocal: true,
+		Clock:       cfg.clock,
+		RandSource:  cfg.randSource,
+		SecureRNG:   cfg.secureRNG,
+	})
+	if cfg.forwarding {
+		// Note: this also sets the default for the NICs we create later
+		runtimex.Assert(nsp.SetForwardingDefaultAndAllNICs(ipv4.ProtocolNumber, true) == nil)
+		runtimex.Assert(nsp.SetForwardingDefaultAndAllNICs(ipv6.ProtocolNumber, true) == nil)
+	}
+	for _, opt := range cfg.tcpOptions {
+		// Note: the options validate their values before adding them
+		runtimex.Assert(nsp.SetTransportProtocolOption(tcp.ProtocolNumber, opt) == nil)
+	}
+	return nsp
+}
+
+func stackAddrToProtocolAddress(addr netip.Addr) tcpip.ProtocolAddress {
+	return stackPrefixToProtocolAddress(netip.PrefixFrom(addr, addr.BitLen()))
+}
+
+// stackPrefixToProtocolAddress converts an address along with the prefix
+// length of its subnet (e.g., 10.0.0.2/24) to a [tcpip.ProtocolAddress].
+func stackPrefixToProtocolAddress(prefix netip.Prefix) tcpip.ProtocolAddress {
+	protocol := ipv6.ProtocolNumber
+	if prefix.Addr().Is4() {
+		protocol = ipv4.ProtocolNumber
+	}
+	return tcpip.ProtocolAddress{
+		Protocol: protocol,
+		AddressWithPrefix: tcpip.AddressWithPrefix{
+			Address:   stackAddrToAddress(prefix.Addr()),
+			PrefixLen: prefix.Bits(),
+		},
+	}
+}
+
+// stackPrefixToSubnet converts a [netip.Prefix] to a [tcpip.Subnet].
+func stackPrefixToSubnet(prefix netip.Prefix) tcpip.Subnet {
+	return tcpip.AddressWithPrefix{
+		Address:   stackAddrToAddress(prefix.Addr()),
+		PrefixLen: prefix.Bits(),
+	}.Subnet()
+}
+
+// stackAddrToAddress converts a [netip.Addr] to a [tcpip.Address], mapping
+// the zero value to the empty address (e.g., to represent no gateway).
+func stackAddrToAddress(addr netip.Addr) tcpip.Address {
+	if !addr.IsValid() {
+		return tcpip.Address{}
 	}
+	return tcpip.AddrFromSlice(addr.AsSlice())
 }
 
 // DialTCP establishes a new [*gonet.TCPConn].
 func (sx *Stack) DialTCP(ctx context.Context, addr netip.AddrPort) (*gonet.TCPConn, error) {
-	return gonet.DialContextTCP(ctx, sx.Stack, stackAddrPortToFullAddress(addr),
+	return gonet.DialContextTCP(ctx, sx.Stack, stackAddrPortToFullAddress(sx.nic, addr),
 		stackAddrPortToNetworkProtocolNumber(addr))
 }
 
 // ListenTCP creates a new [*gonet.TCPListener].
 func (sx *Stack) ListenTCP(addr netip.AddrPort) (*gonet.TCPListener, error) {
-	return gonet.ListenTCP(sx.Stack, stackAddrPortToFullAddress(addr),
+	return gonet.ListenTCP(sx.Stack, stackAddrPortToFullAddress(sx.nic, addr),
 		stackAddrPortToNetworkProtocolNumber(addr))
 }
 
 // DialUDP creates a new connected [*gonet.UDPConn].
 func (sx *Stack) DialUDP(addr netip.AddrPort) (*gonet.UDPConn, error) {
-	raddr := stackAddrPortToFullAddress(addr)
+	raddr := stackAddrPortToFullAddress(sx.nic, addr)
 	return gonet.DialUDP(sx.Stack, nil, &raddr, stackAddrPortToNetworkProtocolNumber(addr))
 }
 
 // ListenUDP creates a new listening [*gonet.UDPConn].
+//
+// Like the stdlib, the conn is allowed to send broadcast datagrams.
+//
+// When addr is a multicast address, the conn joins the corresponding
+// multicast group, which causes the stack to send an IGMP or MLD report
+// when using [StackOptionMulticast] (see [*Internet.Deliver]), and receives
+// the datagrams sent to the group.
 func (sx *Stack) ListenUDP(addr netip.AddrPort) (*gonet.UDPConn, error) {
-	laddr := stackAddrPortToFullAddress(addr)
-	return gonet.DialUDP(sx.Stack, &laddr, nil, stackAddrPortToNetworkProtocolNumber(addr))
+	// 1. create the UDP endpoint
+	var wq waiter.Queue
+	laddr := stackAddrPortToFullAddress(sx.nic, addr)
+	ep, tcpErr := sx.Stack.NewEndpoint(udp.ProtocolNumber, stackAddrPortToNetworkProtocolNumber(addr), &wq)
+	if tcpErr != nil {
+		return nil, errors.New(tcpErr.String())
+	}
+
+	// 2. allow sending broadcast datagrams
+	ep.SocketOptions().SetBroadcast(true)
+
+	// 3. bind to the local address
+	if tcpErr := ep.Bind(laddr); tcpErr != nil {
+		ep.Close()
+		return nil, stackNewOpError("bind", "udp", addr, tcpErr)
+	}
+
+	// 4. join the multicast group, if needed
+	if addr.Addr().IsMulticast() {
+		opt := &tcpip.AddMembershipOption{NIC: sx.nic, MulticastAddr: laddr.Addr}
+		if tcpErr := ep.SetSockOpt(opt); tcpErr != nil {
+			ep.Close()
+			return nil, stackNewOpError("setsockopt", "udp", addr, tcpErr)
+		}
+	}
+
+	return gonet.NewUDPConn(&wq, ep), nil
+}
+
+// DialICMP creates a new connected ICMP [*gonet.UDPConn].
+//
+// The conn is a ping socket: it only sends ICMP echo requests and
+// only receives the matching ICMP echo replies. When sending, the stack
+// overwrites the echo identifier and computes the checksum.
+func (sx *Stack) DialICMP(addr netip.Addr) (*gonet.UDPConn, error) {
+	raddr := netip.AddrPortFrom(addr, 0)
+	ep, wq, err := sx.dialEndpoint(context.Background(), networkProtoICMP, netip.AddrPort{}, raddr, nil)
+	if err != nil {
+		return nil, err
+	}
+	return gonet.NewUDPConn(wq, ep), nil
+}
+
+// dialEndpoint creates a connected endpoint using the given protocol ("tcp", "udp",
+// or "icmp"), which allows callers to configure the endpoint before connecting.
+//
+// The control function is OPTIONAL and we call it before binding, if the local
+// address is valid, and before connecting, like the stdlib does. For TCP, we
+// wait for the handshake to complete or for the context to be done.
+func (sx *Stack) dialEndpoint(ctx context.Context, proto string, laddr, raddr netip.AddrPort,
+	control func(ep tcpip.Endpoint) error) (tcpip.Endpoint, *waiter.Queue, error) {
+	// 1. create the endpoint
+	var (
+		ep     tcpip.Endpoint
+		opNet  = proto
+		tcpErr tcpip.Error
+		wq     = &waiter.Queue{}
+	)
+	switch proto {
+	case networkProtoTCP:
+		ep, tcpErr = sx.Stack.NewEndpoint(tcp.ProtocolNumber, stackAddrPortToNetworkProtocolNumber(raddr), wq)
+	case networkProtoICMP:
+		opNet = "ip"
+		ep, tcpErr = sx.newICMPEndpoint(raddr.Addr(), wq)
+	default:
+		ep, tcpErr = sx.Stack.NewEndpoint(udp.ProtocolNumber, stackAddrPortToNetworkProtocolNumber(raddr), wq)
+	}
+	if tcpErr != nil {
+		return nil, nil, errors.New(tcpErr.String())
+	}
+
+	// 2. allow the caller to configure the endpoint
+	if control != nil {
+		if err := control(ep); err != nil {
+			ep.Close()
+			return nil, nil, err
+		}
+	}
+
+	// 3. bind to the local address, if needed
+	if laddr.IsValid() {
+		if tcpErr := ep.Bind(stackAddrPortToFullAddress(sx.nic, laddr)); tcpErr != nil {
+			ep.Close()
+			return nil, nil, stackNewOpError("bind", opNet, laddr, tcpErr)
+		}
+	}
+
+	// 4. connect, waiting for the handshake when connecting is asynchronous
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.WritableEvents)
+	wq.EventRegister(&waitEntry)
+	defer wq.EventUnregister(&waitEntry)
+	tcpErr = ep.Connect(stackAddrPortToFullAddress(sx.nic, raddr))
+	if _, ok := tcpErr.(*tcpip.ErrConnectStarted); ok {
+		select {
+		case <-ctx.Done():
+			ep.Close()
+			return nil, nil, ctx.Err()
+		case <-notifyCh:
+		}
+		tcpErr = ep.LastError()
+	}
+	if tcpErr != nil {
+		ep.Close()
+		return nil, nil, stackNewOpError("connect", opNet, raddr, tcpErr)
+	}
+	return ep, wq, nil
+}
+
+// ListenICMP creates a new listening ICMP [*gonet.UDPConn].
+//
+// Like the conn returned by [*Stack.DialICMP], the conn is a ping socket.
+func (sx *Stack) ListenICMP(addr netip.Addr) (*gonet.UDPConn, error) {
+	// 1. create the ICMP endpoint
+	var wq waiter.Queue
+	ep, tcpErr := sx.newICMPEndpoint(addr, &wq)
+	if tcpErr != nil {
+		return nil, errors.New(tcpErr.String())
+	}
+
+	// 2. bind to the local address
+	if tcpErr := ep.Bind(stackAddrPortToFullAddress(sx.nic, netip.AddrPortFrom(addr, 0))); tcpErr != nil {
+		ep.Close()
+		return nil, stackNewOpError("bind", "ip", netip.AddrPortFrom(addr, 0), tcpErr)
+	}
+	return gonet.NewUDPConn(&wq, ep), nil
+}
+
+// newICMPEndpoint creates an ICMP endpoint for the family of the given address.
+func (sx *Stack) newICMPEndpoint(addr netip.Addr, wq *waiter.Queue) (tcpip.Endpoint, tcpip.Error) {
+	if addr.Is4() {
+		return sx.Stack.NewEndpoint(icmp.ProtocolNumber4, ipv4.ProtocolNumber, wq)
+	}
+	return sx.Stack.NewEndpoint(icmp.ProtocolNumber6, ipv6.ProtocolNumber, wq)
+}
+
+// stackNewOpError wraps a [tcpip.Error] like gonet does.
+func stackNewOpError(op, network string, addr netip.AddrPort, err tcpip.Error) error {
+	var netAddr net.Addr
+	switch network {
+	case "ip":
+		netAddr = &net.IPAddr{IP: addr.Addr().AsSlice(), Zone: addr.Addr().Zone()}
+	case "tcp":
+		netAddr = net.TCPAddrFromAddrPort(addr)
+	default:
+		netAddr = net.UDPAddrFromAddrPort(addr)
+	}
+	return &net.OpError{
+		Op:   op,
+		Net:  network,
+		Addr: netAddr,
+		Err:  errors.New(err.String()),
+	}
 }
 
-func stackAddrPortToFullAddress(epnt netip.AddrPort) tcpip.FullAddress {
+func stackAddrPortToFullAddress(nic tcpip.NICID, epnt netip.AddrPort) tcpip.FullAddress {
 	// In a single-NIC config, unspecified addresses (`0.0.0.0` or `::`) work as expected
-	// when bound to the NIC - they'll accept connections on any configured address.
+	// when bound to the NIC - they'll accept connections on any configured address. In
+	// a multi-NIC config, the NIC is zero, which allows to use any NIC.
 	return tcpip.FullAddress{
-		NIC:  stackNICID,
+		NIC:  nic,
 		Addr: tcpip.AddrFromSlice(epnt.Addr().AsSlice()),
 		Port: epnt.Port(),
 	}
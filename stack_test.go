@@ -0,0 +1,215 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/require"
+)
+
+// stackCaptureSYN returns the SYN sent by a client created using the given seed.
+func stackCaptureSYN(t *testing.T, seed uint64) []byte {
+	clock := uis.NewVirtualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	ix := uis.NewInternet(uis.InternetOptionClock(clock))
+	clientAddr := netip.MustParseAddr("10.0.0.2")
+	client, err := ix.NewStackWithOptions(uis.MTUEthernet, []netip.Addr{clientAddr}, uis.StackOptionSeed(seed))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = client.DialTCP(ctx, netip.MustParseAddrPort("10.0.0.1:443"))
+	}()
+
+	var frame uis.VNICFrame
+	for len(frame.Packet) < 20 || frame.Packet[0]>>4 != 4 || frame.Packet[9] != 6 {
+		select {
+		case frame = <-ix.InFlight():
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the SYN")
+		}
+	}
+
+	cancel()
+	<-done
+	client.Close()
+	return frame.Packet
+}
+
+func TestStackOptionSeed(t *testing.T) {
+	first := stackCaptureSYN(t, 42)
+	second := stackCaptureSYN(t, 42)
+	require.Equal(t, first, second)
+
+	third := stackCaptureSYN(t, 43)
+	require.NotEqual(t, first, third)
+}
+
+func TestNewMultiNICStack(t *testing.T) {
+	t.Run("multihomed", func(t *testing.T) {
+		// create two distinct networks each with a server
+		ix1, ix2 := uis.NewInternet(), uis.NewInternet()
+		server1, err := ix1.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.1"))
+		require.NoError(t, err)
+		t.Cleanup(server1.Close)
+		server2, err := ix2.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.1.0.1"))
+		require.NoError(t, err)
+		t.Cleanup(server2.Close)
+
+		// create a client attached to both networks
+		addr1, addr2 := netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.1.0.2")
+		vnic1, vnic2 := ix1.NewVNIC(uis.MTUEthernet), ix2.NewVNIC(uis.MTUEthernet)
+		require.NoError(t, ix1.AddRoute(vnic1, addr1))
+		require.NoError(t, ix2.AddRoute(vnic2, addr2))
+		client, err := uis.NewMultiNICStack([]uis.StackNIC{
+			{Addrs: []netip.Addr{addr1}, Link: vnic1},
+			{Addrs: []netip.Addr{addr2}, Link: vnic2},
+		}, []uis.StackRoute{
+			{Destination: netip.MustParsePrefix("0.0.0.0/0"), NIC: 1},
+			{Destination: netip.MustParsePrefix("10.1.0.0/16"), NIC: 2},
+		})
+		require.NoError(t, err)
+		t.Cleanup(client.Close)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		go ix1.Run(ctx)
+		go ix2.Run(ctx)
+
+		// the client uses the most specific route and the address of its NIC
+		switchTestEcho(t, server1, "10.0.0.1:80")
+		switchTestEcho(t, server2, "10.1.0.1:80")
+		for _, tc := range []struct{ endpoint, local string }{
+			{"10.0.0.1:80", "10.0.0.2"},
+			{"10.1.0.1:80", "10.1.0.2"},
+		} {
+			conn, err := uis.NewConnector(client).DialContext(ctx, "tcp", tc.endpoint)
+			require.NoError(t, err)
+			local := conn.LocalAddr().(*net.TCPAddr).AddrPort().Addr()
+			require.Equal(t, tc.local, local.String())
+			require.NoError(t, conn.Close())
+		}
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		vnic := uis.NewVNIC(uis.MTUEthernet, nil)
+		any4 := netip.MustParsePrefix("0.0.0.0/0")
+		cases := []struct {
+			name   string
+			nics   []uis.StackNIC
+			routes []uis.StackRoute
+		}{{
+			name: "no NICs",
+		}, {
+			name:   "invalid destination",
+			nics:   []uis.StackNIC{{Link: vnic}},
+			routes: []uis.StackRoute{{NIC: 1}},
+		}, {
+			name:   "nonexistent NIC",
+			nics:   []uis.StackNIC{{Link: vnic}},
+			routes: []uis.StackRoute{{Destination: any4, NIC: 2}},
+		}, {
+			name:   "gateway family mismatch",
+			nics:   []uis.StackNIC{{Link: vnic}},
+			routes: []uis.StackRoute{{Destination: any4, Gateway: netip.MustParseAddr("::1"), NIC: 1}},
+		}, {
+			name: "duplicate address",
+			nics: []uis.StackNIC{{
+				Addrs: []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.1")},
+				Link:  vnic,
+			}},
+		}}
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				stack, err := uis.NewMultiNICStack(tc.nics, tc.routes)
+				require.Error(t, err)
+				require.Nil(t, stack)
+			})
+		}
+	})
+}
+
+func TestNewStackWithPrefixes(t *testing.T) {
+	ix := uis.NewInternet()
+	stack, err := ix.NewStackWithPrefixes(uis.MTUEthernet, []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.2/24"),
+		netip.MustParsePrefix("2001:db8::2/64"),
+	}, uis.StackOptionGateway(netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2001:db8::1")))
+	require.NoError(t, err)
+	t.Cleanup(stack.Close)
+
+	// the on-link routes precede the default routes through the gateways
+	var routes []string
+	for _, route := range stack.Stack.GetRouteTable() {
+		routes = append(routes, route.String())
+	}
+	require.Equal(t, []string{
+		"2001:db8::/64 nic 1",
+		"10.0.0.0/24 nic 1",
+		"0.0.0.0/0 via 10.0.0.1 nic 1",
+		"::/0 via 2001:db8::1 nic 1",
+	}, routes)
+
+	// the internet only routes the addresses toward the stack
+	require.True(t, ix.Deliver(uis.VNICFrame{Packet: newTestIPv4Packet(netip.MustParseAddr("10.0.0.2"))}))
+	require.False(t, ix.Deliver(uis.VNICFrame{Packet: newTestIPv4Packet(netip.MustParseAddr("10.0.0.3"))}))
+}
+
+func TestNewRouterStack(t *testing.T) {
+	// newRouter creates a stack between two internets using the given constructor
+	newRouter := func(t *testing.T, ctor func([]uis.StackNIC, []uis.StackRoute, ...uis.StackOption) (*uis.Stack, error)) (*uis.Stack, *uis.Stack) {
+		ix1, ix2 := uis.NewInternet(), uis.NewInternet()
+		client, err := ix1.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.0.0.2"))
+		require.NoError(t, err)
+		t.Cleanup(client.Close)
+		server, err := ix2.NewStack(uis.MTUEthernet, netip.MustParseAddr("10.1.0.2"))
+		require.NoError(t, err)
+		t.Cleanup(server.Close)
+
+		// each internet routes the other segment toward the router
+		vnic1, vnic2 := ix1.NewVNIC(uis.MTUEthernet), ix2.NewVNIC(uis.MTUEthernet)
+		require.NoError(t, ix1.AddPrefixRoute(vnic1,
+			netip.MustParsePrefix("10.0.0.1/32"), netip.MustParsePrefix("10.1.0.0/16")))
+		require.NoError(t, ix2.AddPrefixRoute(vnic2,
+			netip.MustParsePrefix("10.1.0.1/32"), netip.MustParsePrefix("10.0.0.0/16")))
+		router, err := ctor([]uis.StackNIC{
+			{Addrs: []netip.Addr{netip.MustParseAddr("10.0.0.1")}, Link: vnic1},
+			{Addrs: []netip.Addr{netip.MustParseAddr("10.1.0.1")}, Link: vnic2},
+		}, []uis.StackRoute{
+			{Destination: netip.MustParsePrefix("10.0.0.0/16"), NIC: 1},
+			{Destination: netip.MustParsePrefix("10.1.0.0/16"), NIC: 2},
+		})
+		require.NoError(t, err)
+		t.Cleanup(router.Close)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		go ix1.Run(ctx)
+		go ix2.Run(ctx)
+		return client, server
+	}
+
+	t.Run("forwarding", func(t *testing.T) {
+		client, server := newRouter(t, uis.NewRouterStack)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		switchTestEcho(t, server, "10.1.0.2:80")
+		switchTestRoundTrip(ctx, t, client, "10.1.0.2:80")
+	})
+
+	t.Run("no forwarding", func(t *testing.T) {
+		client, server := newRouter(t, uis.NewMultiNICStack)
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		switchTestEcho(t, server, "10.1.0.2:80")
+		_, err := uis.NewConnector(client).DialContext(ctx, "tcp", "10.1.0.2:80")
+		require.Error(t, err)
+	})
+}
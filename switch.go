@@ -0,0 +1,315 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+)
+
+// Switch models a learning Ethernet switch connecting [*EthernetVNIC] instances.
+//
+// The switch learns the MAC address of the sender of each frame, forwards
+// unicast frames toward the port where it learned the destination address,
+// and floods broadcast, multicast, and unknown unicast frames to all ports
+// except the one where the frame arrived. Learned addresses expire after the
+// aging time (see [SwitchOptionAgingTime]).
+//
+// Like [*Internet], the switch queues the frames sent by the NICs and you
+// need to invoke [*Switch.Run] to forward them.
+//
+// Construct using [NewSwitch].
+type Switch struct {
+	// agingTime is the time after which we forget learned addresses.
+	agingTime time.Duration
+
+	// clock is the clock shared by the stacks and the switch.
+	clock tcpip.Clock
+
+	// inflight is the channel receiving inflight frames.
+	inflight chan switchFrame
+
+	// macs maps learned MAC addresses to ports.
+	macs map[tcpip.LinkAddress]*switchEntry
+
+	// mu provides mutual exclusion.
+	mu sync.Mutex
+
+	// nextMAC is the next automatically assigned MAC address.
+	nextMAC uint32
+
+	// ports contains the connected ports in the order in which we
+	// connected them, such that flooding uses a deterministic order.
+	ports []*switchPort
+
+	// steps receives the [*Switch.Step] requests.
+	steps chan chan bool
+}
+
+// switchFrame is a frame along with the port where it arrived.
+type switchFrame struct {
+	frame EthernetFrame
+	port  *switchPort
+}
+
+// switchEntry is a learned MAC address.
+type switchEntry struct {
+	expires time.Time
+	port    *switchPort
+}
+
+// switchPort is a switch port connected to an [*EthernetVNIC].
+type switchPort struct {
+	sw   *Switch
+	vnic *EthernetVNIC
+}
+
+// Ensure that [*switchPort] implements [EthernetNetwork].
+var _ EthernetNetwork = &switchPort{}
+
+// SendEthernetFrame implements [EthernetNetwork].
+func (p *switchPort) SendEthernetFrame(frame EthernetFrame) bool {
+	select {
+	case p.sw.inflight <- switchFrame{frame: frame, port: p}:
+		return true
+	default:
+		return false
+	}
+}
+
+// SwitchOption is an option for [NewSwitch].
+type SwitchOption func(cfg *switchConfig)
+
+// switchConfig is the internal type modified by [SwitchOption].
+type switchConfig struct {
+	agingTime   time.Duration
+	clock       tcpip.Clock
+	maxInflight int
+}
+
+// DefaultSwitchAgingTime is the default aging time of learned MAC addresses.
+const DefaultSwitchAgingTime = 5 * time.Minute
+
+// SwitchOptionAgingTime sets the aging time of learned MAC addresses.
+//
+// The default is [DefaultSwitchAgingTime]. A zero or negative
+// value is silently ignored.
+func SwitchOptionAgingTime(value time.Duration) SwitchOption {
+	return func(cfg *switchConfig) {
+		if value > 0 {
+			cfg.agingTime = value
+		}
+	}
+}
+
+// SwitchOptionClock is like [InternetOptionClock] but for the [*Switch].
+func SwitchOptionClock(clock tcpip.Clock) SwitchOption {
+	return func(cfg *switchConfig) {
+		cfg.clock = clock
+	}
+}
+
+// SwitchOptionMaxInflight is like [InternetOptionMaxInflight] but for the [*Switch].
+func SwitchOptionMaxInflight(max int) SwitchOption {
+	return func(cfg *switchConfig) {
+		cfg.maxInflight = max
+	}
+}
+
+// NewSwitch creates a new [*Switch] without ports.
+func NewSwitch(options ...SwitchOption) *Switch {
+	cfg := &switchConfig{
+		agingTime:   DefaultSwitchAgingTime,
+		clock:       tcpip.NewStdClock(),
+		maxInflight: DefaultMaxInflight,
+	}
+	for _, opt := range options {
+		opt(cfg)
+	}
+
+	return &Switch{
+		agingTime: cfg.agingTime,
+		clock:     cfg.clock,
+		inflight:  make(chan switchFrame, cfg.maxInflight),
+		macs:      make(map[tcpip.LinkAddress]*switchEntry),
+		mu:        sync.Mutex{},
+		nextMAC:   1,
+		ports:     []*switchPort{},
+		steps:     make(chan chan bool),
+	}
+}
+
+// NewVNIC constructs a new [*EthernetVNIC] connected to a new port of the [*Switch].
+//
+// The mtu parameter is like the one of [NewEthernetVNIC].
+//
+// The mac parameter is the OPTIONAL MAC address. When empty, we assign
+// a locally administered address (e.g., 02:00:00:00:00:01).
+//
+// The port is disconnected when the [*EthernetVNIC] is closed.
+func (sw *Switch) NewVNIC(mtu uint32, mac tcpip.LinkAddress) *EthernetVNIC {
+	sw.mu.Lock()
+	if mac == "" {
+		var addr [6]byte
+		addr[0] = 0x02
+		binary.BigEndian.PutUint32(addr[2:], sw.nextMAC)
+		sw.nextMAC++
+		mac = tcpip.LinkAddress(addr[:])
+	}
+	port := &switchPort{sw: sw, vnic: nil}
+	port.vnic = NewEthernetVNIC(mtu, mac, port)
+	sw.ports = append(sw.ports, port)
+	sw.mu.Unlock()
+
+	if !port.vnic.addCloseHook(sw, func() { sw.disconnect(port) }) {
+		sw.disconnect(port)
+	}
+	return port.vnic
+}
+
+// disconnect removes the given port and the addresses learned on it.
+func (sw *Switch) disconnect(port *switchPort) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.ports = slices.DeleteFunc(sw.ports, func(p *switchPort) bool { return p == port })
+	for mac, entry := range sw.macs {
+		if entry.port == port {
+			delete(sw.macs, mac)
+		}
+	}
+}
+
+// NewStack creates a [*Stack] connected to a new port of the [*Switch].
+//
+// The mtu and mac parameters are like the ones of [*Switch.NewVNIC].
+//
+// The addrs argument contains the IPv4/IPv6 addresses to configure.
+func (sw *Switch) NewStack(mtu uint32, mac tcpip.LinkAddress, addrs ...netip.Addr) *Stack {
+	return sw.NewStackWithOptions(mtu, mac, addrs)
+}
+
+// NewStackWithOptions is like [*Switch.NewStack] but additionally
+// allows to specify options for [NewStackWithOptions].
+//
+// The created stack uses the [*Switch] clock (see [SwitchOptionClock])
+// unless you override it using [StackOptionClock].
+func (sw *Switch) NewStackWithOptions(mtu uint32, mac tcpip.LinkAddress, addrs []netip.Addr, options ...StackOption) *Stack {
+	return sw.NewStackWithPrefixes(mtu, mac, internetAddrsToPrefixes(addrs...), options...)
+}
+
+// NewStackWithPrefixes is like [*Switch.NewStackWithOptions] but configures
+// addresses along with the prefix length of their on-link subnet (e.g., 10.0.0.2/24)
+// using [NewStackWithPrefixes]. Use [StackOptionGateway] to configure gateways.
+func (sw *Switch) NewStackWithPrefixes(mtu uint32, mac tcpip.LinkAddress, prefixes []netip.Prefix, options ...StackOption) *Stack {
+	vnic := sw.NewVNIC(mtu, mac)
+	options = append([]StackOption{StackOptionClock(sw.clock)}, options...)
+	return NewStackWithPrefixes(vnic, prefixes, options...)
+}
+
+// Clock returns the [tcpip.Clock] used by the [*Switch].
+func (sw *Switch) Clock() tcpip.Clock {
+	return sw.clock
+}
+
+// Run forwards the frames in flight until the context is done.
+//
+// The switch never advances a [*VirtualClock] (see [SwitchOptionClock])
+// on its own: use [*Switch.Step] to move virtual time forward.
+func (sw *Switch) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case sf := <-sw.inflight:
+			sw.forward(sf)
+
+		case reply := <-sw.steps:
+			reply <- sw.step(sw.clock.(*VirtualClock))
+		}
+	}
+}
+
+// Step is like [*Router.Step] but for the [*Switch]: it asks [*Switch.Run] to
+// forward all the frames in flight and then to advance the [*VirtualClock]
+// to the deadline of its earliest timer.
+//
+// This method returns false when the clock is not a [*VirtualClock], when
+// the clock has no pending timers, or when the context is done before
+// [*Switch.Run] handles the request.
+func (sw *Switch) Step(ctx context.Context) bool {
+	if _, ok := sw.clock.(*VirtualClock); !ok {
+		return false
+	}
+	reply := make(chan bool, 1)
+	select {
+	case sw.steps <- reply:
+		return <-reply
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// step implements [*Switch.Step] on the goroutine running [*Switch.Run].
+func (sw *Switch) step(vclock *VirtualClock) bool {
+	// 1. forward the frames in flight, if any
+	for drained := false; !drained; {
+		select {
+		case sf := <-sw.inflight:
+			sw.forward(sf)
+		default:
+			drained = true
+		}
+	}
+
+	// 2. advance the clock to the next deadline
+	return vclock.AdvanceToNext()
+}
+
+// forward learns the source address of the frame and forwards it.
+func (sw *Switch) forward(sf switchFrame) {
+	// 1. drop frames too short to contain the Ethernet header
+	if len(sf.frame.Data) <= header.EthernetMinimumSize {
+		return
+	}
+	eth := header.Ethernet(sf.frame.Data)
+	now := sw.clock.Now()
+
+	// 2. learn the source address and find the destination ports
+	sw.mu.Lock()
+	if !slices.Contains(sw.ports, sf.port) {
+		sw.mu.Unlock()
+		return // the port has been disconnected
+	}
+	if src := eth.SourceAddress(); header.IsValidUnicastEthernetAddress(src) {
+		sw.macs[src] = &switchEntry{expires: now.Add(sw.agingTime), port: sf.port}
+	}
+	var ports []*switchPort
+	entry := sw.macs[eth.DestinationAddress()]
+	switch {
+	case entry != nil && now.Before(entry.expires):
+		if entry.port != sf.port {
+			ports = append(ports, entry.port)
+		}
+
+	default:
+		for _, port := range sw.ports {
+			if port != sf.port {
+				ports = append(ports, port)
+			}
+		}
+	}
+	sw.mu.Unlock()
+
+	// 3. deliver to the destination ports without holding the lock
+	for _, port := range ports {
+		_ = port.vnic.InjectFrame(sf.frame)
+	}
+}
@@ -0,0 +1,275 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/require"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// switchTestEcho runs a TCP echo server accepting a single connection.
+func switchTestEcho(t *testing.T, stack *uis.Stack, endpoint string) {
+	listener, err := uis.NewListenConfig(stack).Listen(context.Background(), "tcp", endpoint)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+}
+
+// switchTestRoundTrip dials the given endpoint and checks that it echoes data.
+func switchTestRoundTrip(ctx context.Context, t *testing.T, stack *uis.Stack, endpoint string) {
+	conn, err := uis.NewConnector(stack).DialContext(ctx, "tcp", endpoint)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
+
+func TestSwitchWithStacks(t *testing.T) {
+	sw := uis.NewSwitch()
+	serverMAC, err := tcpip.ParseMACAddress("02:00:00:00:00:aa")
+	require.NoError(t, err)
+	server := sw.NewStack(uis.MTUEthernet, serverMAC,
+		netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2001:db8::1"))
+	t.Cleanup(server.Close)
+	client := sw.NewStack(uis.MTUEthernet, "",
+		netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("2001:db8::2"))
+	t.Cleanup(client.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go sw.Run(ctx)
+
+	switchTestEcho(t, server, "10.0.0.1:80")
+	switchTestEcho(t, server, "[2001:db8::1]:80")
+	switchTestRoundTrip(ctx, t, client, "10.0.0.1:80")
+	switchTestRoundTrip(ctx, t, client, "[2001:db8::1]:80")
+
+	// the client has resolved the server MAC address using ARP and NDP
+	for _, proto := range []tcpip.NetworkProtocolNumber{ipv4.ProtocolNumber, ipv6.ProtocolNumber} {
+		neighbors, tcpErr := client.Stack.Neighbors(1, proto)
+		require.Nil(t, tcpErr)
+		var found bool
+		for _, entry := range neighbors {
+			found = found || entry.LinkAddr == serverMAC
+		}
+		require.True(t, found, "no neighbor entry for protocol %d", proto)
+	}
+}
+
+// switchTestStep steps the [*uis.Switch] until the condition holds,
+// sleeping a bit when there are no timers to let the stacks make progress.
+func switchTestStep(ctx context.Context, t *testing.T, sw *uis.Switch, cond func() bool) {
+	for !cond() {
+		require.NoError(t, ctx.Err())
+		if !sw.Step(ctx) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestSwitchARPTimeout(t *testing.T) {
+	clock := uis.NewVirtualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	sw := uis.NewSwitch(uis.SwitchOptionClock(clock))
+	client := sw.NewStack(uis.MTUEthernet, "", netip.MustParseAddr("10.0.0.2"))
+	t.Cleanup(client.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go sw.Run(ctx)
+
+	// nobody answers the ARP requests for 10.0.0.1
+	t0 := clock.Now()
+	errch := make(chan error, 1)
+	go func() {
+		_, err := uis.NewConnector(client).DialContext(ctx, "tcp", "10.0.0.1:80")
+		errch <- err
+	}()
+	var err error
+	switchTestStep(ctx, t, sw, func() bool {
+		select {
+		case err = <-errch:
+			return true
+		default:
+			return false
+		}
+	})
+	require.Error(t, err)
+	require.NoError(t, ctx.Err())
+	require.GreaterOrEqual(t, clock.Now().Sub(t0), time.Second)
+}
+
+func TestSwitchDuplicateAddressDetection(t *testing.T) {
+	clock := uis.NewVirtualClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	sw := uis.NewSwitch(uis.SwitchOptionClock(clock))
+	addr := netip.MustParseAddr("2001:db8::1")
+	dad := uis.StackOptionDAD(1, 100*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go sw.Run(ctx)
+
+	// hasAddress returns whether the stack has completed DAD for addr
+	hasAddress := func(stack *uis.Stack) bool {
+		main, tcpErr := stack.Stack.GetMainNICAddress(1, ipv6.ProtocolNumber)
+		return tcpErr == nil && main.Address == tcpip.AddrFromSlice(addr.AsSlice())
+	}
+
+	first := sw.NewStackWithOptions(uis.MTUEthernet, "", []netip.Addr{addr}, dad)
+	t.Cleanup(first.Close)
+	switchTestStep(ctx, t, sw, func() bool { return hasAddress(first) })
+
+	// the second stack detects the duplicate address and gives up on it
+	second := sw.NewStackWithOptions(uis.MTUEthernet, "", []netip.Addr{addr}, dad)
+	t.Cleanup(second.Close)
+	t0 := clock.Now()
+	switchTestStep(ctx, t, sw, func() bool { return clock.Now().Sub(t0) > time.Second })
+	require.False(t, hasAddress(second))
+	require.True(t, hasAddress(first))
+}
+
+func TestSwitchDisconnect(t *testing.T) {
+	sw := uis.NewSwitch()
+	server := sw.NewStack(uis.MTUEthernet, "", netip.MustParseAddr("10.0.0.1"))
+	client := sw.NewStack(uis.MTUEthernet, "", netip.MustParseAddr("10.0.0.2"))
+	t.Cleanup(client.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go sw.Run(ctx)
+
+	switchTestEcho(t, server, "10.0.0.1:80")
+	switchTestRoundTrip(ctx, t, client, "10.0.0.1:80")
+
+	// closing the server disconnects its port
+	server.Close()
+	dialCtx, dialCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer dialCancel()
+	_, err := uis.NewConnector(client).DialContext(dialCtx, "tcp", "10.0.0.1:80")
+	require.Error(t, err)
+}
+
+func TestSwitchOnLinkAndGateway(t *testing.T) {
+	sw := uis.NewSwitch()
+	gatewayMAC, err := tcpip.ParseMACAddress("02:00:00:00:00:01")
+	require.NoError(t, err)
+	gateway := sw.NewStackWithPrefixes(uis.MTUEthernet, gatewayMAC,
+		[]netip.Prefix{netip.MustParsePrefix("10.0.0.1/24")})
+	t.Cleanup(gateway.Close)
+	server := sw.NewStackWithPrefixes(uis.MTUEthernet, "",
+		[]netip.Prefix{netip.MustParsePrefix("10.0.0.3/24")})
+	t.Cleanup(server.Close)
+	client := sw.NewStackWithPrefixes(uis.MTUEthernet, "",
+		[]netip.Prefix{netip.MustParsePrefix("10.0.0.2/24")},
+		uis.StackOptionGateway(netip.MustParseAddr("10.0.0.1")))
+	t.Cleanup(client.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go sw.Run(ctx)
+
+	// the client reaches on-link hosts directly
+	switchTestEcho(t, server, "10.0.0.3:80")
+	switchTestRoundTrip(ctx, t, client, "10.0.0.3:80")
+
+	// the client sends the packets for remote hosts to the gateway, which
+	// drops them since it does not forward packets
+	dialCtx, dialCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer dialCancel()
+	_, err = uis.NewConnector(client).DialContext(dialCtx, "tcp", "192.0.2.1:80")
+	require.Error(t, err)
+	neighbors, tcpErr := client.Stack.Neighbors(1, ipv4.ProtocolNumber)
+	require.Nil(t, tcpErr)
+	var found bool
+	for _, entry := range neighbors {
+		found = found || (entry.Addr == tcpip.AddrFrom4([4]byte{10, 0, 0, 1}) && entry.LinkAddr == gatewayMAC)
+	}
+	require.True(t, found)
+}
+
+// switchTestOrderDispatcher records the order in which NICs receive frames.
+type switchTestOrderDispatcher struct {
+	id    int
+	mu    *sync.Mutex
+	order *[]int
+}
+
+func (d *switchTestOrderDispatcher) DeliverNetworkPacket(tcpip.NetworkProtocolNumber, *stack.PacketBuffer) {
+	d.mu.Lock()
+	*d.order = append(*d.order, d.id)
+	d.mu.Unlock()
+}
+
+func (d *switchTestOrderDispatcher) DeliverLinkPacket(tcpip.NetworkProtocolNumber, *stack.PacketBuffer) {
+}
+
+func TestSwitchFloodingOrder(t *testing.T) {
+	sw := uis.NewSwitch()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go sw.Run(ctx)
+
+	mu := &sync.Mutex{}
+	order := []int{}
+	var vnics []*uis.EthernetVNIC
+	connect := func(id int) {
+		vnic := sw.NewVNIC(uis.MTUEthernet, "")
+		vnic.Attach(&switchTestOrderDispatcher{id: id, mu: mu, order: &order})
+		vnics = append(vnics, vnic)
+	}
+	for id := range 5 {
+		connect(id)
+	}
+
+	// flood sends a broadcast frame from the first NIC and returns the
+	// order in which the other NICs received it
+	flood := func(expect int) []int {
+		mu.Lock()
+		order = []int{}
+		mu.Unlock()
+		frame := append(bytes.Repeat([]byte{0xff}, 6), 0x02, 0, 0, 0, 0, 0x01, 0x08, 0x00)
+		frame = append(frame, newTestIPv4Packet(netip.MustParseAddr("10.0.0.1"))...)
+		pkts := makePacketList(frame)
+		defer pkts.DecRef()
+		num, err := vnics[0].WritePackets(pkts)
+		require.True(t, err == nil)
+		require.Equal(t, 1, num)
+		require.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(order) == expect
+		}, time.Second, time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(order)
+	}
+	require.Equal(t, []int{1, 2, 3, 4}, flood(4))
+
+	// disconnected ports disappear and new ports go at the end
+	vnics[2].Close()
+	connect(5)
+	require.Equal(t, []int{1, 3, 4, 5}, flood(4))
+}
@@ -0,0 +1,267 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"encoding/binary"
+	"slices"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// TCPCongestionControl is a TCP congestion control algorithm.
+type TCPCongestionControl string
+
+// Enumerate the supported [TCPCongestionControl] values.
+const (
+	// TCPCongestionControlReno is the NewReno algorithm (see RFC 6582).
+	TCPCongestionControlReno = TCPCongestionControl("reno")
+
+	// TCPCongestionControlCubic is the CUBIC algorithm (see RFC 9438).
+	TCPCongestionControlCubic = TCPCongestionControl("cubic")
+)
+
+// StackOptionTCPCongestionControl sets the TCP congestion control algorithm.
+//
+// The default is to use the gVisor default, which is [TCPCongestionControlReno].
+// Unsupported algorithms are silently ignored.
+func StackOptionTCPCongestionControl(algorithm TCPCongestionControl) StackOption {
+	return func(cfg *stackConfig) {
+		if algorithm == TCPCongestionControlReno || algorithm == TCPCongestionControlCubic {
+			opt := tcpip.CongestionControlOption(algorithm)
+			cfg.tcpOptions = append(cfg.tcpOptions, &opt)
+		}
+	}
+}
+
+// StackOptionTCPSACK enables or disables TCP selective acknowledgements.
+//
+// The default is to use the gVisor default.
+func StackOptionTCPSACK(enabled bool) StackOption {
+	return func(cfg *stackConfig) {
+		opt := tcpip.TCPSACKEnabled(enabled)
+		cfg.tcpOptions = append(cfg.tcpOptions, &opt)
+	}
+}
+
+// StackOptionTCPNagle enables or disables Nagle's algorithm, which delays the
+// transmission of small TCP segments while there is unacknowledged data.
+//
+// The default is to use the gVisor default.
+//
+// Note that gVisor does not allow to configure delayed acknowledgements.
+func StackOptionTCPNagle(enabled bool) StackOption {
+	return func(cfg *stackConfig) {
+		opt := tcpip.TCPDelayEnabled(enabled)
+		cfg.tcpOptions = append(cfg.tcpOptions, &opt)
+	}
+}
+
+// StackOptionTCPTimestamps enables or disables the TCP timestamps option (see RFC 7323).
+//
+// The default is to enable timestamps. Because gVisor always offers timestamps,
+// we disable them by removing the timestamps option from the SYN segments sent
+// and received by the stack, which prevents negotiating timestamps regardless
+// of the configuration of the peer, as if the stack did not support them.
+//
+// Because we rewrite the SYN segments on the wire, packet captures (e.g., a
+// [*PCAPTrace]) show the peer sending a SYN without timestamps even though
+// the peer offered them, while the peer's own capture shows the opposite.
+func StackOptionTCPTimestamps(enabled bool) StackOption {
+	return func(cfg *stackConfig) {
+		cfg.tcpNoTimestamps = !enabled
+	}
+}
+
+// StackOptionTCPWindowScaling enables or disables the TCP window scale option (see RFC 7323).
+//
+// The default is to enable window scaling. We disable window scaling like
+// we disable timestamps (see [StackOptionTCPTimestamps]). Without window
+// scaling, the receive window cannot exceed 65535 bytes.
+func StackOptionTCPWindowScaling(enabled bool) StackOption {
+	return func(cfg *stackConfig) {
+		cfg.tcpNoWindowScaling = !enabled
+	}
+}
+
+// StackOptionTCPSendBufferSize sets the minimum, default, and maximum size
+// in bytes of the send buffer of TCP sockets.
+//
+// The default is to use the gVisor defaults. Values not satisfying
+// 0 < min <= def <= max are silently ignored.
+func StackOptionTCPSendBufferSize(min, def, max int) StackOption {
+	return func(cfg *stackConfig) {
+		if 0 < min && min <= def && def <= max {
+			opt := tcpip.TCPSendBufferSizeRangeOption{Min: min, Default: def, Max: max}
+			cfg.tcpOptions = append(cfg.tcpOptions, &opt)
+		}
+	}
+}
+
+// StackOptionTCPReceiveBufferSize is like [StackOptionTCPSendBufferSize]
+// but for the receive buffer, which determines the advertised window.
+func StackOptionTCPReceiveBufferSize(min, def, max int) StackOption {
+	return func(cfg *stackConfig) {
+		if 0 < min && min <= def && def <= max {
+			opt := tcpip.TCPReceiveBufferSizeRangeOption{Min: min, Default: def, Max: max}
+			cfg.tcpOptions = append(cfg.tcpOptions, &opt)
+		}
+	}
+}
+
+// StackOptionTCPMinRTO sets the minimum TCP retransmission timeout.
+//
+// The default is to use the gVisor default, which is 200 milliseconds.
+// A zero or negative value is silently ignored.
+func StackOptionTCPMinRTO(value time.Duration) StackOption {
+	return func(cfg *stackConfig) {
+		if value > 0 {
+			opt := tcpip.TCPMinRTOOption(value)
+			cfg.tcpOptions = append(cfg.tcpOptions, &opt)
+		}
+	}
+}
+
+// tcpStrippedOptions returns the kinds of the TCP options that
+// the stack MUST NOT negotiate according to the given config.
+func tcpStrippedOptions(cfg *stackConfig) []uint8 {
+	var kinds []uint8
+	if cfg.tcpNoTimestamps {
+		kinds = append(kinds, header.TCPOptionTS)
+	}
+	if cfg.tcpNoWindowScaling {
+		kinds = append(kinds, header.TCPOptionWS)
+	}
+	return kinds
+}
+
+// tcpWrapLinkEndpoint wraps the given [stack.LinkEndpoint] to remove the
+// TCP options the stack MUST NOT negotiate, if any, from SYN segments.
+func tcpWrapLinkEndpoint(cfg *stackConfig, link stack.LinkEndpoint) stack.LinkEndpoint {
+	kinds := tcpStrippedOptions(cfg)
+	if len(kinds) <= 0 {
+		return link
+	}
+	return &tcpOptionsFilter{LinkEndpoint: link, kinds: kinds}
+}
+
+// tcpOptionsFilter is a [stack.LinkEndpoint] removing TCP options
+// from the SYN segments sent and received by the stack.
+type tcpOptionsFilter struct {
+	stack.LinkEndpoint
+
+	// kinds contains the kinds of the options to remove.
+	kinds []uint8
+}
+
+// Attach implements [stack.LinkEndpoint].
+func (f *tcpOptionsFilter) Attach(disp stack.NetworkDispatcher) {
+	if disp != nil {
+		disp = &tcpOptionsDispatcher{NetworkDispatcher: disp, kinds: f.kinds}
+	}
+	f.LinkEndpoint.Attach(disp)
+}
+
+// WritePackets implements [stack.LinkEndpoint].
+func (f *tcpOptionsFilter) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	for _, pb := range pkts.AsSlice() {
+		if pb.TransportProtocolNumber == header.TCPProtocolNumber {
+			// Note: the transport header is a view of the packet bytes
+			_ = tcpStripSYNOptions(pb.TransportHeader().Slice(), f.kinds)
+		}
+	}
+	return f.LinkEndpoint.WritePackets(pkts)
+}
+
+// tcpOptionsDispatcher is a [stack.NetworkDispatcher] removing
+// TCP options from the SYN segments received by the stack.
+type tcpOptionsDispatcher struct {
+	stack.NetworkDispatcher
+
+	// kinds contains the kinds of the options to remove.
+	kinds []uint8
+}
+
+// tcpMaxHeadersSize is the maximum size of the IPv4 or IPv6 header
+// followed by a TCP header including the maximum amount of options.
+const tcpMaxHeadersSize = header.IPv4MaximumHeaderSize + header.TCPHeaderMaximumSize
+
+// DeliverNetworkPacket implements [stack.NetworkDispatcher].
+func (d *tcpOptionsDispatcher) DeliverNetworkPacket(proto tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	// 1. copy just the headers to find and rewrite the SYN segments
+	headers := pkt.Data().AsRange().Capped(tcpMaxHeadersSize).ToSlice()
+	transport, offset, ok := packetTransport(headers)
+	if !ok || transport != ProtocolTCP || packetIsNonFirstFragment(headers) {
+		d.NetworkDispatcher.DeliverNetworkPacket(proto, pkt)
+		return
+	}
+
+	// 2. deliver the original packet unless we modified the headers
+	if !tcpStripSYNOptions(headers[offset:], d.kinds) {
+		d.NetworkDispatcher.DeliverNetworkPacket(proto, pkt)
+		return
+	}
+
+	// 3. otherwise, deliver a copy of the packet with the modified headers
+	data := pkt.Data().AsRange().ToSlice()
+	copy(data, headers)
+	modified := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(data),
+	})
+	modified.PktType = pkt.PktType
+	d.NetworkDispatcher.DeliverNetworkPacket(proto, modified)
+}
+
+// tcpStripSYNOptions replaces with NOPs the options of the given kinds within
+// the given TCP header, if it belongs to a SYN segment, incrementally updating
+// the checksum (see RFC 1624), and returns whether it modified the header.
+func tcpStripSYNOptions(hdr []byte, kinds []uint8) bool {
+	// 1. make sure this is a SYN segment with options
+	if len(hdr) < header.TCPMinimumSize || hdr[13]&TCPFlagSYN == 0 {
+		return false
+	}
+	size := int(hdr[12]>>4) * 4
+	if size <= header.TCPMinimumSize || size > len(hdr) {
+		return false
+	}
+	options := hdr[header.TCPMinimumSize:size]
+	original := slices.Clone(options)
+
+	// 2. walk the options and replace the matching ones
+	var modified bool
+	for idx := 0; idx < len(options); {
+		kind := options[idx]
+		if kind == header.TCPOptionEOL {
+			break
+		}
+		if kind == header.TCPOptionNOP {
+			idx++
+			continue
+		}
+		if idx+1 >= len(options) {
+			break
+		}
+		length := int(options[idx+1])
+		if length < 2 || idx+length > len(options) {
+			break
+		}
+		if slices.Contains(kinds, kind) {
+			for off := idx; off < idx+length; off++ {
+				options[off] = header.TCPOptionNOP
+			}
+			modified = true
+		}
+		idx += length
+	}
+
+	// 3. update the checksum since the options start at an even offset
+	if modified {
+		csum := packetChecksumReplace(binary.BigEndian.Uint16(hdr[16:18]), original, options)
+		binary.BigEndian.PutUint16(hdr[16:18], csum)
+	}
+	return modified
+}
@@ -0,0 +1,93 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPStripSYNOptions(t *testing.T) {
+	// sum computes the one's complement sum of the given bytes.
+	sum := func(data []byte) uint16 {
+		var acc uint32
+		for idx := 0; idx+1 < len(data); idx += 2 {
+			acc += uint32(binary.BigEndian.Uint16(data[idx:]))
+		}
+		for acc > 0xffff {
+			acc = (acc >> 16) + (acc & 0xffff)
+		}
+		return uint16(acc)
+	}
+
+	// newHeader returns a TCP header with the given flags, options, and a valid checksum.
+	newHeader := func(flags uint8, options ...byte) []byte {
+		hdr := make([]byte, 20, 20+len(options))
+		binary.BigEndian.PutUint16(hdr[0:2], 54321)
+		binary.BigEndian.PutUint16(hdr[2:4], 443)
+		hdr[12] = uint8((20+len(options))/4) << 4
+		hdr[13] = flags
+		hdr = append(hdr, options...)
+		binary.BigEndian.PutUint16(hdr[16:18], ^sum(hdr))
+		return hdr
+	}
+
+	mss := []byte{2, 4, 0x05, 0xb4}
+	ws := []byte{3, 3, 7}
+	ts := []byte{8, 10, 0, 0, 0, 1, 0, 0, 0, 0}
+	options := append(append(append(append(append([]byte{}, mss...), 1), ws...), 1, 1), ts...)
+
+	cases := []struct {
+		name     string
+		flags    uint8
+		options  []byte
+		kinds    []uint8
+		modified bool
+		expect   []byte
+	}{{
+		name:     "timestamps",
+		flags:    TCPFlagSYN,
+		options:  options,
+		kinds:    []uint8{8},
+		modified: true,
+		expect:   append(append(append(append([]byte{}, mss...), 1), ws...), 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1),
+	}, {
+		name:     "window scaling and timestamps",
+		flags:    TCPFlagSYN | TCPFlagACK,
+		options:  options,
+		kinds:    []uint8{8, 3},
+		modified: true,
+		expect:   append(append([]byte{}, mss...), 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1),
+	}, {
+		name:     "not a SYN",
+		flags:    TCPFlagACK,
+		options:  options,
+		kinds:    []uint8{8, 3},
+		modified: false,
+		expect:   options,
+	}, {
+		name:     "no matching options",
+		flags:    TCPFlagSYN,
+		options:  append(append([]byte{}, mss...), 0, 0, 0, 0),
+		kinds:    []uint8{8, 3},
+		modified: false,
+		expect:   append(append([]byte{}, mss...), 0, 0, 0, 0),
+	}, {
+		name:     "truncated option",
+		flags:    TCPFlagSYN,
+		options:  []byte{1, 1, 8, 12},
+		kinds:    []uint8{8},
+		modified: false,
+		expect:   []byte{1, 1, 8, 12},
+	}}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			hdr := newHeader(tc.flags, tc.options...)
+			require.Equal(t, tc.modified, tcpStripSYNOptions(hdr, tc.kinds))
+			require.Equal(t, tc.expect, hdr[20:])
+			require.Equal(t, uint16(0xffff), sum(hdr))
+		})
+	}
+}
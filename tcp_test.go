@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: GPL-3.0-or-later
+
+package uis_test
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/bassosimone/uis"
+	"github.com/stretchr/testify/require"
+)
+
+// tcpTestOptionKinds returns the kinds of the options of the TCP segment in the given IPv4 packet.
+func tcpTestOptionKinds(pkt []byte) []byte {
+	hdr := pkt[int(pkt[0]&0x0f)*4:]
+	options := hdr[20 : int(hdr[12]>>4)*4]
+	var kinds []byte
+	for idx := 0; idx < len(options) && options[idx] != 0; {
+		if options[idx] == 1 {
+			idx++
+			continue
+		}
+		kinds = append(kinds, options[idx])
+		idx += int(options[idx+1])
+	}
+	return kinds
+}
+
+// tcpTestHandshake routes the packets of a TCP handshake between a client and a
+// server created with the given options and returns the SYN and the SYN-ACK.
+func tcpTestHandshake(t *testing.T, clientOptions, serverOptions []uis.StackOption) ([]byte, []byte) {
+	ix := uis.NewInternet()
+	clientAddr, serverAddr := netip.MustParseAddr("10.0.0.2"), netip.MustParseAddr("10.0.0.1")
+	client, err := ix.NewStackWithOptions(uis.MTUEthernet, []netip.Addr{clientAddr}, clientOptions...)
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	server, err := ix.NewStackWithOptions(uis.MTUEthernet, []netip.Addr{serverAddr}, serverOptions...)
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+	switchTestEcho(t, server, "10.0.0.1:443")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := uis.NewConnector(client).DialContext(ctx, "tcp", "10.0.0.1:443")
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	var syn, synack []byte
+	for syn == nil || synack == nil {
+		select {
+		case frame := <-ix.InFlight():
+			ix.Deliver(frame)
+			pkt := frame.Packet
+			if len(pkt) < 20 || pkt[0]>>4 != 4 || pkt[9] != 6 {
+				continue
+			}
+			flags := pkt[int(pkt[0]&0x0f)*4+13]
+			switch flags & (uis.TCPFlagSYN | uis.TCPFlagACK) {
+			case uis.TCPFlagSYN:
+				syn = pkt
+			case uis.TCPFlagSYN | uis.TCPFlagACK:
+				synack = pkt
+			}
+		case <-ctx.Done():
+			t.Fatal("timed out waiting for the handshake")
+		}
+	}
+
+	cancel()
+	<-done
+	return syn, synack
+}
+
+func TestStackOptionTCPTimestampsAndWindowScaling(t *testing.T) {
+	const timestamps, windowScale = 8, 3
+
+	t.Run("enabled by default", func(t *testing.T) {
+		syn, synack := tcpTestHandshake(t, nil, nil)
+		require.Contains(t, tcpTestOptionKinds(syn), byte(timestamps))
+		require.Contains(t, tcpTestOptionKinds(syn), byte(windowScale))
+		require.Contains(t, tcpTestOptionKinds(synack), byte(timestamps))
+		require.Contains(t, tcpTestOptionKinds(synack), byte(windowScale))
+	})
+
+	t.Run("disabled by the client", func(t *testing.T) {
+		syn, synack := tcpTestHandshake(t, []uis.StackOption{
+			uis.StackOptionTCPTimestamps(false),
+			uis.StackOptionTCPWindowScaling(false),
+		}, nil)
+		require.NotContains(t, tcpTestOptionKinds(syn), byte(timestamps))
+		require.NotContains(t, tcpTestOptionKinds(syn), byte(windowScale))
+		require.NotContains(t, tcpTestOptionKinds(synack), byte(timestamps))
+		require.NotContains(t, tcpTestOptionKinds(synack), byte(windowScale))
+	})
+
+	t.Run("disabled by the server", func(t *testing.T) {
+		syn, synack := tcpTestHandshake(t, nil, []uis.StackOption{
+			uis.StackOptionTCPTimestamps(false),
+		})
+		require.Contains(t, tcpTestOptionKinds(syn), byte(timestamps))
+		require.NotContains(t, tcpTestOptionKinds(synack), byte(timestamps))
+		require.Contains(t, tcpTestOptionKinds(synack), byte(windowScale))
+	})
+}
+
+func TestStackOptionTCP(t *testing.T) {
+	options := []uis.StackOption{
+		uis.StackOptionTCPCongestionControl(uis.TCPCongestionControlCubic),
+		uis.StackOptionTCPCongestionControl("bbr"), // silently ignored
+		uis.StackOptionTCPSACK(true),
+		uis.StackOptionTCPNagle(true),
+		uis.StackOptionTCPTimestamps(false),
+		uis.StackOptionTCPWindowScaling(false),
+		uis.StackOptionTCPSendBufferSize(4096, 16384, 1<<20),
+		uis.StackOptionTCPReceiveBufferSize(4096, 16384, 1<<20),
+		uis.StackOptionTCPReceiveBufferSize(16384, 4096, 1<<20), // silently ignored
+		uis.StackOptionTCPMinRTO(50 * time.Millisecond),
+		uis.StackOptionTCPMinRTO(-1), // silently ignored
+	}
+
+	ix := uis.NewInternet()
+	client, err := ix.NewStackWithOptions(uis.MTUEthernet, []netip.Addr{netip.MustParseAddr("10.0.0.2")}, options...)
+	require.NoError(t, err)
+	t.Cleanup(client.Close)
+	server, err := ix.NewStackWithOptions(uis.MTUEthernet, []netip.Addr{netip.MustParseAddr("10.0.0.1")}, options...)
+	require.NoError(t, err)
+	t.Cleanup(server.Close)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go ix.Run(ctx)
+
+	switchTestEcho(t, server, "10.0.0.1:443")
+	switchTestRoundTrip(ctx, t, client, "10.0.0.1:443")
+}
@@ -15,9 +15,16 @@ import (
 )
 
 // VNICFrame models a virtual link-layer frame without addressing.
+//
+// The frames read from [*Internet.InFlight] remember the [*VNIC] that sent
+// them, such that [*Internet.Deliver] does not deliver broadcast and multicast
+// frames back to the sender. The frames you construct have no sender.
 type VNICFrame struct {
 	// Packet contains a raw IP packet (IPv4 or IPv6).
 	Packet []byte
+
+	// sender is the OPTIONAL [*VNIC] that sent the frame.
+	sender *VNIC
 }
 
 // VNICNetwork models the network that a VNIC sends packets to.
@@ -44,6 +51,11 @@ type VNIC struct {
 	// closefunc is the function invoked on close.
 	closefunc func()
 
+	// closehooks contains additional functions invoked on close indexed by
+	// owner, which allows networks to clean up their state (e.g., routes)
+	// without interfering with the [stack.Stack] close action.
+	closehooks map[any]func()
+
 	// disp is set by Attach and used to deliver inbound packets into netstack.
 	disp stack.NetworkDispatcher
 
@@ -74,13 +86,14 @@ type VNIC struct {
 // The network parameter is the [*VNICNetwork] to use.
 func NewVNIC(mtu uint32, network VNICNetwork) *VNIC {
 	return &VNIC{
-		closefunc: nil,
-		disp:      nil,
-		network:   network,
-		isclosed:  false,
-		laddr:     "",
-		mtu:       mtu,
-		mu:        sync.RWMutex{},
+		closefunc:  nil,
+		closehooks: make(map[any]func()),
+		disp:       nil,
+		network:    network,
+		isclosed:   false,
+		laddr:      "",
+		mtu:        mtu,
+		mu:         sync.RWMutex{},
 	}
 }
 
@@ -121,7 +134,26 @@ func (n *VNIC) Close() {
 		if n.closefunc != nil {
 			n.closefunc()
 		}
+		for _, hook := range n.closehooks {
+			hook()
+		}
+		n.closehooks = nil
+	}
+}
+
+// addCloseHook registers a hook that will be invoked on close. Registering a
+// hook with the same owner replaces the previously registered hook.
+//
+// This method returns false if the [*VNIC] has already been closed, in which
+// case the hook is not registered and the caller should clean up directly.
+func (n *VNIC) addCloseHook(owner any, hook func()) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isclosed {
+		return false
 	}
+	n.closehooks[owner] = hook
+	return true
 }
 
 // IsAttached implements [stack.LinkEndpoint].